@@ -0,0 +1,523 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/userexport"
+	"github.com/juju/errors"
+)
+
+const commandsUsage = `Usage: geekmarks-server [flags] [command [command flags] [args]]
+
+Without a command, the HTTP server is started. Commands:
+
+  migrate          Apply or revert migrations, see "migrate -h"
+  check-integrity  Check (and optionally repair) integrity of the database
+  create-user      Create a new user
+  delete-user      Delete a user with all their data
+  list-users       Print all users
+  issue-token      Issue an access token for a user
+  export-user      Print all data of a user
+  import-user      Create a new user from the data printed by export-user
+
+All commands except migrate print results to stdout as JSON, and errors to
+stderr. Exit codes: 0 on success, 1 on error, 2 on wrong usage, and 3 if
+check-integrity has found violations which are not repaired.
+
+Flags:
+`
+
+// Exit codes of the commands
+const (
+	exitCodeError           = 1
+	exitCodeUsage           = 2
+	exitCodeIntegrityBroken = 3
+)
+
+// commands maps command names to their implementations; args are the ones
+// after the command name.
+var commands = map[string]func(si storage.Storage, args []string) error{
+	"migrate":         runMigrate,
+	"check-integrity": requireMigrated(runCheckIntegrity),
+	"create-user":     requireMigrated(runCreateUser),
+	"delete-user":     requireMigrated(runDeleteUser),
+	"list-users":      requireMigrated(runListUsers),
+	"issue-token":     requireMigrated(runIssueToken),
+	"export-user":     requireMigrated(runExportUser),
+	"import-user":     requireMigrated(runImportUser),
+}
+
+// exitError is an error which results in the specific exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func usageError(format string, args ...interface{}) error {
+	return &exitError{code: exitCodeUsage, err: errors.Errorf(format, args...)}
+}
+
+// getExitCode returns the exit code for the error returned by a command.
+func getExitCode(err error) int {
+	if ee, ok := errors.Cause(err).(*exitError); ok {
+		return ee.code
+	}
+	return exitCodeError
+}
+
+// newFlagSet returns a flag set for the command; usage is printed before the
+// command flags.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses command flags, and checks the number of the positional
+// arguments.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		return &exitError{code: exitCodeUsage, err: err}
+	}
+
+	if fs.NArg() < minArgs || fs.NArg() > maxArgs {
+		fs.Usage()
+		return usageError("wrong number of arguments")
+	}
+
+	return nil
+}
+
+// requireMigrated wraps the command so that it fails if the database schema
+// is not up to date: unlike the server, commands don't apply migrations.
+func requireMigrated(
+	run func(si storage.Storage, args []string) error,
+) func(si storage.Storage, args []string) error {
+	return func(si storage.Storage, args []string) error {
+		if migrator, ok := si.(storage.Migrator); ok {
+			status, err := migrator.MigrationStatus()
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if status.CurrentID != status.LatestID {
+				return errors.Errorf(
+					"the current migration is %d, but the latest one is %d; run \"migrate up\" first",
+					status.CurrentID, status.LatestID,
+				)
+			}
+		}
+
+		return run(si, args)
+	}
+}
+
+func printJSON(v interface{}) error {
+	return errors.Trace(writeJSON(os.Stdout, v))
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return errors.Trace(enc.Encode(v))
+}
+
+type adminUserData struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+func makeAdminUserData(ud *storage.UserData) adminUserData {
+	return adminUserData{
+		ID:       ud.ID,
+		Username: ud.Username,
+		Email:    ud.Email,
+	}
+}
+
+// userFlags are the flags of commands which operate on a single user.
+type userFlags struct {
+	id       *int
+	username *string
+}
+
+func addUserFlags(fs *flag.FlagSet) *userFlags {
+	return &userFlags{
+		id:       fs.Int("id", 0, "Id of the user."),
+		username: fs.String("username", "", "Username of the user."),
+	}
+}
+
+// check returns an error unless exactly one of the flags is given.
+func (uf *userFlags) check(fs *flag.FlagSet) error {
+	if (*uf.id == 0) == (*uf.username == "") {
+		fs.Usage()
+		return usageError("exactly one of -id and -username should be given")
+	}
+	return nil
+}
+
+func (uf *userFlags) getUser(tx *sql.Tx, si storage.Storage) (*storage.UserData, error) {
+	args := &storage.GetUserArgs{}
+	if *uf.id != 0 {
+		args.ID = cptr.Int(*uf.id)
+	} else {
+		args.Username = cptr.String(*uf.username)
+	}
+
+	ud, err := si.GetUser(tx, args)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ud, nil
+}
+
+const checkIntegrityUsage = `Usage: geekmarks-server [flags] check-integrity [-repair]
+
+Prints the integrity violations. Without -repair, nothing is changed, so it's
+a dry run of the repair.
+
+Flags:
+`
+
+func runCheckIntegrity(si storage.Storage, args []string) error {
+	fs := newFlagSet("check-integrity", checkIntegrityUsage)
+	repair := fs.Bool("repair", false,
+		"Repair the violations, all in a single transaction.")
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return errors.Trace(err)
+	}
+
+	report, err := si.CheckIntegrity(*repair)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := printJSON(report); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := report.Err(); err != nil {
+		return &exitError{code: exitCodeIntegrityBroken, err: err}
+	}
+
+	return nil
+}
+
+const createUserUsage = `Usage: geekmarks-server [flags] create-user -username <username> -email <email>
+
+Flags:
+`
+
+func runCreateUser(si storage.Storage, args []string) error {
+	fs := newFlagSet("create-user", createUserUsage)
+	username := fs.String("username", "", "Username of the new user.")
+	email := fs.String("email", "", "Email of the new user.")
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return errors.Trace(err)
+	}
+
+	if *username == "" || *email == "" {
+		fs.Usage()
+		return usageError("both -username and -email should be given")
+	}
+
+	var ud *storage.UserData
+	err := si.Tx(func(tx *sql.Tx) error {
+		userID, err := si.CreateUser(tx, &storage.UserData{
+			Username: *username,
+			Email:    *email,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		ud, err = si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(userID)})
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(printJSON(makeAdminUserData(ud)))
+}
+
+const deleteUserUsage = `Usage: geekmarks-server [flags] delete-user -id <id> | -username <username>
+
+Deletes the user with all their data, and prints the deleted user.
+
+Flags:
+`
+
+func runDeleteUser(si storage.Storage, args []string) error {
+	fs := newFlagSet("delete-user", deleteUserUsage)
+	uf := addUserFlags(fs)
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return errors.Trace(err)
+	}
+	if err := uf.check(fs); err != nil {
+		return errors.Trace(err)
+	}
+
+	var ud *storage.UserData
+	err := si.Tx(func(tx *sql.Tx) error {
+		var err error
+		ud, err = uf.getUser(tx, si)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return errors.Trace(si.DeleteUser(tx, ud.ID))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(printJSON(makeAdminUserData(ud)))
+}
+
+const listUsersUsage = `Usage: geekmarks-server [flags] list-users
+
+`
+
+func runListUsers(si storage.Storage, args []string) error {
+	fs := newFlagSet("list-users", listUsersUsage)
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return errors.Trace(err)
+	}
+
+	users := []adminUserData{}
+	err := si.TxOpt(
+		storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+		func(tx *sql.Tx) error {
+			uds, err := si.GetUsers(tx)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			for i := range uds {
+				users = append(users, makeAdminUserData(&uds[i]))
+			}
+
+			return nil
+		})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(printJSON(users))
+}
+
+const issueTokenUsage = `Usage: geekmarks-server [flags] issue-token [-descr <descr>] [-ttl <duration>] [-scope read|write] [-root-tag <path>] -id <id> | -username <username>
+
+A new token is issued every time; it can't be printed again later, since only
+its hash is stored.
+
+Flags:
+`
+
+func runIssueToken(si storage.Storage, args []string) error {
+	fs := newFlagSet("issue-token", issueTokenUsage)
+	uf := addUserFlags(fs)
+	descr := fs.String("descr", "",
+		"Description of the token; by default, it contains the current time.")
+	ttl := fs.Duration("ttl", 0,
+		"Lifetime of the token, e.g. 720h; by default, the token never expires.")
+	scope := fs.String("scope", string(storage.AccessTokenScopeDefault),
+		"Scope of the token: read or write.")
+	rootTag := fs.String("root-tag", "",
+		"Path of the tag, like /foo/bar, to restrict the token to its subtree.")
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return errors.Trace(err)
+	}
+	if err := uf.check(fs); err != nil {
+		return errors.Trace(err)
+	}
+	if *ttl < 0 {
+		return usageError("-ttl can't be negative")
+	}
+	if err := storage.ValidateAccessTokenScope(storage.AccessTokenScope(*scope)); err != nil {
+		return usageError("%s", err)
+	}
+
+	if *descr == "" {
+		*descr = fmt.Sprintf(
+			"Issued by geekmarks-server at %s", time.Now().UTC().Format(time.RFC3339),
+		)
+	}
+
+	var expiresAt uint64
+	if *ttl != 0 {
+		expiresAt = uint64(time.Now().Add(*ttl).Unix())
+	}
+
+	resp := struct {
+		UserID    int    `json:"userID"`
+		Descr     string `json:"descr"`
+		Scope     string `json:"scope"`
+		RootTagID int    `json:"rootTagID,omitempty"`
+		ExpiresAt uint64 `json:"expiresAt,omitempty"`
+		Token     string `json:"token"`
+	}{
+		Descr:     *descr,
+		Scope:     *scope,
+		ExpiresAt: expiresAt,
+	}
+
+	err := si.Tx(func(tx *sql.Tx) error {
+		ud, err := uf.getUser(tx, si)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		resp.UserID = ud.ID
+
+		if *rootTag != "" {
+			resp.RootTagID, err = si.GetTagIDByPath(tx, ud.ID, *rootTag)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		_, resp.Token, err = si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID:    ud.ID,
+			Descr:     *descr,
+			Scope:     storage.AccessTokenScope(*scope),
+			RootTagID: resp.RootTagID,
+			ExpiresAt: expiresAt,
+		})
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(printJSON(resp))
+}
+
+const exportUserUsage = `Usage: geekmarks-server [flags] export-user [-o <file>] -id <id> | -username <username>
+
+Prints tags, bookmarks and notes of the user. Trashed items, revision history
+and timestamps are not exported.
+
+Flags:
+`
+
+func runExportUser(si storage.Storage, args []string) error {
+	fs := newFlagSet("export-user", exportUserUsage)
+	uf := addUserFlags(fs)
+	outPath := fs.String("o", "", "Write to the given file instead of stdout.")
+	if err := parseFlags(fs, args, 0, 0); err != nil {
+		return errors.Trace(err)
+	}
+	if err := uf.check(fs); err != nil {
+		return errors.Trace(err)
+	}
+
+	var data *userexport.UserData
+	err := si.TxOpt(
+		storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+		func(tx *sql.Tx) error {
+			ud, err := uf.getUser(tx, si)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			data, err = userexport.Export(tx, si, ud.ID)
+			return errors.Trace(err)
+		})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if *outPath == "" {
+		return errors.Trace(printJSON(data))
+	}
+
+	f, err := os.Create(*outPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := writeJSON(f, data); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(f.Close())
+}
+
+const importUserUsage = `Usage: geekmarks-server [flags] import-user [-username <username>] [-email <email>] [<file>]
+
+Creates a new user from the data printed by export-user, read from the file or
+from stdin, and prints the new user. Canonical urls of the imported bookmarks
+are calculated on the next start of the server.
+
+Flags:
+`
+
+func runImportUser(si storage.Storage, args []string) error {
+	fs := newFlagSet("import-user", importUserUsage)
+	username := fs.String("username", "", "Override the username from the data.")
+	email := fs.String("email", "", "Override the email from the data.")
+	if err := parseFlags(fs, args, 0, 1); err != nil {
+		return errors.Trace(err)
+	}
+
+	in := io.Reader(os.Stdin)
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var data userexport.UserData
+	if err := json.NewDecoder(in).Decode(&data); err != nil {
+		return errors.Annotatef(err, "parsing user data")
+	}
+
+	if *username != "" {
+		data.Username = *username
+	}
+	if *email != "" {
+		data.Email = *email
+	}
+
+	var ud *storage.UserData
+	err := si.Tx(func(tx *sql.Tx) error {
+		userID, err := userexport.Import(tx, si, &data)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		ud, err = si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(userID)})
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(printJSON(makeAdminUserData(ud)))
+}
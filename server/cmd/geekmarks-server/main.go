@@ -4,9 +4,11 @@
 package main // import "dmitryfrank.com/geekmarks/server/cmd/geekmarks-server"
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 
 	gmserver "dmitryfrank.com/geekmarks/server/server"
 	storagecommon "dmitryfrank.com/geekmarks/server/storage/common"
@@ -19,6 +21,10 @@ var (
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	defer glog.Flush()
@@ -33,6 +39,22 @@ func main() {
 		glog.Fatalf("%s\n", errors.ErrorStack(err))
 	}
 
+	if flag.NArg() > 0 {
+		run, ok := commands[flag.Arg(0)]
+		if !ok {
+			flag.Usage()
+			fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", flag.Arg(0))
+			os.Exit(exitCodeUsage)
+		}
+
+		if err := run(si, flag.Args()[1:]); err != nil {
+			glog.Flush()
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(getExitCode(err))
+		}
+		return
+	}
+
 	err = si.ApplyMigrations()
 	if err != nil {
 		glog.Fatalf("%s\n", errors.ErrorStack(err))
@@ -43,11 +65,17 @@ func main() {
 		glog.Fatalf("%s\n", errors.ErrorStack(err))
 	}
 
+	if err := gminstance.UpdateCanonicalURLs(context.Background()); err != nil {
+		glog.Fatalf("%s\n", errors.ErrorStack(err))
+	}
+
 	handler, err := gminstance.CreateHandler()
 	if err != nil {
 		glog.Fatalf("%s\n", errors.ErrorStack(err))
 	}
 
+	go gminstance.RunTrashPurger(context.Background())
+
 	glog.Infof("Listening at the port %s ...", *port)
 	http.ListenAndServe(fmt.Sprintf(":%s", *port), handler)
 }
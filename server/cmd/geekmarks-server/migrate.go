@@ -0,0 +1,130 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+const migrateUsage = `Usage: geekmarks-server [flags] migrate [-dry-run] <command>
+
+Commands:
+  up [target_id]    Apply migrations up to target_id (default: the latest one)
+  down [target_id]  Revert migrations down to target_id (default: revert the
+                    last applied one; 0 reverts all of them)
+  status            Print applied and pending migrations
+
+Flags:
+`
+
+// runMigrate implements the "migrate" subcommand; args are the ones after
+// "migrate".
+func runMigrate(si storage.Storage, args []string) error {
+	fs := newFlagSet("migrate", migrateUsage)
+	dryRun := fs.Bool("dry-run", false,
+		"Only print the migrations which would be applied or reverted.")
+
+	if err := parseFlags(fs, args, 1, 2); err != nil {
+		return errors.Trace(err)
+	}
+
+	migrator, ok := si.(storage.Migrator)
+	if !ok {
+		return errors.Errorf("the storage %T does not support migrations", si)
+	}
+
+	status, err := migrator.MigrationStatus()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	cmd := fs.Arg(0)
+	var targetID int
+
+	switch cmd {
+	case "status":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return usageError("status takes no arguments")
+		}
+		printMigrationStatus(status)
+		return nil
+
+	case "up":
+		targetID = status.LatestID
+	case "down":
+		targetID = status.CurrentID - 1
+		if targetID < 0 {
+			targetID = 0
+		}
+
+	default:
+		fs.Usage()
+		return usageError("unknown migrate command %q", cmd)
+	}
+
+	if fs.NArg() == 2 {
+		targetID, err = strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return errors.Annotatef(err, "parsing target migration id")
+		}
+	}
+
+	if cmd == "up" && targetID < status.CurrentID {
+		return errors.Errorf(
+			"target %d is below the current migration %d, use down instead",
+			targetID, status.CurrentID,
+		)
+	} else if cmd == "down" && targetID > status.CurrentID {
+		return errors.Errorf(
+			"target %d is above the current migration %d, use up instead",
+			targetID, status.CurrentID,
+		)
+	}
+
+	steps, err := migrator.Migrate(targetID, *dryRun)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	verb := "applied"
+	if cmd == "down" {
+		verb = "reverted"
+	}
+	if *dryRun {
+		verb = "would be " + verb
+	}
+
+	if len(steps) == 0 {
+		fmt.Printf("Nothing to do, the current migration is %d\n", status.CurrentID)
+		return nil
+	}
+
+	for _, step := range steps {
+		fmt.Printf("%3d %-45s %s\n", step.ID, step.Descr, verb)
+	}
+
+	return nil
+}
+
+func printMigrationStatus(status *dfmigrate.Status) {
+	for _, ms := range status.Migrations {
+		state := "pending"
+		if ms.Modified {
+			state = "applied, MODIFIED since then"
+		} else if ms.Applied {
+			state = "applied"
+		}
+		fmt.Printf("%3d %-45s %s\n", ms.ID, ms.Descr, state)
+	}
+
+	fmt.Printf(
+		"\nCurrent migration: %d, latest: %d\n", status.CurrentID, status.LatestID,
+	)
+}
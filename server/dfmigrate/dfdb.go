@@ -7,15 +7,18 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/juju/errors"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const (
 	paramCurMigrationID = "cur_migration_id"
+	paramChecksumPrefix = "checksum_"
 )
 
 func tx(db *sql.DB, fn func(*sql.Tx) error) error {
@@ -64,61 +67,116 @@ func tx(db *sql.DB, fn func(*sql.Tx) error) error {
 	return nil
 }
 
-func initialize(db *sql.DB) error {
-	err := tx(db, func(tx *sql.Tx) error {
-		_, err := tx.Exec(`
+// advisoryLockKey is a key of the Postgres advisory lock which serializes
+// concurrent migration runners (it's "dfmg" in ASCII).
+const advisoryLockKey = 0x64666d67
+
+// lockState (on Postgres) takes an advisory lock which is held until the end
+// of the given transaction, and makes sure that the state table exists. So as
+// long as the state is read and updated in the same transaction, no other
+// runner can interfere.
+//
+// Other databases (SQLite) serialize writers anyway: a concurrent
+// transaction which tries to update the state fails instead of waiting.
+func lockState(db *sql.DB, tx *sql.Tx) error {
+	if _, ok := db.Driver().(*pq.Driver); ok {
+		if _, err := tx.Exec(
+			"SELECT pg_advisory_xact_lock($1)", advisoryLockKey,
+		); err != nil {
+			return errors.Annotatef(err, "taking advisory lock")
+		}
+	}
+
+	if _, err := tx.Exec(`
         CREATE TABLE IF NOT EXISTS dfmigrate_state (
           param TEXT NOT NULL UNIQUE,
           value INTEGER NOT NULL
         )
-      `)
-		return err
-	})
-	if err != nil {
-		return errors.Trace(err)
+      `); err != nil {
+		return errors.Annotatef(err, "creating state table")
 	}
 
 	return nil
 }
 
-func getCurrentMigrationID(db *sql.DB) (int, error) {
+func getCurrentMigrationID(tx *sql.Tx) (int, error) {
 	curID := 0
 
-	err := tx(db, func(tx *sql.Tx) error {
-		err := tx.QueryRow(
-			"SELECT value FROM dfmigrate_state WHERE param = $1", paramCurMigrationID,
-		).Scan(&curID)
-		if err != nil {
-			if errors.Cause(err) == sql.ErrNoRows {
-				curID = 0
-			} else {
-				return errors.Trace(err)
-			}
+	err := tx.QueryRow(
+		"SELECT value FROM dfmigrate_state WHERE param = $1", paramCurMigrationID,
+	).Scan(&curID)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			curID = 0
+		} else {
+			return 0, errors.Trace(err)
 		}
+	}
+
+	return curID, nil
+}
 
-		return nil
-	})
+func setCurrentMigrationID(tx *sql.Tx, curID int) error {
+	return errors.Trace(setParam(tx, paramCurMigrationID, int64(curID)))
+}
+
+// getChecksums returns checksums of the applied migrations, keyed by
+// migration id. Migrations applied before checksums were introduced don't
+// have them.
+func getChecksums(tx *sql.Tx) (map[int]int32, error) {
+	rows, err := tx.Query(
+		"SELECT param, value FROM dfmigrate_state WHERE param LIKE $1",
+		paramChecksumPrefix+"%",
+	)
 	if err != nil {
-		return 0, errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
+	defer rows.Close()
+
+	checksums := map[int]int32{}
+	for rows.Next() {
+		var param string
+		var value int32
+		if err := rows.Scan(&param, &value); err != nil {
+			return nil, errors.Trace(err)
+		}
 
-	return curID, nil
+		id, err := strconv.Atoi(strings.TrimPrefix(param, paramChecksumPrefix))
+		if err != nil {
+			return nil, errors.Annotatef(err, "wrong checksum param %q", param)
+		}
+
+		checksums[id] = value
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return checksums, nil
+}
+
+func setChecksum(tx *sql.Tx, id int, sum int32) error {
+	return errors.Trace(setParam(tx, checksumParam(id), int64(sum)))
 }
 
-func setCurrentMigrationID(db *sql.DB, curID int) error {
-	err := tx(db, func(tx *sql.Tx) error {
-		_, err := tx.Exec(`
+func deleteChecksum(tx *sql.Tx, id int) error {
+	_, err := tx.Exec(
+		"DELETE FROM dfmigrate_state WHERE param = $1", checksumParam(id),
+	)
+	return errors.Trace(err)
+}
+
+func checksumParam(id int) string {
+	return fmt.Sprintf("%s%d", paramChecksumPrefix, id)
+}
+
+func setParam(tx *sql.Tx, param string, value int64) error {
+	_, err := tx.Exec(`
       INSERT INTO dfmigrate_state (param, value) values ($1, $2)
       ON CONFLICT (param) DO UPDATE SET value = $2;
     `,
-			paramCurMigrationID, curID,
-		)
-		if err != nil {
-			return errors.Trace(err)
-		}
-
-		return nil
-	})
+		param, value,
+	)
 	if err != nil {
 		return errors.Trace(err)
 	}
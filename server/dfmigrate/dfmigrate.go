@@ -14,26 +14,70 @@ import (
 type MigrationFunc func(tx *sql.Tx) error
 
 type Migration struct {
-	id    int
-	descr string
-	up    MigrationFunc
-	down  MigrationFunc
+	id       int
+	descr    string
+	up       MigrationFunc
+	down     MigrationFunc
+	checksum int32
 }
 
 type Migrations struct {
 	migrations []Migration
 }
 
+type Direction string
+
+const (
+	DirectionUp   Direction = "up"
+	DirectionDown Direction = "down"
+)
+
+// Step is a single migration to be applied or reverted.
+type Step struct {
+	ID        int
+	Descr     string
+	Direction Direction
+}
+
+type MigrationStatus struct {
+	ID      int
+	Descr   string
+	Applied bool
+	// Modified is true if the migration was edited after it had been applied.
+	Modified bool
+}
+
+type Status struct {
+	// CurrentID is the id of the last applied migration, or 0 if none is
+	// applied.
+	CurrentID int
+	// LatestID is the id of the last known migration.
+	LatestID   int
+	Migrations []MigrationStatus
+}
+
+// AddMigration adds a migration with the given id, which should be the
+// next one.
+//
+// Since migrations are Go funcs, their checksums can't be calculated without
+// running them, so the checksum is declared explicitly: it's saved when the
+// migration is applied, and whenever the up func of a migration is edited,
+// its checksum has to be changed as well (any other value will do). Then,
+// wherever the old version of the migration was applied, migrating refuses
+// to run. Changing the down func doesn't require that: once a migration is
+// applied, its up func is never run again, but a broken down func can still
+// be fixed.
 func (m *Migrations) AddMigration(
-	id int, descr string, up MigrationFunc, down MigrationFunc,
+	id int, descr string, checksum int32, up MigrationFunc, down MigrationFunc,
 ) error {
 	if id != len(m.migrations)+1 {
 		return errors.Errorf("wrong migration id for %q: expected %d, given %d",
 			descr, len(m.migrations)+1, id,
 		)
 	}
+
 	m.migrations = append(m.migrations, Migration{
-		id, descr, up, down,
+		id, descr, up, down, checksum,
 	})
 	return nil
 }
@@ -42,53 +86,241 @@ func (m *Migrations) MigrateToLatest(db *sql.DB) error {
 	return m.Migrate(db, len(m.migrations))
 }
 
+// LatestID returns the id of the last known migration.
+func (m *Migrations) LatestID() int {
+	return len(m.migrations)
+}
+
+// Migrate applies (or reverts, if the target is lower than the current one)
+// migrations so that targetMigrationID becomes the current one. Target 0
+// means reverting all migrations.
+//
+// Each migration runs in its own transaction, together with the update of
+// the current migration id, so a failed migration leaves no traces. See
+// lockState for how concurrent runners are handled.
 func (m *Migrations) Migrate(db *sql.DB, targetMigrationID int) error {
-	err := initialize(db)
+	if err := m.checkTargetID(targetMigrationID); err != nil {
+		return errors.Trace(err)
+	}
+
+	for done := false; !done; {
+		err := tx(db, func(tx *sql.Tx) error {
+			curID, err := m.getCurrentID(db, tx, true)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			switch {
+			case targetMigrationID > curID:
+				mig := m.migrations[curID]
+				glog.Infof("Applying migration %d %q", mig.id, mig.descr)
+				if err := mig.up(tx); err != nil {
+					return errors.Annotatef(err, "applying migration %d", mig.id)
+				}
+
+				if err := setCurrentMigrationID(tx, mig.id); err != nil {
+					return errors.Trace(err)
+				}
+
+				if err := setChecksum(tx, mig.id, mig.checksum); err != nil {
+					return errors.Trace(err)
+				}
+				glog.Infof("Applied successfully")
+
+			case targetMigrationID < curID:
+				mig := m.migrations[curID-1]
+				if mig.down == nil {
+					return errors.Errorf(
+						"migration %d %q can't be reverted", mig.id, mig.descr,
+					)
+				}
+
+				glog.Infof("Reverting migration %d %q", mig.id, mig.descr)
+				if err := mig.down(tx); err != nil {
+					return errors.Annotatef(err, "reverting migration %d", mig.id)
+				}
+
+				if err := setCurrentMigrationID(tx, mig.id-1); err != nil {
+					return errors.Trace(err)
+				}
+
+				if err := deleteChecksum(tx, mig.id); err != nil {
+					return errors.Trace(err)
+				}
+				glog.Infof("Reverted successfully")
+
+			default:
+				done = true
+			}
+
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Plan returns the steps which Migrate would perform in order to get to the
+// given target migration id, without performing them.
+func (m *Migrations) Plan(db *sql.DB, targetMigrationID int) ([]Step, error) {
+	if err := m.checkTargetID(targetMigrationID); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var curID int
+	err := tx(db, func(tx *sql.Tx) error {
+		var err error
+		curID, err = m.getCurrentID(db, tx, false)
+		return errors.Trace(err)
+	})
 	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	steps := []Step{}
+
+	if targetMigrationID > curID {
+		// migrate up
+		for _, mig := range m.migrations[curID:targetMigrationID] {
+			steps = append(steps, Step{
+				ID:        mig.id,
+				Descr:     mig.descr,
+				Direction: DirectionUp,
+			})
+		}
+	} else if targetMigrationID < curID {
+		// migrate down, in reverse order
+		for i := curID - 1; i >= targetMigrationID; i-- {
+			mig := m.migrations[i]
+			if mig.down == nil {
+				return nil, errors.Errorf(
+					"migration %d %q can't be reverted", mig.id, mig.descr,
+				)
+			}
+
+			steps = append(steps, Step{
+				ID:        mig.id,
+				Descr:     mig.descr,
+				Direction: DirectionDown,
+			})
+		}
+	}
+
+	return steps, nil
+}
+
+// Status returns the current migration id and the list of all known
+// migrations, each of which is either applied or pending. Unlike other
+// methods, it doesn't fail if some applied migrations were modified, but
+// reports them instead.
+func (m *Migrations) Status(db *sql.DB) (*Status, error) {
+	var curID int
+	var checksums map[int]int32
+	err := tx(db, func(tx *sql.Tx) error {
+		if err := lockState(db, tx); err != nil {
+			return errors.Trace(err)
+		}
+
+		var err error
+		curID, checksums, err = m.getState(tx)
 		return errors.Trace(err)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	status := &Status{
+		CurrentID:  curID,
+		LatestID:   len(m.migrations),
+		Migrations: make([]MigrationStatus, 0, len(m.migrations)),
+	}
+
+	for _, mig := range m.migrations {
+		sum, ok := checksums[mig.id]
+		status.Migrations = append(status.Migrations, MigrationStatus{
+			ID:       mig.id,
+			Descr:    mig.descr,
+			Applied:  mig.id <= curID,
+			Modified: mig.id <= curID && ok && sum != mig.checksum,
+		})
 	}
 
-	if targetMigrationID > len(m.migrations) {
+	return status, nil
+}
+
+func (m *Migrations) checkTargetID(targetMigrationID int) error {
+	if targetMigrationID > len(m.migrations) || targetMigrationID < 0 {
 		return errors.Errorf("wrong target migration id %d (max: %d)",
 			targetMigrationID, len(m.migrations),
 		)
 	}
 
-	curID, err := getCurrentMigrationID(db)
+	return nil
+}
+
+// getState returns the current migration id, making sure it's valid, and
+// checksums of the applied migrations.
+func (m *Migrations) getState(tx *sql.Tx) (int, map[int]int32, error) {
+	curID, err := getCurrentMigrationID(tx)
 	if err != nil {
-		return errors.Trace(err)
+		return 0, nil, errors.Trace(err)
 	}
 
 	if curID > len(m.migrations) {
-		return errors.Errorf("wrong saved current migration id %d (max: %d)",
+		return 0, nil, errors.Errorf("wrong saved current migration id %d (max: %d)",
 			curID, len(m.migrations),
 		)
 	}
 
 	if curID < 0 {
-		return errors.Errorf("wrong saved current migration id %d", curID)
+		return 0, nil, errors.Errorf("wrong saved current migration id %d", curID)
 	}
 
-	if targetMigrationID > curID {
-		// migrate up
-		for _, mig := range m.migrations[curID:] {
-			glog.Infof("Applying migration %d %q", mig.id, mig.descr)
-			err := tx(db, mig.up)
-			if err != nil {
-				return errors.Trace(err)
-			}
+	checksums, err := getChecksums(tx)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
 
-			err = setCurrentMigrationID(db, mig.id)
-			if err != nil {
-				return errors.Trace(err)
+	return curID, checksums, nil
+}
+
+// getCurrentID locks the state (see lockState) and returns the current
+// migration id, making sure that none of the applied migrations was modified.
+// If saveMissing is true, the checksums of the applied migrations which don't
+// have them yet (because they were applied by an older version) are saved.
+func (m *Migrations) getCurrentID(
+	db *sql.DB, tx *sql.Tx, saveMissing bool,
+) (int, error) {
+	if err := lockState(db, tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	curID, checksums, err := m.getState(tx)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	for _, mig := range m.migrations[:curID] {
+		sum, ok := checksums[mig.id]
+		if !ok {
+			if saveMissing {
+				if err := setChecksum(tx, mig.id, mig.checksum); err != nil {
+					return 0, errors.Trace(err)
+				}
 			}
-			glog.Infof("Applied successfully")
+			continue
+		}
+
+		if sum != mig.checksum {
+			return 0, errors.Errorf(
+				"migration %d %q was modified after it had been applied",
+				mig.id, mig.descr,
+			)
 		}
-	} else if targetMigrationID < curID {
-		// migrate down
-		// TODO
-		return errors.Errorf("migration down is not implemented")
 	}
 
-	return nil
+	return curID, nil
 }
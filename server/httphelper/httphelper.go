@@ -8,8 +8,8 @@ import (
 	"encoding/json"
 	"net/http"
 
-	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/middleware"
+	"github.com/dimonomid/interrors"
 
 	"github.com/golang/glog"
 	"github.com/juju/errors"
@@ -20,6 +20,7 @@ var (
 	unauthorizedError   error
 	forbiddenError      error
 	notImplementedError error
+	timeoutError        error
 )
 
 const (
@@ -31,6 +32,7 @@ func init() {
 	unauthorizedError = errors.New("unauthorized")
 	forbiddenError = errors.New("forbidden")
 	notImplementedError = errors.New("not implemented")
+	timeoutError = errors.New("request timed out")
 }
 
 type ErrorResponse struct {
@@ -57,6 +59,8 @@ func RespondWithError(w http.ResponseWriter, r *http.Request, errResp error) {
 
 	if errors.Cause(errResp) == internalServerError {
 		glog.Errorf("INTERNAL SERVER ERROR:\n" + interrors.ErrorStack(errResp))
+	} else if errors.Cause(errResp) == timeoutError {
+		glog.Warningf("REQUEST TIMED OUT:\n%s", interrors.ErrorStack(errResp))
 	} else {
 		glog.V(2).Infof(errors.ErrorStack(errResp))
 	}
@@ -173,6 +177,13 @@ func MakeNotImplementedError() error {
 	return notImplementedError
 }
 
+// MakeTimeoutError returns an error which should be returned when the request
+// could not be completed in time (e.g. its context is done), wrapping the
+// internal error intError.
+func MakeTimeoutError(intError error) error {
+	return interrors.WrapInternalError(intError, timeoutError)
+}
+
 func GetHTTPErrorCode(err error) int {
 	status := http.StatusBadRequest
 
@@ -185,6 +196,8 @@ func GetHTTPErrorCode(err error) int {
 		status = http.StatusForbidden
 	case notImplementedError:
 		status = http.StatusNotAcceptable
+	case timeoutError:
+		status = http.StatusServiceUnavailable
 	}
 
 	return status
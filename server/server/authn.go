@@ -63,40 +63,20 @@ func parseBearerAuth(r *http.Request) (token string, ok bool) {
 func (gm *GMServer) authnMiddleware(inner http.Handler) http.Handler {
 	mw := func(w http.ResponseWriter, r *http.Request) {
 		// TODO: use https://github.com/abbot/go-http-auth for digest auth
-		token, ok := parseBearerAuth(r)
-
-		if !ok {
-			// When connecting via websocket protocol, JavaScript API does not have a
-			// way to provide HTTP authorization header, so we have to use a trick
-			// here: get token from the query string.
-			token = r.FormValue("token")
-			if token != "" {
-				glog.V(2).Infof("Getting token from the query string")
-				ok = true
-			}
-		}
+		token, ok := getTokenFromReq(r)
 
 		if ok {
-			var ud *storage.UserData
-			err := gm.si.Tx(func(tx *sql.Tx) error {
-				ud2, err := gm.si.GetUserByAccessToken(tx, token)
-
-				if err != nil {
-					return errors.Trace(err)
-				}
-
-				ud = ud2
-				return nil
-			})
+			ud, atd, err := gm.authenticateToken(r.Context(), token)
 			if err != nil {
 				w.Header().Set("WWW-Authenticate", "Bearer realm=\"login please\"")
-				hh.RespondWithError(w, r, err)
+				hh.RespondWithError(w, r, wrapCtxError(r.Context(), err))
 				return
 			}
 
 			// Authn data is correct: create a new request with updated context
 			ctx := r.Context()
 			ctx = context.WithValue(ctx, "authUserData", ud)
+			ctx = context.WithValue(ctx, "authTokenData", atd)
 			r = r.WithContext(ctx)
 		}
 
@@ -107,6 +87,48 @@ func (gm *GMServer) authnMiddleware(inner http.Handler) http.Handler {
 	return middleware.MkMiddleware(mw)
 }
 
+// getTokenFromReq returns the access token given in the request, if any.
+func getTokenFromReq(r *http.Request) (token string, ok bool) {
+	token, ok = parseBearerAuth(r)
+
+	if !ok {
+		// When connecting via websocket protocol, JavaScript API does not have a
+		// way to provide HTTP authorization header, so we have to use a trick
+		// here: get token from the query string.
+		token = r.FormValue("token")
+		if token != "" {
+			glog.V(2).Infof("Getting token from the query string")
+			ok = true
+		}
+	}
+
+	return token, ok
+}
+
+// authenticateToken returns the owner of the token and the token data. It
+// fails with an unauthorized error if the token is unknown (e.g. revoked) or
+// expired.
+func (gm *GMServer) authenticateToken(
+	ctx context.Context, token string,
+) (*storage.UserData, *storage.AccessTokenData, error) {
+	var ud *storage.UserData
+	var atd *storage.AccessTokenData
+	err := gm.si.TxCtx(ctx, func(tx *sql.Tx) error {
+		var err error
+		ud, atd, err = gm.si.GetUserByAccessToken(tx, token)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return ud, atd, nil
+}
+
 func getAuthnUserDataByReq(r *http.Request) *storage.UserData {
 	v := r.Context().Value("authUserData")
 	if v == nil {
@@ -117,8 +139,25 @@ func getAuthnUserDataByReq(r *http.Request) *storage.UserData {
 	return v.(*storage.UserData)
 }
 
+// getAuthnTokenDataByReq returns the token the request is authenticated with;
+// its scope and subtree restrict what the caller can do.
+func getAuthnTokenDataByReq(r *http.Request) *storage.AccessTokenData {
+	v := r.Context().Value("authTokenData")
+	if v == nil {
+		// Not authenticated
+		return nil
+	}
+
+	return v.(*storage.AccessTokenData)
+}
+
 func (gm *GMServer) oauthClientIDGet(gmr *GMRequest) (resp interface{}, err error) {
 	provider := pat.Param(gmr.HttpReq, "provider")
+
+	if op, ok := gm.oidcProviders[provider]; ok {
+		return gm.oidcClientIDGet(gmr, op)
+	}
+
 	oauthCreds, ok := gm.oauthProviders[provider]
 	if !ok {
 		return nil, errors.Errorf("unknown auth provider: %q", provider)
@@ -133,6 +172,28 @@ func (gm *GMServer) oauthClientIDGet(gmr *GMRequest) (resp interface{}, err erro
 
 func (gm *GMServer) authenticatePost(gmr *GMRequest) (resp interface{}, err error) {
 	provider := pat.Param(gmr.HttpReq, "provider")
+
+	if provider == providerLocal {
+		// Username and password; no OAuth creds are involved
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+			var err error
+			resp, err = gm.authenticatePostLocal(tx, gmr)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		return resp, nil
+	}
+
+	if op, ok := gm.oidcProviders[provider]; ok {
+		return gm.authenticatePostOIDC(gmr, op)
+	}
+
 	oauthCreds, ok := gm.oauthProviders[provider]
 	if !ok {
 		return nil, errors.Errorf("unknown auth provider: %q", provider)
@@ -142,7 +203,7 @@ func (gm *GMServer) authenticatePost(gmr *GMRequest) (resp interface{}, err erro
 		return nil, errors.Errorf("auth provider %q is disabled (corresponding flag to the creds file was not provided)", provider)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
 		switch provider {
 		case providerGoogle:
@@ -164,10 +225,122 @@ func (gm *GMServer) authenticatePost(gmr *GMRequest) (resp interface{}, err erro
 	return resp, nil
 }
 
+// getOrCreateExternalUser returns the id of the user which the external
+// identity belongs to. If there's no such user yet, then, if userID is 0, a
+// new user is created (with the email as the username); otherwise, the
+// identity is associated with the existing user userID. If userID is given
+// and the identity already belongs to some other user, it's an error.
+func (gm *GMServer) getOrCreateExternalUser(
+	tx *sql.Tx, eid *storage.ExternalIdentityData, userID int,
+) (int, error) {
+	ud, err := gm.si.GetUserByExternalIdentity(tx, eid.Provider, eid.Subject)
+	if err == nil {
+		glog.V(2).Infof("%s user %q (email %q) belongs to user id %d",
+			eid.Provider, eid.Subject, eid.Email, ud.ID,
+		)
+
+		if userID != 0 && ud.ID != userID {
+			return 0, errors.Errorf(
+				"%s user %q is already linked to another account", eid.Provider, eid.Email,
+			)
+		}
+
+		return ud.ID, nil
+	}
+
+	if errors.Cause(err) != storage.ErrUserDoesNotExist {
+		// Some unexpected error
+		return 0, errors.Trace(err)
+	}
+
+	// We don't have a record for that user: let's create one
+	glog.V(2).Infof("No record for the %s user %q, going to create..", eid.Provider, eid.Subject)
+
+	if userID == 0 {
+		glog.V(2).Infof("Creating a new GeekMarks user..")
+
+		// Check the uniqueness explicitly, to get a meaningful error instead of
+		// the internal one from the storage
+		if err := gm.checkUserNotExists(
+			tx, &storage.GetUserArgs{Username: &eid.Email}, "username", eid.Email,
+		); err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if err := gm.checkUserNotExists(
+			tx, &storage.GetUserArgs{Email: &eid.Email}, "email", eid.Email,
+		); err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		userID, err = gm.si.CreateUser(tx, &storage.UserData{
+			Username: eid.Email,
+			Email:    eid.Email,
+		})
+		if err != nil {
+			return 0, hh.MakeInternalServerError(err)
+		}
+	} else {
+		glog.V(2).Infof("Using user id %d..", userID)
+	}
+
+	glog.V(2).Infof("Associating %s user %q with GeekMarks user %d", eid.Provider, eid.Subject, userID)
+
+	eid2 := *eid
+	eid2.UserID = userID
+	if _, err := gm.si.CreateExternalIdentity(tx, &eid2); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return userID, nil
+}
+
+// checkUserNotExists returns an error if there is a user matching args; what
+// and value are used in the error message.
+func (gm *GMServer) checkUserNotExists(
+	tx *sql.Tx, args *storage.GetUserArgs, what, value string,
+) error {
+	_, err := gm.si.GetUser(tx, args)
+	if err == nil {
+		return errors.Errorf("%s %q is already taken", what, value)
+	}
+
+	if errors.Cause(err) != storage.ErrUserDoesNotExist {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// createLoginAccessToken creates a new GeekMarks access token for the user
+// who has just logged in, and returns the response for the client. Only hashes
+// of tokens are stored, so an existing one can't be returned, and every login
+// gets its own token.
+func (gm *GMServer) createLoginAccessToken(
+	tx *sql.Tx, userID int, tokenDescr string,
+) (resp interface{}, err error) {
+	glog.V(2).Infof("Creating geekmarks token: %q", tokenDescr)
+
+	_, token, err := gm.si.CreateAccessToken(tx, &storage.AccessTokenData{
+		UserID: userID,
+		Descr:  tokenDescr,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return map[string]string{
+		"token": token,
+	}, nil
+}
+
 func (gm *GMServer) setupAuthAPIEndpoints(mux *goji.Mux, gsu getSubjUser) {
 	setUserEndpoint(pat.Get("/client_id"), gm.oauthClientIDGet, nil, mux, gsu)
 	mux.HandleFunc(pat.Options("/client_id"), gm.createOptionsHandler("GET"))
 
 	setUserEndpoint(pat.Post("/authenticate"), gm.authenticatePost, nil, mux, gsu)
 	mux.HandleFunc(pat.Options("/authenticate"), gm.createOptionsHandler("POST"))
+
+	setUserEndpoint(pat.Post("/signup"), gm.localSignupPost, nil, mux, gsu)
+	mux.HandleFunc(pat.Options("/signup"), gm.createOptionsHandler("POST"))
 }
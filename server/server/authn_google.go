@@ -14,9 +14,7 @@ import (
 
 	"golang.org/x/oauth2"
 
-	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/storage"
-	"github.com/golang/glog"
 	"github.com/juju/errors"
 )
 
@@ -112,43 +110,13 @@ func (gm *GMServer) handleOAuthGoogle(
 		return 0, nil, errors.Annotatef(err, "error getting token info: %q", *googleTokenInfo)
 	}
 
-	// Check if we have a record for that Google user
-	ud, err := gm.si.GetUserByGoogleUserID(tx, googleTokenInfo.UserID)
+	userID, err = gm.getOrCreateExternalUser(tx, &storage.ExternalIdentityData{
+		Provider: providerGoogle,
+		Subject:  googleTokenInfo.UserID,
+		Email:    googleTokenInfo.Email,
+	}, userID)
 	if err != nil {
-		if errors.Cause(err) != storage.ErrUserDoesNotExist {
-			// Some unexpected error
-			return 0, nil, errors.Trace(err)
-		}
-
-		// We don't have a record for that Google user: let's create one
-		glog.V(2).Infof("No record for the Google user %q, going to create..", googleTokenInfo.UserID)
-
-		if userID == 0 {
-			var err error
-			glog.V(2).Infof("Creating a new GeekMarks user..")
-
-			userID, err = gm.si.CreateUser(tx, &storage.UserData{
-				Username: googleTokenInfo.Email,
-				Email:    googleTokenInfo.Email,
-			})
-			if err != nil {
-				return 0, nil, hh.MakeInternalServerError(err)
-			}
-		} else {
-			glog.V(2).Infof("Using user id %d..", userID)
-		}
-
-		glog.V(2).Infof("Associating google user %q with GeekMarks user %d", googleTokenInfo.UserID, userID)
-		if err := gm.si.CreateGoogleUser(
-			tx, userID, googleTokenInfo.UserID, googleTokenInfo.Email,
-		); err != nil {
-			return 0, nil, errors.Trace(err)
-		}
-	} else {
-		userID = ud.ID
-		glog.V(2).Infof("Google user %q (email %q) belongs to user id %d",
-			googleTokenInfo.UserID, googleTokenInfo.Email, userID,
-		)
+		return 0, nil, errors.Trace(err)
 	}
 
 	return userID, googleTokenInfo, nil
@@ -167,19 +135,13 @@ func (gm *GMServer) authenticatePostOAuthGoogle(
 		return nil, errors.Trace(err)
 	}
 
-	// Get or create GeekMarks access token
-	tokenDescr := fmt.Sprintf(
+	resp, err = gm.createLoginAccessToken(tx, userID, fmt.Sprintf(
 		"Created for Google user %q (email: %q)",
 		googleTokenInfo.UserID, googleTokenInfo.Email,
-	)
-	glog.V(2).Infof("Getting or creating geekmarks token: %q", tokenDescr)
-
-	token, err := gm.si.GetAccessToken(tx, userID, tokenDescr, true)
+	))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	return map[string]string{
-		"token": token,
-	}, nil
+	return resp, nil
 }
@@ -0,0 +1,312 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+	"goji.io/pat"
+)
+
+const (
+	minPasswordLen = 8
+	// bcrypt ignores everything after 72 bytes, so longer passwords are
+	// rejected instead of being silently truncated.
+	maxPasswordLen = 72
+
+	// Matches the size of the corresponding columns in the users table.
+	maxUsernameLen = 50
+	maxEmailLen    = 50
+)
+
+// dummyPasswordHash is compared against when the user to log in doesn't
+// exist, so that the response time doesn't reveal which usernames are taken.
+var dummyPasswordHash = mustHashPassword("dummy password")
+
+type localSignupArgs struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type localAuthenticateArgs struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type userPasswordPutArgs struct {
+	// OldPassword is required if the user already has a password; users
+	// which have only logged in via OAuth so far don't have one.
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type userPasswordPutResp struct {
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", hh.MakeInternalServerError(err)
+	}
+
+	return string(hash), nil
+}
+
+func mustHashPassword(password string) string {
+	hash, err := hashPassword(password)
+	if err != nil {
+		panic(err)
+	}
+
+	return hash
+}
+
+// checkPassword returns whether the password matches the hash; an empty hash
+// never matches.
+func checkPassword(hash, password string) bool {
+	if hash == "" {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLen {
+		return errors.Errorf("password should be at least %d characters long", minPasswordLen)
+	}
+
+	if len(password) > maxPasswordLen {
+		return errors.Errorf("password should be at most %d bytes long", maxPasswordLen)
+	}
+
+	return nil
+}
+
+// localSignupPost creates a new user with the given username, email and
+// password, and returns an access token for it, just like authenticatePost
+// does.
+func (gm *GMServer) localSignupPost(gmr *GMRequest) (resp interface{}, err error) {
+	provider := pat.Param(gmr.HttpReq, "provider")
+	if provider != providerLocal {
+		return nil, errors.Errorf("auth provider %q does not support signup", provider)
+	}
+
+	if *localSignupDisabled {
+		return nil, errors.Errorf("signup is disabled")
+	}
+
+	args, err := getLocalSignupArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	hash, err := hashPassword(args.Password)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		// Check the uniqueness explicitly, to get a meaningful error instead of
+		// the internal one from the storage
+		if err := gm.checkUserNotExists(
+			tx, &storage.GetUserArgs{Username: &args.Username}, "username", args.Username,
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.checkUserNotExists(
+			tx, &storage.GetUserArgs{Email: &args.Email}, "email", args.Email,
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		userID, err := gm.si.CreateUser(tx, &storage.UserData{
+			Username: args.Username,
+			Password: hash,
+			Email:    args.Email,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		glog.V(2).Infof("Created local user %q, id %d", args.Username, userID)
+
+		resp, err = gm.createLoginAccessToken(
+			tx, userID, fmt.Sprintf("Created for local user %q", args.Username),
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+func (gm *GMServer) authenticatePostLocal(
+	tx *sql.Tx, gmr *GMRequest,
+) (resp interface{}, err error) {
+	args, err := getLocalAuthenticateArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ud, err := gm.si.GetUser(tx, &storage.GetUserArgs{Username: &args.Username})
+	if err != nil {
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return nil, errors.Trace(err)
+		}
+
+		checkPassword(dummyPasswordHash, args.Password)
+		return nil, hh.MakeUnauthorizedError()
+	}
+
+	if !checkPassword(ud.Password, args.Password) {
+		return nil, hh.MakeUnauthorizedError()
+	}
+
+	resp, err = gm.createLoginAccessToken(
+		tx, ud.ID, fmt.Sprintf("Created for local user %q", ud.Username),
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+func (gm *GMServer) userPasswordPut(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args, err := getUserPasswordPutArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	hash, err := hashPassword(args.NewPassword)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		ud, err := gm.si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(gmr.SubjUser.ID)})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if ud.Password != "" && !checkPassword(ud.Password, args.OldPassword) {
+			return hh.MakeForbiddenError()
+		}
+
+		if err := gm.si.SetUserPassword(tx, ud.ID, hash); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return userPasswordPutResp{}, nil
+}
+
+func getLocalSignupArgs(gmr *GMRequest) (*localSignupArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args localSignupArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	args.Username = strings.TrimSpace(args.Username)
+	args.Email = strings.TrimSpace(args.Email)
+
+	if args.Username == "" {
+		return nil, errors.Errorf("username is required")
+	}
+
+	if len(args.Username) > maxUsernameLen {
+		return nil, errors.Errorf("username should be at most %d bytes long", maxUsernameLen)
+	}
+
+	if args.Email == "" {
+		return nil, errors.Errorf("email is required")
+	}
+
+	if len(args.Email) > maxEmailLen {
+		return nil, errors.Errorf("email should be at most %d bytes long", maxEmailLen)
+	}
+
+	if !strings.Contains(args.Email, "@") {
+		return nil, errors.Errorf("invalid email %q", args.Email)
+	}
+
+	if err := validatePassword(args.Password); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &args, nil
+}
+
+func getLocalAuthenticateArgs(gmr *GMRequest) (*localAuthenticateArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args localAuthenticateArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if args.Username == "" || args.Password == "" {
+		return nil, errors.Errorf("username and password are required")
+	}
+
+	return &args, nil
+}
+
+func getUserPasswordPutArgs(gmr *GMRequest) (*userPasswordPutArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userPasswordPutArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if err := validatePassword(args.NewPassword); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &args, nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// Test local authentication {{{
+func TestLocalAuth(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestLocalAuth)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestLocalAuth(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	// Sign up a new user; the returned token should work right away
+	token, err := localAuthReq(be, "/signup", H{
+		"username": "alice",
+		"email":    "alice@example.com",
+		"password": "alicepass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := doTokenReq(be, "GET", "/tokens", token, nil, http.StatusOK); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Taken username and email, too short password
+	for _, tc := range []struct {
+		args H
+		msg  string
+	}{
+		{H{"username": "alice", "email": "a@b.c", "password": "12345678"}, `username "alice" is already taken`},
+		{H{"username": u1.username, "email": "a@b.c", "password": "12345678"}, `username "test1" is already taken`},
+		{H{"username": "bob", "email": u2.email, "password": "12345678"}, `email "2@1.1" is already taken`},
+		{H{"username": "bob", "email": "a@b.c", "password": "1234567"}, "password should be at least 8 characters long"},
+		{H{"username": "", "email": "a@b.c", "password": "12345678"}, "username is required"},
+		{H{"username": "bob", "email": "", "password": "12345678"}, "email is required"},
+	} {
+		if err := localAuthExpectError(be, "/signup", tc.args, http.StatusBadRequest, tc.msg); err != nil {
+			return errors.Annotatef(err, "%v", tc.args)
+		}
+	}
+
+	// Log in
+	token2, err := localAuthReq(be, "/authenticate", H{
+		"username": "alice", "password": "alicepass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if token2 == token {
+		return errors.Errorf("every login should get its own token")
+	}
+
+	// Wrong password, unknown user, and a user without a password
+	for _, args := range []H{
+		{"username": "alice", "password": "wrongpass"},
+		{"username": "nobody", "password": "alicepass"},
+		{"username": u1.username, "password": "alicepass"},
+	} {
+		if err := localAuthExpectError(be, "/authenticate", args, http.StatusUnauthorized, "unauthorized"); err != nil {
+			return errors.Annotatef(err, "%v", args)
+		}
+	}
+
+	// Change the password: the old one is required
+	_, err = doTokenReq(be, "PUT", "/password", token2, H{
+		"oldPassword": "wrongpass", "newPassword": "newalicepass",
+	}, http.StatusForbidden)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = doTokenReq(be, "PUT", "/password", token2, H{
+		"oldPassword": "alicepass", "newPassword": "newalicepass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = localAuthExpectError(be, "/authenticate", H{
+		"username": "alice", "password": "alicepass",
+	}, http.StatusUnauthorized, "unauthorized")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = localAuthReq(be, "/authenticate", H{
+		"username": "alice", "password": "newalicepass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// A user without a password can set one without the old password, and
+	// then log in with it
+	_, err = doTokenReq(be, "PUT", "/password", u1.token, H{
+		"newPassword": "test1pass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = localAuthReq(be, "/authenticate", H{
+		"username": u1.username, "password": "test1pass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Read-only tokens can't change the password
+	readToken, err := createScopedToken(be, u2.id, "read", "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = doTokenReq(be, "PUT", "/password", readToken, H{
+		"newPassword": "test2pass",
+	}, http.StatusForbidden)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Signup can be disabled, but existing users can still log in
+	err = func() error {
+		origDisabled := *localSignupDisabled
+		*localSignupDisabled = true
+		defer func() {
+			*localSignupDisabled = origDisabled
+		}()
+
+		err := localAuthExpectError(be, "/signup", H{
+			"username": "bob", "email": "bob@example.com", "password": "bobspass",
+		}, http.StatusBadRequest, "signup is disabled")
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = localAuthReq(be, "/authenticate", H{
+			"username": "alice", "password": "newalicepass",
+		}, http.StatusOK)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	}()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+func doLocalAuthReq(be testBackend, path string, args H) (*genericResp, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp, err := be.DoReq(
+		"POST", "/api/auth/"+providerLocal+path, "", bytes.NewReader(data), false,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+// localAuthReq performs a request to the local auth provider, and returns the
+// token from the response.
+func localAuthReq(
+	be testBackend, path string, args H, expectedCode int,
+) (string, error) {
+	resp, err := doLocalAuthReq(be, path, args)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	if err := expectHTTPCode(resp, expectedCode); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var tokenResp map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	if tokenResp["token"] == "" {
+		return "", errors.Errorf("no token in the response: %v", tokenResp)
+	}
+
+	return tokenResp["token"], nil
+}
+
+func localAuthExpectError(
+	be testBackend, path string, args H, code int, msg string,
+) error {
+	resp, err := doLocalAuthReq(be, path, args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(expectErrorResp(resp, code, msg))
+}
@@ -0,0 +1,283 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// OIDCProviderConfig is a config of a generic OpenID Connect provider; the
+// file given with -geekmarks.oidc_providers_file maps provider names (as in
+// /api/auth/:provider) to these.
+type OIDCProviderConfig struct {
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// Optional; by default, it's <issuer>/.well-known/openid-configuration.
+	DiscoveryURL string `yaml:"discovery_url"`
+	// Optional; overrides jwks_uri from the discovery document.
+	JWKSURL string `yaml:"jwks_url"`
+}
+
+type oidcDiscoveryDoc struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+type oidcClaims struct {
+	Email string `json:"email"`
+	// Not all providers return it; missing means verified.
+	EmailVerified *bool `json:"email_verified"`
+}
+
+type oidcProvider struct {
+	name   string
+	config OIDCProviderConfig
+
+	// The discovery document is fetched on the first use, not on startup, so
+	// that the server can start while the provider is unreachable. Until the
+	// discovery succeeds, verifier is nil.
+	mtx      sync.Mutex
+	endpoint oauth2.Endpoint
+	verifier *oidc.IDTokenVerifier
+}
+
+func ReadOIDCProvidersFile(providersFile string) (map[string]*OIDCProviderConfig, error) {
+	configs := map[string]*OIDCProviderConfig{}
+	contents, err := ioutil.ReadFile(providersFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := yaml.Unmarshal(contents, configs); err != nil {
+		return nil, errors.Annotatef(err, "unmarshalling OIDC providers")
+	}
+	for name, config := range configs {
+		if name == "" || name == providerGoogle || name == providerLocal {
+			return nil, errors.Errorf("%s: invalid provider name %q", providersFile, name)
+		}
+		if config == nil || config.Issuer == "" || config.ClientID == "" || config.ClientSecret == "" {
+			return nil, errors.Errorf(
+				"%s: %s: issuer, client_id and client_secret are required",
+				providersFile, name,
+			)
+		}
+	}
+	return configs, nil
+}
+
+func newOIDCProvider(name string, config *OIDCProviderConfig) *oidcProvider {
+	return &oidcProvider{
+		name:   name,
+		config: *config,
+	}
+}
+
+// discover returns the provider endpoint and the id_token verifier, fetching
+// the discovery document if it's not done yet.
+func (op *oidcProvider) discover(
+	ctx context.Context,
+) (oauth2.Endpoint, *oidc.IDTokenVerifier, error) {
+	op.mtx.Lock()
+	defer op.mtx.Unlock()
+
+	if op.verifier != nil {
+		return op.endpoint, op.verifier, nil
+	}
+
+	discoveryURL := op.config.DiscoveryURL
+	if discoveryURL == "" {
+		discoveryURL = strings.TrimSuffix(op.config.Issuer, "/") + "/.well-known/openid-configuration"
+	}
+
+	req, err := http.NewRequest("GET", discoveryURL, nil)
+	if err != nil {
+		return oauth2.Endpoint{}, nil, errors.Trace(err)
+	}
+
+	hc := &http.Client{Timeout: 10 * time.Second}
+	dresp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return oauth2.Endpoint{}, nil, hh.MakeInternalServerError(
+			errors.Annotatef(err, "fetching OIDC discovery document %q", discoveryURL),
+		)
+	}
+	defer dresp.Body.Close()
+
+	if dresp.StatusCode != http.StatusOK {
+		return oauth2.Endpoint{}, nil, hh.MakeInternalServerError(errors.Errorf(
+			"fetching OIDC discovery document %q: %s", discoveryURL, dresp.Status,
+		))
+	}
+
+	var doc oidcDiscoveryDoc
+	if err := json.NewDecoder(dresp.Body).Decode(&doc); err != nil {
+		return oauth2.Endpoint{}, nil, hh.MakeInternalServerError(
+			errors.Annotatef(err, "decoding OIDC discovery document %q", discoveryURL),
+		)
+	}
+
+	// Tokens are checked against the configured issuer, so the document
+	// should be about the same one.
+	if doc.Issuer != op.config.Issuer {
+		return oauth2.Endpoint{}, nil, hh.MakeInternalServerError(errors.Errorf(
+			"OIDC discovery document %q is for the issuer %q, expected %q",
+			discoveryURL, doc.Issuer, op.config.Issuer,
+		))
+	}
+
+	jwksURL := doc.JWKSURL
+	if op.config.JWKSURL != "" {
+		jwksURL = op.config.JWKSURL
+	}
+
+	if doc.TokenURL == "" || jwksURL == "" {
+		return oauth2.Endpoint{}, nil, hh.MakeInternalServerError(errors.Errorf(
+			"OIDC discovery document %q lacks token_endpoint or jwks_uri", discoveryURL,
+		))
+	}
+
+	op.endpoint = oauth2.Endpoint{
+		AuthURL:  doc.AuthURL,
+		TokenURL: doc.TokenURL,
+	}
+
+	// The key set outlives the request, and fetches the keys again when it
+	// encounters an unknown key id, so it should not use the request context.
+	keySet := oidc.NewRemoteKeySet(context.Background(), jwksURL)
+	op.verifier = oidc.NewVerifier(op.config.Issuer, keySet, &oidc.Config{
+		ClientID: op.config.ClientID,
+	})
+
+	return op.endpoint, op.verifier, nil
+}
+
+// verify exchanges the authorization code for the tokens, verifies the
+// id_token, and returns the identity it's about.
+func (op *oidcProvider) verify(
+	ctx context.Context, code, redirectURL string,
+) (*storage.ExternalIdentityData, error) {
+	if code == "" {
+		return nil, errors.Errorf("code is required")
+	}
+
+	if redirectURL == "" {
+		return nil, errors.Errorf("redirect_uri is required")
+	}
+
+	endpoint, verifier, err := op.discover(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conf := &oauth2.Config{
+		ClientID:     op.config.ClientID,
+		ClientSecret: op.config.ClientSecret,
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+		Endpoint:     endpoint,
+		RedirectURL:  redirectURL,
+	}
+
+	tok, err := conf.Exchange(ctx, code)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to exchange code for the token")
+	}
+
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.Errorf("failed to get id_token data from the token")
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		glog.V(2).Infof("Failed to verify id_token from %q: %s", op.name, err)
+		return nil, hh.MakeUnauthorizedError()
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, errors.Annotatef(err, "failed to decode id_token claims")
+	}
+
+	// The email becomes the username of a new user, so it's required.
+	if claims.Email == "" {
+		return nil, errors.Errorf("auth provider %q did not return the email", op.name)
+	}
+
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return nil, errors.Errorf("email %q is not verified", claims.Email)
+	}
+
+	return &storage.ExternalIdentityData{
+		Provider: op.name,
+		Subject:  idToken.Subject,
+		Email:    claims.Email,
+	}, nil
+}
+
+func (gm *GMServer) oidcClientIDGet(
+	gmr *GMRequest, op *oidcProvider,
+) (resp interface{}, err error) {
+	endpoint, _, err := op.discover(gmr.Context())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return clientIDGetResp{
+		ClientID: op.config.ClientID,
+		AuthURL:  endpoint.AuthURL,
+	}, nil
+}
+
+func (gm *GMServer) authenticatePostOIDC(
+	gmr *GMRequest, op *oidcProvider,
+) (resp interface{}, err error) {
+	// Talk to the provider before starting the transaction, so that it's not
+	// kept open for the network round trips.
+	eid, err := op.verify(
+		gmr.Context(), gmr.FormValue("code"), gmr.FormValue("redirect_uri"),
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		userID, err := gm.getOrCreateExternalUser(tx, eid, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		resp, err = gm.createLoginAccessToken(tx, userID, fmt.Sprintf(
+			"Created for %s user %q (email: %q)", op.name, eid.Subject, eid.Email,
+		))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
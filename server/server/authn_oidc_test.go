@@ -0,0 +1,374 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+	jose "gopkg.in/go-jose/go-jose.v2"
+)
+
+const (
+	testOIDCProvider = "corp"
+	testOIDCClientID = "geekmarks-client"
+)
+
+// testIssuer is a stand-in OpenID Connect issuer: it serves the discovery
+// document, the keys, and the token endpoint, which returns an id_token with
+// the claims registered for the given code.
+type testIssuer struct {
+	ts *httptest.Server
+
+	key      *rsa.PrivateKey
+	otherKey *rsa.PrivateKey
+
+	mtx sync.Mutex
+	// Map from code to the claims of the id_token issued for it
+	codes map[string]H
+	// Codes whose id_tokens are signed with otherKey, which isn't published
+	badSigCodes map[string]bool
+}
+
+func newTestIssuer() (*testIssuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ti := &testIssuer{
+		key:         key,
+		otherKey:    otherKey,
+		codes:       map[string]H{},
+		badSigCodes: map[string]bool{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", ti.handleDiscovery)
+	mux.HandleFunc("/keys", ti.handleKeys)
+	mux.HandleFunc("/token", ti.handleToken)
+	ti.ts = httptest.NewServer(mux)
+
+	return ti, nil
+}
+
+func (ti *testIssuer) Close() {
+	ti.ts.Close()
+}
+
+// AddCode registers the code, for which the id_token with the default claims
+// (valid for testOIDCClientID) overridden by the given ones is issued.
+func (ti *testIssuer) AddCode(code string, claims H, badSig bool) {
+	now := time.Now().Unix()
+	c := H{
+		"iss": ti.ts.URL,
+		"aud": testOIDCClientID,
+		"iat": now,
+		"exp": now + 3600,
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+
+	ti.mtx.Lock()
+	defer ti.mtx.Unlock()
+	ti.codes[code] = c
+	ti.badSigCodes[code] = badSig
+}
+
+func (ti *testIssuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(H{
+		"issuer":                 ti.ts.URL,
+		"authorization_endpoint": ti.ts.URL + "/auth",
+		"token_endpoint":         ti.ts.URL + "/token",
+		"jwks_uri":               ti.ts.URL + "/keys",
+	})
+}
+
+func (ti *testIssuer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{
+			{Key: &ti.key.PublicKey, KeyID: "key1", Algorithm: "RS256", Use: "sig"},
+		},
+	})
+}
+
+func (ti *testIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+
+	ti.mtx.Lock()
+	claims, ok := ti.codes[code]
+	badSig := ti.badSigCodes[code]
+	ti.mtx.Unlock()
+
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(H{"error": "invalid_grant"})
+		return
+	}
+
+	key := ti.key
+	if badSig {
+		key = ti.otherKey
+	}
+
+	idToken, err := signTestIDToken(key, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(H{
+		"access_token": "access-" + code,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func signTestIDToken(key *rsa.PrivateKey, claims H) (string, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "key1"),
+	)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return jws.CompactSerialize()
+}
+
+// withTestOIDCProvider configures the server to use the given issuer as the
+// provider testOIDCProvider, and calls f.
+func withTestOIDCProvider(ti *testIssuer, f func() error) error {
+	file, err := ioutil.TempFile("", "oidc_providers")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = fmt.Fprintf(file, `
+%s:
+  issuer: %q
+  client_id: %q
+  client_secret: "secret"
+`, testOIDCProvider, ti.ts.URL, testOIDCClientID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	origFile := *oidcProvidersFile
+	*oidcProvidersFile = file.Name()
+	defer func() {
+		*oidcProvidersFile = origFile
+	}()
+
+	return errors.Trace(f())
+}
+
+// Test OpenID Connect authentication {{{
+func TestOIDCAuth(t *testing.T) {
+	ti, err := newTestIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ti.Close()
+
+	ti.AddCode("alice", H{"sub": "alice-id", "email": "alice@corp.com"}, false)
+	ti.AddCode("alice2", H{"sub": "alice-id", "email": "alice@corp.com"}, false)
+	ti.AddCode("bob", H{"sub": "bob-id", "email": "bob@corp.com", "email_verified": true}, false)
+	ti.AddCode("wrong-aud", H{"sub": "alice-id", "email": "alice@corp.com", "aud": "other"}, false)
+	ti.AddCode("wrong-iss", H{"sub": "alice-id", "email": "alice@corp.com", "iss": "http://other"}, false)
+	ti.AddCode("expired", H{"sub": "alice-id", "email": "alice@corp.com", "exp": time.Now().Unix() - 60}, false)
+	ti.AddCode("bad-sig", H{"sub": "alice-id", "email": "alice@corp.com"}, true)
+	ti.AddCode("no-email", H{"sub": "carol-id"}, false)
+	ti.AddCode("unverified", H{"sub": "carol-id", "email": "carol@corp.com", "email_verified": false}, false)
+	ti.AddCode("taken-email", H{"sub": "dave-id", "email": "1@1.1"}, false)
+
+	err = withTestOIDCProvider(ti, func() error {
+		runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+			var err error
+
+			err = runPerUserTest(
+				si, be, "test1", "1@1.1", "test2", "2@1.1",
+				func(si storage.Storage, be testBackend, u1, u2 *perUserData) error {
+					return perUserTestOIDCAuth(si, be, ti, u1, u2)
+				},
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func perUserTestOIDCAuth(
+	si storage.Storage, be testBackend, ti *testIssuer, u1, u2 *perUserData,
+) error {
+	// Clients need the client id and the authorization endpoint
+	resp, err := be.DoReq(
+		"GET", "/api/auth/"+testOIDCProvider+"/client_id", "", nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var cidResp clientIDGetResp
+	if err := json.NewDecoder(resp.Body).Decode(&cidResp); err != nil {
+		return errors.Trace(err)
+	}
+
+	if cidResp.ClientID != testOIDCClientID || cidResp.AuthURL != ti.ts.URL+"/auth" {
+		return errors.Errorf("wrong client_id response: %+v", cidResp)
+	}
+
+	// The first login creates a new user, the second one logs into the same
+	// user
+	token, err := oidcAuthReq(be, "alice")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	token2, err := oidcAuthReq(be, "alice2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err = doTokenReq(be, "GET", "/tokens", token2, nil, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var tokens []userTokenData
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(tokens) != 2 {
+		return errors.Errorf("both logins should belong to the same user, got tokens %+v", tokens)
+	}
+
+	// Another identity gets another user
+	token3, err := oidcAuthReq(be, "bob")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if token3 == token || token3 == token2 {
+		return errors.Errorf("every login should get its own token")
+	}
+
+	// Tokens which fail verification
+	for _, code := range []string{"wrong-aud", "wrong-iss", "expired", "bad-sig"} {
+		if err := oidcAuthExpectError(be, code, http.StatusUnauthorized, "unauthorized"); err != nil {
+			return errors.Annotatef(err, "%s", code)
+		}
+	}
+
+	for _, tc := range []struct {
+		code string
+		msg  string
+	}{
+		{"no-email", `auth provider "corp" did not return the email`},
+		{"unverified", `email "carol@corp.com" is not verified`},
+		{"taken-email", `email "1@1.1" is already taken`},
+	} {
+		if err := oidcAuthExpectError(be, tc.code, http.StatusBadRequest, tc.msg); err != nil {
+			return errors.Annotatef(err, "%s", tc.code)
+		}
+	}
+
+	return nil
+}
+
+// }}}
+
+func doOIDCAuthReq(be testBackend, code string) (*genericResp, error) {
+	qsVals := url.Values{}
+	qsVals.Add("code", code)
+	qsVals.Add("redirect_uri", "http://localhost/callback")
+
+	resp, err := be.DoReq(
+		"POST", "/api/auth/"+testOIDCProvider+"/authenticate?"+qsVals.Encode(),
+		"", nil, false,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+// oidcAuthReq logs in with the given code, and returns the token.
+func oidcAuthReq(be testBackend, code string) (string, error) {
+	resp, err := doOIDCAuthReq(be, code)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	if err := expectHTTPCode(resp, http.StatusOK); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var tokenResp map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	if tokenResp["token"] == "" {
+		return "", errors.Errorf("no token in the response: %v", tokenResp)
+	}
+
+	return tokenResp["token"], nil
+}
+
+func oidcAuthExpectError(be testBackend, code string, httpCode int, msg string) error {
+	resp, err := doOIDCAuthReq(be, code)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(expectErrorResp(resp, httpCode, msg))
+}
@@ -4,6 +4,7 @@
 package server
 
 import (
+	"database/sql"
 	"net/http"
 
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
@@ -13,35 +14,236 @@ import (
 
 type authzArgs struct {
 	OwnerID int
+
+	// Write should be set for operations which modify any data; tokens with
+	// the read scope can't perform them.
+	Write bool
+
+	// AllowSubtree should be set by handlers which can work with tokens
+	// restricted to a tag subtree; they're responsible for not touching
+	// anything outside of the subtree, e.g. by checking the tags with
+	// authorizeTagsOperation. Other handlers can't be used with such tokens
+	// at all.
+	AllowSubtree bool
+
+	// AllowShared should be set by read-only handlers which can work with
+	// subtrees shared by the owner with other users (see
+	// storage.TagGrantData); like with AllowSubtree, they're responsible for
+	// not touching anything outside of the shared subtrees, by checking the
+	// tags with authorizeTagsOperation.
+	AllowShared bool
+
+	// TagID is the target tag of the operation, if any: if the caller is not
+	// the owner, it should be within one of the subtrees shared with the
+	// caller, which is checked against the tag's ancestors. Used by
+	// authorizeTagsOperation only.
+	TagID int
+
+	// TagIDs which the operation is going to access; used by
+	// authorizeTagsOperation only, and checked just like TagID.
+	TagIDs []int
 }
 
 func (gm *GMServer) authorizeOperationByReq(
 	r *http.Request, args *authzArgs,
 ) error {
 	callerData := getAuthnUserDataByReq(r)
+	callerToken := getAuthnTokenDataByReq(r)
 
-	return gm.authorizeOperation(callerData, args)
+	return gm.authorizeOperation(callerData, callerToken, args)
 }
 
+// authorizeOperation checks whether the caller, authenticated with the given
+// token, is allowed to perform the operation. The token might be nil, e.g.
+// for the operations performed by the server itself on behalf of the user.
 func (gm *GMServer) authorizeOperation(
-	callerData *storage.UserData, args *authzArgs,
+	callerData *storage.UserData, callerToken *storage.AccessTokenData,
+	args *authzArgs,
+) error {
+	if callerData == nil {
+		return hh.MakeForbiddenError()
+	}
+
+	// Owner can do things with their data; others can only read the subtrees
+	// shared with them, and only with the handlers which support it. Tokens
+	// restricted to a subtree of the caller's own tags don't give access to
+	// anything shared.
+	if callerData.ID != args.OwnerID {
+		if !args.AllowShared || args.Write || tokenRootTagID(callerToken) != 0 {
+			return hh.MakeForbiddenError()
+		}
+	}
+
+	if callerToken != nil {
+		if args.Write && callerToken.Scope == storage.AccessTokenScopeRead {
+			return hh.MakeForbiddenError()
+		}
+
+		if !args.AllowSubtree && callerToken.RootTagID != 0 {
+			return hh.MakeForbiddenError()
+		}
+	}
+
+	return nil
+}
+
+// authorizeTagsOperation is like authorizeOperation, but it also checks that
+// args.TagID and all args.TagIDs are within the subtree the token is
+// restricted to, if any, or, if the caller is not the owner (which requires
+// args.AllowShared), within the subtrees shared with the caller.
+// args.AllowSubtree is implied.
+func (gm *GMServer) authorizeTagsOperation(
+	tx *sql.Tx, callerData *storage.UserData,
+	callerToken *storage.AccessTokenData, args *authzArgs,
 ) error {
-	// We might have much more fields in authzArgs in the future, but for now
-	// we keep things simple: only owner can do everything with their data;
-	// others can do nothing.
+	aArgs := *args
+	aArgs.AllowSubtree = true
+
+	if err := gm.authorizeOperation(callerData, callerToken, &aArgs); err != nil {
+		return errors.Trace(err)
+	}
+
+	tagIDs := args.TagIDs
+	if args.TagID != 0 {
+		tagIDs = append([]int{args.TagID}, tagIDs...)
+	}
+
+	if callerData.ID != args.OwnerID {
+		return errors.Trace(
+			gm.authorizeSharedTags(tx, callerData.ID, args.OwnerID, tagIDs),
+		)
+	}
+
+	rootTagID := tokenRootTagID(callerToken)
+	if rootTagID == 0 {
+		return nil
+	}
+
+	for _, tagID := range tagIDs {
+		ok, err := gm.isTagInSubtree(tx, tagID, rootTagID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if !ok {
+			return hh.MakeForbiddenError()
+		}
+	}
+
+	return nil
+}
 
-	if callerData == nil || callerData.ID != args.OwnerID {
-		// No user or another user
+// authorizeSharedTags checks that all the given tags of the owner are within
+// the subtrees shared with the grantee. Nothing is shared implicitly, so at
+// least one tag should be given.
+func (gm *GMServer) authorizeSharedTags(
+	tx *sql.Tx, granteeID, ownerID int, tagIDs []int,
+) error {
+	if len(tagIDs) == 0 {
 		return hh.MakeForbiddenError()
 	}
 
+	sharedTagIDs, err := gm.getSharedTagIDs(tx, granteeID, ownerID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, tagID := range tagIDs {
+		shared := false
+		for _, sharedTagID := range sharedTagIDs {
+			ok, err := gm.isTagInSubtree(tx, tagID, sharedTagID)
+			if err != nil {
+				// See hideMissingTag
+				if errors.Cause(err) == storage.ErrTagDoesNotExist {
+					return hh.MakeForbiddenError()
+				}
+				return errors.Trace(err)
+			}
+
+			if ok {
+				shared = true
+				break
+			}
+		}
+
+		if !shared {
+			return hh.MakeForbiddenError()
+		}
+	}
+
 	return nil
 }
 
+// hideMissingTag returns a forbidden error instead of err if the latter tells
+// that a tag doesn't exist, and the caller is not the owner: for others, tags
+// which don't exist should look just like the ones not shared with them, so
+// that the owner's tags can't be probed by paths or ids.
+func hideMissingTag(callerData *storage.UserData, ownerID int, err error) error {
+	if errors.Cause(err) == storage.ErrTagDoesNotExist &&
+		(callerData == nil || callerData.ID != ownerID) {
+		return hh.MakeForbiddenError()
+	}
+
+	return err
+}
+
+// getSharedTagIDs returns ids of the tags of the owner whose subtrees are
+// shared with the grantee.
+func (gm *GMServer) getSharedTagIDs(
+	tx *sql.Tx, granteeID, ownerID int,
+) ([]int, error) {
+	grants, err := gm.si.GetTagGrantsByGrantee(tx, granteeID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagIDs := []int{}
+	for _, g := range grants {
+		if g.OwnerID == ownerID {
+			tagIDs = append(tagIDs, g.TagID)
+		}
+	}
+
+	return tagIDs, nil
+}
+
+// isTagInSubtree returns whether the tag is either rootTagID itself or one of
+// its descendants.
+func (gm *GMServer) isTagInSubtree(
+	tx *sql.Tx, tagID, rootTagID int,
+) (bool, error) {
+	for tagID != 0 {
+		if tagID == rootTagID {
+			return true, nil
+		}
+
+		td, err := gm.si.GetTag(tx, tagID, &storage.GetTagOpts{})
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+
+		tagID = 0
+		if td.ParentTagID != nil {
+			tagID = *td.ParentTagID
+		}
+	}
+
+	return false, nil
+}
+
+// tokenRootTagID returns the root of the subtree the token is restricted to,
+// or 0 if it isn't restricted (or if there is no token at all).
+func tokenRootTagID(token *storage.AccessTokenData) int {
+	if token == nil {
+		return 0
+	}
+
+	return token.RootTagID
+}
+
 // The OwnerID field in args is overwritten by the user data returned by
-// gsu, so at the moment clients have to call this function with just
-// &authzArgs{}, but we'll probably have more fields in the future, so,
-// this function still takes this argument.
+// gsu, so clients typically call this function with just &authzArgs{}, or
+// with the fields which aren't related to the owner.
 func (gm *GMServer) getUserAndAuthorizeByReq(
 	r *http.Request, gsu getSubjUser, args *authzArgs,
 ) (*storage.UserData, error) {
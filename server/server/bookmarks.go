@@ -5,21 +5,32 @@ package server
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"strconv"
 
 	"goji.io/pat"
 
 	"dmitryfrank.com/geekmarks/server/cptr"
-	"github.com/dimonomid/interrors"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
 
 	"github.com/juju/errors"
 )
 
 const (
-	QSArgBkmGetArgTagID = "tag_id"
-	QSArgBkmGetArgURL   = "url"
+	QSArgBkmGetArgTagID    = "tag_id"
+	QSArgBkmGetArgURL      = "url"
+	QSArgBkmGetArgQuery    = "q"
+	QSArgBkmGetArgTagQuery = "query"
+	QSArgBkmGetArgLimit    = "limit"
+	QSArgBkmGetArgCursor   = "cursor"
+	QSArgBkmGetArgSort     = "sort"
+	QSArgBkmGetArgOrder    = "order"
+
+	QSArgBkmGetArgOrderAsc  = "asc"
+	QSArgBkmGetArgOrderDesc = "desc"
 )
 
 type userBookmarkTag struct {
@@ -40,6 +51,33 @@ type userBookmarkData struct {
 	Tags      []userBookmarkTag `json:"tags,omitempty"`
 }
 
+// userBookmarkSearchData is returned instead of userBookmarkData when
+// searching bookmarks: matched words in the snippets are wrapped in <b></b>.
+type userBookmarkSearchData struct {
+	userBookmarkData
+	Rank           float64 `json:"rank"`
+	TitleSnippet   string  `json:"titleSnippet,omitempty"`
+	CommentSnippet string  `json:"commentSnippet,omitempty"`
+}
+
+// userBookmarksPage is returned instead of a plain array of bookmarks if the
+// client asks for a limited number of them (or for the next page).
+type userBookmarksPage struct {
+	Bookmarks  []userBookmarkData `json:"bookmarks"`
+	TotalCnt   int                `json:"totalCnt"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+// userBookmarksCursor is how storage.BookmarksCursor is serialized (and then
+// base64-encoded) for the clients; they shouldn't care about the contents.
+type userBookmarksCursor struct {
+	SortField string `json:"s"`
+	SortDesc  bool   `json:"d,omitempty"`
+	ID        int    `json:"i"`
+	Time      uint64 `json:"t,omitempty"`
+	Str       string `json:"v,omitempty"`
+}
+
 type userBookmarkPostArgs struct {
 	URL     string `json:"url"`
 	Title   string `json:"title,omitempty"`
@@ -58,16 +96,64 @@ type userBookmarkDeleteResp struct {
 }
 
 func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, AllowSubtree: true, AllowShared: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	// Check if both tag_id and url are given (it's an error)
-	if len(gmr.Values[QSArgBkmGetArgTagID]) > 0 && len(gmr.Values[QSArgBkmGetArgURL]) > 0 {
-		return nil, errors.Errorf(
-			"%q and %q cannot be given both", QSArgBkmGetArgTagID, QSArgBkmGetArgURL,
-		)
+	// Shared bookmarks can only be looked up by the shared tags
+	if gmr.Caller.ID != gmr.SubjUser.ID {
+		for _, arg := range []string{QSArgBkmGetArgURL, QSArgBkmGetArgTagQuery} {
+			if len(gmr.Values[arg]) > 0 {
+				return nil, errors.Annotatef(
+					hh.MakeForbiddenError(), "%q can't be used with shared bookmarks", arg,
+				)
+			}
+		}
+	}
+
+	// Check if url is given together with tag_id or q (it's an error)
+	if len(gmr.Values[QSArgBkmGetArgURL]) > 0 {
+		for _, arg := range []string{QSArgBkmGetArgTagID, QSArgBkmGetArgQuery} {
+			if len(gmr.Values[arg]) > 0 {
+				return nil, errors.Errorf(
+					"%q and %q cannot be given both", arg, QSArgBkmGetArgURL,
+				)
+			}
+		}
+	}
+
+	// Tag query replaces all the other ways to look up bookmarks
+	if len(gmr.Values[QSArgBkmGetArgTagQuery]) > 0 {
+		for _, arg := range []string{
+			QSArgBkmGetArgTagID, QSArgBkmGetArgURL, QSArgBkmGetArgQuery,
+		} {
+			if len(gmr.Values[arg]) > 0 {
+				return nil, errors.Errorf(
+					"%q and %q cannot be given both", arg, QSArgBkmGetArgTagQuery,
+				)
+			}
+		}
+	}
+
+	pageOpts, paged, err := getBookmarksPageOptsFromQS(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Sorting and paging is only supported for tagged bookmarks
+	if pageOpts != nil {
+		for _, arg := range []string{QSArgBkmGetArgURL, QSArgBkmGetArgQuery} {
+			if len(gmr.Values[arg]) > 0 {
+				return nil, errors.Errorf(
+					"%q, %q, %q and %q cannot be used with %q",
+					QSArgBkmGetArgLimit, QSArgBkmGetArgCursor,
+					QSArgBkmGetArgSort, QSArgBkmGetArgOrder, arg,
+				)
+			}
+		}
 	}
 
 	tagsFetchOpts := storage.TagsFetchOpts{
@@ -75,41 +161,65 @@ func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err erro
 		TagNamesFetchMode: storage.TagNamesFetchModeFull,
 	}
 
+	// If the caller's token is restricted to a subtree, only bookmarks tagged
+	// within it are returned, and only with the tags within it; the same goes
+	// for the subtrees shared with the caller.
+	rootTagID := tokenRootTagID(gmr.CallerToken)
+	var rootTagIDs []int
+
 	var bkms []storage.BookmarkDataWTags
 
 	if len(gmr.Values[QSArgBkmGetArgURL]) > 0 {
 		// get bookmarks by URL
 
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			var err error
 			bkms, err = gm.si.GetBookmarksByURL(
-				tx, gmr.Values[QSArgBkmGetArgURL][0], gmr.SubjUser.ID, &tagsFetchOpts,
+				tx, canonicalizeURL(gmr.Values[QSArgBkmGetArgURL][0]), gmr.SubjUser.ID,
+				&tagsFetchOpts,
 			)
 			if err != nil {
 				return errors.Trace(err)
 			}
 
+			if rootTagID != 0 {
+				subtreeBkms := []storage.BookmarkDataWTags{}
+				for i := range bkms {
+					if filterSubtreeTags(&bkms[i], []int{rootTagID}) {
+						subtreeBkms = append(subtreeBkms, bkms[i])
+					}
+				}
+				bkms = subtreeBkms
+			}
+
 			return nil
 		})
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-	} else {
-		// get tagged bookmarks
+	} else if len(gmr.Values[QSArgBkmGetArgQuery]) > 0 {
+		// search bookmarks, possibly among tagged ones
+
+		tagIDs, err := getTagIDsFromQS(gmr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 
-		tagIDs := []int{}
-		for _, stid := range gmr.Values[QSArgBkmGetArgTagID] {
-			v, err := strconv.Atoi(stid)
+		var results []storage.BookmarkSearchResult
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+			tagIDs, err := gm.getSubtreeTagIDs(gmr, tx, tagIDs)
 			if err != nil {
-				return nil, errors.Annotatef(err, "wrong tag id %q", stid)
+				return errors.Trace(err)
 			}
-			tagIDs = append(tagIDs, v)
-		}
 
-		err = gm.si.Tx(func(tx *sql.Tx) error {
-			var err error
-			bkms, err = gm.si.GetTaggedBookmarks(
-				tx, tagIDs, cptr.Int(gmr.SubjUser.ID), &tagsFetchOpts,
+			rootTagIDs, err = gm.getVisibleRootTagIDs(gmr, tx)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			results, err = gm.si.SearchBookmarks(
+				tx, gmr.Values[QSArgBkmGetArgQuery][0], gmr.SubjUser.ID, tagIDs,
+				&tagsFetchOpts,
 			)
 			if err != nil {
 				return errors.Trace(err)
@@ -120,26 +230,308 @@ func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err erro
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
+
+		resultsUser := []userBookmarkSearchData{}
+		for _, res := range results {
+			filterSubtreeTags(&res.BookmarkDataWTags, rootTagIDs)
+			resultsUser = append(resultsUser, userBookmarkSearchData{
+				userBookmarkData: makeUserBookmarkData(&res.BookmarkDataWTags),
+				Rank:             res.Rank,
+				TitleSnippet:     res.TitleSnippet,
+				CommentSnippet:   res.CommentSnippet,
+			})
+		}
+
+		return resultsUser, nil
+	} else {
+		var page *storage.BookmarksPage
+
+		if len(gmr.Values[QSArgBkmGetArgTagQuery]) > 0 {
+			// get bookmarks matching the tag query
+
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+				query, err := storage.ParseTagQuery(
+					gmr.Values[QSArgBkmGetArgTagQuery][0],
+					func(ref string) (int, error) {
+						tagID, err := gm.resolveTagRef(tx, gmr.SubjUser.ID, ref)
+						if err != nil {
+							return 0, errors.Trace(hideMissingTag(gmr.Caller, gmr.SubjUser.ID, err))
+						}
+
+						err = gm.authorizeTagsOperation(
+							tx, gmr.Caller, gmr.CallerToken, &authzArgs{
+								OwnerID: gmr.SubjUser.ID,
+								TagIDs:  []int{tagID},
+							},
+						)
+						if err != nil {
+							return 0, errors.Trace(err)
+						}
+
+						return tagID, nil
+					},
+				)
+				if err != nil {
+					return errors.Annotatef(err, "invalid %q", QSArgBkmGetArgTagQuery)
+				}
+
+				rootTagIDs, err = gm.getVisibleRootTagIDs(gmr, tx)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				if rootTagID != 0 {
+					query = &storage.TagQuery{
+						Op: storage.TagQueryOpAnd,
+						Operands: []storage.TagQuery{
+							{Op: storage.TagQueryOpTag, TagID: rootTagID},
+							*query,
+						},
+					}
+				}
+
+				page, err = gm.si.GetBookmarksByTagQuery(
+					tx, query, gmr.SubjUser.ID, &tagsFetchOpts, pageOpts,
+				)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		} else {
+			// get tagged bookmarks
+
+			tagIDs, err := getTagIDsFromQS(gmr)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+				tagIDs, err := gm.getSubtreeTagIDs(gmr, tx, tagIDs)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				rootTagIDs, err = gm.getVisibleRootTagIDs(gmr, tx)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				page, err = gm.si.GetTaggedBookmarks(
+					tx, tagIDs, cptr.Int(gmr.SubjUser.ID), &tagsFetchOpts, pageOpts,
+				)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		for i := range page.Bookmarks {
+			filterSubtreeTags(&page.Bookmarks[i], rootTagIDs)
+		}
+
+		if paged {
+			pageUser := userBookmarksPage{
+				Bookmarks: []userBookmarkData{},
+				TotalCnt:  page.TotalCnt,
+			}
+
+			for i := range page.Bookmarks {
+				pageUser.Bookmarks = append(
+					pageUser.Bookmarks, makeUserBookmarkData(&page.Bookmarks[i]),
+				)
+			}
+
+			if page.NextCursor != nil {
+				pageUser.NextCursor, err = encodeBookmarksCursor(page.NextCursor)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+
+			return pageUser, nil
+		}
+
+		bkms = page.Bookmarks
 	}
 
 	bkmsUser := []userBookmarkData{}
 
-	for _, bkm := range bkms {
-		bkmsUser = append(bkmsUser, userBookmarkData{
-			ID:        bkm.ID,
-			URL:       bkm.URL,
-			Title:     bkm.Title,
-			Comment:   bkm.Comment,
-			UpdatedAt: bkm.UpdatedAt,
-			Tags:      getUserBookmarkTags(bkm.Tags),
-		})
+	for i := range bkms {
+		bkmsUser = append(bkmsUser, makeUserBookmarkData(&bkms[i]))
 	}
 
 	return bkmsUser, nil
 }
 
+func makeUserBookmarkData(bkm *storage.BookmarkDataWTags) userBookmarkData {
+	return userBookmarkData{
+		ID:        bkm.ID,
+		URL:       bkm.URL,
+		Title:     bkm.Title,
+		Comment:   bkm.Comment,
+		UpdatedAt: bkm.UpdatedAt,
+		Tags:      getUserBookmarkTags(bkm.Tags),
+	}
+}
+
+// getBookmarksPageOptsFromQS returns nil opts if none of the sorting and
+// paging query string params are given. paged is true if the client wants a
+// page of bookmarks (i.e. userBookmarksPage) instead of a plain array.
+func getBookmarksPageOptsFromQS(
+	gmr *GMRequest,
+) (opts *storage.BookmarksPageOpts, paged bool, err error) {
+	for _, arg := range []string{
+		QSArgBkmGetArgLimit, QSArgBkmGetArgCursor,
+		QSArgBkmGetArgSort, QSArgBkmGetArgOrder,
+	} {
+		if len(gmr.Values[arg]) > 0 {
+			opts = &storage.BookmarksPageOpts{}
+			break
+		}
+	}
+
+	if opts == nil {
+		return nil, false, nil
+	}
+
+	if len(gmr.Values[QSArgBkmGetArgSort]) > 0 {
+		opts.SortField = storage.BookmarksSortField(gmr.Values[QSArgBkmGetArgSort][0])
+	}
+
+	if len(gmr.Values[QSArgBkmGetArgOrder]) > 0 {
+		switch order := gmr.Values[QSArgBkmGetArgOrder][0]; order {
+		case QSArgBkmGetArgOrderAsc:
+			opts.SortDesc = false
+		case QSArgBkmGetArgOrderDesc:
+			opts.SortDesc = true
+		default:
+			return nil, false, errors.Errorf(
+				"invalid %q: %q, valid values are: %q, %q",
+				QSArgBkmGetArgOrder, order, QSArgBkmGetArgOrderAsc, QSArgBkmGetArgOrderDesc,
+			)
+		}
+	}
+
+	if len(gmr.Values[QSArgBkmGetArgLimit]) > 0 {
+		slimit := gmr.Values[QSArgBkmGetArgLimit][0]
+		opts.Limit, err = strconv.Atoi(slimit)
+		if err != nil || opts.Limit <= 0 {
+			return nil, false, errors.Errorf(
+				"invalid %q: %q, should be a positive number", QSArgBkmGetArgLimit, slimit,
+			)
+		}
+		paged = true
+	}
+
+	if len(gmr.Values[QSArgBkmGetArgCursor]) > 0 {
+		opts.Cursor, err = decodeBookmarksCursor(gmr.Values[QSArgBkmGetArgCursor][0])
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+		paged = true
+	}
+
+	// Check the opts right away, so that the errors are reported the same way
+	// regardless of the storage
+	if _, err := storage.PrepareBookmarksPageOpts(opts); err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	return opts, paged, nil
+}
+
+func encodeBookmarksCursor(c *storage.BookmarksCursor) (string, error) {
+	data, err := json.Marshal(userBookmarksCursor{
+		SortField: string(c.SortField),
+		SortDesc:  c.SortDesc,
+		ID:        c.ID,
+		Time:      c.Time,
+		Str:       c.Str,
+	})
+	if err != nil {
+		return "", hh.MakeInternalServerError(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeBookmarksCursor(s string) (*storage.BookmarksCursor, error) {
+	var uc userBookmarksCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &uc)
+	}
+	if err != nil {
+		return nil, errors.Errorf("invalid %q", QSArgBkmGetArgCursor)
+	}
+
+	return &storage.BookmarksCursor{
+		SortField: storage.BookmarksSortField(uc.SortField),
+		SortDesc:  uc.SortDesc,
+		ID:        uc.ID,
+		Time:      uc.Time,
+		Str:       uc.Str,
+	}, nil
+}
+
+// getTagIDsFromQS returns tag ids given as tag_id query string params.
+// resolveTagRef returns the id of the tag referred to by either its id or
+// its path. Tags of other users are treated as non-existing.
+func (gm *GMServer) resolveTagRef(tx *sql.Tx, ownerID int, ref string) (int, error) {
+	if tagID, err := strconv.Atoi(ref); err == nil {
+		td, err := gm.si.GetTag(tx, tagID, &storage.GetTagOpts{})
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if td.OwnerID != ownerID {
+			return 0, errors.Trace(storage.ErrTagDoesNotExist)
+		}
+
+		return tagID, nil
+	}
+
+	tagID, err := gm.si.GetTagIDByPath(tx, ownerID, ref)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrTagDoesNotExist {
+			// The storage annotates the error with the tag name, but the caller
+			// already knows the ref
+			return 0, errors.Trace(storage.ErrTagDoesNotExist)
+		}
+		return 0, errors.Trace(err)
+	}
+
+	return tagID, nil
+}
+
+func getTagIDsFromQS(gmr *GMRequest) ([]int, error) {
+	tagIDs := []int{}
+	for _, stid := range gmr.Values[QSArgBkmGetArgTagID] {
+		v, err := strconv.Atoi(stid)
+		if err != nil {
+			return nil, errors.Annotatef(err, "wrong tag id %q", stid)
+		}
+		tagIDs = append(tagIDs, v)
+	}
+
+	return tagIDs, nil
+}
+
 func (gm *GMServer) userBookmarkGet(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, AllowSubtree: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -151,10 +543,10 @@ func (gm *GMServer) userBookmarkGet(gmr *GMRequest) (resp interface{}, err error
 
 	var bkm *storage.BookmarkDataWTags
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
-		bkm, err = gm.si.GetBookmarkByID(
-			tx, bkmID, &storage.TagsFetchOpts{
+		bkm, err = gm.getCallerBookmark(
+			gmr, tx, bkmID, &storage.TagsFetchOpts{
 				TagsFetchMode:     storage.TagsFetchModeLeafs,
 				TagNamesFetchMode: storage.TagNamesFetchModeFull,
 			},
@@ -169,20 +561,13 @@ func (gm *GMServer) userBookmarkGet(gmr *GMRequest) (resp interface{}, err error
 		return nil, errors.Trace(err)
 	}
 
-	bkmUser := userBookmarkData{
-		ID:        bkm.ID,
-		URL:       bkm.URL,
-		Title:     bkm.Title,
-		Comment:   bkm.Comment,
-		UpdatedAt: bkm.UpdatedAt,
-		Tags:      getUserBookmarkTags(bkm.Tags),
-	}
-
-	return bkmUser, nil
+	return makeUserBookmarkData(bkm), nil
 }
 
 func (gm *GMServer) userBookmarksPost(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true, AllowSubtree: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -200,13 +585,18 @@ func (gm *GMServer) userBookmarksPost(gmr *GMRequest) (resp interface{}, err err
 
 	bkmID := 0
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
-		var err error
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		err := gm.authorizeBookmarkTags(gmr, tx, args.TagIDs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
 		bkmID, err = gm.si.CreateBookmark(tx, &storage.BookmarkData{
-			OwnerID: gmr.SubjUser.ID,
-			Title:   args.Title,
-			Comment: args.Comment,
-			URL:     args.URL,
+			OwnerID:      gmr.SubjUser.ID,
+			Title:        args.Title,
+			Comment:      args.Comment,
+			URL:          args.URL,
+			CanonicalURL: canonicalizeURL(args.URL),
 		})
 		if err != nil {
 			return errors.Trace(err)
@@ -232,7 +622,9 @@ func (gm *GMServer) userBookmarksPost(gmr *GMRequest) (resp interface{}, err err
 }
 
 func (gm *GMServer) userBookmarkPut(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true, AllowSubtree: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -253,13 +645,46 @@ func (gm *GMServer) userBookmarkPut(gmr *GMRequest) (resp interface{}, err error
 		)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
-		var err error
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		// Trashed bookmarks can't be edited
+		_, err := gm.getCallerBookmark(gmr, tx, bkmID, &storage.TagsFetchOpts{
+			TagsFetchMode: storage.TagsFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.authorizeBookmarkTags(gmr, tx, args.TagIDs); err != nil {
+			return errors.Trace(err)
+		}
+
+		// The caller might not see all tags of the bookmark; those outside of
+		// the subtree are kept intact.
+		tagIDs := args.TagIDs
+		if rootTagID := tokenRootTagID(gmr.CallerToken); rootTagID != 0 {
+			leafIDs, err := gm.si.GetTaggings(tx, bkmID, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			for _, tagID := range leafIDs {
+				ok, err := gm.isTagInSubtree(tx, tagID, rootTagID)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				if !ok {
+					tagIDs = append(tagIDs, tagID)
+				}
+			}
+		}
+
 		err = gm.si.UpdateBookmark(tx, &storage.BookmarkData{
-			ID:      bkmID,
-			Title:   args.Title,
-			Comment: args.Comment,
-			URL:     args.URL,
+			ID:           bkmID,
+			Title:        args.Title,
+			Comment:      args.Comment,
+			URL:          args.URL,
+			CanonicalURL: canonicalizeURL(args.URL),
 			// NOTE: we need to pass OwnerID since it's used to check whether this
 			// owner already has the bookmark with the same URL
 			OwnerID: gmr.SubjUser.ID,
@@ -269,7 +694,7 @@ func (gm *GMServer) userBookmarkPut(gmr *GMRequest) (resp interface{}, err error
 		}
 
 		err = gm.si.SetTaggings(
-			tx, bkmID, args.TagIDs, storage.TaggingModeLeafs,
+			tx, bkmID, tagIDs, storage.TaggingModeLeafs,
 		)
 		if err != nil {
 			return errors.Trace(err)
@@ -286,7 +711,9 @@ func (gm *GMServer) userBookmarkPut(gmr *GMRequest) (resp interface{}, err error
 }
 
 func (gm *GMServer) userBookmarkDelete(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true, AllowSubtree: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -296,8 +723,16 @@ func (gm *GMServer) userBookmarkDelete(gmr *GMRequest) (resp interface{}, err er
 		return nil, errors.Trace(err)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
-		if err := gm.si.DeleteTaggable(tx, bkmID); err != nil {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		_, err := gm.getCallerBookmark(gmr, tx, bkmID, &storage.TagsFetchOpts{
+			TagsFetchMode: storage.TagsFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// The bookmark can be restored from the trash later
+		if err := gm.si.TrashTaggable(tx, bkmID); err != nil {
 			return errors.Trace(err)
 		}
 
@@ -311,6 +746,172 @@ func (gm *GMServer) userBookmarkDelete(gmr *GMRequest) (resp interface{}, err er
 	return resp, nil
 }
 
+// getBookmark is like GetBookmarkByID, but returns ErrBookmarkDoesNotExist for
+// trashed bookmarks.
+func (gm *GMServer) getBookmark(
+	tx *sql.Tx, bkmID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (*storage.BookmarkDataWTags, error) {
+	bkm, err := gm.si.GetBookmarkByID(tx, bkmID, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if bkm.TrashedAt != 0 {
+		return nil, errors.Annotatef(storage.ErrBookmarkDoesNotExist, "id %d", bkmID)
+	}
+
+	return bkm, nil
+}
+
+// getCallerBookmark is like getBookmark, but it returns
+// ErrBookmarkDoesNotExist for bookmarks of users other than gmr.SubjUser, and
+// if the caller's token is restricted to a subtree, also for bookmarks which
+// aren't tagged within the subtree; only the tags within it are left then.
+func (gm *GMServer) getCallerBookmark(
+	gmr *GMRequest, tx *sql.Tx, bkmID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (*storage.BookmarkDataWTags, error) {
+	rootTagIDs, err := gm.getVisibleRootTagIDs(gmr, tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if rootTagIDs != nil {
+		// Full paths of the leaf tags are needed to check the subtree
+		tagsFetchOpts = &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeLeafs,
+			TagNamesFetchMode: storage.TagNamesFetchModeFull,
+		}
+	}
+
+	bkm, err := gm.getBookmark(tx, bkmID, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if bkm.OwnerID != gmr.SubjUser.ID || !filterSubtreeTags(bkm, rootTagIDs) {
+		return nil, errors.Annotatef(storage.ErrBookmarkDoesNotExist, "id %d", bkmID)
+	}
+
+	return bkm, nil
+}
+
+// filterSubtreeTags leaves only the tags of the bookmark which are within the
+// subtrees of rootTagIDs, and returns whether there are any. If rootTagIDs is
+// nil, the bookmark is left intact. The tags should be fetched with
+// TagsFetchModeLeafs, so that every path starts from the root tag.
+func filterSubtreeTags(bkm *storage.BookmarkDataWTags, rootTagIDs []int) bool {
+	if rootTagIDs == nil {
+		return true
+	}
+
+	tags := []storage.BookmarkTagPath{}
+	for _, t := range bkm.Tags {
+		if isInSubtrees(t.TagItems, rootTagIDs) {
+			tags = append(tags, t)
+		}
+	}
+	bkm.Tags = tags
+
+	return len(tags) > 0
+}
+
+// isInSubtrees returns whether the tag path contains any of rootTagIDs.
+func isInSubtrees(items []storage.BookmarkTagPathItem, rootTagIDs []int) bool {
+	for _, item := range items {
+		for _, rootTagID := range rootTagIDs {
+			if item.ID == rootTagID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getVisibleRootTagIDs returns the roots of the subtrees which the caller can
+// see: the subtree the caller's token is restricted to, or the subtrees shared
+// with the caller if the caller is not the owner. If the caller can see
+// everything, nil is returned.
+func (gm *GMServer) getVisibleRootTagIDs(
+	gmr *GMRequest, tx *sql.Tx,
+) ([]int, error) {
+	if gmr.Caller.ID != gmr.SubjUser.ID {
+		return gm.getSharedTagIDs(tx, gmr.Caller.ID, gmr.SubjUser.ID)
+	}
+
+	if rootTagID := tokenRootTagID(gmr.CallerToken); rootTagID != 0 {
+		return []int{rootTagID}, nil
+	}
+
+	return nil, nil
+}
+
+// getSubtreeTagIDs checks that the given tags are within the subtree the
+// caller's token is restricted to, if any, and adds the root of the subtree
+// to them, so that only the bookmarks within it are looked up. If the caller
+// is not the owner, the tags should be given, and they should be within the
+// subtrees shared with the caller.
+func (gm *GMServer) getSubtreeTagIDs(
+	gmr *GMRequest, tx *sql.Tx, tagIDs []int,
+) ([]int, error) {
+	err := gm.authorizeTagsOperation(tx, gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID:     gmr.SubjUser.ID,
+		AllowShared: true,
+		TagIDs:      tagIDs,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if rootTagID := tokenRootTagID(gmr.CallerToken); rootTagID != 0 {
+		tagIDs = append(tagIDs, rootTagID)
+	}
+
+	return tagIDs, nil
+}
+
+// authorizeBookmarkTags checks the tags which a bookmark is going to be tagged
+// with: if the caller's token is restricted to a subtree, there should be at
+// least one tag, and all of them should be within the subtree (otherwise the
+// caller wouldn't see the bookmark).
+func (gm *GMServer) authorizeBookmarkTags(
+	gmr *GMRequest, tx *sql.Tx, tagIDs []int,
+) error {
+	if tokenRootTagID(gmr.CallerToken) != 0 && len(tagIDs) == 0 {
+		return errors.Errorf("tagIDs should not be empty")
+	}
+
+	err := gm.authorizeTagsOperation(tx, gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID,
+		Write:   true,
+		TagIDs:  tagIDs,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// getUserBookmark is like getBookmark, but it also returns
+// ErrBookmarkDoesNotExist if the bookmark belongs to another user.
+func (gm *GMServer) getUserBookmark(
+	tx *sql.Tx, ownerID, bkmID int,
+) (*storage.BookmarkDataWTags, error) {
+	bkm, err := gm.getBookmark(tx, bkmID, &storage.TagsFetchOpts{
+		TagsFetchMode: storage.TagsFetchModeNone,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if bkm.OwnerID != ownerID {
+		return nil, errors.Annotatef(storage.ErrBookmarkDoesNotExist, "id %d", bkmID)
+	}
+
+	return bkm, nil
+}
+
 func getBookmarkIDFromQueryString(gmr *GMRequest) (int, error) {
 	bkmIDStr := pat.Param(gmr.HttpReq, BookmarkID)
 	bkmID, err := strconv.Atoi(bkmIDStr)
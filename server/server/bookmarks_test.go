@@ -454,6 +454,29 @@ func perUserTestDeleteBookmarks(
 		}
 	}
 
+	// and that it can't be accessed by its id via the user's own bookmarks
+	// either
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		var args H
+		if method == "PUT" {
+			args = H{"url": "http://url6_new.com"}
+		}
+
+		resp, err := be.DoUserReq(
+			method, fmt.Sprintf("/bookmarks/%d", bkmIDs.bkm6ID), u2.id, args, false,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = expectErrorResp(
+			resp, http.StatusBadRequest,
+			fmt.Sprintf("id %d: bookmark does not exist", bkmIDs.bkm6ID),
+		)
+		if err != nil {
+			return errors.Annotatef(err, "%s", method)
+		}
+	}
+
 	// get tagged with tag3 (should not change)
 	_, err = checkBkmGet(
 		be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag3ID}}, []int{
@@ -473,6 +496,426 @@ func perUserTestDeleteBookmarks(
 
 // }}}
 
+// Test search of bookmarks {{{
+func TestSearchBookmarks(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestSearchBookmarks)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestSearchBookmarks(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	var err error
+
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "http://learn.example.com",
+		Title:  "Learning Golang",
+		TagIDs: []int{tagIDs.tag3ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:     "http://tutorial.example.com",
+		Title:   "Misc",
+		Comment: "A nice golang tutorial",
+		TagIDs:  []int{tagIDs.tag8ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = addBookmark(be, u1.id, &bkmData{
+		URL:    "http://rust.example.com",
+		Title:  "Rust",
+		TagIDs: []int{},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bookmarks of other users should not be found
+	_, err = addBookmark(be, u2.id, &bkmData{
+		URL:    "http://golang.org",
+		Title:  "Golang",
+		TagIDs: []int{},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Best matches go first
+	results, err := checkBkmSearch(be, u1.id, "golang", nil, []int{bkm1ID, bkm2ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if expected := "Learning <b>Golang</b>"; results[0].TitleSnippet != expected {
+		return errors.Errorf(
+			"expected title snippet %q, got %q", expected, results[0].TitleSnippet,
+		)
+	}
+
+	if expected := "A nice <b>golang</b> tutorial"; results[1].CommentSnippet != expected {
+		return errors.Errorf(
+			"expected comment snippet %q, got %q", expected, results[1].CommentSnippet,
+		)
+	}
+
+	err = checkBkmTags(&results[0].bkmData, []bkmTagData{
+		bkmTagData{
+			Items: []bkmTagDataItem{
+				bkmTagDataItem{
+					ID:   tagIDs.tag1ID,
+					Name: "tag1",
+				},
+				bkmTagDataItem{
+					ID:   tagIDs.tag3ID,
+					Name: "tag3_alias",
+				},
+			},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Search among tagged bookmarks
+	_, err = checkBkmSearch(be, u1.id, "golang", []int{tagIDs.tag1ID}, []int{bkm1ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmSearch(be, u1.id, "golang", []int{tagIDs.tag8ID}, []int{bkm2ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmSearch(be, u1.id, "rust", []int{tagIDs.tag1ID}, []int{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Invalid requests
+	resp, err := be.DoUserReq("GET", "/bookmarks?q=%20", u1.id, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectErrorResp(resp, http.StatusBadRequest, "search query is empty"); err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err = be.DoUserReq("GET", "/bookmarks?q=golang&url=foo", u1.id, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = expectErrorResp(
+		resp, http.StatusBadRequest, `"q" and "url" cannot be given both`,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test sorting and pagination of bookmarks {{{
+func TestBookmarksPagination(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksPagination)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBookmarksPagination(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	var err error
+
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmIDs := []int{}
+	for _, title := range []string{"c", "e", "a", "d", "b"} {
+		bkmID, err := addBookmark(be, u1.id, &bkmData{
+			URL:    "url_" + title,
+			Title:  title,
+			TagIDs: []int{tagIDs.tag1ID},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bkmIDs = append(bkmIDs, bkmID)
+	}
+
+	// Get all of them by pages of 2, sorted by title in descending order
+	qsVals := url.Values{}
+	qsVals.Add("tag_id", strconv.Itoa(tagIDs.tag1ID))
+	qsVals.Add("sort", "title")
+	qsVals.Add("order", "desc")
+	qsVals.Add("limit", "2")
+
+	gotIDs := []int{}
+	for i := 0; ; i++ {
+		if i > 2 {
+			return errors.Errorf("too many pages")
+		}
+
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qsVals.Encode(), u1.id, nil, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var page bkmsPage
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			return errors.Trace(err)
+		}
+
+		if page.TotalCnt != 5 {
+			return errors.Errorf("expected total count 5, got %d", page.TotalCnt)
+		}
+
+		for _, b := range page.Bookmarks {
+			gotIDs = append(gotIDs, b.ID)
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		qsVals.Set("cursor", page.NextCursor)
+	}
+
+	expectedIDs := []int{bkmIDs[1], bkmIDs[3], bkmIDs[0], bkmIDs[4], bkmIDs[2]}
+	if !reflect.DeepEqual(gotIDs, expectedIDs) {
+		return errors.Errorf("expected bookmarks %v, got %v", expectedIDs, gotIDs)
+	}
+
+	// Without limit and cursor, a plain array is returned, but sorted as well
+	resp, err := be.DoUserReq(
+		"GET", fmt.Sprintf("/bookmarks?tag_id=%d&sort=url", tagIDs.tag1ID),
+		u1.id, nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	v := bkms{}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return errors.Trace(err)
+	}
+
+	gotIDs = []int{}
+	for _, b := range v {
+		gotIDs = append(gotIDs, b.ID)
+	}
+
+	expectedIDs = []int{bkmIDs[2], bkmIDs[4], bkmIDs[0], bkmIDs[3], bkmIDs[1]}
+	if !reflect.DeepEqual(gotIDs, expectedIDs) {
+		return errors.Errorf("expected bookmarks %v, got %v", expectedIDs, gotIDs)
+	}
+
+	// Invalid requests
+	for qs, msg := range map[string]string{
+		"limit=0":              `invalid "limit": "0", should be a positive number`,
+		"limit=foo":            `invalid "limit": "foo", should be a positive number`,
+		"cursor=foo":           `invalid "cursor"`,
+		"sort=foo":             `invalid sort field "foo"`,
+		"order=foo":            `invalid "order": "foo", valid values are: "asc", "desc"`,
+		"sort=title&url=url_a": `"limit", "cursor", "sort" and "order" cannot be used with "url"`,
+		"limit=1&q=foo":        `"limit", "cursor", "sort" and "order" cannot be used with "q"`,
+	} {
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qs, u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusBadRequest, msg); err != nil {
+			return errors.Annotatef(err, "query string %q", qs)
+		}
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test boolean tag queries {{{
+
+func TestBookmarksTagQuery(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksTagQuery)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBookmarksTagQuery(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	var err error
+
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2TagIDs, err := makeTestTagsHierarchy(be, u2.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmIDs := []int{}
+	for i, tags := range [][]int{
+		{tagIDs.tag4ID},
+		{tagIDs.tag2ID},
+		{tagIDs.tag6ID, tagIDs.tag8ID},
+		{},
+	} {
+		bkmID, err := addBookmark(be, u1.id, &bkmData{
+			URL:    fmt.Sprintf("url_%d", i),
+			TagIDs: tags,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bkmIDs = append(bkmIDs, bkmID)
+	}
+
+	getBookmarkIDs := func(qsVals url.Values) ([]int, error) {
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qsVals.Encode(), u1.id, nil, true)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		v := bkms{}
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ids := []int{}
+		for _, b := range v {
+			ids = append(ids, b.ID)
+		}
+
+		return ids, nil
+	}
+
+	for query, expectedIDs := range map[string][]int{
+		"tag1": {bkmIDs[0], bkmIDs[2]},
+		"tag1/tag3 AND (tag1/tag3/tag4 OR tag7/tag8)": {bkmIDs[0], bkmIDs[2]},
+		"not tag1":                    {bkmIDs[1], bkmIDs[3]},
+		"tag2 OR tag7_alias":          {bkmIDs[1], bkmIDs[2]},
+		"NOT (tag1 OR tag2)":          {bkmIDs[3]},
+		"tag1 AND NOT tag1/tag3/tag5": {bkmIDs[0]},
+		// Tag ids can be used as well
+		fmt.Sprintf("%d OR %d", tagIDs.tag4ID, tagIDs.tag2ID): {bkmIDs[0], bkmIDs[1]},
+	} {
+		qsVals := url.Values{}
+		qsVals.Add("query", query)
+
+		ids, err := getBookmarkIDs(qsVals)
+		if err != nil {
+			return errors.Annotatef(err, "query %q", query)
+		}
+
+		sort.Ints(ids)
+		if !reflect.DeepEqual(ids, expectedIDs) {
+			return errors.Errorf("query %q: expected bookmarks %v, got %v", query, expectedIDs, ids)
+		}
+	}
+
+	// Paging works with tag queries
+	qsVals := url.Values{}
+	qsVals.Add("query", "tag1 OR tag2")
+	qsVals.Add("sort", "url")
+	qsVals.Add("limit", "2")
+
+	resp, err := be.DoUserReq("GET", "/bookmarks?"+qsVals.Encode(), u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var page bkmsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return errors.Trace(err)
+	}
+
+	if page.TotalCnt != 3 || len(page.Bookmarks) != 2 || page.NextCursor == "" {
+		return errors.Errorf(
+			"expected 2 bookmarks of 3 and a cursor, got %d of %d and %q",
+			len(page.Bookmarks), page.TotalCnt, page.NextCursor,
+		)
+	}
+
+	// Invalid requests
+	for query, msg := range map[string]string{
+		"tag1 AND":    `invalid "query": unexpected end of query at position 9, expected a tag, NOT or "("`,
+		"(tag1 tag2":  `invalid "query": unexpected tag "tag2" at position 7, expected ")" to close "(" at position 1`,
+		"tag1 OR foo": `invalid "query": tag "foo" at position 9: tag does not exist`,
+		// Tags of other users can't be used
+		strconv.Itoa(u2TagIDs.tag1ID): fmt.Sprintf(
+			`invalid "query": tag "%d" at position 1: tag does not exist`, u2TagIDs.tag1ID,
+		),
+	} {
+		qsVals := url.Values{}
+		qsVals.Add("query", query)
+
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qsVals.Encode(), u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusBadRequest, msg); err != nil {
+			return errors.Annotatef(err, "query %q", query)
+		}
+	}
+
+	for qs, msg := range map[string]string{
+		"query=tag1&tag_id=1": `"tag_id" and "query" cannot be given both`,
+		"query=tag1&url=foo":  `"url" and "query" cannot be given both`,
+		"query=tag1&q=foo":    `"q" and "query" cannot be given both`,
+	} {
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qs, u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusBadRequest, msg); err != nil {
+			return errors.Annotatef(err, "query string %q", qs)
+		}
+	}
+
+	return nil
+}
+
+// }}}
+
 type bkmData struct {
 	ID        int          `json:"id"`
 	URL       string       `json:"url"`
@@ -508,6 +951,12 @@ func (s bkmTagsByID) Less(i, j int) bool {
 }
 
 type bkms []bkmData
+
+type bkmsPage struct {
+	Bookmarks  bkms   `json:"bookmarks"`
+	TotalCnt   int    `json:"totalCnt"`
+	NextCursor string `json:"nextCursor"`
+}
 type bkmsByID bkms
 
 func (s bkmsByID) Len() int {
@@ -649,6 +1098,58 @@ func checkBkmGet(
 	return []bkmData(v), nil
 }
 
+type bkmSearchResult struct {
+	bkmData
+	Rank           float64 `json:"rank"`
+	TitleSnippet   string  `json:"titleSnippet"`
+	CommentSnippet string  `json:"commentSnippet"`
+}
+
+// checkBkmSearch searches bookmarks and checks that the expected ones are
+// found, in the given order.
+func checkBkmSearch(
+	be testBackend, userID int, query string, tagIDs []int, expectedBkmIDs []int,
+) ([]bkmSearchResult, error) {
+	qsVals := url.Values{}
+	qsVals.Add("q", query)
+	for _, tagID := range tagIDs {
+		qsVals.Add("tag_id", strconv.Itoa(tagID))
+	}
+
+	resp, err := be.DoUserReq(
+		"GET", "/bookmarks?"+qsVals.Encode(), userID, nil, true,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := []bkmSearchResult{}
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		fmt.Printf("body: %q\n", body)
+		return nil, errors.Trace(err)
+	}
+
+	bkmIDs := []int{}
+	for _, b := range v {
+		bkmIDs = append(bkmIDs, b.ID)
+	}
+
+	if !reflect.DeepEqual(bkmIDs, expectedBkmIDs) {
+		return nil, errors.Errorf(
+			"search %q: bookmarks mismatch: expected %v, got %v",
+			query, expectedBkmIDs, bkmIDs,
+		)
+	}
+
+	return v, nil
+}
+
 func checkBkmGetByID(be testBackend, userID int, bkmID int, expectedBkm *bkmData) error {
 	resp, err := be.DoUserReq(
 		"GET", fmt.Sprintf("/bookmarks/%d", bkmID), userID, nil, true,
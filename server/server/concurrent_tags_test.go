@@ -0,0 +1,229 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/juju/errors"
+)
+
+// TestConcurrentTagMoves moves tags of a single user under each other from
+// many goroutines at once, and concurrently deletes other tags the same
+// bookmarks are tagged with. Each move is checked against the current tags
+// hierarchy, but two concurrent ones could still make a cycle (e.g. a under b
+// and b under a), unless transactions are serializable. In the end, all moved
+// tags must still be reachable from the root tag, exactly once.
+func TestConcurrentTagMoves(t *testing.T) {
+	goroutinesCnt := 8
+	opsCnt := 40
+	movableTagsCnt := 8
+	deletableTagsCnt := 8
+
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	be := makeTestBackendHTTP(t, testBackendOpts{
+		UseWS: true,
+	})
+
+	runWithRealDBAndBackend(t, be, func(si storage.Storage, be testBackend) error {
+		userID, token, err := testutils.CreateTestUser(si, "test1", "1@1.1")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		be.UserCreated(userID, "test1", token)
+
+		// Create movable and deletable tags, all right under the root tag
+		movableTagIDs := []int{}
+		for i := 0; i < movableTagsCnt; i++ {
+			tagID, err := addTag(
+				be, "/tags", userID, []string{fmt.Sprintf("m%d", i)}, "", false,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			movableTagIDs = append(movableTagIDs, tagID)
+		}
+
+		deletableTagIDs := []int{}
+		for i := 0; i < deletableTagsCnt; i++ {
+			tagID, err := addTag(
+				be, "/tags", userID, []string{fmt.Sprintf("d%d", i)}, "", false,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			deletableTagIDs = append(deletableTagIDs, tagID)
+		}
+
+		// Every bookmark is tagged with a movable and a deletable tag, so that
+		// moves and deletions have to retag the same bookmarks
+		for i := 0; i < movableTagsCnt*2; i++ {
+			_, err := addBookmark(be, userID, &bkmData{
+				URL: fmt.Sprintf("http://test%d.com", i),
+				TagIDs: []int{
+					movableTagIDs[i%movableTagsCnt],
+					deletableTagIDs[i%deletableTagsCnt],
+				},
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		rootTagID := 0
+		err = si.Tx(func(tx *sql.Tx) error {
+			var err error
+			rootTagID, err = si.GetRootTagID(tx, userID)
+			return errors.Trace(err)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Moves under descendants and deletions of already deleted tags are
+		// expected to fail; anything else (e.g. a transaction which failed to
+		// commit even after retries) is a test failure.
+		expectOKOrError := func(resp *genericResp, allowedMsg string) error {
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			rmap := map[string]interface{}{}
+			if err := json.Unmarshal(body, &rmap); err != nil {
+				return errors.Annotatef(err, "body: %q", body)
+			}
+
+			if resp.StatusCode != http.StatusBadRequest || rmap["message"] != allowedMsg {
+				return errors.Errorf(
+					"unexpected response: HTTP status code %d, body: %q",
+					resp.StatusCode, body,
+				)
+			}
+
+			return nil
+		}
+
+		runOps := func(errChan chan<- error) {
+			for i := 0; i < opsCnt; i++ {
+				var resp *genericResp
+				var err error
+
+				if rand.Intn(4) == 0 {
+					tagID := deletableTagIDs[rand.Intn(len(deletableTagIDs))]
+					resp, err = be.DoUserReq(
+						"DELETE",
+						fmt.Sprintf("/tags/%d?%s=%s", tagID, QSArgNewLeafPolicy, QSArgNewLeafPolicyKeep),
+						userID, nil, false,
+					)
+					if err == nil {
+						err = expectOKOrError(resp, "tag does not exist")
+					}
+				} else {
+					tagID := movableTagIDs[rand.Intn(len(movableTagIDs))]
+					parentTagID := rootTagID
+					if n := rand.Intn(len(movableTagIDs) + 1); n < len(movableTagIDs) {
+						parentTagID = movableTagIDs[n]
+					}
+
+					leafPolicy := QSArgNewLeafPolicyKeep
+					if rand.Intn(2) == 0 {
+						leafPolicy = QSArgNewLeafPolicyDel
+					}
+
+					resp, err = be.DoUserReq(
+						"PUT", fmt.Sprintf("/tags/%d", tagID), userID,
+						H{
+							"parentTagID":   parentTagID,
+							"newLeafPolicy": leafPolicy,
+						},
+						false,
+					)
+					if err == nil {
+						err = expectOKOrError(
+							resp, "tag cannot be moved under itself or one of its descendants",
+						)
+					}
+				}
+
+				if err != nil {
+					errChan <- errors.Trace(err)
+					return
+				}
+			}
+
+			errChan <- nil
+		}
+
+		errChan := make(chan error)
+		for i := 0; i < goroutinesCnt; i++ {
+			go runOps(errChan)
+		}
+
+		var firstErr error
+		for i := 0; i < goroutinesCnt; i++ {
+			if err := <-errChan; err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return errors.Trace(firstErr)
+		}
+
+		// Walk the tree from the root tag and make sure that every movable tag is
+		// there exactly once
+		var tagData *storage.TagData
+		err = si.Tx(func(tx *sql.Tx) error {
+			var err error
+			tagData, err = si.GetTag(tx, rootTagID, &storage.GetTagOpts{
+				GetSubtags: true,
+			})
+			return errors.Trace(err)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		seen := map[int]int{}
+		var walk func(td *storage.TagData)
+		walk = func(td *storage.TagData) {
+			seen[td.ID]++
+			for i := range td.Subtags {
+				walk(&td.Subtags[i])
+			}
+		}
+		walk(tagData)
+
+		for _, tagID := range movableTagIDs {
+			if seen[tagID] != 1 {
+				return errors.Errorf(
+					"tag %d is reachable from the root %d times, expected once (a cycle?)",
+					tagID, seen[tagID],
+				)
+			}
+		}
+
+		if err := be.DeleteUser(userID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
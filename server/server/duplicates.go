@@ -0,0 +1,336 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"io"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/urlcanon"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+
+	"github.com/juju/errors"
+)
+
+// URL canonicalization rules, see urlcanon.Rules. When they are changed,
+// canonical URLs of all bookmarks are updated on the next startup.
+var (
+	urlCanonIgnoreScheme = flag.Bool(
+		"geekmarks.url_canon.ignore_scheme", true,
+		"Treat http and https urls as the same.",
+	)
+	urlCanonTrimTrailingSlash = flag.Bool(
+		"geekmarks.url_canon.trim_trailing_slash", true,
+		"Ignore trailing slashes of url paths.",
+	)
+	urlCanonStripDefaultPort = flag.Bool(
+		"geekmarks.url_canon.strip_default_port", true,
+		"Ignore default ports (80 for http, 443 for https).",
+	)
+	urlCanonPunycodeHost = flag.Bool(
+		"geekmarks.url_canon.punycode_host", true,
+		"Treat internationalized domain names and their punycode as the same.",
+	)
+	urlCanonTrackingParams = flag.String(
+		"geekmarks.url_canon.tracking_params",
+		strings.Join(urlcanon.DefaultTrackingParams, ","),
+		"Comma-separated list of query parameters to ignore; a trailing \"*\" "+
+			"matches any suffix. Empty means no parameters are ignored.",
+	)
+)
+
+type userDuplicateBookmarks struct {
+	CanonicalURL string             `json:"canonicalURL"`
+	Bookmarks    []userBookmarkData `json:"bookmarks"`
+}
+
+type userDuplicatesMergeArgs struct {
+	// If empty, all duplicates of the user are merged
+	BookmarkIDs []int `json:"bookmarkIDs"`
+}
+
+type userMergedBookmarks struct {
+	BookmarkID int   `json:"bookmarkID"`
+	MergedIDs  []int `json:"mergedIDs"`
+}
+
+type userDuplicatesMergeResp struct {
+	Merged []userMergedBookmarks `json:"merged"`
+}
+
+// getURLCanonRules returns the URL canonicalization rules specified by the
+// flags.
+func getURLCanonRules() *urlcanon.Rules {
+	rules := &urlcanon.Rules{
+		IgnoreScheme:      *urlCanonIgnoreScheme,
+		TrimTrailingSlash: *urlCanonTrimTrailingSlash,
+		StripDefaultPort:  *urlCanonStripDefaultPort,
+		PunycodeHost:      *urlCanonPunycodeHost,
+	}
+
+	for _, p := range strings.Split(*urlCanonTrackingParams, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			rules.TrackingParams = append(rules.TrackingParams, p)
+		}
+	}
+
+	return rules
+}
+
+func canonicalizeURL(rawURL string) string {
+	return getURLCanonRules().Canonicalize(rawURL)
+}
+
+// UpdateCanonicalURLs recalculates canonical URLs of all bookmarks, in case
+// the canonicalization rules have changed. It's supposed to be called on
+// startup. Bookmarks which become duplicates are left as they are; they can
+// be merged by the users.
+func (gm *GMServer) UpdateCanonicalURLs(ctx context.Context) error {
+	rules := getURLCanonRules()
+	updatedCnt := 0
+
+	err := gm.si.TxCtx(ctx, func(tx *sql.Tx) error {
+		urls, err := gm.si.GetAllBookmarkURLs(tx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, u := range urls {
+			canonicalURL := rules.Canonicalize(u.URL)
+			if canonicalURL == u.CanonicalURL {
+				continue
+			}
+
+			if err := gm.si.SetBookmarkCanonicalURL(tx, u.ID, canonicalURL); err != nil {
+				return errors.Trace(err)
+			}
+
+			updatedCnt++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if updatedCnt > 0 {
+		glog.Infof("Updated canonical urls of %d bookmarks", updatedCnt)
+	}
+
+	return nil
+}
+
+func (gm *GMServer) userBookmarkDuplicatesGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts := storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeLeafs,
+		TagNamesFetchMode: storage.TagNamesFetchModeFull,
+	}
+
+	duplicatesUser := []userDuplicateBookmarks{}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		duplicates, err := gm.si.GetDuplicateBookmarks(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, d := range duplicates {
+			item := userDuplicateBookmarks{
+				CanonicalURL: d.CanonicalURL,
+				Bookmarks:    []userBookmarkData{},
+			}
+
+			for _, bkmID := range d.BookmarkIDs {
+				bkm, err := gm.si.GetBookmarkByID(tx, bkmID, &tagsFetchOpts)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				item.Bookmarks = append(item.Bookmarks, makeUserBookmarkData(bkm))
+			}
+
+			duplicatesUser = append(duplicatesUser, item)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return duplicatesUser, nil
+}
+
+func (gm *GMServer) userBookmarkDuplicatesMerge(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Request body is optional
+	var args userDuplicatesMergeArgs
+	decoder := json.NewDecoder(gmr.Body)
+	if err := decoder.Decode(&args); err != nil && err != io.EOF {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	merged := []userMergedBookmarks{}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		duplicates, err := gm.si.GetDuplicateBookmarks(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(args.BookmarkIDs) > 0 {
+			// Only merge the given bookmarks, which should all be duplicates of
+			// each other
+			var found *storage.DuplicateBookmarks
+			for i, d := range duplicates {
+				if containsInt(d.BookmarkIDs, args.BookmarkIDs[0]) {
+					found = &duplicates[i]
+					break
+				}
+			}
+
+			if len(args.BookmarkIDs) < 2 || found == nil {
+				return errors.Errorf("bookmarks %v are not duplicates", args.BookmarkIDs)
+			}
+
+			bkmIDs := []int{}
+			for _, id := range found.BookmarkIDs {
+				if containsInt(args.BookmarkIDs, id) {
+					bkmIDs = append(bkmIDs, id)
+				}
+			}
+
+			if len(bkmIDs) != len(args.BookmarkIDs) {
+				return errors.Errorf("bookmarks %v are not duplicates", args.BookmarkIDs)
+			}
+
+			duplicates = []storage.DuplicateBookmarks{
+				{CanonicalURL: found.CanonicalURL, BookmarkIDs: bkmIDs},
+			}
+		}
+
+		for _, d := range duplicates {
+			if err := gm.mergeBookmarks(tx, d.BookmarkIDs); err != nil {
+				return errors.Trace(err)
+			}
+
+			merged = append(merged, userMergedBookmarks{
+				BookmarkID: d.BookmarkIDs[0],
+				MergedIDs:  d.BookmarkIDs[1:],
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userDuplicatesMergeResp{
+		Merged: merged,
+	}
+	return resp, nil
+}
+
+// mergeBookmarks merges the bookmarks with the given ids into the first one:
+// it gets tagged with all their tags, empty title is taken from the others,
+// and comments are concatenated. Other bookmarks are moved to the trash.
+func (gm *GMServer) mergeBookmarks(tx *sql.Tx, bkmIDs []int) error {
+	var target *storage.BookmarkDataWTags
+	comments := []string{}
+	tagSet := map[int]bool{}
+
+	for _, bkmID := range bkmIDs {
+		bkm, err := gm.si.GetBookmarkByID(tx, bkmID, &storage.TagsFetchOpts{
+			TagsFetchMode: storage.TagsFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		tagIDs, err := gm.si.GetTaggings(tx, bkmID, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, tagID := range tagIDs {
+			tagSet[tagID] = true
+		}
+
+		if bkm.Comment != "" && !containsString(comments, bkm.Comment) {
+			comments = append(comments, bkm.Comment)
+		}
+
+		if target == nil {
+			target = bkm
+			continue
+		}
+
+		if target.Title == "" {
+			target.Title = bkm.Title
+		}
+
+		// Trash it right away, so that the target can be updated without
+		// violating url uniqueness
+		if err := gm.si.TrashTaggable(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	bd := target.BookmarkData
+	bd.Comment = strings.Join(comments, "\n\n")
+	if err := gm.si.UpdateBookmark(tx, &bd); err != nil {
+		return errors.Trace(err)
+	}
+
+	tagIDs := []int{}
+	for tagID := range tagSet {
+		tagIDs = append(tagIDs, tagID)
+	}
+
+	err := gm.si.SetTaggings(tx, bd.ID, tagIDs, storage.TaggingModeAll)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(strs []string, str string) bool {
+	for _, v := range strs {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// Test duplicates {{{
+func TestDuplicates(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestDuplicates)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestDuplicates(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "http://x.com/a",
+		Title:  "title_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The same url, spelled differently
+	resp, err := be.DoUserReq("POST", "/bookmarks", u1.id, H{
+		"url":    "https://X.com/a/?utm_source=foo",
+		"tagIDs": A{},
+	}, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = expectErrorResp(
+		resp, http.StatusBadRequest,
+		`bookmark with the url "https://X.com/a/?utm_source=foo" already exists`,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(
+		be, u1.id, &bkmGetArg{url: cptr.String("https://x.com:443/a/")}, []int{bkm1ID},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Add a bookmark with another scheme while schemes are not ignored, and
+	// then change the rules back: it becomes a duplicate
+	*urlCanonIgnoreScheme = false
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:     "http://x.com/a/",
+		Comment: "comment_2",
+		TagIDs:  []int{tagIDs.tag2ID},
+	})
+	*urlCanonIgnoreScheme = true
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkDuplicatesGet(be, u1.id, [][]int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	gm := &GMServer{si: si}
+	if err := gm.UpdateCanonicalURLs(context.Background()); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkDuplicatesGet(be, u1.id, [][]int{{bkm1ID, bkm2ID}}); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkDuplicatesGet(be, u2.id, [][]int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Only duplicates can be merged
+	for _, ids := range [][]int{{bkm1ID}, {bkm1ID, 100500}, {bkm1ID, bkm1ID}} {
+		resp, err := be.DoUserReq(
+			"POST", "/bookmarks/duplicates/merge", u1.id, H{"bookmarkIDs": ids}, false,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = expectErrorResp(
+			resp, http.StatusBadRequest, fmt.Sprintf("bookmarks %v are not duplicates", ids),
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Other users can't merge them
+	resp, err = be.DoUserReq(
+		"POST", "/bookmarks/duplicates/merge", u2.id, H{"bookmarkIDs": []int{bkm1ID, bkm2ID}}, false,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = expectErrorResp(
+		resp, http.StatusBadRequest, fmt.Sprintf("bookmarks %v are not duplicates", []int{bkm1ID, bkm2ID}),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Merge all duplicates
+	resp, err = be.DoUserReq("POST", "/bookmarks/duplicates/merge", u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var mergeResp struct {
+		Merged []struct {
+			BookmarkID int   `json:"bookmarkID"`
+			MergedIDs  []int `json:"mergedIDs"`
+		} `json:"merged"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&mergeResp); err != nil {
+		return errors.Trace(err)
+	}
+	if len(mergeResp.Merged) != 1 ||
+		mergeResp.Merged[0].BookmarkID != bkm1ID ||
+		!reflect.DeepEqual(mergeResp.Merged[0].MergedIDs, []int{bkm2ID}) {
+		return errors.Errorf("wrong merge response: %+v", mergeResp)
+	}
+
+	err = checkBkmGetByID(be, u1.id, bkm1ID, &bkmData{
+		ID:      bkm1ID,
+		URL:     "http://x.com/a",
+		Title:   "title_1",
+		Comment: "comment_2",
+		Tags: []bkmTagData{
+			bkmTagData{
+				Items: []bkmTagDataItem{
+					bkmTagDataItem{ID: tagIDs.tag2ID, Name: "tag2"},
+				},
+			},
+			bkmTagData{
+				Items: []bkmTagDataItem{
+					bkmTagDataItem{ID: tagIDs.tag1ID, Name: "tag1"},
+					bkmTagDataItem{ID: tagIDs.tag3ID, Name: "tag3_alias"},
+					bkmTagDataItem{ID: tagIDs.tag4ID, Name: "tag4"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The merged bookmark goes to the trash
+	if err := checkTrashGet(be, u1.id, []taggableRef{{"bookmark", bkm2ID}}); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkDuplicatesGet(be, u1.id, [][]int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+func checkDuplicatesGet(be testBackend, userID int, expected [][]int) error {
+	resp, err := be.DoUserReq("GET", "/bookmarks/duplicates", userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var duplicates []struct {
+		CanonicalURL string    `json:"canonicalURL"`
+		Bookmarks    []bkmData `json:"bookmarks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&duplicates); err != nil {
+		return errors.Trace(err)
+	}
+
+	got := [][]int{}
+	for _, d := range duplicates {
+		ids := []int{}
+		for _, bkm := range d.Bookmarks {
+			ids = append(ids, bkm.ID)
+		}
+		got = append(got, ids)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		return errors.Errorf("duplicates: expected %v, got %v", expected, got)
+	}
+
+	return nil
+}
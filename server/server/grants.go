@@ -0,0 +1,312 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+type userGrantData struct {
+	ID              int                        `json:"id"`
+	TagID           int                        `json:"tagID"`
+	TagPath         string                     `json:"tagPath"`
+	GranteeID       int                        `json:"granteeID"`
+	GranteeUsername string                     `json:"granteeUsername"`
+	Permission      storage.TagGrantPermission `json:"permission"`
+	// Unix timestamp
+	CreatedAt uint64 `json:"createdAt"`
+}
+
+type userGrantPostArgs struct {
+	// Exactly one of TagID and TagPath should be given: the subtree of this
+	// tag gets shared.
+	TagID   *int    `json:"tagID,omitempty"`
+	TagPath *string `json:"tagPath,omitempty"`
+	// Username of the user to share the subtree with.
+	Grantee string `json:"grantee"`
+	// Only "read" is supported for now, and it's the default.
+	Permission storage.TagGrantPermission `json:"permission,omitempty"`
+}
+
+type userGrantPostResp struct {
+	GrantID int `json:"grantID"`
+}
+
+type userGrantDeleteResp struct {
+}
+
+// userSharedTagData is a subtree shared with the user by another user; it
+// can be browsed via /api/users/<ownerID>/tags<tagPath>, and the bookmarks
+// via /api/users/<ownerID>/bookmarks?tag_id=<tagID>.
+type userSharedTagData struct {
+	GrantID       int                        `json:"grantID"`
+	OwnerID       int                        `json:"ownerID"`
+	OwnerUsername string                     `json:"ownerUsername"`
+	TagID         int                        `json:"tagID"`
+	TagPath       string                     `json:"tagPath"`
+	Permission    storage.TagGrantPermission `json:"permission"`
+	// Unix timestamp
+	CreatedAt uint64 `json:"createdAt"`
+}
+
+// userGrantsGet returns the grants for the tags of the user.
+func (gm *GMServer) userGrantsGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	grantsUser := []userGrantData{}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		grants, err := gm.si.GetTagGrantsByOwner(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, g := range grants {
+			tagPath, err := gm.getTagPath(tx, g.TagID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			grantee, err := gm.si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(g.GranteeID)})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			grantsUser = append(grantsUser, userGrantData{
+				ID:              g.ID,
+				TagID:           g.TagID,
+				TagPath:         tagPath,
+				GranteeID:       g.GranteeID,
+				GranteeUsername: grantee.Username,
+				Permission:      g.Permission,
+				CreatedAt:       g.CreatedAt,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return grantsUser, nil
+}
+
+// userGrantsPost shares the subtree of a tag of the user with another user.
+func (gm *GMServer) userGrantsPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args, err := getUserGrantPostArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var grantID int
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		tagID, err := gm.getTargetTagID(gmr, tx, args.TagID, args.TagPath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		grantee, err := gm.si.GetUser(tx, &storage.GetUserArgs{Username: &args.Grantee})
+		if err != nil {
+			return errors.Annotatef(err, "grantee %q", args.Grantee)
+		}
+
+		if grantee.ID == gmr.SubjUser.ID {
+			return errors.Errorf("can't share tags with yourself")
+		}
+
+		// Check the uniqueness explicitly, to get a meaningful error instead of
+		// the internal one from the storage
+		grants, err := gm.si.GetTagGrantsByOwner(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, g := range grants {
+			if g.TagID == tagID && g.GranteeID == grantee.ID {
+				return errors.Errorf(
+					"tag %d is already shared with %q", tagID, args.Grantee,
+				)
+			}
+		}
+
+		grantID, err = gm.si.CreateTagGrant(tx, &storage.TagGrantData{
+			TagID:      tagID,
+			GranteeID:  grantee.ID,
+			Permission: args.Permission,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userGrantPostResp{
+		GrantID: grantID,
+	}
+	return resp, nil
+}
+
+// userGrantDelete stops sharing the subtree; the grantee loses access to it
+// immediately.
+func (gm *GMServer) userGrantDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	grantID, err := getGrantIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		grants, err := gm.si.GetTagGrantsByOwner(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Make sure it's a grant for a tag of the user
+		found := false
+		for _, g := range grants {
+			if g.ID == grantID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return errors.Annotatef(storage.ErrTagGrantDoesNotExist, "id %d", grantID)
+		}
+
+		if err := gm.si.DeleteTagGrant(tx, grantID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userGrantDeleteResp{}
+	return resp, nil
+}
+
+// userSharedGet returns the subtrees shared with the user by other users.
+func (gm *GMServer) userSharedGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sharedUser := []userSharedTagData{}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		grants, err := gm.si.GetTagGrantsByGrantee(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, g := range grants {
+			tagPath, err := gm.getTagPath(tx, g.TagID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			owner, err := gm.si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(g.OwnerID)})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			sharedUser = append(sharedUser, userSharedTagData{
+				GrantID:       g.ID,
+				OwnerID:       g.OwnerID,
+				OwnerUsername: owner.Username,
+				TagID:         g.TagID,
+				TagPath:       tagPath,
+				Permission:    g.Permission,
+				CreatedAt:     g.CreatedAt,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return sharedUser, nil
+}
+
+func getUserGrantPostArgs(gmr *GMRequest) (*userGrantPostArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userGrantPostArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if (args.TagID == nil) == (args.TagPath == nil) {
+		return nil, errors.Errorf(
+			"exactly one of %q and %q should be given", "tagID", "tagPath",
+		)
+	}
+
+	args.Grantee = strings.TrimSpace(args.Grantee)
+	if args.Grantee == "" {
+		return nil, errors.Errorf("grantee is required")
+	}
+
+	if args.Permission != "" {
+		if err := storage.ValidateTagGrantPermission(args.Permission); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return &args, nil
+}
+
+func getGrantIDFromQueryString(gmr *GMRequest) (int, error) {
+	grantIDStr := pat.Param(gmr.HttpReq, GrantID)
+	grantID, err := strconv.Atoi(grantIDStr)
+	if err != nil {
+		return 0, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong grant id %q", grantIDStr),
+		)
+	}
+	return grantID, nil
+}
@@ -0,0 +1,475 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// Test sharing tag subtrees {{{
+func TestTagGrants(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTagGrants)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestTagGrants(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "http://bkm1.com",
+		Title:  "bkm1",
+		TagIDs: []int{tagIDs.tag4ID, tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = addBookmark(be, u1.id, &bkmData{
+		URL:    "http://bkm2.com",
+		Title:  "bkm2",
+		TagIDs: []int{tagIDs.tag7ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Nothing is shared yet, and tags which don't exist look the same as the
+	// ones which do
+	for _, path := range []string{
+		"/tags/tag1",
+		"/tags/nonexisting",
+		fmt.Sprintf("/tags/%d", tagIDs.tag1ID),
+		"/tags/1000000",
+	} {
+		if _, err := doSharedReq(
+			be, "GET", u1.id, path, u2.token, nil, http.StatusForbidden,
+		); err != nil {
+			return errors.Annotatef(err, "%s", path)
+		}
+	}
+
+	// Invalid grants
+	for _, tc := range []struct {
+		args H
+		msg  string
+	}{
+		{H{"tagPath": "/tag1", "grantee": "test1"}, "can't share tags with yourself"},
+		{H{"tagPath": "/tag1", "grantee": "nobody"}, `grantee "nobody": user does not exist`},
+		{H{"grantee": "test2"}, `exactly one of "tagID" and "tagPath" should be given`},
+		{H{"tagPath": "/tag1"}, "grantee is required"},
+		{
+			H{"tagPath": "/tag1", "grantee": "test2", "permission": "write"},
+			`invalid grant permission "write", valid values are: "read"`,
+		},
+	} {
+		resp, err := doTokenReq(be, "POST", "/grants", u1.token, tc.args, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectErrorResp(resp, http.StatusBadRequest, tc.msg); err != nil {
+			return errors.Annotatef(err, "%v", tc.args)
+		}
+	}
+
+	// Share /tag1 with the second user
+	grantID, err := addGrant(be, u1.token, H{"tagPath": "/tag1", "grantee": "test2"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := doTokenReq(
+		be, "POST", "/grants", u1.token,
+		H{"tagID": tagIDs.tag1ID, "grantee": "test2"}, 0,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = expectErrorResp(
+		resp, http.StatusBadRequest,
+		fmt.Sprintf(`tag %d is already shared with "test2"`, tagIDs.tag1ID),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tags of other users can't be shared
+	resp, err = doTokenReq(
+		be, "POST", "/grants", u2.token,
+		H{"tagID": tagIDs.tag2ID, "grantee": "test1"}, 0,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := expectHTTPCode(resp, http.StatusForbidden); err != nil {
+		return errors.Trace(err)
+	}
+
+	var grants []userGrantData
+	if err := getJSON(be, "/grants", u1.token, &grants); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(grants) != 1 || grants[0].ID != grantID ||
+		grants[0].TagID != tagIDs.tag1ID || grants[0].TagPath != "/tag1" ||
+		grants[0].GranteeID != u2.id || grants[0].GranteeUsername != "test2" ||
+		grants[0].Permission != storage.TagGrantPermissionRead || grants[0].CreatedAt == 0 {
+		return errors.Errorf("wrong grants: %+v", grants)
+	}
+
+	var shared []userSharedTagData
+	if err := getJSON(be, "/shared", u2.token, &shared); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(shared) != 1 || shared[0].GrantID != grantID ||
+		shared[0].OwnerID != u1.id || shared[0].OwnerUsername != "test1" ||
+		shared[0].TagID != tagIDs.tag1ID || shared[0].TagPath != "/tag1" {
+		return errors.Errorf("wrong shared tags: %+v", shared)
+	}
+
+	if err := getJSON(be, "/shared", u1.token, &shared); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(shared) != 0 {
+		return errors.Errorf("nothing should be shared with the owner, got %+v", shared)
+	}
+
+	// Populate the owner's tags cache, which should not be used for the
+	// second user
+	for _, path := range []string{"", "/tag2", "/tag1"} {
+		if _, err := doTokenReq(
+			be, "GET", "/tags"+path, u1.token, nil, http.StatusOK,
+		); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// The shared subtree can be browsed, by paths or by ids
+	resp, err = doSharedReq(be, "GET", u1.id, "/tags/tag1", u2.token, nil, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var td userTagData
+	if err := json.NewDecoder(resp.Body).Decode(&td); err != nil {
+		return errors.Trace(err)
+	}
+
+	if td.ID != tagIDs.tag1ID || len(td.Subtags) != 1 || td.Subtags[0].ID != tagIDs.tag3ID {
+		return errors.Errorf("wrong shared tag: %+v", td)
+	}
+
+	for _, path := range []string{
+		"/tags/tag1/tag3/tag5",
+		fmt.Sprintf("/tags/%d", tagIDs.tag4ID),
+		"/tags/tag1?shape=flat",
+	} {
+		if _, err := doSharedReq(
+			be, "GET", u1.id, path, u2.token, nil, http.StatusOK,
+		); err != nil {
+			return errors.Annotatef(err, "%s", path)
+		}
+	}
+
+	// New tags are not suggested, since the suggestion could reveal the tags
+	// which are not shared
+	if err := expectNoNewTagSuggestion(
+		be, u1.id, "/tags/tag1?pattern=tag2/new&allow_new=1", u2.token,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Everything else is not
+	for _, path := range []string{
+		"/tags",
+		"/tags/tag2",
+		"/tags/tag7/tag8",
+		"/tags/nonexisting",
+		"/tags/tag1/nonexisting",
+		fmt.Sprintf("/tags/%d", tagIDs.tag2ID),
+		"/tags/1000000",
+		"/tags?shape=flat&pattern=tag",
+		"/bookmarks",
+		fmt.Sprintf("/bookmarks?tag_id=%d", tagIDs.tag2ID),
+		fmt.Sprintf("/bookmarks?tag_id=%d&tag_id=%d", tagIDs.tag4ID, tagIDs.tag2ID),
+		"/bookmarks?tag_id=1000000",
+		fmt.Sprintf("/bookmarks/%d", bkm1ID),
+		"/bookmarks?url=http://bkm1.com",
+		"/bookmarks?query=tag1",
+		"/tokens",
+		"/grants",
+	} {
+		if _, err := doSharedReq(
+			be, "GET", u1.id, path, u2.token, nil, http.StatusForbidden,
+		); err != nil {
+			return errors.Annotatef(err, "%s", path)
+		}
+	}
+
+	// Bookmarks within the shared subtree are visible, but only with the
+	// shared tags
+	resp, err = doSharedReq(
+		be, "GET", u1.id, fmt.Sprintf("/bookmarks?tag_id=%d", tagIDs.tag3ID), u2.token,
+		nil, http.StatusOK,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var bkmsResp bkms
+	if err := json.NewDecoder(resp.Body).Decode(&bkmsResp); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(bkmsResp) != 1 || bkmsResp[0].ID != bkm1ID ||
+		len(bkmsResp[0].Tags) != 1 || len(bkmsResp[0].Tags[0].Items) != 3 ||
+		bkmsResp[0].Tags[0].Items[2].ID != tagIDs.tag4ID {
+		return errors.Errorf("wrong shared bookmarks: %+v", bkmsResp)
+	}
+
+	resp, err = doSharedReq(
+		be, "GET", u1.id, fmt.Sprintf("/bookmarks?tag_id=%d&q=bkm", tagIDs.tag1ID),
+		u2.token, nil, http.StatusOK,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var searchResp []userBookmarkSearchData
+	if err := json.NewDecoder(resp.Body).Decode(&searchResp); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(searchResp) != 1 || searchResp[0].ID != bkm1ID || len(searchResp[0].Tags) != 1 {
+		return errors.Errorf("wrong shared search results: %+v", searchResp)
+	}
+
+	// The shared subtree is read-only
+	for _, tc := range []struct {
+		method, path string
+		args         H
+	}{
+		{"POST", "/tags/tag1", H{"names": []string{"new"}}},
+		{"PUT", "/tags/tag1/tag3", H{"description": "new"}},
+		{"DELETE", "/tags/tag1/tag3", nil},
+		{"POST", "/bookmarks", H{"url": "http://bkm3.com", "tagIDs": []int{tagIDs.tag3ID}}},
+		{"DELETE", fmt.Sprintf("/bookmarks/%d", bkm1ID), nil},
+	} {
+		if _, err := doSharedReq(
+			be, tc.method, u1.id, tc.path, u2.token, tc.args, http.StatusForbidden,
+		); err != nil {
+			return errors.Annotatef(err, "%s %s", tc.method, tc.path)
+		}
+	}
+
+	// Shared tags can't be used in the grantee's own data either
+	if _, err := addTag(be, "/tags", u2.id, []string{"tag1"}, "", false); err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err = doTokenReq(
+		be, "PUT", "/tags/tag1", u2.token, H{
+			"parentTagID": tagIDs.tag3ID, "newLeafPolicy": QSArgNewLeafPolicyKeep,
+		}, 0,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := expectHTTPCode(resp, http.StatusForbidden); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tokens restricted to a subtree of the grantee's own tags don't give
+	// access to the shared ones
+	subtreeToken, err := createScopedToken(be, u2.id, "read", "/tag1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := doSharedReq(
+		be, "GET", u1.id, "/tags/tag1", subtreeToken, nil, http.StatusForbidden,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	readToken, err := createScopedToken(be, u2.id, "read", "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := doSharedReq(
+		be, "GET", u1.id, "/tags/tag1", readToken, nil, http.StatusOK,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Only the owner can delete the grant
+	resp, err = doTokenReq(
+		be, "DELETE", fmt.Sprintf("/grants/%d", grantID), u2.token, nil, 0,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = expectErrorResp(
+		resp, http.StatusBadRequest, fmt.Sprintf("id %d: grant does not exist", grantID),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := doTokenReq(
+		be, "DELETE", fmt.Sprintf("/grants/%d", grantID), u1.token, nil, http.StatusOK,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := doSharedReq(
+		be, "GET", u1.id, "/tags/tag1", u2.token, nil, http.StatusForbidden,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := getJSON(be, "/shared", u2.token, &shared); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(shared) != 0 {
+		return errors.Errorf("nothing should be shared anymore, got %+v", shared)
+	}
+
+	// Grants are deleted together with the tag
+	if _, err := addGrant(be, u1.token, H{"tagPath": "/tag1/tag3", "grantee": "test2"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := doTokenReq(
+		be, "DELETE", fmt.Sprintf("/tags/tag1?%s=%s", QSArgNewLeafPolicy, QSArgNewLeafPolicyKeep),
+		u1.token, nil, http.StatusOK,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := getJSON(be, "/grants", u1.token, &grants); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(grants) != 0 {
+		return errors.Errorf("grants should be deleted with the tag, got %+v", grants)
+	}
+
+	return nil
+}
+
+// }}}
+
+// doSharedReq performs an HTTP request to the /api/users/<ownerID> endpoint
+// with the given token; if expectedCode is not 0, the response status is
+// checked.
+func doSharedReq(
+	be testBackend, method string, ownerID int, path, token string, args H,
+	expectedCode int,
+) (*genericResp, error) {
+	data := []byte{}
+	if args != nil {
+		var err error
+		data, err = json.Marshal(args)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	resp, err := be.DoReq(
+		method, fmt.Sprintf("/api/users/%d%s", ownerID, path), token,
+		bytes.NewReader(data), false,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if expectedCode != 0 {
+		if err := expectHTTPCode(resp, expectedCode); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return resp, nil
+}
+
+// expectNoNewTagSuggestion performs GET of the given tags path, which should
+// have allow_new=1, and checks that no new tag is suggested in the response.
+func expectNoNewTagSuggestion(
+	be testBackend, ownerID int, path, token string,
+) error {
+	resp, err := doSharedReq(be, "GET", ownerID, path, token, nil, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var tags []tagData
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, t := range tags {
+		if t.NewTagsCnt > 0 {
+			return errors.Errorf("%s: unexpected new tag suggestion: %+v", path, t)
+		}
+	}
+
+	return nil
+}
+
+// addGrant creates a grant with the given args, and returns its id.
+func addGrant(be testBackend, token string, args H) (int, error) {
+	resp, err := doTokenReq(be, "POST", "/grants", token, args, http.StatusOK)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var postResp userGrantPostResp
+	if err := json.NewDecoder(resp.Body).Decode(&postResp); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return postResp.GrantID, nil
+}
+
+// getJSON gets the given path of the /api/my endpoint with the given token,
+// and decodes the response into v.
+func getJSON(be testBackend, path, token string, v interface{}) error {
+	resp, err := doTokenReq(be, "GET", path, token, nil, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(json.NewDecoder(resp.Body).Decode(v))
+}
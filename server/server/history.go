@@ -0,0 +1,209 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+type userHistoryRecord struct {
+	RevisionID int                 `json:"revisionID"`
+	CreatedAt  uint64              `json:"createdAt"`
+	Diff       storage.HistoryDiff `json:"diff"`
+}
+
+type userBookmarkRevertArgs struct {
+	// The bookmark is reverted to the state right after the given revision;
+	// zero means the state before the first revision.
+	RevisionID int `json:"revisionID"`
+}
+
+type userBookmarkRevertResp struct {
+}
+
+func (gm *GMServer) userBookmarkHistoryGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkmID, err := getBookmarkIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var records []storage.HistoryRecord
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if _, err := gm.getUserBookmark(tx, gmr.SubjUser.ID, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		var err error
+		records, err = gm.si.GetHistory(tx, storage.HistoryObjectTaggable, bkmID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return makeUserHistory(records), nil
+}
+
+func (gm *GMServer) userBookmarkRevert(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkmID, err := getBookmarkIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	decoder := json.NewDecoder(gmr.Body)
+	var args userBookmarkRevertArgs
+	err = decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		bkm, err := gm.getUserBookmark(tx, gmr.SubjUser.ID, bkmID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		records, err := gm.si.GetHistory(tx, storage.HistoryObjectTaggable, bkmID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Find the records made after the requested revision
+		idx := 0
+		if args.RevisionID != 0 {
+			idx = -1
+			for i, r := range records {
+				if r.ID == args.RevisionID {
+					idx = i + 1
+					break
+				}
+			}
+			if idx < 0 {
+				return errors.Errorf(
+					"bookmark %d does not have revision %d", bkmID, args.RevisionID,
+				)
+			}
+		}
+
+		tagIDs, err := gm.si.GetTaggings(tx, bkmID, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bd := bkm.BookmarkData
+		revertedTagIDs := storage.RevertBookmark(&bd, tagIDs, records[idx:])
+
+		rootTagID, err := gm.si.GetRootTagID(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Some of the tags might have been deleted since then. The root tag is
+		// dropped as well: if nothing else is left, the bookmark becomes
+		// untagged, just like when its tags are deleted.
+		existingTagIDs := []int{}
+		for _, tagID := range revertedTagIDs {
+			if tagID == rootTagID {
+				continue
+			}
+
+			td, err := gm.si.GetTag(tx, tagID, &storage.GetTagOpts{})
+			if err != nil {
+				if errors.Cause(err) == storage.ErrTagDoesNotExist {
+					continue
+				}
+				return errors.Trace(err)
+			}
+
+			if td.OwnerID == gmr.SubjUser.ID {
+				existingTagIDs = append(existingTagIDs, tagID)
+			}
+		}
+
+		// NOTE: we need to pass OwnerID since it's used to check whether this
+		// owner already has the bookmark with the same URL
+		bd.OwnerID = gmr.SubjUser.ID
+		bd.CanonicalURL = canonicalizeURL(bd.URL)
+		if err := gm.si.UpdateBookmark(tx, &bd); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(tx, bkmID, existingTagIDs, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userBookmarkRevertResp{}
+	return resp, nil
+}
+
+func (gm *GMServer) userTagHistoryGet(
+	gmr *GMRequest, tagPath string,
+) (resp interface{}, err error) {
+	var records []storage.HistoryRecord
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		tagID, err := gm.getTagIDByPath(gmr, tx, gmr.SubjUser.ID, tagPath, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		records, err = gm.si.GetHistory(tx, storage.HistoryObjectTag, tagID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return makeUserHistory(records), nil
+}
+
+func makeUserHistory(records []storage.HistoryRecord) []userHistoryRecord {
+	ret := make([]userHistoryRecord, 0, len(records))
+	for _, r := range records {
+		ret = append(ret, userHistoryRecord{
+			RevisionID: r.ID,
+			CreatedAt:  r.CreatedAt,
+			Diff:       r.Diff,
+		})
+	}
+
+	return ret
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// Test history {{{
+func TestHistory(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestHistory)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestHistory(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_1",
+		Title:  "title_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = updateBookmark(be, u1.id, &bkmData{
+		ID:     bkm1ID,
+		URL:    "url_1",
+		Title:  "title_2",
+		TagIDs: []int{tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmHistoryPath := fmt.Sprintf("/bookmarks/%d/history", bkm1ID)
+
+	history, err := getHistory(be, u1.id, bkmHistoryPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Taggings after creation, the title, and taggings after the update
+	if len(history) != 3 {
+		return errors.Errorf("expected 3 history records, got %+v", history)
+	}
+
+	expectedDiff := storage.HistoryDiff{
+		Title: &storage.StringChange{Old: "title_1", New: "title_2"},
+	}
+	if !reflect.DeepEqual(history[1].Diff, expectedDiff) {
+		return errors.Errorf("wrong title diff: %+v", history[1].Diff)
+	}
+
+	expectedDiff = storage.HistoryDiff{
+		TagIDs: &storage.TagIDsChange{
+			Added:   []int{tagIDs.tag2ID},
+			Removed: []int{tagIDs.tag1ID, tagIDs.tag3ID, tagIDs.tag4ID},
+		},
+	}
+	if !reflect.DeepEqual(history[2].Diff, expectedDiff) {
+		return errors.Errorf("wrong taggings diff: %+v", history[2].Diff)
+	}
+
+	// Revert to the first revision
+	_, err = be.DoUserReq(
+		"POST", fmt.Sprintf("/bookmarks/%d/revert", bkm1ID), u1.id,
+		H{"revisionID": history[0].RevisionID}, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkBkmGetByID(be, u1.id, bkm1ID, &bkmData{
+		ID:    bkm1ID,
+		URL:   "url_1",
+		Title: "title_1",
+		Tags: []bkmTagData{
+			bkmTagData{
+				Items: []bkmTagDataItem{
+					bkmTagDataItem{ID: tagIDs.tag1ID, Name: "tag1"},
+					bkmTagDataItem{ID: tagIDs.tag3ID, Name: "tag3_alias"},
+					bkmTagDataItem{ID: tagIDs.tag4ID, Name: "tag4"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The revert itself is recorded as well
+	history, err = getHistory(be, u1.id, bkmHistoryPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(history) != 5 {
+		return errors.Errorf("expected 5 history records, got %+v", history)
+	}
+
+	// Reverting to a revision whose tags have been deleted since then leaves
+	// the bookmark untagged
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_2",
+		Title:  "title_2",
+		TagIDs: []int{tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = updateBookmark(be, u1.id, &bkmData{
+		ID:     bkm2ID,
+		URL:    "url_2",
+		Title:  "title_2",
+		TagIDs: []int{tagIDs.tag8ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	history, err = getHistory(be, u1.id, fmt.Sprintf("/bookmarks/%d/history", bkm2ID))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := deleteTag(be, "/tags/tag2", u1.id, "keep"); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = be.DoUserReq(
+		"POST", fmt.Sprintf("/bookmarks/%d/revert", bkm2ID), u1.id,
+		H{"revisionID": history[0].RevisionID}, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkBkmGetByID(be, u1.id, bkm2ID, &bkmData{
+		ID:    bkm2ID,
+		URL:   "url_2",
+		Title: "title_2",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tag history
+	err = updateTag(
+		be, "/tags/tag7", u1.id, nil, cptr.String("new descr"), nil, nil,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	history, err = getHistory(be, u1.id, "/tags/tag7?history=1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expectedDiff = storage.HistoryDiff{
+		Description: &storage.StringChange{Old: "test tag", New: "new descr"},
+	}
+	if len(history) != 1 || !reflect.DeepEqual(history[0].Diff, expectedDiff) {
+		return errors.Errorf("wrong tag history: %+v", history)
+	}
+
+	// A tag named "history" is just a tag
+	historyTagID, err := addTag(be, "/tags/tag7", u1.id, []string{"history"}, "", false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := be.DoUserReq("GET", "/tags/tag7/history", u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var td userTagData
+	if err := json.NewDecoder(resp.Body).Decode(&td); err != nil {
+		return errors.Trace(err)
+	}
+
+	if td.ID != historyTagID {
+		return errors.Errorf("expected tag %d, got %+v", historyTagID, td)
+	}
+
+	// Errors
+	for _, tc := range []struct {
+		method  string
+		path    string
+		userID  int
+		args    H
+		message string
+	}{
+		{
+			"POST", fmt.Sprintf("/bookmarks/%d/revert", bkm1ID), u1.id,
+			H{"revisionID": 100500},
+			fmt.Sprintf("bookmark %d does not have revision 100500", bkm1ID),
+		},
+		// History of other users is not accessible
+		{
+			"GET", bkmHistoryPath, u2.id, nil,
+			fmt.Sprintf("id %d: bookmark does not exist", bkm1ID),
+		},
+		{
+			"POST", fmt.Sprintf("/bookmarks/%d/revert", bkm1ID), u2.id,
+			H{"revisionID": 0},
+			fmt.Sprintf("id %d: bookmark does not exist", bkm1ID),
+		},
+	} {
+		resp, err := be.DoUserReq(tc.method, tc.path, tc.userID, tc.args, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusBadRequest, tc.message); err != nil {
+			return errors.Annotatef(err, "%s %s", tc.method, tc.path)
+		}
+	}
+
+	return nil
+}
+
+// }}}
+
+type historyRecord struct {
+	RevisionID int                 `json:"revisionID"`
+	CreatedAt  uint64              `json:"createdAt"`
+	Diff       storage.HistoryDiff `json:"diff"`
+}
+
+func getHistory(be testBackend, userID int, path string) ([]historyRecord, error) {
+	resp, err := be.DoUserReq("GET", path, userID, nil, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var history []historyRecord
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, r := range history {
+		if r.CreatedAt == 0 {
+			return nil, errors.Errorf("createdAt is not set for revision %d", r.RevisionID)
+		}
+	}
+
+	return history, nil
+}
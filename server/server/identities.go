@@ -0,0 +1,378 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/userexport"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+type userIdentityData struct {
+	ID       int    `json:"id"`
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+	Email    string `json:"email"`
+	// Unix timestamp
+	CreatedAt uint64 `json:"createdAt"`
+}
+
+type userIdentityPostArgs struct {
+	// Provider is the name of the auth provider, as in /api/auth/:provider;
+	// Code and RedirectURI are the same as for authentication.
+	Provider    string `json:"provider"`
+	Code        string `json:"code"`
+	RedirectURI string `json:"redirectURI"`
+}
+
+type userIdentityDeleteResp struct {
+}
+
+type userMergePostArgs struct {
+	// Token of the account to merge into the current one; it should have the
+	// write scope and should not be restricted to a subtree.
+	Token string `json:"token"`
+}
+
+type userMergePostResp struct {
+	// ID of the merged account, which doesn't exist anymore.
+	MergedUserID int `json:"mergedUserID"`
+}
+
+func (gm *GMServer) userIdentitiesGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		resp, err = gm.getUserIdentities(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+// userIdentitiesPost links one more identity at some auth provider to the
+// user, so that the user can log in with it, and returns all identities of
+// the user.
+func (gm *GMServer) userIdentitiesPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args, err := getUserIdentityPostArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	userID := gmr.SubjUser.ID
+
+	var link func(tx *sql.Tx) error
+
+	if op, ok := gm.oidcProviders[args.Provider]; ok {
+		// Like with authentication, talk to the provider before starting the
+		// transaction.
+		eid, err := op.verify(gmr.Context(), args.Code, args.RedirectURI)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		link = func(tx *sql.Tx) error {
+			_, err := gm.getOrCreateExternalUser(tx, eid, userID)
+			return errors.Trace(err)
+		}
+	} else {
+		oauthCreds, ok := gm.oauthProviders[args.Provider]
+		if !ok {
+			return nil, errors.Errorf("unknown auth provider: %q", args.Provider)
+		}
+
+		if oauthCreds == nil {
+			return nil, errors.Errorf("auth provider %q is disabled (corresponding flag to the creds file was not provided)", args.Provider)
+		}
+
+		switch args.Provider {
+		case providerGoogle:
+			link = func(tx *sql.Tx) error {
+				_, _, err := gm.handleOAuthGoogle(
+					tx, args.Code, args.RedirectURI, oauthCreds, googleEndpoint, userID,
+				)
+				return errors.Trace(err)
+			}
+		default:
+			return nil, hh.MakeInternalServerError(
+				errors.Errorf("auth provider %q exists, but is not handled", args.Provider),
+			)
+		}
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if err := link(tx); err != nil {
+			return errors.Trace(err)
+		}
+
+		var err error
+		resp, err = gm.getUserIdentities(tx, userID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+// userIdentityDelete unlinks the identity from the user; the last way to log
+// in (an identity or the password) can't be unlinked.
+func (gm *GMServer) userIdentityDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	eidID, err := getIdentityIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		eids, err := gm.si.GetExternalIdentities(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Make sure it's an identity of the user
+		found := false
+		for _, eid := range eids {
+			if eid.ID == eidID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return errors.Annotatef(storage.ErrIdentityDoesNotExist, "id %d", eidID)
+		}
+
+		if len(eids) == 1 {
+			ud, err := gm.si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(gmr.SubjUser.ID)})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if ud.Password == "" {
+				return errors.Annotatef(
+					hh.MakeForbiddenError(), "can't unlink the last identity",
+				)
+			}
+		}
+
+		if err := gm.si.DeleteExternalIdentity(tx, eidID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userIdentityDeleteResp{}
+	return resp, nil
+}
+
+// userMergePost moves all tags, bookmarks, notes and identities of another
+// account, given by its token, into the user's account, and deletes the other
+// account. Tags with the same names under the same parents are merged, and so
+// are bookmarks with the same canonical URLs (see userexport.ImportInto).
+// Trashed items, history and the password of the other account are not moved.
+func (gm *GMServer) userMergePost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args, err := getUserMergePostArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	userID := gmr.SubjUser.ID
+	var srcUserID int
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		srcUser, srcToken, err := gm.si.GetUserByAccessToken(tx, args.Token)
+		if err != nil {
+			if hh.GetHTTPErrorCode(err) == http.StatusUnauthorized {
+				return errors.Errorf("invalid token of the account to merge")
+			}
+			return errors.Trace(err)
+		}
+
+		// The whole account is going to be deleted, so the token should be
+		// allowed to do anything with it
+		err = gm.authorizeOperation(srcUser, srcToken, &authzArgs{
+			OwnerID: srcUser.ID, Write: true,
+		})
+		if err != nil {
+			return errors.Annotatef(err, "token of the account to merge")
+		}
+
+		if srcUser.ID == userID {
+			return errors.Errorf("can't merge the account into itself")
+		}
+
+		srcUserID = srcUser.ID
+
+		data, err := userexport.Export(tx, gm.si, srcUserID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		eids, err := gm.si.GetExternalIdentities(tx, srcUserID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Delete the other account first, so that its identities can be
+		// linked to the user
+		if err := gm.si.DeleteUser(tx, srcUserID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := userexport.ImportInto(
+			tx, gm.si, userID, data, canonicalizeURL,
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, eid := range eids {
+			eid.UserID = userID
+			if _, err := gm.si.CreateExternalIdentity(tx, &eid); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Invalidate tree cache for both users
+	userIDToTagsTree.DeleteCacheForUser(userID)
+	userIDToTagsTree.DeleteCacheForUser(srcUserID)
+
+	glog.V(2).Infof("Merged user %d into user %d", srcUserID, userID)
+
+	resp = userMergePostResp{
+		MergedUserID: srcUserID,
+	}
+	return resp, nil
+}
+
+func (gm *GMServer) getUserIdentities(
+	tx *sql.Tx, userID int,
+) ([]userIdentityData, error) {
+	eids, err := gm.si.GetExternalIdentities(tx, userID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	eidsUser := []userIdentityData{}
+	for _, eid := range eids {
+		eidsUser = append(eidsUser, userIdentityData{
+			ID:        eid.ID,
+			Provider:  eid.Provider,
+			Subject:   eid.Subject,
+			Email:     eid.Email,
+			CreatedAt: eid.CreatedAt,
+		})
+	}
+
+	return eidsUser, nil
+}
+
+func getUserIdentityPostArgs(gmr *GMRequest) (*userIdentityPostArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userIdentityPostArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if args.Provider == "" {
+		return nil, errors.Errorf("provider is required")
+	}
+
+	if args.Provider == providerLocal {
+		return nil, errors.Errorf("use /password to set the password")
+	}
+
+	return &args, nil
+}
+
+func getUserMergePostArgs(gmr *GMRequest) (*userMergePostArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userMergePostArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if args.Token == "" {
+		return nil, errors.Errorf("token is required")
+	}
+
+	return &args, nil
+}
+
+func getIdentityIDFromQueryString(gmr *GMRequest) (int, error) {
+	eidIDStr := pat.Param(gmr.HttpReq, IdentityID)
+	eidID, err := strconv.Atoi(eidIDStr)
+	if err != nil {
+		return 0, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong identity id %q", eidIDStr),
+		)
+	}
+	return eidID, nil
+}
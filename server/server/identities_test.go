@@ -0,0 +1,508 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+const testRedirectURI = "http://localhost/callback"
+
+// Test linking and unlinking identities {{{
+func TestIdentities(t *testing.T) {
+	ti, err := newTestIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ti.Close()
+
+	ti.AddCode("link1", H{"sub": "u1-sub", "email": "u1@corp.com"}, false)
+	ti.AddCode("link1-again", H{"sub": "u1-sub", "email": "u1@corp.com"}, false)
+	ti.AddCode("link1-u2", H{"sub": "u1-sub", "email": "u1@corp.com"}, false)
+	ti.AddCode("login1", H{"sub": "u1-sub", "email": "u1@corp.com"}, false)
+	ti.AddCode("link2", H{"sub": "u1-sub2", "email": "u1@corp.com"}, false)
+
+	err = withTestOIDCProvider(ti, func() error {
+		runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+			var err error
+
+			err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestIdentities)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func perUserTestIdentities(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	if err := checkIdentitiesGet(be, u1.token, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Link an identity; then, logging in with it gets into the same user
+	if err := linkIdentity(be, u1.token, "link1", http.StatusOK); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, u1.token, []string{"u1-sub"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	token, err := oidcAuthReq(be, "login1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, token, []string{"u1-sub"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Linking it again is a no-op, but it can't be linked to another user
+	if err := linkIdentity(be, u1.token, "link1-again", http.StatusOK); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, u1.token, []string{"u1-sub"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := doLinkIdentityReq(be, u2.token, testOIDCProvider, "link1-u2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = expectErrorResp(
+		resp, http.StatusBadRequest,
+		`corp user "u1@corp.com" is already linked to another account`,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Unknown provider, and a read-only token
+	resp, err = doLinkIdentityReq(be, u1.token, "unknown", "link2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = expectErrorResp(resp, http.StatusBadRequest, `unknown auth provider: "unknown"`)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	readToken, err := createScopedToken(be, u1.id, "read", "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := linkIdentity(be, readToken, "link2", http.StatusForbidden); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, readToken, []string{"u1-sub"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// The last identity can't be unlinked, unless the user has a password
+	eids, err := getIdentities(be, u1.token)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err = doTokenReq(
+		be, "DELETE", fmt.Sprintf("/identities/%d", eids[0].ID), u1.token, nil, 0,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = expectErrorResp(
+		resp, http.StatusForbidden, "can't unlink the last identity: forbidden",
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := linkIdentity(be, u1.token, "link2", http.StatusOK); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, u1.token, []string{"u1-sub", "u1-sub2"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Other users can't unlink it
+	_, err = doTokenReq(
+		be, "DELETE", fmt.Sprintf("/identities/%d", eids[0].ID), u2.token, nil,
+		http.StatusBadRequest,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = doTokenReq(
+		be, "DELETE", fmt.Sprintf("/identities/%d", eids[0].ID), u1.token, nil,
+		http.StatusOK,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, u1.token, []string{"u1-sub2"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// With a password, the last identity can be unlinked as well
+	_, err = doTokenReq(be, "PUT", "/password", u1.token, H{
+		"newPassword": "test1pass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	eids, err = getIdentities(be, u1.token)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = doTokenReq(
+		be, "DELETE", fmt.Sprintf("/identities/%d", eids[0].ID), u1.token, nil,
+		http.StatusOK,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, u1.token, nil); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test merging accounts {{{
+func TestMergeAccounts(t *testing.T) {
+	ti, err := newTestIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ti.Close()
+
+	ti.AddCode("link3", H{"sub": "u3-sub", "email": "u3@corp.com"}, false)
+	ti.AddCode("login3", H{"sub": "u3-sub", "email": "u3@corp.com"}, false)
+
+	err = withTestOIDCProvider(ti, func() error {
+		runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+			var err error
+
+			err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestMergeAccounts)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func perUserTestMergeAccounts(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	// The account to merge into u1 is a separate one, since runPerUserTest
+	// expects both u1 and u2 to exist at the end
+	u3Token, err := localAuthReq(be, "/signup", H{
+		"username": "test3",
+		"email":    "3@1.1",
+		"password": "test3pass",
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := linkIdentity(be, u3Token, "link3", http.StatusOK); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tags of u1:
+	// /common/sub1
+	if _, err := addTag(be, "/tags", u1.id, []string{"common"}, "", false); err != nil {
+		return errors.Trace(err)
+	}
+
+	u1Sub1ID, err := addTag(be, "/tags/common", u1.id, []string{"sub1"}, "", false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tags of u3; "c" and "common" are the same tag:
+	// /c/sub1
+	// /c/sub2
+	// /other
+	u3TagIDs := map[string]int{}
+	for _, tc := range []struct {
+		parentPath string
+		names      []string
+	}{
+		{"", []string{"c", "common"}},
+		{"/c", []string{"sub1"}},
+		{"/c", []string{"sub2"}},
+		{"", []string{"other"}},
+	} {
+		resp, err := doTokenReq(
+			be, "POST", "/tags"+tc.parentPath, u3Token, H{"names": tc.names}, http.StatusOK,
+		)
+		if err != nil {
+			return errors.Annotatef(err, "%s %v", tc.parentPath, tc.names)
+		}
+
+		var postResp userTagsPostResp
+		if err := json.NewDecoder(resp.Body).Decode(&postResp); err != nil {
+			return errors.Trace(err)
+		}
+
+		u3TagIDs[tc.parentPath+"/"+tc.names[0]] = postResp.TagID
+	}
+
+	bkmAID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "http://example.com/a",
+		Title:  "a",
+		TagIDs: []int{u1Sub1ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bookmarks of u3: the first one has the same canonical URL as the bookmark
+	// of u1
+	for _, bkm := range []H{
+		{"url": "http://example.com/a/?utm_source=foo", "title": "a2", "tagIDs": A{u3TagIDs["/other"]}},
+		{"url": "http://example.com/b", "title": "b", "tagIDs": A{u3TagIDs["/c/sub2"]}},
+	} {
+		if _, err := doTokenReq(be, "POST", "/bookmarks", u3Token, bkm, http.StatusOK); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Tokens which can't be used for merging
+	u2ReadToken, err := createScopedToken(be, u2.id, "read", "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, tc := range []struct {
+		token string
+		code  int
+		msg   string
+	}{
+		{"bogus", http.StatusBadRequest, "invalid token of the account to merge"},
+		{u1.token, http.StatusBadRequest, "can't merge the account into itself"},
+		{u2ReadToken, http.StatusForbidden, "token of the account to merge: forbidden"},
+	} {
+		resp, err := doTokenReq(be, "POST", "/merge", u1.token, H{"token": tc.token}, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectErrorResp(resp, tc.code, tc.msg); err != nil {
+			return errors.Annotatef(err, "%q", tc.token)
+		}
+	}
+
+	// Merge u3 into u1
+	if _, err := doTokenReq(
+		be, "POST", "/merge", u1.token, H{"token": u3Token}, http.StatusOK,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := expectTokenUnauthorized(be, u3Token); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tags are merged
+	err = checkTagPaths(be, u1.token, []string{
+		"/common", "/common/sub1", "/common/sub2", "/other",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The bookmark with the same URL got the tags of the merged one
+	bkms, err := getBookmarksByTagPath(be, u1.token, "/common")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(bkms) != 2 {
+		return errors.Errorf("expected 2 bookmarks tagged with /common, got %v", bkms)
+	}
+
+	bkms, err = getBookmarksByTagPath(be, u1.token, "/other")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(bkms) != 1 || bkms[0].ID != bkmAID || bkms[0].Title != "a" {
+		return errors.Errorf("expected the bookmark %d tagged with /other, got %v", bkmAID, bkms)
+	}
+
+	// The identity of u3 now logs into u1
+	token, err := oidcAuthReq(be, "login3")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkIdentitiesGet(be, token, []string{"u3-sub"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+func doLinkIdentityReq(
+	be testBackend, token, provider, code string,
+) (*genericResp, error) {
+	resp, err := doTokenReq(be, "POST", "/identities", token, H{
+		"provider":    provider,
+		"code":        code,
+		"redirectURI": testRedirectURI,
+	}, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
+func linkIdentity(be testBackend, token, code string, expectedCode int) error {
+	resp, err := doLinkIdentityReq(be, token, testOIDCProvider, code)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(expectHTTPCode(resp, expectedCode))
+}
+
+func getIdentities(be testBackend, token string) ([]userIdentityData, error) {
+	resp, err := doTokenReq(be, "GET", "/identities", token, nil, http.StatusOK)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var eids []userIdentityData
+	if err := json.NewDecoder(resp.Body).Decode(&eids); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return eids, nil
+}
+
+// checkIdentitiesGet checks that the user has the identities with the given
+// subjects at testOIDCProvider, and no other ones.
+func checkIdentitiesGet(be testBackend, token string, expectedSubjects []string) error {
+	eids, err := getIdentities(be, token)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	subjects := []string{}
+	for _, eid := range eids {
+		if eid.Provider != testOIDCProvider {
+			return errors.Errorf("unexpected identity %+v", eid)
+		}
+		subjects = append(subjects, eid.Subject)
+	}
+
+	if expectedSubjects == nil {
+		expectedSubjects = []string{}
+	}
+
+	if !reflect.DeepEqual(subjects, expectedSubjects) {
+		return errors.Errorf("expected identities %v, got %+v", expectedSubjects, eids)
+	}
+
+	return nil
+}
+
+func checkTagPaths(be testBackend, token string, expectedPaths []string) error {
+	resp, err := doTokenReq(be, "GET", "/tags?shape=flat", token, nil, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var tags []userTagDataFlat
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return errors.Trace(err)
+	}
+
+	paths := []string{}
+	for _, td := range tags {
+		if td.Path != "" {
+			paths = append(paths, td.Path)
+		}
+	}
+	sort.Strings(paths)
+
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		return errors.Errorf("expected tags %v, got %v", expectedPaths, paths)
+	}
+
+	return nil
+}
+
+// getBookmarksByTagPath returns bookmarks tagged with the tag with the given
+// path.
+func getBookmarksByTagPath(be testBackend, token, tagPath string) ([]bkmData, error) {
+	resp, err := doTokenReq(
+		be, "GET", "/tags"+tagPath+"?shape=single", token, nil, http.StatusOK,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var td userTagData
+	if err := json.NewDecoder(resp.Body).Decode(&td); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp, err = doTokenReq(
+		be, "GET", fmt.Sprintf("/bookmarks?tag_id=%d", td.ID), token, nil, http.StatusOK,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := bkms{}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return []bkmData(v), nil
+}
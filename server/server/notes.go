@@ -0,0 +1,409 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+type userNoteData struct {
+	ID        int               `json:"id"`
+	Title     string            `json:"title,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Format    string            `json:"format"`
+	UpdatedAt uint64            `json:"updatedAt"`
+	Tags      []userBookmarkTag `json:"tags,omitempty"`
+}
+
+// userTaggableData is an item of the mixed list of taggables; depending on
+// the Type, either Bookmark or Note is set.
+type userTaggableData struct {
+	Type     string            `json:"type"`
+	Bookmark *userBookmarkData `json:"bookmark,omitempty"`
+	Note     *userNoteData     `json:"note,omitempty"`
+}
+
+type userNotePostArgs struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// If empty, storage.NoteFormatDefault is used
+	Format string `json:"format,omitempty"`
+	TagIDs []int  `json:"tagIDs"`
+}
+
+type userNotePostResp struct {
+	NoteID int `json:"noteID"`
+}
+
+type userNotePutResp struct {
+}
+
+type userNoteDeleteResp struct {
+}
+
+func (gm *GMServer) userNotesGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagIDs, err := getTagIDsFromQS(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var notes []storage.NoteDataWTags
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		notes, err = gm.si.GetTaggedNotes(
+			tx, tagIDs, cptr.Int(gmr.SubjUser.ID), &storage.TagsFetchOpts{
+				TagsFetchMode:     storage.TagsFetchModeLeafs,
+				TagNamesFetchMode: storage.TagNamesFetchModeFull,
+			},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	notesUser := []userNoteData{}
+	for i := range notes {
+		notesUser = append(notesUser, makeUserNoteData(&notes[i]))
+	}
+
+	return notesUser, nil
+}
+
+func makeUserNoteData(note *storage.NoteDataWTags) userNoteData {
+	return userNoteData{
+		ID:        note.ID,
+		Title:     note.Title,
+		Body:      note.Body,
+		Format:    string(note.Format),
+		UpdatedAt: note.UpdatedAt,
+		Tags:      getUserBookmarkTags(note.Tags),
+	}
+}
+
+func (gm *GMServer) userNoteGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	noteID, err := getNoteIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var note *storage.NoteDataWTags
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		note, err = gm.getUserNote(tx, gmr.SubjUser.ID, noteID, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeLeafs,
+			TagNamesFetchMode: storage.TagNamesFetchModeFull,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return makeUserNoteData(note), nil
+}
+
+func (gm *GMServer) userNotesPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args, err := getUserNotePostArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	noteID := 0
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		noteID, err = gm.si.CreateNote(tx, &storage.NoteData{
+			OwnerID: gmr.SubjUser.ID,
+			Title:   args.Title,
+			Body:    args.Body,
+			Format:  storage.NoteFormat(args.Format),
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(
+			tx, noteID, args.TagIDs, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userNotePostResp{
+		NoteID: noteID,
+	}
+	return resp, nil
+}
+
+func (gm *GMServer) userNotePut(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	noteID, err := getNoteIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args, err := getUserNotePostArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		// Make sure it's a note of the user, and not some other taggable
+		_, err := gm.getUserNote(tx, gmr.SubjUser.ID, noteID, &storage.TagsFetchOpts{
+			TagsFetchMode: storage.TagsFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.UpdateNote(tx, &storage.NoteData{
+			ID:     noteID,
+			Title:  args.Title,
+			Body:   args.Body,
+			Format: storage.NoteFormat(args.Format),
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(
+			tx, noteID, args.TagIDs, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userNotePutResp{}
+	return resp, nil
+}
+
+func (gm *GMServer) userNoteDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	noteID, err := getNoteIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		_, err := gm.getUserNote(tx, gmr.SubjUser.ID, noteID, &storage.TagsFetchOpts{
+			TagsFetchMode: storage.TagsFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.si.TrashTaggable(tx, noteID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userNoteDeleteResp{}
+	return resp, nil
+}
+
+// userTaggablesGet returns both bookmarks and notes tagged with the given
+// tags (or untagged ones, if no tags are given), in the order of creation.
+func (gm *GMServer) userTaggablesGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagIDs, err := getTagIDsFromQS(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts := storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeLeafs,
+		TagNamesFetchMode: storage.TagNamesFetchModeFull,
+	}
+
+	var page *storage.BookmarksPage
+	var notes []storage.NoteDataWTags
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		page, err = gm.si.GetTaggedBookmarks(
+			tx, tagIDs, cptr.Int(gmr.SubjUser.ID), &tagsFetchOpts, nil,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		notes, err = gm.si.GetTaggedNotes(
+			tx, tagIDs, cptr.Int(gmr.SubjUser.ID), &tagsFetchOpts,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	type taggableWTime struct {
+		userTaggableData
+		id        int
+		createdAt uint64
+	}
+
+	all := []taggableWTime{}
+
+	for i := range page.Bookmarks {
+		bkm := makeUserBookmarkData(&page.Bookmarks[i])
+		all = append(all, taggableWTime{
+			userTaggableData: userTaggableData{
+				Type:     string(storage.TaggableTypeBookmark),
+				Bookmark: &bkm,
+			},
+			id:        bkm.ID,
+			createdAt: page.Bookmarks[i].CreatedAt,
+		})
+	}
+
+	for i := range notes {
+		note := makeUserNoteData(&notes[i])
+		all = append(all, taggableWTime{
+			userTaggableData: userTaggableData{
+				Type: string(storage.TaggableTypeNote),
+				Note: &note,
+			},
+			id:        note.ID,
+			createdAt: notes[i].CreatedAt,
+		})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].createdAt != all[j].createdAt {
+			return all[i].createdAt < all[j].createdAt
+		}
+		return all[i].id < all[j].id
+	})
+
+	taggablesUser := []userTaggableData{}
+	for _, v := range all {
+		taggablesUser = append(taggablesUser, v.userTaggableData)
+	}
+
+	return taggablesUser, nil
+}
+
+// getUserNote returns the note with the given id if it belongs to the given
+// user and is not trashed; otherwise (also if it's not a note at all),
+// ErrNoteDoesNotExist is returned.
+func (gm *GMServer) getUserNote(
+	tx *sql.Tx, ownerID, noteID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (*storage.NoteDataWTags, error) {
+	note, err := gm.si.GetNoteByID(tx, noteID, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if note.OwnerID != ownerID || note.TrashedAt != 0 {
+		return nil, errors.Annotatef(storage.ErrNoteDoesNotExist, "id %d", noteID)
+	}
+
+	return note, nil
+}
+
+func getUserNotePostArgs(gmr *GMRequest) (*userNotePostArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userNotePostArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if args.Format == "" {
+		args.Format = string(storage.NoteFormatDefault)
+	}
+
+	return &args, nil
+}
+
+func getNoteIDFromQueryString(gmr *GMRequest) (int, error) {
+	noteIDStr := pat.Param(gmr.HttpReq, NoteID)
+	noteID, err := strconv.Atoi(noteIDStr)
+	if err != nil {
+		return 0, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong note id %q", noteIDStr),
+		)
+	}
+	return noteID, nil
+}
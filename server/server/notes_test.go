@@ -0,0 +1,351 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// Test notes {{{
+func TestNotes(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestNotes)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestNotes(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = makeTestTagsHierarchy(be, u2.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	note1ID, err := addNote(be, u1.id, &noteData{
+		Title:  "note1",
+		Body:   "body1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	note2ID, err := addNote(be, u1.id, &noteData{
+		Title:  "note2",
+		Body:   "*body2*",
+		Format: "markdown",
+		TagIDs: []int{tagIDs.tag6ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	note3ID, err := addNote(be, u2.id, &noteData{
+		Title: "note3",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_1",
+		TagIDs: []int{tagIDs.tag5ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The format is plain by default
+	err = checkNoteGetByID(be, u1.id, note1ID, &noteData{
+		ID:     note1ID,
+		Title:  "note1",
+		Body:   "body1",
+		Format: "plain",
+		Tags: []bkmTagData{
+			{Items: []bkmTagDataItem{
+				{ID: tagIDs.tag1ID, Name: "tag1"},
+				{ID: tagIDs.tag3ID, Name: "tag3_alias"},
+				{ID: tagIDs.tag4ID, Name: "tag4"},
+			}},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, tc := range []struct {
+		tagIDs  []int
+		userID  int
+		noteIDs []int
+	}{
+		{[]int{tagIDs.tag3ID}, u1.id, []int{note1ID, note2ID}},
+		{[]int{tagIDs.tag5ID}, u1.id, []int{note2ID}},
+		{[]int{}, u1.id, []int{}},
+		{[]int{}, u2.id, []int{note3ID}},
+	} {
+		if err := checkNotesGet(be, tc.userID, tc.tagIDs, tc.noteIDs); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Bookmarks and notes together
+	err = checkTaggablesGet(be, u1.id, []int{tagIDs.tag3ID}, []taggableRef{
+		{"note", note1ID}, {"note", note2ID}, {"bookmark", bkm1ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTaggablesGet(be, u1.id, []int{tagIDs.tag5ID}, []taggableRef{
+		{"note", note2ID}, {"bookmark", bkm1ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Update a note
+	_, err = be.DoUserReq("PUT", fmt.Sprintf("/notes/%d", note2ID), u1.id, H{
+		"title":  "note2 updated",
+		"body":   "body2",
+		"format": "plain",
+		"tagIDs": A{tagIDs.tag2ID},
+	}, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkNoteGetByID(be, u1.id, note2ID, &noteData{
+		ID:     note2ID,
+		Title:  "note2 updated",
+		Body:   "body2",
+		Format: "plain",
+		Tags: []bkmTagData{
+			{Items: []bkmTagDataItem{
+				{ID: tagIDs.tag2ID, Name: "tag2"},
+			}},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	notExist := func(id int) string {
+		return fmt.Sprintf("id %d: note does not exist", id)
+	}
+
+	// Invalid requests
+	for _, tc := range []struct {
+		method  string
+		path    string
+		args    H
+		message string
+	}{
+		{
+			"POST", "/notes", H{"title": "note", "format": "html"},
+			`invalid note format "html", valid values are: "plain", "markdown"`,
+		},
+		// A bookmark is not a note
+		{"GET", fmt.Sprintf("/notes/%d", bkm1ID), nil, notExist(bkm1ID)},
+		{"DELETE", fmt.Sprintf("/notes/%d", bkm1ID), nil, notExist(bkm1ID)},
+		// Notes of other users are not accessible
+		{"GET", fmt.Sprintf("/notes/%d", note3ID), nil, notExist(note3ID)},
+		{"PUT", fmt.Sprintf("/notes/%d", note3ID), H{"title": "foo"}, notExist(note3ID)},
+		{"DELETE", fmt.Sprintf("/notes/%d", note3ID), nil, notExist(note3ID)},
+	} {
+		resp, err := be.DoUserReq(tc.method, tc.path, u1.id, tc.args, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusBadRequest, tc.message); err != nil {
+			return errors.Annotatef(err, "%s %s", tc.method, tc.path)
+		}
+	}
+
+	// Delete a note
+	_, err = be.DoUserReq("DELETE", fmt.Sprintf("/notes/%d", note1ID), u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTaggablesGet(be, u1.id, []int{tagIDs.tag3ID}, []taggableRef{
+		{"bookmark", bkm1ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+type noteData struct {
+	ID        int          `json:"id"`
+	Title     string       `json:"title,omitempty"`
+	Body      string       `json:"body,omitempty"`
+	Format    string       `json:"format,omitempty"`
+	UpdatedAt uint64       `json:"updatedAt"`
+	TagIDs    []int        `json:"tagIDs"`
+	Tags      []bkmTagData `json:"tags,omitempty"`
+}
+
+type taggableRef struct {
+	Type string
+	ID   int
+}
+
+func addNote(be testBackend, userID int, data *noteData) (noteID int, err error) {
+	tagIDs := A{}
+	for _, id := range data.TagIDs {
+		tagIDs = append(tagIDs, id)
+	}
+	resp, err := be.DoUserReq("POST", "/notes", userID, H{
+		"title":  data.Title,
+		"body":   data.Body,
+		"format": data.Format,
+		"tagIDs": tagIDs,
+	}, true)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	v := map[string]int{}
+	err = json.Unmarshal(body, &v)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return v["noteID"], nil
+}
+
+func checkNotesGet(
+	be testBackend, userID int, tagIDs []int, expectedNoteIDs []int,
+) error {
+	qsVals := url.Values{}
+	for _, tagID := range tagIDs {
+		qsVals.Add("tag_id", strconv.Itoa(tagID))
+	}
+
+	resp, err := be.DoUserReq(
+		"GET", "/notes?"+qsVals.Encode(), userID, nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	notes := []noteData{}
+	if err := json.NewDecoder(resp.Body).Decode(&notes); err != nil {
+		return errors.Trace(err)
+	}
+
+	noteIDs := []int{}
+	for _, note := range notes {
+		noteIDs = append(noteIDs, note.ID)
+	}
+
+	if !reflect.DeepEqual(noteIDs, expectedNoteIDs) {
+		return errors.Errorf(
+			"notes tagged with %v: expected %v, got %v", tagIDs, expectedNoteIDs, noteIDs,
+		)
+	}
+
+	return nil
+}
+
+func checkNoteGetByID(be testBackend, userID int, noteID int, expectedNote *noteData) error {
+	resp, err := be.DoUserReq(
+		"GET", fmt.Sprintf("/notes/%d", noteID), userID, nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	v := noteData{}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return errors.Trace(err)
+	}
+
+	// UpdatedAt is not checked
+	v.UpdatedAt = 0
+
+	if !reflect.DeepEqual(&v, expectedNote) {
+		return errors.Errorf("note: expected %+v, got %+v", expectedNote, &v)
+	}
+
+	return nil
+}
+
+func checkTaggablesGet(
+	be testBackend, userID int, tagIDs []int, expected []taggableRef,
+) error {
+	qsVals := url.Values{}
+	for _, tagID := range tagIDs {
+		qsVals.Add("tag_id", strconv.Itoa(tagID))
+	}
+
+	resp, err := be.DoUserReq(
+		"GET", "/taggables?"+qsVals.Encode(), userID, nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var taggables []struct {
+		Type     string    `json:"type"`
+		Bookmark *bkmData  `json:"bookmark"`
+		Note     *noteData `json:"note"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&taggables); err != nil {
+		return errors.Trace(err)
+	}
+
+	refs := []taggableRef{}
+	for _, t := range taggables {
+		switch {
+		case t.Type == "bookmark" && t.Bookmark != nil:
+			refs = append(refs, taggableRef{t.Type, t.Bookmark.ID})
+		case t.Type == "note" && t.Note != nil:
+			refs = append(refs, taggableRef{t.Type, t.Note.ID})
+		default:
+			return errors.Errorf("malformed taggable of type %q", t.Type)
+		}
+	}
+
+	if !reflect.DeepEqual(refs, expected) {
+		return errors.Errorf(
+			"taggables tagged with %v: expected %v, got %v", tagIDs, expected, refs,
+		)
+	}
+
+	return nil
+}
@@ -19,6 +19,9 @@ type OAuthCreds struct {
 
 type clientIDGetResp struct {
 	ClientID string `json:"clientID"`
+	// Only for OIDC providers: the authorization endpoint, where clients
+	// should send users to log in.
+	AuthURL string `json:"authURL,omitempty"`
 }
 
 var googleEndpoint = oauth2.Endpoint{
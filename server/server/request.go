@@ -21,6 +21,9 @@ type GMRequest struct {
 	HttpReq  *http.Request
 	SubjUser *storage.UserData
 	Caller   *storage.UserData
+	// CallerToken is the access token the caller is authenticated with, if
+	// any; see authorizeOperation.
+	CallerToken *storage.AccessTokenData
 	// TODO: remove Method from here, use HttpReq.Method instead
 	//       (it is already populated correctly from websocket request)
 	Method string
@@ -28,6 +31,12 @@ type GMRequest struct {
 	Body   io.ReadCloser
 }
 
+// Context returns the context of the request; it's done when the client
+// goes away or when the request times out.
+func (gmr *GMRequest) Context() context.Context {
+	return gmr.HttpReq.Context()
+}
+
 func (gmr *GMRequest) FormValue(key string) string {
 	if vs := gmr.Values[key]; len(vs) > 0 {
 		return vs[0]
@@ -54,19 +63,22 @@ func makeGMRequestFromHttpRequest(
 	}
 
 	gmr := &GMRequest{
-		HttpReq:  r,
-		SubjUser: subjUser,
-		Caller:   getAuthnUserDataByReq(r),
-		Method:   r.Method,
-		Values:   map[string][]string(r.Form),
-		Body:     ioutil.NopCloser(bytes.NewReader(b.Bytes())),
+		HttpReq:     r,
+		SubjUser:    subjUser,
+		Caller:      getAuthnUserDataByReq(r),
+		CallerToken: getAuthnTokenDataByReq(r),
+		Method:      r.Method,
+		Values:      map[string][]string(r.Form),
+		Body:        ioutil.NopCloser(bytes.NewReader(b.Bytes())),
 	}
 
 	return gmr, nil
 }
 
 func makeGMRequestFromWebSocketRequest(
-	wsr *WebSocketRequest, caller *storage.UserData, subjUser *storage.UserData,
+	ctx context.Context,
+	wsr *WebSocketRequest, caller *storage.UserData,
+	callerToken *storage.AccessTokenData, subjUser *storage.UserData,
 ) (*GMRequest, error) {
 	values := map[string][]string{}
 	for k, v := range wsr.Values {
@@ -102,17 +114,17 @@ func makeGMRequestFromWebSocketRequest(
 		return nil, errors.Trace(err)
 	}
 
-	ctx := context.Background()
 	ctx = pattern.SetPath(ctx, httpReq.URL.EscapedPath())
 	httpReq = httpReq.WithContext(ctx)
 
 	gmr := &GMRequest{
-		HttpReq:  httpReq,
-		SubjUser: subjUser,
-		Caller:   caller,
-		Method:   wsr.Method,
-		Values:   values,
-		Body:     ioutil.NopCloser(bytes.NewReader(bodyData)),
+		HttpReq:     httpReq,
+		SubjUser:    subjUser,
+		Caller:      caller,
+		CallerToken: callerToken,
+		Method:      wsr.Method,
+		Values:      values,
+		Body:        ioutil.NopCloser(bytes.NewReader(bodyData)),
 	}
 
 	return gmr, nil
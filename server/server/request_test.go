@@ -7,6 +7,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -46,7 +47,9 @@ func TestFromWebSocketRequest(t *testing.T) {
 	caller := &storage.UserData{}
 	subjUser := &storage.UserData{}
 
-	gmr, err := makeGMRequestFromWebSocketRequest(wsr, caller, subjUser)
+	gmr, err := makeGMRequestFromWebSocketRequest(
+		context.Background(), wsr, caller, nil, subjUser,
+	)
 	if err != nil {
 		t.Errorf("error making GMRequest from WebSocketRequest: %s", err)
 	}
@@ -105,7 +108,9 @@ func shouldFail(t *testing.T, str string) {
 	caller := &storage.UserData{}
 	subjUser := &storage.UserData{}
 
-	_, err = makeGMRequestFromWebSocketRequest(wsr, caller, subjUser)
+	_, err = makeGMRequestFromWebSocketRequest(
+		context.Background(), wsr, caller, nil, subjUser,
+	)
 	if err == nil {
 		t.Errorf("should not be able to convert %s", str)
 	}
@@ -6,6 +6,7 @@
 package server // import "dmitryfrank.com/geekmarks/server/server"
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	goji "goji.io"
 	"goji.io/pat"
@@ -31,16 +33,44 @@ var googleOAuthCredsFile = flag.String(
 	"Path to the file with Google app ID and secret.",
 )
 
+var oidcProvidersFile = flag.String(
+	"geekmarks.oidc_providers_file", "",
+	"Path to the YAML file with OpenID Connect providers: a map from provider "+
+		"name to issuer, client_id, client_secret, and optionally discovery_url "+
+		"and jwks_url.",
+)
+
+var localSignupDisabled = flag.Bool(
+	"geekmarks.disable_signup", false,
+	"If true, new users can't sign up with a username and password; existing "+
+		"users can still log in.",
+)
+
+var requestTimeout = flag.Duration(
+	"geekmarks.request_timeout", 30*time.Second,
+	"Max duration of an API request (or of a single request over a websocket); "+
+		"once it's exceeded, the request is cancelled. Zero means no timeout.",
+)
+
 const (
 	BookmarkID = "bkmid"
+	NoteID     = "noteid"
+	TaggableID = "taggableid"
+	TokenID    = "tokenid"
+	IdentityID = "identityid"
+	GrantID    = "grantid"
 
 	providerGoogle = "google"
+	// providerLocal authenticates users by username and password; unlike
+	// OAuth providers, it doesn't need any creds, so it's always enabled.
+	providerLocal = "local"
 )
 
 type GMServer struct {
 	si             storage.Storage
 	wsMux          *WebSocketMux
 	oauthProviders map[string]*OAuthCreds
+	oidcProviders  map[string]*oidcProvider
 }
 
 func New(si storage.Storage) (*GMServer, error) {
@@ -58,10 +88,24 @@ func New(si storage.Storage) (*GMServer, error) {
 		oauthProviders[providerGoogle] = nil
 	}
 
+	oidcProviders := map[string]*oidcProvider{}
+
+	if *oidcProvidersFile != "" {
+		configs, err := ReadOIDCProvidersFile(*oidcProvidersFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for name, config := range configs {
+			oidcProviders[name] = newOIDCProvider(name, config)
+		}
+	}
+
 	gm := GMServer{
 		si:             si,
 		wsMux:          &WebSocketMux{},
 		oauthProviders: oauthProviders,
+		oidcProviders:  oidcProviders,
 	}
 	return &gm, nil
 }
@@ -78,7 +122,13 @@ func setUserEndpoint(
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
-			return uh(gmr)
+
+			resp, err = uh(gmr)
+			if err != nil {
+				return nil, errors.Trace(wrapCtxError(r.Context(), err))
+			}
+
+			return resp, nil
 		}
 	}
 
@@ -101,6 +151,7 @@ func (gm *GMServer) CreateHandler() (http.Handler, error) {
 	rRoot.Handle(pat.New("/api/*"), rAPI)
 	{
 		rAPI.Use(hh.MakeDesiredContentTypeMiddleware("application/json"))
+		rAPI.Use(gm.requestTimeoutMiddleware)
 		// We use authnMiddleware here and not on the root router above, since we
 		// need hh.MakeDesiredContentTypeMiddleware to go before it.
 		rAPI.Use(gm.authnMiddleware)
@@ -198,10 +249,65 @@ func (gm *GMServer) setupUserAPIEndpoints(mux *goji.Mux, gsu getSubjUser) {
 	setUserEndpoint(pat.Get("/bookmarks"), gm.userBookmarksGet, gm.wsMux, mux, gsu)
 	setUserEndpoint(pat.Post("/bookmarks"), gm.userBookmarksPost, gm.wsMux, mux, gsu)
 	mux.HandleFunc(pat.Options("/bookmarks"), gm.createOptionsHandler("GET", "POST"))
+	// Should go before "/bookmarks/:bkmid"
+	setUserEndpoint(pat.Get("/bookmarks/duplicates"), gm.userBookmarkDuplicatesGet, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/bookmarks/duplicates"), gm.createOptionsHandler("GET"))
+	setUserEndpoint(pat.Post("/bookmarks/duplicates/merge"), gm.userBookmarkDuplicatesMerge, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/bookmarks/duplicates/merge"), gm.createOptionsHandler("POST"))
 	setUserEndpoint(pat.Get("/bookmarks/:"+BookmarkID), gm.userBookmarkGet, gm.wsMux, mux, gsu)
 	setUserEndpoint(pat.Put("/bookmarks/:"+BookmarkID), gm.userBookmarkPut, gm.wsMux, mux, gsu)
 	setUserEndpoint(pat.Delete("/bookmarks/:"+BookmarkID), gm.userBookmarkDelete, gm.wsMux, mux, gsu)
 	mux.HandleFunc(pat.Options("/bookmarks/:"+BookmarkID), gm.createOptionsHandler("GET", "PUT", "DELETE"))
+	setUserEndpoint(pat.Get("/bookmarks/:"+BookmarkID+"/history"), gm.userBookmarkHistoryGet, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/bookmarks/:"+BookmarkID+"/history"), gm.createOptionsHandler("GET"))
+	setUserEndpoint(pat.Post("/bookmarks/:"+BookmarkID+"/revert"), gm.userBookmarkRevert, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/bookmarks/:"+BookmarkID+"/revert"), gm.createOptionsHandler("POST"))
+
+	setUserEndpoint(pat.Get("/notes"), gm.userNotesGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Post("/notes"), gm.userNotesPost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/notes"), gm.createOptionsHandler("GET", "POST"))
+	setUserEndpoint(pat.Get("/notes/:"+NoteID), gm.userNoteGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Put("/notes/:"+NoteID), gm.userNotePut, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Delete("/notes/:"+NoteID), gm.userNoteDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/notes/:"+NoteID), gm.createOptionsHandler("GET", "PUT", "DELETE"))
+
+	setUserEndpoint(pat.Get("/taggables"), gm.userTaggablesGet, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/taggables"), gm.createOptionsHandler("GET"))
+
+	setUserEndpoint(pat.Get("/trash"), gm.userTrashGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Delete("/trash"), gm.userTrashDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/trash"), gm.createOptionsHandler("GET", "DELETE"))
+	setUserEndpoint(pat.Delete("/trash/:"+TaggableID), gm.userTrashItemDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/trash/:"+TaggableID), gm.createOptionsHandler("DELETE"))
+	setUserEndpoint(pat.Post("/trash/:"+TaggableID+"/restore"), gm.userTrashItemRestore, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/trash/:"+TaggableID+"/restore"), gm.createOptionsHandler("POST"))
+
+	setUserEndpoint(pat.Get("/tokens"), gm.userTokensGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Post("/tokens"), gm.userTokensPost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/tokens"), gm.createOptionsHandler("GET", "POST"))
+	setUserEndpoint(pat.Delete("/tokens/:"+TokenID), gm.userTokenDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/tokens/:"+TokenID), gm.createOptionsHandler("DELETE"))
+
+	setUserEndpoint(pat.Put("/password"), gm.userPasswordPut, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/password"), gm.createOptionsHandler("PUT"))
+
+	setUserEndpoint(pat.Get("/identities"), gm.userIdentitiesGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Post("/identities"), gm.userIdentitiesPost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/identities"), gm.createOptionsHandler("GET", "POST"))
+	setUserEndpoint(pat.Delete("/identities/:"+IdentityID), gm.userIdentityDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/identities/:"+IdentityID), gm.createOptionsHandler("DELETE"))
+
+	setUserEndpoint(pat.Post("/merge"), gm.userMergePost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/merge"), gm.createOptionsHandler("POST"))
+
+	setUserEndpoint(pat.Get("/grants"), gm.userGrantsGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Post("/grants"), gm.userGrantsPost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/grants"), gm.createOptionsHandler("GET", "POST"))
+	setUserEndpoint(pat.Delete("/grants/:"+GrantID), gm.userGrantDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/grants/:"+GrantID), gm.createOptionsHandler("DELETE"))
+
+	setUserEndpoint(pat.Get("/shared"), gm.userSharedGet, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/shared"), gm.createOptionsHandler("GET"))
 
 	setUserEndpoint(pat.Get("/add_test_tags_tree"), gm.addTestTagsTree, gm.wsMux, mux, gsu)
 
@@ -225,7 +331,7 @@ func (gm *GMServer) getUserFromURLParam(r *http.Request) (*storage.UserData, err
 	}
 
 	var ud *storage.UserData
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(r.Context(), func(tx *sql.Tx) error {
 		var err error
 		ud, err = gm.si.GetUser(tx, &storage.GetUserArgs{
 			ID: cptr.Int(userid),
@@ -280,3 +386,29 @@ func (gm *GMServer) allowOriginMiddleware(inner http.Handler) http.Handler {
 	}
 	return middleware.MkMiddleware(mw)
 }
+
+// Middleware which sets a deadline for the request, see requestTimeout. The
+// request context is passed to the storage, so once the deadline is exceeded
+// (or the client goes away), database queries are cancelled.
+func (gm *GMServer) requestTimeoutMiddleware(inner http.Handler) http.Handler {
+	mw := func(w http.ResponseWriter, r *http.Request) {
+		if *requestTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		inner.ServeHTTP(w, r)
+	}
+	return middleware.MkMiddleware(mw)
+}
+
+// wrapCtxError returns err as is if ctx is still active; otherwise, it's most
+// likely that err happened because the context was done, so a timeout error
+// is returned, wrapping err.
+func wrapCtxError(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+
+	return hh.MakeTimeoutError(err)
+}
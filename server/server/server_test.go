@@ -140,7 +140,9 @@ func (be *testBackendHTTP) DoReq(
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -495,7 +497,7 @@ func runWithRealDBAndBackend(
 	}
 
 	// Before running tests, check database integrity, just in case (for all users)
-	err = si.CheckIntegrity()
+	err = storage.CheckIntegrity(si)
 	if err != nil {
 		t.Errorf("%s", interrors.ErrorStack(err))
 		return
@@ -519,7 +521,7 @@ func runWithRealDBAndBackend(
 	}
 
 	// After test function ran, check database integrity (for all users)
-	err = si.CheckIntegrity()
+	err = storage.CheckIntegrity(si)
 	if err != nil {
 		t.Errorf("%s", interrors.ErrorStack(err))
 		return
@@ -570,6 +572,49 @@ func TestUnauthorized(t *testing.T) {
 	})
 }
 
+func TestRequestTimeout(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		userID, token, err := testutils.CreateTestUser(si, "test1", "1@1.1")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		be.UserCreated(userID, "test1", token)
+
+		// With a tiny timeout, the deadline is exceeded before the request gets
+		// to the storage, so every request fails
+		err = func() error {
+			origTimeout := *requestTimeout
+			*requestTimeout = time.Nanosecond
+			defer func() {
+				*requestTimeout = origTimeout
+			}()
+
+			resp, err := be.DoUserReq("GET", "/tags", userID, nil, false)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return errors.Trace(expectErrorResp(
+				resp, http.StatusServiceUnavailable, "request timed out",
+			))
+		}()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// And with the normal timeout, it works again
+		if _, err := be.DoUserReq("GET", "/tags", userID, nil, true); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := be.DeleteUser(userID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
 func expectHTTPCode(resp *genericResp, code int) error {
 	if resp.StatusCode != code {
 		body, err := ioutil.ReadAll(resp.Body)
@@ -674,7 +719,7 @@ func runPerUserTest(
 		return errors.Trace(err)
 	}
 
-	if err := si.CheckIntegrity(); err != nil {
+	if err := storage.CheckIntegrity(si); err != nil {
 		return errors.Trace(err)
 	}
 
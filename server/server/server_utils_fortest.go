@@ -28,12 +28,14 @@ type testUserDeleteResp struct {
 }
 
 func (gm *GMServer) testUserDelete(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		err = gm.si.DeleteUser(tx, gmr.SubjUser.ID)
 		if err != nil {
 			return errors.Trace(err)
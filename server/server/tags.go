@@ -16,9 +16,9 @@ import (
 
 	"dmitryfrank.com/geekmarks/server/cptr"
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
-	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/storage"
 	"dmitryfrank.com/geekmarks/server/tagmatcher"
+	"github.com/dimonomid/interrors"
 
 	"github.com/golang/glog"
 	"github.com/juju/errors"
@@ -38,6 +38,16 @@ const (
 	QSArgNewLeafPolicyKeep = "keep"
 	QSArgNewLeafPolicyDel  = "del"
 
+	QSArgDryRun = "dry_run"
+
+	// GET /tags/{path}?history=1 returns the history of the tag
+	QSArgTagsHistory = "history"
+
+	// POST /tags/{path}?merge_into=1 merges the tag into another one, and
+	// POST /tags/{path}?copy_to=1 copies it under another one
+	QSArgTagsMergeInto = "merge_into"
+	QSArgTagsCopyTo    = "copy_to"
+
 	// In flat tags response, index at which new tag suggestion gets inserted
 	// (if QSArgTagsAllowNew was equal to "1")
 	newTagSuggestionIndex = 1
@@ -163,14 +173,63 @@ type userTagPutArgs struct {
 type userTagPutResp struct {
 }
 
+type userTagMergeIntoArgs struct {
+	// Either TargetTagID or TargetTagPath should be given
+	TargetTagID   *int    `json:"targetTagID"`
+	TargetTagPath *string `json:"targetTagPath"`
+}
+
+type userTagMergeIntoResp struct {
+	// Id of the target tag
+	TagID int `json:"tagID"`
+}
+
+type userTagCopyToArgs struct {
+	// Either TargetTagID or TargetTagPath should be given: the copy is created
+	// under that tag
+	TargetTagID   *int    `json:"targetTagID"`
+	TargetTagPath *string `json:"targetTagPath"`
+	// Optional names of the copy; by default, names of the source tag are used
+	Names []string `json:"names"`
+	// If true, taggables tagged with the original tags get tagged with their
+	// copies as well
+	Retag bool `json:"retag"`
+}
+
+type userTagCopyToResp struct {
+	// Id of the copy
+	TagID int `json:"tagID"`
+}
+
 type userTagDeleteResp struct {
+	// True if nothing was actually deleted
+	DryRun bool `json:"dryRun"`
+	// Taggables which were tagged with the deleted tag or its subtags, and
+	// stay tagged with some other tags
+	RetaggedIDs []int `json:"retaggedIDs"`
+	// Taggables which become untagged
+	UntaggedIDs []int `json:"untaggedIDs"`
 }
 
 func (gm *GMServer) getTagIDFromPath(
 	gmr *GMRequest, tx *sql.Tx, ownerID int, createNonExisting bool,
 ) (int, error) {
-	parentTagID := 0
+	tagPath, err := getTagPathFromRequest(gmr)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
 
+	tagID, err := gm.getTagIDByPath(gmr, tx, ownerID, tagPath, createNonExisting)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return tagID, nil
+}
+
+// getTagPathFromRequest returns the tag path from the request URL, i.e. the
+// part after /tags.
+func getTagPathFromRequest(gmr *GMRequest) (string, error) {
 	tagPath := pattern.Path(gmr.HttpReq.Context())
 
 	// A hack for the Swagger spec path parameter to work. There's no support for
@@ -183,9 +242,46 @@ func (gm *GMServer) getTagIDFromPath(
 	// TODO(dfrank) remove it when Swagger spec supports wildcard path parameters
 	tagPath, err := url.QueryUnescape(tagPath)
 	if err != nil {
-		return 0, errors.Annotatef(err, "wrong tag path")
+		return "", errors.Annotatef(err, "wrong tag path")
+	}
+
+	return tagPath, nil
+}
+
+// getTagIDByPath returns the id of the tag with the given path, which might
+// also be a tag id, like "/123".
+func (gm *GMServer) getTagIDByPath(
+	gmr *GMRequest, tx *sql.Tx, ownerID int, tagPath string, createNonExisting bool,
+) (int, error) {
+	tagID, err := gm.resolveTagPath(gmr, tx, ownerID, tagPath, createNonExisting)
+	if err != nil {
+		return 0, errors.Trace(hideMissingTag(gmr.Caller, ownerID, err))
+	}
+
+	// If the caller's token is restricted to a subtree, the tag has to be
+	// within it. Tags created above are then outside of it as well, and they
+	// are rolled back together with the transaction. If the caller is not the
+	// owner (which is only possible if the handler allows shared tags), the
+	// tag has to be within a subtree shared with the caller.
+	err = gm.authorizeTagsOperation(tx, gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID:     ownerID,
+		AllowShared: true,
+		TagID:       tagID,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
 	}
 
+	return tagID, nil
+}
+
+// resolveTagPath is like getTagIDByPath, but it doesn't check whether the
+// caller can access the tag.
+func (gm *GMServer) resolveTagPath(
+	gmr *GMRequest, tx *sql.Tx, ownerID int, tagPath string, createNonExisting bool,
+) (int, error) {
+	parentTagID := 0
+
 	if len(tagPath) > 0 {
 		if parentID, err := strconv.Atoi(tagPath[1:]); err == nil {
 			parentTagData, err := gm.si.GetTag(tx, parentID, &storage.GetTagOpts{})
@@ -193,11 +289,10 @@ func (gm *GMServer) getTagIDFromPath(
 				return 0, errors.Trace(err)
 			}
 
-			err = gm.authorizeOperation(
-				gmr.Caller, &authzArgs{OwnerID: parentTagData.OwnerID},
-			)
-			if err != nil {
-				return 0, errors.Trace(err)
+			// The tag should belong to the given owner; whether the caller can
+			// access it is checked below
+			if parentTagData.OwnerID != ownerID {
+				return 0, hh.MakeForbiddenError()
 			}
 
 			parentTagID = parentID
@@ -242,14 +337,50 @@ func (gm *GMServer) getTagIDFromPath(
 	return parentTagID, nil
 }
 
+// getTagPath returns the path of the tag made of the primary names, like
+// "/foo/bar"; the path of the root tag is "/".
+func (gm *GMServer) getTagPath(tx *sql.Tx, tagID int) (string, error) {
+	names := []string{}
+	for {
+		td, err := gm.si.GetTag(tx, tagID, &storage.GetTagOpts{GetNames: true})
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+
+		if td.ParentTagID == nil || *td.ParentTagID == 0 {
+			break
+		}
+
+		names = append([]string{td.Names[0]}, names...)
+		tagID = *td.ParentTagID
+	}
+
+	return "/" + strings.Join(names, "/"), nil
+}
+
 // userTagsGet is a GET /tags and /tags/* handler
 func (gm *GMServer) userTagsGet(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, AllowSubtree: true, AllowShared: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	reqTagPath, err := getTagPathFromRequest(gmr)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	allowNew := gmr.FormValue(QSArgTagsAllowNew) == "1"
+	if gmr.FormValue(QSArgTagsHistory) == "1" {
+		return gm.userTagHistoryGet(gmr, reqTagPath)
+	}
+
+	// The new tag suggestion is looked up in the whole tree of the owner, so
+	// it would reveal the tags outside of the shared subtrees or of the
+	// subtree the token is restricted to; for such callers, it's not given.
+	allowNew := gmr.FormValue(QSArgTagsAllowNew) == "1" &&
+		gmr.Caller.ID == gmr.SubjUser.ID && tokenRootTagID(gmr.CallerToken) == 0
 
 	// By default, use shape "tree"
 	shape := QSArgTagsShapeTree
@@ -298,14 +429,20 @@ func (gm *GMServer) userTagsGet(gmr *GMRequest) (resp interface{}, err error) {
 	// Try to get cached tree data from the cache struct. If cache does not
 	// contain what we need, we'll need to reach the database, get tree data
 	// from there, and put it to the cache.
+	//
+	// The cache doesn't know about tokens restricted to a subtree and about
+	// shared subtrees, so for them it's bypassed, and the tag is checked when
+	// getting it from the database.
 	tagPath := pattern.Path(gmr.HttpReq.Context())
-	tagData = cache.GetTagData(tagPath, withSubtags)
+	if tokenRootTagID(gmr.CallerToken) == 0 && gmr.Caller.ID == gmr.SubjUser.ID {
+		tagData = cache.GetTagData(tagPath, withSubtags)
+	}
 	if tagData == nil {
 		glog.V(3).Infof(
 			"No tree data cache for user %d, path=%q, withSubtags=%v, creating",
 			gmr.SubjUser.ID, tagPath, withSubtags,
 		)
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			var parentTagID int
 			var err error
 
@@ -508,13 +645,25 @@ func (gm *GMServer) getNewTagSuggestion(
 ) (*userTagDataFlat, error) {
 	var newTagDetails *newTagDetails
 
-	err := gm.si.Tx(func(tx *sql.Tx) error {
+	err := gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
 		newTagDetails, err = gm.getNewTagDetails(gmr, tx, pattern)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
+		// Don't suggest tags which the caller's token can't create
+		if rootTagID := tokenRootTagID(gmr.CallerToken); rootTagID != 0 {
+			ok, err := gm.isTagInSubtree(tx, newTagDetails.ParentTagID, rootTagID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if !ok {
+				return errors.Annotatef(ErrTagSuggestionFailed, "outside of the subtree")
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -589,11 +738,35 @@ func (gm *GMServer) createTagDataFlatInternal(
 }
 
 func (gm *GMServer) userTagsPost(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true, AllowSubtree: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagPath, err := getTagPathFromRequest(gmr)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	mergeInto := gmr.FormValue(QSArgTagsMergeInto) == "1"
+	copyTo := gmr.FormValue(QSArgTagsCopyTo) == "1"
+
+	if mergeInto && copyTo {
+		return nil, errors.Errorf(
+			"%q and %q cannot be given both", QSArgTagsMergeInto, QSArgTagsCopyTo,
+		)
+	}
+
+	if mergeInto {
+		return gm.userTagMergeInto(gmr, tagPath)
+	}
+
+	if copyTo {
+		return gm.userTagCopyTo(gmr, tagPath)
+	}
+
 	decoder := json.NewDecoder(gmr.Body)
 	var args userTagsPostArgs
 	err = decoder.Decode(&args)
@@ -607,7 +780,7 @@ func (gm *GMServer) userTagsPost(gmr *GMRequest) (resp interface{}, err error) {
 
 	tagID := 0
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		parentTagID, err := gm.getTagIDFromPath(
 			gmr, tx, gmr.SubjUser.ID, args.CreateIntermediary,
 		)
@@ -642,7 +815,9 @@ func (gm *GMServer) userTagsPost(gmr *GMRequest) (resp interface{}, err error) {
 }
 
 func (gm *GMServer) userTagPut(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true, AllowSubtree: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -658,7 +833,11 @@ func (gm *GMServer) userTagPut(gmr *GMRequest) (resp interface{}, err error) {
 		)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	// Moving a tag involves checking that the new parent is not a descendant of
+	// the tag; with a weaker isolation level, two concurrent moves could both
+	// pass the check and make a cycle. NOTE: the transaction may be retried, so
+	// the function should not have side effects other than via tx.
+	err = gm.si.TxOptCtx(gmr.Context(), storage.TxILevelSerializable, storage.TxModeReadWrite, func(tx *sql.Tx) error {
 		tagID, err := gm.getTagIDFromPath(
 			gmr, tx, gmr.SubjUser.ID, false,
 		)
@@ -678,7 +857,10 @@ func (gm *GMServer) userTagPut(gmr *GMRequest) (resp interface{}, err error) {
 				return errors.Trace(err)
 			}
 
-			err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: newParentTag.OwnerID})
+			err = gm.authorizeTagsOperation(tx, gmr.Caller, gmr.CallerToken, &authzArgs{
+				OwnerID: newParentTag.OwnerID,
+				TagIDs:  []int{newParentTag.ID},
+			})
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -720,8 +902,164 @@ func (gm *GMServer) userTagPut(gmr *GMRequest) (resp interface{}, err error) {
 	return resp, nil
 }
 
+// userTagMergeInto is a POST /tags/{path}?merge_into=1 handler
+func (gm *GMServer) userTagMergeInto(
+	gmr *GMRequest, tagPath string,
+) (resp interface{}, err error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userTagMergeIntoArgs
+	err = decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if err := checkTargetTagArgs(args.TargetTagID, args.TargetTagPath); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	targetTagID := 0
+
+	// Merging retags the affected taggables according to the current tags
+	// hierarchy, and checks that the target is not a descendant of the source,
+	// so it must not interleave with concurrent moves.
+	err = gm.si.TxOptCtx(gmr.Context(), storage.TxILevelSerializable, storage.TxModeReadWrite, func(tx *sql.Tx) error {
+		tagID, err := gm.getTagIDByPath(gmr, tx, gmr.SubjUser.ID, tagPath, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		targetTagID, err = gm.getTargetTagID(
+			gmr, tx, args.TargetTagID, args.TargetTagPath,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.si.MergeTags(tx, tagID, targetTagID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Invalidate tree cache for the user
+	userIDToTagsTree.DeleteCacheForUser(gmr.SubjUser.ID)
+
+	resp = userTagMergeIntoResp{
+		TagID: targetTagID,
+	}
+
+	return resp, nil
+}
+
+// userTagCopyTo is a POST /tags/{path}?copy_to=1 handler
+func (gm *GMServer) userTagCopyTo(
+	gmr *GMRequest, tagPath string,
+) (resp interface{}, err error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userTagCopyToArgs
+	err = decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if err := checkTargetTagArgs(args.TargetTagID, args.TargetTagPath); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	copyTagID := 0
+
+	// Retagging depends on the current tags hierarchy, so copying must not
+	// interleave with concurrent moves.
+	err = gm.si.TxOptCtx(gmr.Context(), storage.TxILevelSerializable, storage.TxModeReadWrite, func(tx *sql.Tx) error {
+		tagID, err := gm.getTagIDByPath(gmr, tx, gmr.SubjUser.ID, tagPath, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		targetTagID, err := gm.getTargetTagID(
+			gmr, tx, args.TargetTagID, args.TargetTagPath,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		copyTagID, err = gm.si.CopyTag(tx, tagID, targetTagID, args.Names, args.Retag)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Invalidate tree cache for the user
+	userIDToTagsTree.DeleteCacheForUser(gmr.SubjUser.ID)
+
+	resp = userTagCopyToResp{
+		TagID: copyTagID,
+	}
+
+	return resp, nil
+}
+
+// checkTargetTagArgs checks that exactly one of the target tag id and path is
+// given; used by operations which involve two tags, like merging or copying.
+func checkTargetTagArgs(targetTagID *int, targetTagPath *string) error {
+	if (targetTagID == nil) == (targetTagPath == nil) {
+		return errors.Errorf(
+			"exactly one of %q and %q should be given", "targetTagID", "targetTagPath",
+		)
+	}
+
+	return nil
+}
+
+// getTargetTagID returns the id of the target tag given either by id or by
+// path (see checkTargetTagArgs), and checks that the caller has access to it.
+func (gm *GMServer) getTargetTagID(
+	gmr *GMRequest, tx *sql.Tx, targetTagID *int, targetTagPath *string,
+) (int, error) {
+	if targetTagID != nil {
+		targetTag, err := gm.si.GetTag(tx, *targetTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		err = gm.authorizeTagsOperation(tx, gmr.Caller, gmr.CallerToken, &authzArgs{
+			OwnerID: targetTag.OwnerID,
+			TagIDs:  []int{targetTag.ID},
+		})
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		return targetTag.ID, nil
+	}
+
+	tagID, err := gm.getTagIDByPath(gmr, tx, gmr.SubjUser.ID, *targetTagPath, false)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return tagID, nil
+}
+
 func (gm *GMServer) userTagDelete(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true, AllowSubtree: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -738,14 +1076,13 @@ func (gm *GMServer) userTagDelete(gmr *GMRequest) (resp interface{}, err error)
 		return nil, errors.Trace(err)
 	}
 
-	if leafPolicy != storage.TaggableLeafPolicyKeep {
-		return nil, errors.Annotatef(
-			hh.MakeNotImplementedError(),
-			"so far %q can only be %q", QSArgNewLeafPolicy, QSArgNewLeafPolicyKeep,
-		)
-	}
+	dryRun := gmr.FormValue(QSArgDryRun) == "1"
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	var result *storage.TagDeleteResult
+
+	// Deletion retags the affected taggables according to the current tags
+	// hierarchy, so it must not interleave with concurrent moves.
+	err = gm.si.TxOptCtx(gmr.Context(), storage.TxILevelSerializable, storage.TxModeReadWrite, func(tx *sql.Tx) error {
 		tagID, err := gm.getTagIDFromPath(
 			gmr, tx, gmr.SubjUser.ID, false,
 		)
@@ -753,7 +1090,7 @@ func (gm *GMServer) userTagDelete(gmr *GMRequest) (resp interface{}, err error)
 			return errors.Trace(err)
 		}
 
-		err = gm.si.DeleteTag(tx, tagID, leafPolicy)
+		result, err = gm.si.DeleteTag(tx, tagID, leafPolicy, dryRun)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -764,10 +1101,16 @@ func (gm *GMServer) userTagDelete(gmr *GMRequest) (resp interface{}, err error)
 		return nil, errors.Trace(err)
 	}
 
-	// Invalidate tree cache for the user
-	userIDToTagsTree.DeleteCacheForUser(gmr.SubjUser.ID)
+	if !dryRun {
+		// Invalidate tree cache for the user
+		userIDToTagsTree.DeleteCacheForUser(gmr.SubjUser.ID)
+	}
 
-	resp = userTagDeleteResp{}
+	resp = userTagDeleteResp{
+		DryRun:      dryRun,
+		RetaggedIDs: result.RetaggedIDs,
+		UntaggedIDs: result.UntaggedIDs,
+	}
 
 	return resp, nil
 }
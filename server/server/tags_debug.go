@@ -30,11 +30,13 @@ func (gm *GMServer) addBookmark(
 	}
 
 	if gmr.FormValue(skipBkm) == "" {
+		url := fmt.Sprintf("https://google.com?q=%s", title)
 		bkmID, err := gm.si.CreateBookmark(tx, &storage.BookmarkData{
-			OwnerID: gmr.SubjUser.ID,
-			URL:     fmt.Sprintf("https://google.com?q=%s", title),
-			Title:   title,
-			Comment: comment,
+			OwnerID:      gmr.SubjUser.ID,
+			URL:          url,
+			CanonicalURL: canonicalizeURL(url),
+			Title:        title,
+			Comment:      comment,
 		})
 		if err != nil {
 			return 0, errors.Trace(err)
@@ -50,7 +52,9 @@ func (gm *GMServer) addBookmark(
 }
 
 func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error) {
-	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -58,7 +62,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 	var tagIDProgC, tagIDUdev, tagIDKernel, tagIDProgGo, tagIDBike, tagIDKayak int
 
 	{
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "")
 			if err != nil {
 				return errors.Trace(err)
@@ -80,7 +84,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 		}
 
 		{
-			err = gm.si.Tx(func(tx *sql.Tx) error {
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 				parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer")
 				if err != nil {
 					return errors.Trace(err)
@@ -102,7 +106,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -126,7 +130,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -149,7 +153,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -172,7 +176,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -195,7 +199,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -219,7 +223,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 		}
 
 		{
-			err = gm.si.Tx(func(tx *sql.Tx) error {
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 				parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer")
 				if err != nil {
 					return errors.Trace(err)
@@ -241,7 +245,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/linux")
 					if err != nil {
 						return errors.Trace(err)
@@ -264,7 +268,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/linux")
 					if err != nil {
 						return errors.Trace(err)
@@ -287,7 +291,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/linux")
 					if err != nil {
 						return errors.Trace(err)
@@ -313,7 +317,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 	}
 
 	{
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "")
 			if err != nil {
 				return errors.Trace(err)
@@ -335,7 +339,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 		}
 
 		{
-			err = gm.si.Tx(func(tx *sql.Tx) error {
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 				parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "life")
 				if err != nil {
 					return errors.Trace(err)
@@ -357,7 +361,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "life/sports")
 					if err != nil {
 						return errors.Trace(err)
@@ -380,7 +384,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "life/sports")
 					if err != nil {
 						return errors.Trace(err)
@@ -405,7 +409,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
 		_, err = gm.addBookmark(gmr, tx, "Something about C", "", []int{tagIDProgC})
 		if err != nil {
@@ -294,7 +294,8 @@ type tagIDs struct {
 // │           └── tag6
 // ├── tag2
 // └── tag7
-//     └── tag8
+//
+//	   └── tag8
 func makeTestTagsHierarchy(be testBackend, userID int) (ids *tagIDs, err error) {
 	ids = &tagIDs{}
 	ids.tag1ID, err = addTag(
@@ -1163,7 +1164,7 @@ func perUserTestTagsMovingDelLeafs(
 		return errors.Trace(err)
 	}
 
-	if err := si.CheckIntegrity(); err != nil {
+	if err := storage.CheckIntegrity(si); err != nil {
 		return errors.Trace(err)
 	}
 
@@ -1269,7 +1270,7 @@ func perUserTestTagsMovingKeepLeafs(
 		return errors.Trace(err)
 	}
 
-	if err := si.CheckIntegrity(); err != nil {
+	if err := storage.CheckIntegrity(si); err != nil {
 		return errors.Trace(err)
 	}
 
@@ -1432,6 +1433,11 @@ func TestTagsDeletion(t *testing.T) {
 			return errors.Trace(err)
 		}
 
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTagsDeletionDelLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
 		return nil
 	})
 }
@@ -1475,7 +1481,7 @@ func perUserTestTagsDeletion(
 		return errors.Trace(err)
 	}
 
-	if err := si.CheckIntegrity(); err != nil {
+	if err := storage.CheckIntegrity(si); err != nil {
 		return errors.Trace(err)
 	}
 
@@ -1573,7 +1579,7 @@ func perUserTestTagsDeletion(
 	if err := deleteTag(be, "/tags/tag1", u1.id, "keep"); err != nil {
 		return errors.Trace(err)
 	}
-	if err := si.CheckIntegrity(); err != nil {
+	if err := storage.CheckIntegrity(si); err != nil {
 		return errors.Trace(err)
 	}
 	_, err = checkBkmGet(
@@ -1702,6 +1708,423 @@ func perUserTestTagsDeletion(
 	return nil
 }
 
+func perUserTestTagsDeletionDelLeafs(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_2",
+		TagIDs: []int{tagIDs.tag2ID, tagIDs.tag6ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	deleteTag3 := func(dryRun bool) error {
+		qsVals := url.Values{}
+		qsVals.Add("new_leaf_policy", "del")
+		if dryRun {
+			qsVals.Add("dry_run", "1")
+		}
+
+		resp, err := be.DoUserReq(
+			"DELETE", "/tags/tag1/tag3?"+qsVals.Encode(), u1.id, nil, true,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var respData map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+			return errors.Trace(err)
+		}
+
+		// tag1 becomes a new leaf of both bookmarks and gets deleted, so bkm1
+		// becomes untagged
+		expected := map[string]interface{}{
+			"dryRun":      dryRun,
+			"retaggedIDs": []interface{}{float64(bkm2ID)},
+			"untaggedIDs": []interface{}{float64(bkm1ID)},
+		}
+		if !reflect.DeepEqual(respData, expected) {
+			return errors.Errorf("dryRun=%v: expected %v, got %v", dryRun, expected, respData)
+		}
+
+		return nil
+	}
+
+	// Dry run doesn't change anything
+	if err := deleteTag3(true); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkTagsGet(be, u1.id, "tag3", false, []string{
+		"/tag1/tag3_alias",
+		"/tag1/tag3_alias/tag4",
+		"/tag1/tag3_alias/tag5",
+		"/tag1/tag3_alias/tag5/tag6",
+	}); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{}}, []int{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := deleteTag3(false); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := storage.CheckIntegrity(si); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkTagsGet(be, u1.id, "tag3", false, []string{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{}}, []int{bkm1ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag1ID}}, []int{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag2ID}}, []int{bkm2ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test tags merging {{{
+func TestTagsMerging(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTagsMerging)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestTagsMerging(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2TagIDs, err := makeTestTagsHierarchy(be, u2.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_2",
+		TagIDs: []int{tagIDs.tag2ID, tagIDs.tag6ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Merge /tag1/tag3 into /tag7
+	resp, err := be.DoUserReq(
+		"POST", "/tags/tag1/tag3?merge_into=1", u1.id,
+		H{"targetTagPath": "/tag7"}, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var respMap map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&respMap); err != nil {
+		return errors.Trace(err)
+	}
+	if respMap["tagID"] != float64(tagIDs.tag7ID) {
+		return errors.Errorf("expected tagID %d, got %v", tagIDs.tag7ID, respMap)
+	}
+
+	if err := storage.CheckIntegrity(si); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkTagsGet(be, u1.id, "tag4", false, []string{"/tag7/tag4"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag7ID}}, []int{bkm1ID, bkm2ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag1ID}}, []int{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Merge /tag2 into /tag7 by id; now /tag7 can be referred to as /tag2 as
+	// well
+	_, err = be.DoUserReq(
+		"POST", "/tags/tag2?merge_into=1", u1.id,
+		H{"targetTagID": tagIDs.tag7ID}, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag7ID}}, []int{bkm1ID, bkm2ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkTagsGet(be, u1.id, "tag2/tag5", false, []string{"/tag2/tag5", "/tag2/tag5/tag6"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Invalid merges
+	for _, tc := range []struct {
+		path    string
+		args    H
+		code    int
+		message string
+	}{
+		{
+			"/tags/tag7?merge_into=1", H{"targetTagID": tagIDs.tag8ID}, http.StatusBadRequest,
+			"tag cannot be merged into itself or one of its descendants",
+		},
+		{
+			"/tags/tag7?merge_into=1", H{"targetTagPath": "/tag7/tag5/tag6"}, http.StatusBadRequest,
+			"tag cannot be merged into itself or one of its descendants",
+		},
+		{
+			"/tags/tag7?merge_into=1", H{}, http.StatusBadRequest,
+			`exactly one of "targetTagID" and "targetTagPath" should be given`,
+		},
+		{
+			"/tags/tag7/tag8?merge_into=1", H{"targetTagID": u2TagIDs.tag1ID}, http.StatusForbidden,
+			"forbidden",
+		},
+	} {
+		resp, err := be.DoUserReq("POST", tc.path, u1.id, tc.args, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, tc.code, tc.message); err != nil {
+			return errors.Annotatef(err, "merging %s with %v", tc.path, tc.args)
+		}
+	}
+
+	// Subtags of a tag named "merge_into" can be created by its path
+	if _, err := addTag(be, "/tags/tag7", u1.id, []string{"merge_into"}, "", false); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = addTag(be, "/tags/tag7/merge_into", u1.id, []string{"sub"}, "", false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkTagsGet(be, u1.id, "merge_into/sub", false, []string{"/tag7/merge_into/sub"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test tags copying {{{
+func TestTagsCopying(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTagsCopying)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestTagsCopying(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2TagIDs, err := makeTestTagsHierarchy(be, u2.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_2",
+		TagIDs: []int{tagIDs.tag2ID, tagIDs.tag6ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Copy /tag1/tag3 under /tag7, without retagging
+	resp, err := be.DoUserReq(
+		"POST", "/tags/tag1/tag3?copy_to=1", u1.id,
+		H{"targetTagPath": "/tag7"}, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var respMap map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&respMap); err != nil {
+		return errors.Trace(err)
+	}
+	if _, ok := respMap["tagID"].(float64); !ok {
+		return errors.Errorf("expected tagID in the response, got %v", respMap)
+	}
+
+	if err := storage.CheckIntegrity(si); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkTagsGet(be, u1.id, "tag4", false, []string{
+		"/tag1/tag3_alias/tag4", "/tag7/tag3_alias/tag4",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag7ID}}, []int{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Copy /tag1/tag3 under /tag7/tag8 by id, with another name and retagging
+	_, err = be.DoUserReq(
+		"POST", "/tags/tag1/tag3?copy_to=1", u1.id,
+		H{"targetTagID": tagIDs.tag8ID, "names": []string{"tag3_copy"}, "retag": true}, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkTagsGet(be, u1.id, "tag3_copy", false, []string{
+		"/tag7/tag8/tag3_copy",
+		"/tag7/tag8/tag3_copy/tag4",
+		"/tag7/tag8/tag3_copy/tag5",
+		"/tag7/tag8/tag3_copy/tag5/tag6",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag8ID}}, []int{bkm1ID, bkm2ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The originals are still tagged
+	_, err = checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag3ID}}, []int{bkm1ID, bkm2ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Invalid copies
+	for _, tc := range []struct {
+		path    string
+		args    H
+		code    int
+		message string
+	}{
+		{
+			"/tags/tag1/tag3?copy_to=1", H{"targetTagPath": "/tag1"}, http.StatusBadRequest,
+			`Tag with the name "tag3_alias" already exists`,
+		},
+		{
+			"/tags/tag7?copy_to=1", H{}, http.StatusBadRequest,
+			`exactly one of "targetTagID" and "targetTagPath" should be given`,
+		},
+		{
+			"/tags/tag7?copy_to=1", H{"targetTagID": u2TagIDs.tag1ID}, http.StatusForbidden,
+			"forbidden",
+		},
+		{
+			"/tags/tag7?copy_to=1&merge_into=1", H{"targetTagPath": "/tag2"}, http.StatusBadRequest,
+			`"merge_into" and "copy_to" cannot be given both`,
+		},
+	} {
+		resp, err := be.DoUserReq("POST", tc.path, u1.id, tc.args, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, tc.code, tc.message); err != nil {
+			return errors.Annotatef(err, "copying %s with %v", tc.path, tc.args)
+		}
+	}
+
+	// Subtags of a tag named "copy_to" can be created by its path
+	if _, err := addTag(be, "/tags/tag2", u1.id, []string{"copy_to"}, "", false); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = addTag(be, "/tags/tag2/copy_to", u1.id, []string{"sub"}, "", false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = checkTagsGet(be, u1.id, "copy_to/sub", false, []string{"/tag2/copy_to/sub"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
 // }}}
 
 type tagData struct {
@@ -0,0 +1,232 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+type userTokenData struct {
+	ID    int                      `json:"id"`
+	Descr string                   `json:"descr"`
+	Scope storage.AccessTokenScope `json:"scope"`
+	// Zero RootTagID means that the token isn't restricted to a subtree.
+	RootTagID int `json:"rootTagID,omitempty"`
+	// Unix timestamps; zero LastUsedAt means that the token was never used,
+	// and zero ExpiresAt means that the token never expires.
+	CreatedAt  uint64 `json:"createdAt"`
+	LastUsedAt uint64 `json:"lastUsedAt"`
+	ExpiresAt  uint64 `json:"expiresAt"`
+	Expired    bool   `json:"expired"`
+}
+
+type userTokenPostArgs struct {
+	Descr string `json:"descr"`
+	// Lifetime of the token in seconds; zero means that it never expires.
+	ExpiresIn uint64 `json:"expiresIn,omitempty"`
+	// Either "read" or "write"; by default, "write".
+	Scope storage.AccessTokenScope `json:"scope,omitempty"`
+	// If either RootTagID or RootTagPath is given, the token can only access
+	// the tags within that subtree, and the bookmarks tagged with them.
+	RootTagID   *int    `json:"rootTagID,omitempty"`
+	RootTagPath *string `json:"rootTagPath,omitempty"`
+}
+
+type userTokenPostResp struct {
+	TokenID   int    `json:"tokenID"`
+	Token     string `json:"token"`
+	ExpiresAt uint64 `json:"expiresAt"`
+}
+
+type userTokenDeleteResp struct {
+}
+
+func (gm *GMServer) userTokensGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var tokens []storage.AccessTokenData
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		tokens, err = gm.si.GetAccessTokens(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	now := uint64(time.Now().Unix())
+
+	tokensUser := []userTokenData{}
+	for _, tok := range tokens {
+		tokensUser = append(tokensUser, userTokenData{
+			ID:         tok.ID,
+			Descr:      tok.Descr,
+			Scope:      tok.Scope,
+			RootTagID:  tok.RootTagID,
+			CreatedAt:  tok.CreatedAt,
+			LastUsedAt: tok.LastUsedAt,
+			ExpiresAt:  tok.ExpiresAt,
+			Expired:    tok.ExpiresAt != 0 && tok.ExpiresAt <= now,
+		})
+	}
+
+	return tokensUser, nil
+}
+
+func (gm *GMServer) userTokensPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args, err := getUserTokenPostArgs(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var expiresAt uint64
+	if args.ExpiresIn != 0 {
+		expiresAt = uint64(time.Now().Unix()) + args.ExpiresIn
+	}
+
+	var tokenID int
+	var token string
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		rootTagID := 0
+		if args.RootTagID != nil || args.RootTagPath != nil {
+			var err error
+			rootTagID, err = gm.getTargetTagID(gmr, tx, args.RootTagID, args.RootTagPath)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		var err error
+		tokenID, token, err = gm.si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID:    gmr.SubjUser.ID,
+			Descr:     args.Descr,
+			Scope:     args.Scope,
+			RootTagID: rootTagID,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userTokenPostResp{
+		TokenID:   tokenID,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	}
+	return resp, nil
+}
+
+// userTokenDelete revokes the token; it can be the token which the request
+// is authenticated with.
+func (gm *GMServer) userTokenDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tokenID, err := getTokenIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		// Make sure it's a token of the user
+		tok, err := gm.si.GetAccessToken(tx, tokenID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if tok.UserID != gmr.SubjUser.ID {
+			return errors.Annotatef(storage.ErrAccessTokenDoesNotExist, "id %d", tokenID)
+		}
+
+		if err := gm.si.DeleteAccessToken(tx, tokenID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userTokenDeleteResp{}
+	return resp, nil
+}
+
+func getUserTokenPostArgs(gmr *GMRequest) (*userTokenPostArgs, error) {
+	decoder := json.NewDecoder(gmr.Body)
+	var args userTokenPostArgs
+	err := decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if args.Descr == "" {
+		return nil, errors.Errorf("descr is required")
+	}
+
+	if args.Scope != "" {
+		if err := storage.ValidateAccessTokenScope(args.Scope); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if args.RootTagID != nil && args.RootTagPath != nil {
+		return nil, errors.Errorf(
+			"%q and %q cannot be given both", "rootTagID", "rootTagPath",
+		)
+	}
+
+	return &args, nil
+}
+
+func getTokenIDFromQueryString(gmr *GMRequest) (int, error) {
+	tokenIDStr := pat.Param(gmr.HttpReq, TokenID)
+	tokenID, err := strconv.Atoi(tokenIDStr)
+	if err != nil {
+		return 0, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong token id %q", tokenIDStr),
+		)
+	}
+	return tokenID, nil
+}
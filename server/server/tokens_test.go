@@ -0,0 +1,525 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/gorilla/websocket"
+	"github.com/juju/errors"
+)
+
+// Test access tokens {{{
+func TestAccessTokens(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestAccessTokens)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestAccessTokens(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	now := uint64(time.Now().Unix())
+
+	resp, err := be.DoUserReq("POST", "/tokens", u1.id, H{
+		"descr":     "extension",
+		"expiresIn": 3600,
+	}, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var postResp userTokenPostResp
+	if err := json.NewDecoder(resp.Body).Decode(&postResp); err != nil {
+		return errors.Trace(err)
+	}
+
+	if postResp.Token == "" || postResp.ExpiresAt < now+3600 {
+		return errors.Errorf("unexpected response: %+v", postResp)
+	}
+
+	// The new token can be used right away
+	if _, err := be.DoReq("GET", "/api/my/tags", postResp.Token, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	// An expired token is rejected
+	var expiredTokenID int
+	var expiredToken string
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		expiredTokenID, expiredToken, err = si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID:    u1.id,
+			Descr:     "expired",
+			ExpiresAt: now - 1,
+		})
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := expectTokenUnauthorized(be, expiredToken); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTokensGet(be, u1.id, []tokenRef{
+		{"test token for a test user", false},
+		{"extension", false},
+		{"expired", true},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTokensGet(be, u2.id, []tokenRef{
+		{"test token for a test user", false},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, tc := range []struct {
+		method  string
+		path    string
+		userID  int
+		args    H
+		message string
+	}{
+		{"POST", "/tokens", u1.id, H{}, "descr is required"},
+		// Tokens of other users can't be revoked
+		{
+			"DELETE", fmt.Sprintf("/tokens/%d", postResp.TokenID), u2.id, nil,
+			fmt.Sprintf("id %d: access token does not exist", postResp.TokenID),
+		},
+	} {
+		resp, err := be.DoUserReq(tc.method, tc.path, tc.userID, tc.args, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusBadRequest, tc.message); err != nil {
+			return errors.Annotatef(err, "%s %s", tc.method, tc.path)
+		}
+	}
+
+	// A WebSocket connection established with the token works until the
+	// token is revoked
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+be.GetTestServer().URL[4:]+"/api/my/wsconnect",
+		http.Header{"Authorization": []string{"Bearer " + postResp.Token}},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	if err := expectWSStatus(conn, "/tags", http.StatusOK); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Revoke tokens
+	for _, id := range []int{postResp.TokenID, expiredTokenID} {
+		_, err := be.DoUserReq("DELETE", fmt.Sprintf("/tokens/%d", id), u1.id, nil, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := expectTokenUnauthorized(be, postResp.Token); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := expectWSStatus(conn, "/tags", http.StatusUnauthorized); err != nil {
+		return errors.Trace(err)
+	}
+
+	// And then the connection is closed
+	if _, _, err := conn.NextReader(); err == nil {
+		return errors.Errorf("WebSocket connection should be closed")
+	}
+
+	err = checkTokensGet(be, u1.id, []tokenRef{
+		{"test token for a test user", false},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test scoped access tokens {{{
+func TestScopedAccessTokens(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestScopedAccessTokens)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestScopedAccessTokens(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tagged both within the /tag1 subtree and outside of it
+	bkmInsideID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_inside",
+		TagIDs: []int{tagIDs.tag4ID, tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmOutsideID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_outside",
+		TagIDs: []int{tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	readToken, err := createScopedToken(be, u1.id, "read", "/tag1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	writeToken, err := createScopedToken(be, u1.id, "write", "/tag1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := be.DoUserReq("GET", "/tokens", u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var tokens []userTokenData
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(tokens) != 3 ||
+		tokens[0].Scope != storage.AccessTokenScopeWrite || tokens[0].RootTagID != 0 ||
+		tokens[1].Scope != storage.AccessTokenScopeRead || tokens[1].RootTagID != tagIDs.tag1ID ||
+		tokens[2].Scope != storage.AccessTokenScopeWrite || tokens[2].RootTagID != tagIDs.tag1ID {
+		return errors.Errorf("unexpected tokens: %+v", tokens)
+	}
+
+	// Both tokens can read within the subtree
+	for _, token := range []string{readToken, writeToken} {
+		for _, path := range []string{
+			"/tags/tag1",
+			"/tags/tag1/tag3",
+			fmt.Sprintf("/tags/%d", tagIDs.tag3ID),
+			fmt.Sprintf("/bookmarks/%d", bkmInsideID),
+		} {
+			_, err := doTokenReq(be, "GET", path, token, nil, http.StatusOK)
+			if err != nil {
+				return errors.Annotatef(err, "GET %s", path)
+			}
+		}
+	}
+
+	// New tags are not suggested, since the suggestion could reveal the tags
+	// outside of the subtree
+	if err := expectNoNewTagSuggestion(
+		be, u1.id, "/tags/tag1?pattern=tag2/new&allow_new=1", readToken,
+	); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Only the bookmarks tagged within the subtree are returned, and only with
+	// the tags within it
+	resp, err = doTokenReq(be, "GET", "/bookmarks", readToken, nil, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var bkms []userBookmarkData
+	if err := json.NewDecoder(resp.Body).Decode(&bkms); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(bkms) != 1 || bkms[0].ID != bkmInsideID ||
+		len(bkms[0].Tags) != 1 || len(bkms[0].Tags[0].Items) != 3 ||
+		bkms[0].Tags[0].Items[2].ID != tagIDs.tag4ID {
+		return errors.Errorf("unexpected bookmarks: %+v", bkms)
+	}
+
+	// Same for the tag query
+	resp, err = doTokenReq(
+		be, "GET", fmt.Sprintf("/bookmarks?query=%d", tagIDs.tag4ID), readToken,
+		nil, http.StatusOK,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkms = nil
+	if err := json.NewDecoder(resp.Body).Decode(&bkms); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(bkms) != 1 || bkms[0].ID != bkmInsideID ||
+		len(bkms[0].Tags) != 1 || len(bkms[0].Tags[0].Items) != 3 ||
+		bkms[0].Tags[0].Items[2].ID != tagIDs.tag4ID {
+		return errors.Errorf("unexpected bookmarks by tag query: %+v", bkms)
+	}
+
+	resp, err = doTokenReq(
+		be, "GET", fmt.Sprintf("/bookmarks/%d", bkmOutsideID), readToken, nil, 0,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = expectErrorResp(
+		resp, http.StatusBadRequest,
+		fmt.Sprintf("id %d: bookmark does not exist", bkmOutsideID),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		token  string
+		args   H
+	}{
+		// Outside of the subtree
+		{"GET", "/tags", readToken, nil},
+		{"GET", "/tags/tag2", readToken, nil},
+		{"GET", fmt.Sprintf("/tags/%d", tagIDs.tag7ID), readToken, nil},
+		{"GET", fmt.Sprintf("/bookmarks?tag_id=%d", tagIDs.tag2ID), readToken, nil},
+		{"POST", "/tags/tag2", writeToken, H{"names": A{"new"}}},
+		{"POST", "/bookmarks", writeToken, H{"url": "new", "tagIDs": A{tagIDs.tag2ID}}},
+		{"PUT", "/tags/tag1/tag3", writeToken, H{"parentTagID": tagIDs.tag2ID, "newLeafPolicy": "keep"}},
+
+		// Read-only token can't modify anything
+		{"POST", "/tags/tag1", readToken, H{"names": A{"new"}}},
+		{"POST", "/bookmarks", readToken, H{"url": "new", "tagIDs": A{tagIDs.tag3ID}}},
+		{"DELETE", fmt.Sprintf("/bookmarks/%d", bkmInsideID), readToken, nil},
+
+		// Handlers which don't know about subtrees can't be used at all
+		{"GET", "/notes", readToken, nil},
+		{"GET", "/trash", writeToken, nil},
+		{"GET", "/tokens", writeToken, nil},
+		{"POST", "/tokens", writeToken, H{"descr": "escalate"}},
+	} {
+		resp, err := doTokenReq(be, tc.method, tc.path, tc.token, tc.args, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusForbidden, "forbidden"); err != nil {
+			return errors.Annotatef(err, "%s %s", tc.method, tc.path)
+		}
+	}
+
+	// Write token can modify things within the subtree
+	_, err = doTokenReq(be, "POST", "/tags/tag1", writeToken, H{
+		"names": A{"new"},
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The tag outside of the subtree is kept
+	_, err = doTokenReq(be, "PUT", fmt.Sprintf("/bookmarks/%d", bkmInsideID), writeToken, H{
+		"url":    "url_inside",
+		"tagIDs": A{tagIDs.tag6ID},
+	}, http.StatusOK)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkBkmGetByID(be, u1.id, bkmInsideID, &bkmData{
+		ID:  bkmInsideID,
+		URL: "url_inside",
+		Tags: []bkmTagData{
+			bkmTagData{
+				Items: []bkmTagDataItem{
+					bkmTagDataItem{ID: tagIDs.tag2ID, Name: "tag2"},
+				},
+			},
+			bkmTagData{
+				Items: []bkmTagDataItem{
+					bkmTagDataItem{ID: tagIDs.tag1ID, Name: "tag1"},
+					bkmTagDataItem{ID: tagIDs.tag3ID, Name: "tag3_alias"},
+					bkmTagDataItem{ID: tagIDs.tag5ID, Name: "tag5"},
+					bkmTagDataItem{ID: tagIDs.tag6ID, Name: "tag6"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Once the root tag is deleted, the tokens are revoked
+	_, err = be.DoUserReq("DELETE", "/tags/tag1?new_leaf_policy=keep", u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, token := range []string{readToken, writeToken} {
+		if err := expectTokenUnauthorized(be, token); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// }}}
+
+// expectWSStatus sends a GET request for the given path over the WebSocket
+// connection, and checks the status of the response.
+func expectWSStatus(conn *websocket.Conn, path string, expectedStatus int) error {
+	if err := conn.WriteJSON(wsReq{Method: "GET", Path: path}); err != nil {
+		return errors.Trace(err)
+	}
+
+	var resp wsResp
+	if err := conn.ReadJSON(&resp); err != nil {
+		return errors.Trace(err)
+	}
+
+	if resp.Status != expectedStatus {
+		return errors.Errorf(
+			"%s: expected status %d, got %d (%v)",
+			path, expectedStatus, resp.Status, resp.Body,
+		)
+	}
+
+	return nil
+}
+
+// createScopedToken creates a new token with the given scope, restricted to
+// the subtree of the tag with the given path (unless it's empty), and returns
+// the token.
+func createScopedToken(
+	be testBackend, userID int, scope, rootTagPath string,
+) (string, error) {
+	args := H{
+		"descr": scope + " " + rootTagPath,
+		"scope": scope,
+	}
+	if rootTagPath != "" {
+		args["rootTagPath"] = rootTagPath
+	}
+
+	resp, err := be.DoUserReq("POST", "/tokens", userID, args, true)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	var postResp userTokenPostResp
+	if err := json.NewDecoder(resp.Body).Decode(&postResp); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return postResp.Token, nil
+}
+
+// doTokenReq performs an HTTP request to the /api/my endpoint with the given
+// token; if expectedCode is not 0, the response status is checked.
+func doTokenReq(
+	be testBackend, method, path, token string, args H, expectedCode int,
+) (*genericResp, error) {
+	data := []byte{}
+	if args != nil {
+		var err error
+		data, err = json.Marshal(args)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	resp, err := be.DoReq(method, "/api/my"+path, token, bytes.NewReader(data), false)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if expectedCode != 0 {
+		if err := expectHTTPCode(resp, expectedCode); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return resp, nil
+}
+
+type tokenRef struct {
+	descr   string
+	expired bool
+}
+
+func checkTokensGet(be testBackend, userID int, expected []tokenRef) error {
+	resp, err := be.DoUserReq("GET", "/tokens", userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var tokens []userTokenData
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return errors.Trace(err)
+	}
+
+	got := []tokenRef{}
+	for _, tok := range tokens {
+		got = append(got, tokenRef{tok.Descr, tok.Expired})
+
+		if tok.CreatedAt == 0 {
+			return errors.Errorf("token %d: createdAt is not set", tok.ID)
+		}
+
+		// Tokens of test users are used by the requests above
+		if tok.Descr == "test token for a test user" && tok.LastUsedAt == 0 {
+			return errors.Errorf("token %d: lastUsedAt is not set", tok.ID)
+		}
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		return errors.Errorf("tokens: expected %+v, got %+v", expected, got)
+	}
+
+	return nil
+}
+
+func expectTokenUnauthorized(be testBackend, token string) error {
+	resp, err := be.DoReq("GET", "/api/my/tags", token, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(expectErrorResp(resp, http.StatusUnauthorized, "unauthorized"))
+}
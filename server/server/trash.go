@@ -0,0 +1,278 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"strconv"
+	"time"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+
+	"github.com/juju/errors"
+)
+
+var trashPurgeDays = flag.Int(
+	"geekmarks.trash_purge_days", 30,
+	"Trashed bookmarks and notes are purged after this number of days. "+
+		"Zero means they are never purged automatically.",
+)
+
+// How often RunTrashPurger checks for the trashed taggables to purge
+const trashPurgeInterval = 1 * time.Hour
+
+type userTrashedTaggableData struct {
+	userTaggableData
+	TrashedAt uint64 `json:"trashedAt"`
+}
+
+type userTrashRestoreResp struct {
+}
+
+type userTrashPurgeResp struct {
+	PurgedIDs []int `json:"purgedIDs"`
+}
+
+func (gm *GMServer) userTrashGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts := storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeLeafs,
+		TagNamesFetchMode: storage.TagNamesFetchModeFull,
+	}
+
+	trashedUser := []userTrashedTaggableData{}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		taggables, err := gm.si.GetTrashedTaggables(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, t := range taggables {
+			item := userTrashedTaggableData{
+				userTaggableData: userTaggableData{
+					Type: string(t.Type),
+				},
+				TrashedAt: t.TrashedAt,
+			}
+
+			switch t.Type {
+			case storage.TaggableTypeBookmark:
+				bkm, err := gm.si.GetBookmarkByID(tx, t.ID, &tagsFetchOpts)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				bkmUser := makeUserBookmarkData(bkm)
+				item.Bookmark = &bkmUser
+
+			case storage.TaggableTypeNote:
+				note, err := gm.si.GetNoteByID(tx, t.ID, &tagsFetchOpts)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				noteUser := makeUserNoteData(note)
+				item.Note = &noteUser
+			}
+
+			trashedUser = append(trashedUser, item)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return trashedUser, nil
+}
+
+func (gm *GMServer) userTrashItemRestore(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	taggableID, err := getTaggableIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if err := gm.checkUserTrashedTaggable(tx, gmr.SubjUser.ID, taggableID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.si.RestoreTaggable(tx, taggableID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userTrashRestoreResp{}
+	return resp, nil
+}
+
+func (gm *GMServer) userTrashItemDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	taggableID, err := getTaggableIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if err := gm.checkUserTrashedTaggable(tx, gmr.SubjUser.ID, taggableID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.si.DeleteTaggable(tx, taggableID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userTrashPurgeResp{
+		PurgedIDs: []int{taggableID},
+	}
+	return resp, nil
+}
+
+// userTrashDelete purges everything from the trash of the user.
+func (gm *GMServer) userTrashDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, gmr.CallerToken, &authzArgs{
+		OwnerID: gmr.SubjUser.ID, Write: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var purgedIDs []int
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		purgedIDs, err = gm.si.PurgeTrash(
+			tx, cptr.Int(gmr.SubjUser.ID), uint64(time.Now().Unix()),
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userTrashPurgeResp{
+		PurgedIDs: purgedIDs,
+	}
+	return resp, nil
+}
+
+// checkUserTrashedTaggable returns an error if the given user doesn't have
+// the taggable with the given id in the trash.
+func (gm *GMServer) checkUserTrashedTaggable(tx *sql.Tx, ownerID, taggableID int) error {
+	taggables, err := gm.si.GetTrashedTaggables(tx, ownerID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, t := range taggables {
+		if t.ID == taggableID {
+			return nil
+		}
+	}
+
+	return errors.Errorf("id %d: taggable is not in the trash", taggableID)
+}
+
+// RunTrashPurger purges taggables which were trashed more than
+// geekmarks.trash_purge_days ago, once in trashPurgeInterval, until the
+// context is done. It's supposed to be run in a separate goroutine.
+func (gm *GMServer) RunTrashPurger(ctx context.Context) {
+	if *trashPurgeDays <= 0 {
+		glog.Infof("Trash purging is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := gm.purgeOldTrash(ctx, time.Now()); err != nil {
+			glog.Errorf("Failed to purge trash: %s", interrors.ErrorStack(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeOldTrash purges taggables of all users which were trashed more than
+// geekmarks.trash_purge_days before the given time.
+func (gm *GMServer) purgeOldTrash(ctx context.Context, now time.Time) error {
+	trashedBefore := now.Add(-time.Duration(*trashPurgeDays) * 24 * time.Hour)
+
+	var purgedIDs []int
+
+	err := gm.si.TxCtx(ctx, func(tx *sql.Tx) error {
+		var err error
+		purgedIDs, err = gm.si.PurgeTrash(tx, nil, uint64(trashedBefore.Unix()))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(purgedIDs) > 0 {
+		glog.Infof("Purged %d taggables from the trash", len(purgedIDs))
+	}
+
+	return nil
+}
+
+func getTaggableIDFromQueryString(gmr *GMRequest) (int, error) {
+	taggableIDStr := pat.Param(gmr.HttpReq, TaggableID)
+	taggableID, err := strconv.Atoi(taggableIDStr)
+	if err != nil {
+		return 0, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong taggable id %q", taggableIDStr),
+		)
+	}
+	return taggableID, nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// Test trash {{{
+func TestTrash(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTrash)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestTrash(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	note1ID, err := addNote(be, u1.id, &noteData{
+		Title:  "note1",
+		TagIDs: []int{tagIDs.tag5ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u2.id, &bkmData{
+		URL: "url_2",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Deleted bookmarks and notes go to the trash
+	for _, path := range []string{
+		fmt.Sprintf("/bookmarks/%d", bkm1ID),
+		fmt.Sprintf("/notes/%d", note1ID),
+	} {
+		if _, err := be.DoUserReq("DELETE", path, u1.id, nil, true); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if _, err := be.DoUserReq("DELETE", fmt.Sprintf("/bookmarks/%d", bkm2ID), u2.id, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTaggablesGet(be, u1.id, []int{tagIDs.tag3ID}, []taggableRef{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The most recently trashed go first
+	err = checkTrashGet(be, u1.id, []taggableRef{
+		{"note", note1ID}, {"bookmark", bkm1ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	notInTrash := func(id int) string {
+		return fmt.Sprintf("id %d: taggable is not in the trash", id)
+	}
+
+	for _, tc := range []struct {
+		method  string
+		path    string
+		args    H
+		message string
+	}{
+		{
+			"GET", fmt.Sprintf("/bookmarks/%d", bkm1ID), nil,
+			fmt.Sprintf("id %d: bookmark does not exist", bkm1ID),
+		},
+		{
+			"PUT", fmt.Sprintf("/bookmarks/%d", bkm1ID), H{"url": "url_1"},
+			fmt.Sprintf("id %d: bookmark does not exist", bkm1ID),
+		},
+		{
+			"GET", fmt.Sprintf("/notes/%d", note1ID), nil,
+			fmt.Sprintf("id %d: note does not exist", note1ID),
+		},
+		// Trash of other users is not accessible
+		{"POST", fmt.Sprintf("/trash/%d/restore", bkm2ID), nil, notInTrash(bkm2ID)},
+		{"DELETE", fmt.Sprintf("/trash/%d", bkm2ID), nil, notInTrash(bkm2ID)},
+	} {
+		resp, err := be.DoUserReq(tc.method, tc.path, u1.id, tc.args, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusBadRequest, tc.message); err != nil {
+			return errors.Annotatef(err, "%s %s", tc.method, tc.path)
+		}
+	}
+
+	// Another bookmark with the same url can be added, but then the trashed one
+	// can't be restored
+	bkm3ID, err := addBookmark(be, u1.id, &bkmData{
+		URL: "url_1",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := be.DoUserReq("POST", fmt.Sprintf("/trash/%d/restore", bkm1ID), u1.id, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = expectErrorResp(resp, http.StatusBadRequest, `bookmark with the url "url_1" already exists`)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := be.DoUserReq("DELETE", fmt.Sprintf("/bookmarks/%d", bkm3ID), u1.id, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := be.DoUserReq("POST", fmt.Sprintf("/trash/%d/restore", bkm1ID), u1.id, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	// The restored bookmark keeps its tags
+	err = checkTaggablesGet(be, u1.id, []int{tagIDs.tag3ID}, []taggableRef{
+		{"bookmark", bkm1ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Purge a single item
+	err = checkTrashPurge(be, u1.id, fmt.Sprintf("/trash/%d", bkm3ID), []int{bkm3ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTrashGet(be, u1.id, []taggableRef{{"note", note1ID}})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Background purging removes only the old enough trash
+	gm := &GMServer{si: si}
+
+	if err := gm.purgeOldTrash(context.Background(), time.Now()); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTrashGet(be, u1.id, []taggableRef{{"note", note1ID}})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = gm.purgeOldTrash(
+		context.Background(), time.Now().Add(time.Duration(*trashPurgeDays+1)*24*time.Hour),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, userID := range []int{u1.id, u2.id} {
+		if err := checkTrashGet(be, userID, []taggableRef{}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Empty the whole trash
+	if _, err := be.DoUserReq("DELETE", fmt.Sprintf("/bookmarks/%d", bkm1ID), u1.id, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTrashPurge(be, u1.id, "/trash", []int{bkm1ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkTrashGet(be, u1.id, []taggableRef{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+func checkTrashGet(be testBackend, userID int, expected []taggableRef) error {
+	resp, err := be.DoUserReq("GET", "/trash", userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var trashed []struct {
+		Type      string    `json:"type"`
+		Bookmark  *bkmData  `json:"bookmark"`
+		Note      *noteData `json:"note"`
+		TrashedAt uint64    `json:"trashedAt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&trashed); err != nil {
+		return errors.Trace(err)
+	}
+
+	refs := []taggableRef{}
+	for _, t := range trashed {
+		if t.TrashedAt == 0 {
+			return errors.Errorf("trashedAt is not set for a %q", t.Type)
+		}
+
+		switch {
+		case t.Type == "bookmark" && t.Bookmark != nil:
+			refs = append(refs, taggableRef{t.Type, t.Bookmark.ID})
+		case t.Type == "note" && t.Note != nil:
+			refs = append(refs, taggableRef{t.Type, t.Note.ID})
+		default:
+			return errors.Errorf("malformed trashed taggable of type %q", t.Type)
+		}
+	}
+
+	if !reflect.DeepEqual(refs, expected) {
+		return errors.Errorf("trash: expected %v, got %v", expected, refs)
+	}
+
+	return nil
+}
+
+func checkTrashPurge(be testBackend, userID int, path string, expectedIDs []int) error {
+	resp, err := be.DoUserReq("DELETE", path, userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var v userTrashPurgeResp
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return errors.Trace(err)
+	}
+
+	if !reflect.DeepEqual(v.PurgedIDs, expectedIDs) {
+		return errors.Errorf(
+			"purging %s: expected %v, got %v", path, expectedIDs, v.PurgedIDs,
+		)
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -137,12 +138,18 @@ func (gm *GMServer) webSocketConnect(
 	gsu getSubjUser,
 	wsMux GMHandler,
 ) error {
-	subjUser, err := gm.getUserAndAuthorizeByReq(r, gsu, &authzArgs{})
+	// Tokens restricted to a subtree can connect as well: handlers of the
+	// individual requests enforce the restrictions.
+	subjUser, err := gm.getUserAndAuthorizeByReq(
+		r, gsu, &authzArgs{AllowSubtree: true},
+	)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	caller := getAuthnUserDataByReq(r)
+	// The token might be revoked or might expire while the connection is
+	// open, so it's checked again on every request.
+	token, _ := getTokenFromReq(r)
 
 	fmt.Println("subj user:", subjUser)
 
@@ -151,8 +158,14 @@ func (gm *GMServer) webSocketConnect(
 		return errors.Trace(err)
 	}
 
+	// The context of r is done as soon as we return, so the connection has its
+	// own context, which is cancelled when the connection goroutine exits.
+	connCtx, connCancel := context.WithCancel(context.Background())
+
 	go func() (err error) {
 		defer func() {
+			connCancel()
+			conn.Close()
 			glog.Infof(
 				"Websocket goroutine for the user %s exits: %s",
 				subjUser.Email, err,
@@ -168,6 +181,7 @@ func (gm *GMServer) webSocketConnect(
 			start := time.Now()
 
 			status := http.StatusOK
+			tokenValid := true
 
 			// Here we define and call this intermediary function, because the error
 			// which happens there is not considered fatal: instead, it is reported
@@ -178,8 +192,23 @@ func (gm *GMServer) webSocketConnect(
 					return nil, wsr, errors.Trace(err)
 				}
 
+				// Every request gets its own deadline, just like HTTP ones
+				ctx := connCtx
+				if *requestTimeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(connCtx, *requestTimeout)
+					defer cancel()
+				}
+
+				caller, callerToken, err := gm.authenticateToken(ctx, token)
+				if err != nil {
+					err = wrapCtxError(ctx, err)
+					tokenValid = hh.GetHTTPErrorCode(err) != http.StatusUnauthorized
+					return nil, wsr, errors.Trace(err)
+				}
+
 				gmr, err := makeGMRequestFromWebSocketRequest(
-					wsr, caller, subjUser,
+					ctx, wsr, caller, callerToken, subjUser,
 				)
 				if err != nil {
 					return nil, wsr, errors.Trace(err)
@@ -187,7 +216,7 @@ func (gm *GMServer) webSocketConnect(
 
 				resp, err = wsMux(gmr)
 				if err != nil {
-					return nil, wsr, errors.Trace(err)
+					return nil, wsr, errors.Trace(wrapCtxError(ctx, err))
 				}
 
 				return resp, wsr, nil
@@ -230,6 +259,11 @@ func (gm *GMServer) webSocketConnect(
 			}
 
 			glog.Infof("%v: %13v", wsr, latency)
+
+			// Once the token is not valid anymore, the connection is useless
+			if !tokenValid {
+				return errors.Errorf("token is not valid anymore")
+			}
 		}
 	}()
 
@@ -0,0 +1,49 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/juju/errors"
+)
+
+// AccessTokenScope tells what a token allows to do with the data it gives
+// access to.
+type AccessTokenScope string
+
+const (
+	AccessTokenScopeRead    AccessTokenScope = "read"
+	AccessTokenScopeWrite   AccessTokenScope = "write"
+	AccessTokenScopeDefault                  = AccessTokenScopeWrite
+)
+
+// AccessTokenLastUsedResolution is the resolution of
+// AccessTokenData.LastUsedAt, in seconds: the last used time is not updated
+// more often than that, so that every authenticated request doesn't result in
+// a write.
+const AccessTokenLastUsedResolution = 60
+
+// HashAccessToken returns a hash of the token, which is what storages keep
+// instead of the token itself. Tokens are long random strings, so a plain
+// sha256 is enough here (unlike passwords, they can't be brute-forced).
+func HashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidateAccessTokenScope returns an error if the given scope is not one of
+// the known ones.
+func ValidateAccessTokenScope(scope AccessTokenScope) error {
+	switch scope {
+	case AccessTokenScopeRead, AccessTokenScopeWrite:
+		return nil
+	}
+
+	return errors.Errorf(
+		"invalid access token scope %q, valid values are: %q, %q",
+		scope, AccessTokenScopeRead, AccessTokenScopeWrite,
+	)
+}
@@ -6,31 +6,58 @@ package common // import "dmitryfrank.com/geekmarks/server/storage/common"
 import (
 	"flag"
 	"os"
+	"time"
 
 	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/memory"
 	"dmitryfrank.com/geekmarks/server/storage/postgres"
+	"dmitryfrank.com/geekmarks/server/storage/sqlite"
 
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
 
 var (
-	dbType = flag.String("geekmarks.dbtype", "postgres",
-		"Database type. So far, only postgres is supported.")
+	dbType = flag.String("geekmarks.dbtype", "",
+		"Database type: postgres (default), sqlite or memory. Alternatively, can be "+
+			"given in an environment variable GM_DBTYPE.")
 	postgresURL = flag.String("geekmarks.postgres.url", "",
 		"Data source name pointing to the Postgres database. Alternatively, can be "+
 			"given in an environment variable GM_POSTGRES_URL.")
+	postgresStatementTimeout = flag.Duration(
+		"geekmarks.postgres.statement_timeout", 30*time.Second,
+		"Max duration of a single SQL statement (except migrations); longer "+
+			"statements are aborted by Postgres. Zero means no timeout.")
+	sqlitePath = flag.String("geekmarks.sqlite.path", "",
+		"Path to the SQLite database file; \":memory:\" is also accepted. "+
+			"Alternatively, can be given in an environment variable GM_SQLITE_PATH.")
 )
 
 func CreateStorage() (storage.Storage, error) {
-	switch *dbType {
+	dbt := *dbType
+	if dbt == "" {
+		dbt = os.Getenv("GM_DBTYPE")
+	}
+	if dbt == "" {
+		dbt = "postgres"
+	}
+
+	switch dbt {
 	case "postgres":
 		pgURL := *postgresURL
 		if pgURL == "" {
 			pgURL = os.Getenv("GM_POSTGRES_URL")
 		}
-		return postgres.New(pgURL)
+		return postgres.New(pgURL, *postgresStatementTimeout)
+	case "sqlite":
+		path := *sqlitePath
+		if path == "" {
+			path = os.Getenv("GM_SQLITE_PATH")
+		}
+		return sqlite.New(path)
+	case "memory":
+		return memory.New()
 	default:
-		return nil, errors.Errorf("Invalid database type: %q", *dbType)
+		return nil, errors.Errorf("Invalid database type: %q", dbt)
 	}
 }
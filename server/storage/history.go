@@ -0,0 +1,219 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storage
+
+import (
+	"reflect"
+	"sort"
+)
+
+// HistoryObjectType is the type of objects whose changes are recorded in the
+// history.
+type HistoryObjectType string
+
+const (
+	HistoryObjectTaggable HistoryObjectType = "taggable"
+	HistoryObjectTag      HistoryObjectType = "tag"
+)
+
+// HistoryRecord is a single change of a taggable or a tag. Records are never
+// modified; ID grows with every new record, so it's used as a revision id.
+type HistoryRecord struct {
+	ID         int
+	OwnerID    int
+	ObjectType HistoryObjectType
+	ObjectID   int
+	CreatedAt  uint64
+	Diff       HistoryDiff
+}
+
+// HistoryDiff describes a change: only the fields which were changed are
+// non-nil. It is stored in the database as JSON.
+type HistoryDiff struct {
+	// Bookmark fields
+	URL     *StringChange `json:"url,omitempty"`
+	Title   *StringChange `json:"title,omitempty"`
+	Comment *StringChange `json:"comment,omitempty"`
+
+	// Taggings of a taggable, including all the supertags (like in
+	// TaggingModeAll)
+	TagIDs *TagIDsChange `json:"tagIDs,omitempty"`
+
+	// Tag fields
+	Names       *StringsChange `json:"names,omitempty"`
+	ParentTagID *IntChange     `json:"parentTagID,omitempty"`
+	Description *StringChange  `json:"description,omitempty"`
+	// True if the tag (with all its subtags) was deleted
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+type StringChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type StringsChange struct {
+	Old []string `json:"old"`
+	New []string `json:"new"`
+}
+
+type IntChange struct {
+	Old int `json:"old"`
+	New int `json:"new"`
+}
+
+type TagIDsChange struct {
+	Added   []int `json:"added"`
+	Removed []int `json:"removed"`
+}
+
+// IsEmpty returns true if nothing was changed.
+func (d *HistoryDiff) IsEmpty() bool {
+	return reflect.DeepEqual(d, &HistoryDiff{})
+}
+
+// MakeBookmarkDiff returns the difference between the two versions of a
+// bookmark; only URL, Title and Comment are compared.
+func MakeBookmarkDiff(oldBkm, newBkm *BookmarkData) *HistoryDiff {
+	return &HistoryDiff{
+		URL:     makeStringChange(oldBkm.URL, newBkm.URL),
+		Title:   makeStringChange(oldBkm.Title, newBkm.Title),
+		Comment: makeStringChange(oldBkm.Comment, newBkm.Comment),
+	}
+}
+
+// MakeTagIDsDiff returns the difference between the two sets of taggings.
+func MakeTagIDsDiff(oldTagIDs, newTagIDs []int) *HistoryDiff {
+	oldSet := map[int]bool{}
+	for _, id := range oldTagIDs {
+		oldSet[id] = true
+	}
+
+	newSet := map[int]bool{}
+	for _, id := range newTagIDs {
+		newSet[id] = true
+	}
+
+	change := TagIDsChange{
+		Added:   []int{},
+		Removed: []int{},
+	}
+
+	for id := range newSet {
+		if !oldSet[id] {
+			change.Added = append(change.Added, id)
+		}
+	}
+
+	for id := range oldSet {
+		if !newSet[id] {
+			change.Removed = append(change.Removed, id)
+		}
+	}
+
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return &HistoryDiff{}
+	}
+
+	sort.Ints(change.Added)
+	sort.Ints(change.Removed)
+
+	return &HistoryDiff{
+		TagIDs: &change,
+	}
+}
+
+// MakeTagDiff returns the difference between the two versions of a tag; both
+// should be fetched with names.
+func MakeTagDiff(oldTag, newTag *TagData) *HistoryDiff {
+	diff := &HistoryDiff{}
+
+	if !reflect.DeepEqual(oldTag.Names, newTag.Names) {
+		diff.Names = &StringsChange{
+			Old: oldTag.Names,
+			New: newTag.Names,
+		}
+	}
+
+	oldParentID, newParentID := 0, 0
+	if oldTag.ParentTagID != nil {
+		oldParentID = *oldTag.ParentTagID
+	}
+	if newTag.ParentTagID != nil {
+		newParentID = *newTag.ParentTagID
+	}
+	if oldParentID != newParentID {
+		diff.ParentTagID = &IntChange{
+			Old: oldParentID,
+			New: newParentID,
+		}
+	}
+
+	oldDescr, newDescr := "", ""
+	if oldTag.Description != nil {
+		oldDescr = *oldTag.Description
+	}
+	if newTag.Description != nil {
+		newDescr = *newTag.Description
+	}
+	diff.Description = makeStringChange(oldDescr, newDescr)
+
+	return diff
+}
+
+// RevertBookmark takes the current bookmark and its taggings (in
+// TaggingModeAll), and undoes the changes described by the given history
+// records of this bookmark, from the last one to the first one. The bookmark
+// is modified in place, and the resulting taggings are returned.
+func RevertBookmark(bd *BookmarkData, tagIDs []int, records []HistoryRecord) []int {
+	tagSet := map[int]bool{}
+	for _, id := range tagIDs {
+		tagSet[id] = true
+	}
+
+	for i := len(records) - 1; i >= 0; i-- {
+		diff := &records[i].Diff
+
+		if diff.URL != nil {
+			bd.URL = diff.URL.Old
+		}
+
+		if diff.Title != nil {
+			bd.Title = diff.Title.Old
+		}
+
+		if diff.Comment != nil {
+			bd.Comment = diff.Comment.Old
+		}
+
+		if diff.TagIDs != nil {
+			for _, id := range diff.TagIDs.Added {
+				delete(tagSet, id)
+			}
+
+			for _, id := range diff.TagIDs.Removed {
+				tagSet[id] = true
+			}
+		}
+	}
+
+	ret := []int{}
+	for id := range tagSet {
+		ret = append(ret, id)
+	}
+	sort.Ints(ret)
+
+	return ret
+}
+
+func makeStringChange(oldStr, newStr string) *StringChange {
+	if oldStr == newStr {
+		return nil
+	}
+
+	return &StringChange{
+		Old: oldStr,
+		New: newStr,
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+)
+
+func TestMakeBookmarkDiff(t *testing.T) {
+	oldBkm := &BookmarkData{URL: "url1", Title: "title1", Comment: "comment"}
+
+	diff := MakeBookmarkDiff(oldBkm, &BookmarkData{
+		URL: "url1", Title: "title2", Comment: "comment",
+	})
+	expected := &HistoryDiff{
+		Title: &StringChange{Old: "title1", New: "title2"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff)
+	}
+
+	diff = MakeBookmarkDiff(oldBkm, oldBkm)
+	if !diff.IsEmpty() {
+		t.Errorf("diff of the same bookmark should be empty, got %+v", diff)
+	}
+}
+
+func TestMakeTagIDsDiff(t *testing.T) {
+	diff := MakeTagIDsDiff([]int{1, 2, 3}, []int{5, 1, 4})
+	expected := &HistoryDiff{
+		TagIDs: &TagIDsChange{Added: []int{4, 5}, Removed: []int{2, 3}},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff)
+	}
+
+	diff = MakeTagIDsDiff([]int{2, 1}, []int{1, 2})
+	if !diff.IsEmpty() {
+		t.Errorf("diff of the same taggings should be empty, got %+v", diff)
+	}
+}
+
+func TestMakeTagDiff(t *testing.T) {
+	diff := MakeTagDiff(
+		&TagData{Names: []string{"a", "b"}, ParentTagID: cptr.Int(1), Description: cptr.String("")},
+		&TagData{Names: []string{"a", "b"}, ParentTagID: cptr.Int(2), Description: cptr.String("d")},
+	)
+	expected := &HistoryDiff{
+		ParentTagID: &IntChange{Old: 1, New: 2},
+		Description: &StringChange{Old: "", New: "d"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diff)
+	}
+}
+
+func TestRevertBookmark(t *testing.T) {
+	records := []HistoryRecord{
+		{ID: 1, Diff: HistoryDiff{
+			TagIDs: &TagIDsChange{Added: []int{1, 2}, Removed: []int{}},
+		}},
+		{ID: 2, Diff: HistoryDiff{
+			Title: &StringChange{Old: "", New: "title1"},
+		}},
+		{ID: 5, Diff: HistoryDiff{
+			URL:    &StringChange{Old: "url1", New: "url2"},
+			Title:  &StringChange{Old: "title1", New: "title2"},
+			TagIDs: &TagIDsChange{Added: []int{3}, Removed: []int{2}},
+		}},
+	}
+
+	bd := BookmarkData{URL: "url2", Title: "title2"}
+	tagIDs := RevertBookmark(&bd, []int{1, 3}, records[2:])
+	if bd.URL != "url1" || bd.Title != "title1" {
+		t.Errorf("wrong reverted bookmark: %+v", bd)
+	}
+	if !reflect.DeepEqual(tagIDs, []int{1, 2}) {
+		t.Errorf("wrong reverted taggings: %v", tagIDs)
+	}
+
+	bd = BookmarkData{URL: "url2", Title: "title2"}
+	tagIDs = RevertBookmark(&bd, []int{1, 3}, records)
+	if bd.URL != "url1" || bd.Title != "" {
+		t.Errorf("wrong reverted bookmark: %+v", bd)
+	}
+	if !reflect.DeepEqual(tagIDs, []int{}) {
+		t.Errorf("wrong reverted taggings: %v", tagIDs)
+	}
+}
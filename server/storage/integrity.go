@@ -0,0 +1,162 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// IntegrityViolationKind is the kind of an invariant which is broken.
+type IntegrityViolationKind string
+
+const (
+	// The children_cnt of the tag differs from the actual number of its
+	// subtags. Repair: recount the children.
+	IntegrityViolationChildrenCnt IntegrityViolationKind = "children_cnt"
+	// The user has no root tag, or more than one. It can't be repaired
+	// automatically.
+	IntegrityViolationTagRoots IntegrityViolationKind = "tag_roots"
+	// The taggable is tagged with some subtag of the tag, but not with the tag
+	// itself. Repair: add the tagging.
+	IntegrityViolationMissingTagging IntegrityViolationKind = "missing_tagging"
+	// The taggable is tagged with the root tag only. Repair: drop the tagging.
+	IntegrityViolationRootOnlyTagging IntegrityViolationKind = "root_only_tagging"
+)
+
+// integrityViolationKindsOrder is the order in which violations of different
+// kinds go in the report, which is also the order in which they're repaired.
+var integrityViolationKindsOrder = map[IntegrityViolationKind]int{
+	IntegrityViolationChildrenCnt:     0,
+	IntegrityViolationTagRoots:        1,
+	IntegrityViolationMissingTagging:  2,
+	IntegrityViolationRootOnlyTagging: 3,
+}
+
+// IntegrityViolation is a single broken invariant. Fields which aren't
+// relevant for the Kind are zero.
+type IntegrityViolation struct {
+	Kind       IntegrityViolationKind `json:"kind"`
+	UserID     int                    `json:"userID"`
+	TagID      int                    `json:"tagID,omitempty"`
+	TaggableID int                    `json:"taggableID,omitempty"`
+
+	// For IntegrityViolationChildrenCnt: the stored and the actual children
+	// count
+	ChildrenCnt       *int `json:"childrenCnt,omitempty"`
+	ChildrenCntActual *int `json:"childrenCntActual,omitempty"`
+
+	// For IntegrityViolationTagRoots: the root tags of the user
+	RootTagIDs []int `json:"rootTagIDs,omitempty"`
+
+	// Whether the violation was repaired
+	Repaired bool `json:"repaired"`
+}
+
+// Repairable returns whether the violation can be repaired by
+// CheckIntegrity.
+func (v *IntegrityViolation) Repairable() bool {
+	return v.Kind != IntegrityViolationTagRoots
+}
+
+func (v *IntegrityViolation) String() string {
+	var s string
+
+	switch v.Kind {
+	case IntegrityViolationChildrenCnt:
+		s = fmt.Sprintf(
+			"user %d: tag %d has children_cnt=%d, actual children count is %d",
+			v.UserID, v.TagID, *v.ChildrenCnt, *v.ChildrenCntActual,
+		)
+	case IntegrityViolationTagRoots:
+		s = fmt.Sprintf(
+			"user %d: tag roots count is %d (should be 1). tag roots: %v",
+			v.UserID, len(v.RootTagIDs), v.RootTagIDs,
+		)
+	case IntegrityViolationMissingTagging:
+		s = fmt.Sprintf(
+			"user %d: taggable %d is not tagged with the tag %d, but tagged with its subtag",
+			v.UserID, v.TaggableID, v.TagID,
+		)
+	case IntegrityViolationRootOnlyTagging:
+		s = fmt.Sprintf(
+			"user %d: taggable %d is tagged with the root tag %d only",
+			v.UserID, v.TaggableID, v.TagID,
+		)
+	default:
+		s = fmt.Sprintf("user %d: unknown violation %q", v.UserID, v.Kind)
+	}
+
+	if v.Repaired {
+		s += " (repaired)"
+	}
+
+	return s
+}
+
+// IntegrityReport is returned by CheckIntegrity.
+type IntegrityReport struct {
+	Violations []IntegrityViolation `json:"violations"`
+}
+
+// NewIntegrityReport returns an empty report.
+func NewIntegrityReport() *IntegrityReport {
+	return &IntegrityReport{
+		Violations: []IntegrityViolation{},
+	}
+}
+
+// Add adds a violation to the report.
+func (r *IntegrityReport) Add(v IntegrityViolation) {
+	r.Violations = append(r.Violations, v)
+}
+
+// Sort sorts violations by kind, user, tag and taggable, so that the report
+// doesn't depend on the order in which the storage returns the data.
+func (r *IntegrityReport) Sort() {
+	sort.SliceStable(r.Violations, func(i, j int) bool {
+		vi, vj := &r.Violations[i], &r.Violations[j]
+		if ki, kj := integrityViolationKindsOrder[vi.Kind], integrityViolationKindsOrder[vj.Kind]; ki != kj {
+			return ki < kj
+		}
+		if vi.UserID != vj.UserID {
+			return vi.UserID < vj.UserID
+		}
+		if vi.TagID != vj.TagID {
+			return vi.TagID < vj.TagID
+		}
+		return vi.TaggableID < vj.TaggableID
+	})
+}
+
+// Err returns an error describing all the violations which are not repaired,
+// or nil if there are none.
+func (r *IntegrityReport) Err() error {
+	lines := []string{}
+	for _, v := range r.Violations {
+		if !v.Repaired {
+			lines = append(lines, v.String())
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("integrity is broken:\n%s", strings.Join(lines, "\n"))
+}
+
+// CheckIntegrity checks the integrity of the storage without repairing, and
+// returns an error if it's broken.
+func CheckIntegrity(si Storage) error {
+	report, err := si.CheckIntegrity(false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(report.Err())
+}
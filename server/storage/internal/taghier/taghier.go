@@ -1,7 +1,7 @@
 // Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
 // Licensed under the BSD, see LICENSE file for details.
 
-package taghier // import "dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+package taghier // import "dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 
 import (
 	"sort"
@@ -118,6 +118,12 @@ func (h *TagHier) Move(id, newParentID int, removeNewLeafs bool) error {
 
 	oldParentID := h.idToItem[id].parentID
 
+	// Moving under the same parent is a no-op; we must not try to remove the
+	// item from the old parent's children, since the old parent is the new one.
+	if oldParentID == newParentID {
+		return nil
+	}
+
 	h.idToItem[id].parentID = newParentID
 
 	// Maintain children of the new parent
@@ -168,13 +174,45 @@ func (hi *tagHierItem) makeCopy() *tagHierItem {
 	return ret
 }
 
+// Delete removes the item with the given id, together with all its
+// descendants. If the parent becomes a leaf and removeNewLeafs is true, the
+// parent is removed as well, and so on up to the root.
+func (h *TagHier) Delete(id int, removeNewLeafs bool) error {
+	item, ok := h.idToItem[id]
+	if !ok {
+		return errors.Errorf("can't delete %d: no item with id %d", id, id)
+	}
+
+	h.deleteSubtree(id)
+
+	if item.parentID != 0 {
+		h.removeChild(item.parentID, id, removeNewLeafs)
+	}
+
+	return nil
+}
+
+func (h *TagHier) deleteSubtree(id int) {
+	for childID := range h.idToItem[id].childrenIDs {
+		h.deleteSubtree(childID)
+	}
+
+	delete(h.idToItem, id)
+	delete(h.leafs, id)
+	delete(h.roots, id)
+}
+
 func (h *TagHier) removeChild(parentID, oldChildID int, removeNewLeafs bool) {
 	delete(h.idToItem[parentID].childrenIDs, oldChildID)
 
 	if len(h.idToItem[parentID].childrenIDs) == 0 {
 		if removeNewLeafs {
-			h.removeChild(h.idToItem[parentID].parentID, parentID, true)
+			// Root items have no parent to be removed from
+			if grandParentID := h.idToItem[parentID].parentID; grandParentID != 0 {
+				h.removeChild(grandParentID, parentID, true)
+			}
 			delete(h.idToItem, parentID)
+			delete(h.roots, parentID)
 		} else {
 			h.leafs[parentID] = h.idToItem[parentID]
 		}
@@ -30,7 +30,8 @@ import (
 // │       ├── 14
 // │       └── 15
 // └── 3
-//     └── 16
+//
+//	   └── 16
 type tmpRegistry struct{}
 
 var (
@@ -286,6 +287,35 @@ func TestMoveRemoveNewLeafs(t *testing.T) {
 	}
 }
 
+func TestMoveUnderSameParent(t *testing.T) {
+	reg := tmpRegistry{}
+	hier := New(&reg)
+
+	hier.Add(9)
+	if err := check(hier, []int{9}, []int{1}, []int{1, 5, 9}); err != nil {
+		t.Errorf("%s", errors.Trace(err))
+	}
+
+	// 9 is the only child of 5, and 5 is the only child of 1, so if moving
+	// under the same parent wasn't a no-op, 5 and 1 would become new leafs
+	// (and get removed).
+	for _, removeNewLeafs := range []bool{false, true} {
+		if err := hier.Move(9, 5, removeNewLeafs); err != nil {
+			t.Errorf("%s", errors.Trace(err))
+		}
+		if err := check(hier, []int{9}, []int{1}, []int{1, 5, 9}); err != nil {
+			t.Errorf("%s", errors.Trace(err))
+		}
+
+		if err := hier.Move(5, 1, removeNewLeafs); err != nil {
+			t.Errorf("%s", errors.Trace(err))
+		}
+		if err := check(hier, []int{9}, []int{1}, []int{1, 5, 9}); err != nil {
+			t.Errorf("%s", errors.Trace(err))
+		}
+	}
+}
+
 func TestMoveKeepNewLeafs(t *testing.T) {
 	reg := tmpRegistry{}
 	hier := New(&reg)
@@ -318,6 +348,50 @@ func TestMoveKeepNewLeafs(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	reg := tmpRegistry{}
+
+	for _, removeNewLeafs := range []bool{false, true} {
+		hier := New(&reg)
+
+		hier.Add(8)
+		hier.Add(9)
+		hier.Add(14)
+		if err := check(hier, []int{8, 9, 14}, []int{1, 2}, []int{1, 2, 4, 5, 7, 8, 9, 13, 14}); err != nil {
+			t.Errorf("%s", errors.Trace(err))
+		}
+
+		// 4 has a sibling, so its parent doesn't become a leaf regardless of
+		// removeNewLeafs
+		if err := hier.Delete(4, removeNewLeafs); err != nil {
+			t.Errorf("%s", errors.Trace(err))
+		}
+		if err := check(hier, []int{9, 14}, []int{1, 2}, []int{1, 2, 5, 9, 13, 14}); err != nil {
+			t.Errorf("removeNewLeafs=%v: %s", removeNewLeafs, errors.Trace(err))
+		}
+
+		// Now 1 and 13 become leafs
+		hier.Delete(5, removeNewLeafs)
+		hier.Delete(14, removeNewLeafs)
+
+		if removeNewLeafs {
+			// New leafs are removed, up to the roots
+			if err := check(hier, []int{}, []int{}, []int{}); err != nil {
+				t.Errorf("removeNewLeafs=%v: %s", removeNewLeafs, errors.Trace(err))
+			}
+		} else {
+			if err := check(hier, []int{1, 13}, []int{1, 2}, []int{1, 2, 13}); err != nil {
+				t.Errorf("removeNewLeafs=%v: %s", removeNewLeafs, errors.Trace(err))
+			}
+		}
+	}
+
+	hier := New(&reg)
+	if err := hier.Delete(1, false); err == nil {
+		t.Errorf("deleting a non-existing item should fail")
+	}
+}
+
 func TestCopy(t *testing.T) {
 	reg := tmpRegistry{}
 	hier := New(&reg)
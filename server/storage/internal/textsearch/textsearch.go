@@ -0,0 +1,182 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package textsearch is a simple full-text search over bookmark fields, for
+// the storages which don't have one built in. It only approximates what
+// postgres does: there is no stemming and no stop words, every query word
+// just has to be a case-insensitive substring of some word in the bookmark.
+package textsearch // import "dmitryfrank.com/geekmarks/server/storage/internal/textsearch"
+
+import (
+	"strings"
+	"unicode"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+)
+
+const (
+	// Weights of the matches in different fields; same as the postgres
+	// defaults for the weights A, B and C, which are assigned to the title,
+	// comment and url, respectively.
+	titleWeight   = 1.0
+	commentWeight = 0.4
+	urlWeight     = 0.2
+
+	// Max number of words in a snippet, and how many words before the first
+	// match to include into it.
+	snippetMaxWords   = 35
+	snippetWordsAhead = 5
+)
+
+type Query struct {
+	words []string
+}
+
+type Result struct {
+	Rank           float64
+	TitleSnippet   string
+	CommentSnippet string
+}
+
+// token is either a word (a run of letters and digits), or a run of anything
+// else between words.
+type token struct {
+	text   string
+	isWord bool
+}
+
+func ParseQuery(q string) *Query {
+	ret := &Query{}
+	for _, t := range tokenize(q) {
+		if t.isWord {
+			ret.words = append(ret.words, strings.ToLower(t.text))
+		}
+	}
+	return ret
+}
+
+// IsEmpty returns whether the query has no words to search for.
+func (q *Query) IsEmpty() bool {
+	return len(q.words) == 0
+}
+
+// Match returns nil if some of the query words were not found in the given
+// bookmark fields.
+func (q *Query) Match(title, comment, url string) *Result {
+	titleTokens := tokenize(title)
+	commentTokens := tokenize(comment)
+	urlTokens := tokenize(url)
+
+	rank := 0.0
+	for _, w := range q.words {
+		cnt := 0.0
+		cnt += titleWeight * float64(countMatches(titleTokens, w))
+		cnt += commentWeight * float64(countMatches(commentTokens, w))
+		cnt += urlWeight * float64(countMatches(urlTokens, w))
+
+		if cnt == 0 {
+			return nil
+		}
+
+		rank += cnt
+	}
+
+	return &Result{
+		Rank:           rank,
+		TitleSnippet:   q.snippet(titleTokens, 0),
+		CommentSnippet: q.snippet(commentTokens, snippetMaxWords),
+	}
+}
+
+func countMatches(tokens []token, w string) int {
+	cnt := 0
+	for _, t := range tokens {
+		if t.isWord && strings.Contains(strings.ToLower(t.text), w) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (q *Query) isMatch(t token) bool {
+	if !t.isWord {
+		return false
+	}
+
+	lower := strings.ToLower(t.text)
+	for _, w := range q.words {
+		if strings.Contains(lower, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// snippet returns the text made of the given tokens, HTML-escaped, with
+// matched words highlighted. If maxWords is non-zero and there are more words than that,
+// only maxWords words around the first match are included.
+func (q *Query) snippet(tokens []token, maxWords int) string {
+	start, end := 0, len(tokens)
+
+	if maxWords > 0 {
+		wordIdxs := []int{}
+		firstMatch := -1
+		for i, t := range tokens {
+			if t.isWord {
+				if firstMatch < 0 && q.isMatch(t) {
+					firstMatch = len(wordIdxs)
+				}
+				wordIdxs = append(wordIdxs, i)
+			}
+		}
+
+		if len(wordIdxs) > maxWords {
+			first := 0
+			if firstMatch > snippetWordsAhead {
+				first = firstMatch - snippetWordsAhead
+			}
+			if first+maxWords > len(wordIdxs) {
+				first = len(wordIdxs) - maxWords
+			}
+
+			start = wordIdxs[first]
+			end = wordIdxs[first+maxWords-1] + 1
+		}
+	}
+
+	parts := []string{}
+	for _, t := range tokens[start:end] {
+		if q.isMatch(t) {
+			parts = append(
+				parts, storage.SearchHighlightStart, storage.EscapeSnippetText(t.text),
+				storage.SearchHighlightStop,
+			)
+		} else {
+			parts = append(parts, storage.EscapeSnippetText(t.text))
+		}
+	}
+
+	return strings.Join(parts, "")
+}
+
+func tokenize(s string) []token {
+	ret := []token{}
+	cur := []rune{}
+	curIsWord := false
+
+	for _, r := range s {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if len(cur) > 0 && isWord != curIsWord {
+			ret = append(ret, token{text: string(cur), isWord: curIsWord})
+			cur = cur[:0]
+		}
+		cur = append(cur, r)
+		curIsWord = isWord
+	}
+
+	if len(cur) > 0 {
+		ret = append(ret, token{text: string(cur), isWord: curIsWord})
+	}
+
+	return ret
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package textsearch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for q, empty := range map[string]bool{
+		"":           true,
+		"  ":         true,
+		"-- ,, !":    true,
+		"foo":        false,
+		"  foo-bar ": false,
+	} {
+		if ParseQuery(q).IsEmpty() != empty {
+			t.Errorf("query %q: expected IsEmpty() to be %v", q, empty)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	q := ParseQuery("Golang, TEST")
+
+	if r := q.Match("Golang", "", "http://test.com"); r == nil {
+		t.Errorf("words in different fields should match")
+	}
+
+	if r := q.Match("Golang tutorial", "", ""); r != nil {
+		t.Errorf("all words should be required to match, got %v", r)
+	}
+
+	// Title matches are more important than comment ones, and comment matches
+	// are more important than url ones
+	rTitle := q.Match("golang tests", "", "")
+	rComment := q.Match("", "golang tests", "")
+	rURL := q.Match("", "", "http://golang.com/tests")
+	if rTitle == nil || rComment == nil || rURL == nil {
+		t.Fatalf("expected all to match: %v, %v, %v", rTitle, rComment, rURL)
+	}
+	if !(rTitle.Rank > rComment.Rank && rComment.Rank > rURL.Rank) {
+		t.Errorf(
+			"wrong ranks: title %v, comment %v, url %v",
+			rTitle.Rank, rComment.Rank, rURL.Rank,
+		)
+	}
+
+	r := q.Match("Testing in Golang", "Нет совпадений; golang-test!", "")
+	if r == nil {
+		t.Fatalf("expected a match")
+	}
+	if expected := "<b>Testing</b> in <b>Golang</b>"; r.TitleSnippet != expected {
+		t.Errorf("title snippet: expected %q, got %q", expected, r.TitleSnippet)
+	}
+	if expected := "Нет совпадений; <b>golang</b>-<b>test</b>!"; r.CommentSnippet != expected {
+		t.Errorf("comment snippet: expected %q, got %q", expected, r.CommentSnippet)
+	}
+
+	// Everything but the highlighting is escaped
+	r = q.Match("<img src=x onerror=alert(1)> golang & tests", "", "")
+	if r == nil {
+		t.Fatalf("expected a match")
+	}
+	expected := "&lt;img src=x onerror=alert(1)&gt; <b>golang</b> &amp; <b>tests</b>"
+	if r.TitleSnippet != expected {
+		t.Errorf("title snippet: expected %q, got %q", expected, r.TitleSnippet)
+	}
+}
+
+func TestLongSnippet(t *testing.T) {
+	words := []string{}
+	for i := 0; i < 100; i++ {
+		words = append(words, "word")
+	}
+	words[50] = "needle"
+
+	r := ParseQuery("needle").Match("", strings.Join(words, " "), "")
+	if r == nil {
+		t.Fatalf("expected a match")
+	}
+
+	snippetWords := strings.Fields(r.CommentSnippet)
+	if len(snippetWords) != snippetMaxWords {
+		t.Errorf(
+			"expected %d words in the snippet, got %d: %q",
+			snippetMaxWords, len(snippetWords), r.CommentSnippet,
+		)
+	}
+	if snippetWords[snippetWordsAhead] != "<b>needle</b>" {
+		t.Errorf("expected the match after %d words: %q", snippetWordsAhead, r.CommentSnippet)
+	}
+}
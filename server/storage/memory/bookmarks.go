@@ -0,0 +1,478 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/textsearch"
+
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (bkmID int, err error) {
+	// If URL is not empty, check whether the bookmark with the same canonical
+	// URL already exists
+	canonicalURL := bd.GetCanonicalURL()
+	if canonicalURL != "" {
+		existingBkms, err := s.GetBookmarksByURL(tx, canonicalURL, bd.OwnerID, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeNone,
+			TagNamesFetchMode: storage.TagNamesFetchModeNone,
+		})
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if len(existingBkms) > 0 {
+			return 0, errors.Errorf("bookmark with the url %q already exists", bd.URL)
+		}
+	}
+
+	bkmID, err = s.CreateTaggable(tx, &storage.TaggableData{
+		OwnerID: bd.OwnerID,
+		Type:    storage.TaggableTypeBookmark,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	s.data.bookmarks[bkmID] = &bookmark{
+		url:          bd.URL,
+		canonicalURL: canonicalURL,
+		title:        bd.Title,
+		comment:      bd.Comment,
+	}
+
+	return bkmID, nil
+}
+
+func (s *StorageMemory) UpdateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	// The old version is needed for the history
+	oldBkm, err := s.GetBookmarkByID(tx, bd.ID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// If the canonical URL is changed and is not empty, check whether the
+	// bookmark with the same canonical URL already exists. If it's not changed,
+	// then we don't check it, so that the bookmarks which became duplicates
+	// after the canonicalization rules were changed can still be edited.
+	canonicalURL := bd.GetCanonicalURL()
+	if canonicalURL != "" && canonicalURL != oldBkm.CanonicalURL {
+		existingBkms, err := s.GetBookmarksByURL(tx, canonicalURL, bd.OwnerID, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeNone,
+			TagNamesFetchMode: storage.TagNamesFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(existingBkms) > 0 {
+			return errors.Errorf("bookmark with the url %q already exists", bd.URL)
+		}
+	}
+
+	b := s.data.bookmarks[bd.ID]
+	b.url = bd.URL
+	b.canonicalURL = canonicalURL
+	b.title = bd.Title
+	b.comment = bd.Comment
+
+	err = s.addHistoryRecord(
+		oldBkm.OwnerID, storage.HistoryObjectTaggable, bd.ID,
+		storage.MakeBookmarkDiff(&oldBkm.BookmarkData, bd),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func setDefaultTagFetchOpts(tagsFetchOpts *storage.TagsFetchOpts) *storage.TagsFetchOpts {
+	if tagsFetchOpts == nil {
+		tagsFetchOpts = &storage.TagsFetchOpts{}
+	}
+
+	if tagsFetchOpts.TagsFetchMode == "" {
+		tagsFetchOpts.TagsFetchMode = storage.TagsFetchModeDefault
+	}
+
+	if tagsFetchOpts.TagNamesFetchMode == "" {
+		tagsFetchOpts.TagNamesFetchMode = storage.TagNamesFetchModeDefault
+	}
+
+	return tagsFetchOpts
+}
+
+func (s *StorageMemory) GetTaggedBookmarks(
+	tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *storage.TagsFetchOpts,
+	pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	taggableIDs, err := s.GetTaggedTaggableIDs(
+		tx, tagIDs, ownerID, []storage.TaggableType{storage.TaggableTypeBookmark},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s.getBookmarksPage(tx, taggableIDs, tagsFetchOpts, pageOpts)
+}
+
+func (s *StorageMemory) GetBookmarksByTagQuery(
+	tx *sql.Tx, query *storage.TagQuery, ownerID int,
+	tagsFetchOpts *storage.TagsFetchOpts, pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := query.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ids := s.data.getSortedTaggableIDs(func(t *taggable) bool {
+		if _, ok := s.data.bookmarks[t.id]; !ok || t.ownerID != ownerID {
+			return false
+		}
+
+		tgbTagIDs := s.data.taggings[t.id]
+		return query.Eval(func(tagID int) bool {
+			_, ok := tgbTagIDs[tagID]
+			return ok
+		})
+	})
+
+	return s.getBookmarksPage(tx, ids, tagsFetchOpts, pageOpts)
+}
+
+// getBookmarksPage returns a page of bookmarks with the given ids; trashed
+// bookmarks are skipped.
+func (s *StorageMemory) getBookmarksPage(
+	tx *sql.Tx, ids []int,
+	tagsFetchOpts *storage.TagsFetchOpts, pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	ids = s.data.skipTrashed(ids)
+
+	pageOpts, err = storage.PrepareBookmarksPageOpts(pageOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Fetch all bookmarks without tags first, sort them and cut the requested
+	// page, and only then fetch tags of the bookmarks on the page.
+	all, err := s.getBookmarks(tx, ids, &storage.TagsFetchOpts{
+		TagsFetchMode: storage.TagsFetchModeNone,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return compareBookmarks(&all[i], &all[j], pageOpts) < 0
+	})
+
+	start := 0
+	if c := pageOpts.Cursor; c != nil {
+		cursorBkm := &storage.BookmarkDataWTags{
+			BookmarkData: storage.BookmarkData{
+				ID:        c.ID,
+				CreatedAt: c.Time,
+				UpdatedAt: c.Time,
+				Title:     c.Str,
+				URL:       c.Str,
+			},
+		}
+		start = sort.Search(len(all), func(i int) bool {
+			return compareBookmarks(&all[i], cursorBkm, pageOpts) > 0
+		})
+	}
+
+	end := len(all)
+	if pageOpts.Limit > 0 && start+pageOpts.Limit < end {
+		end = start + pageOpts.Limit
+	}
+
+	pageIDs := []int{}
+	for _, bkm := range all[start:end] {
+		pageIDs = append(pageIDs, bkm.ID)
+	}
+
+	page = &storage.BookmarksPage{
+		TotalCnt: len(all),
+	}
+
+	page.Bookmarks, err = s.getBookmarks(tx, pageIDs, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if end < len(all) {
+		page.NextCursor = storage.MakeBookmarksCursor(&all[end-1].BookmarkData, pageOpts)
+	}
+
+	return page, nil
+}
+
+// compareBookmarks returns a negative number if a goes before b in the order
+// specified by pageOpts, and a positive one if a goes after b.
+func compareBookmarks(
+	a, b *storage.BookmarkDataWTags, pageOpts *storage.BookmarksPageOpts,
+) int {
+	ret := 0
+	switch pageOpts.SortField {
+	case storage.BookmarksSortFieldCreated:
+		ret = compareUint64(a.CreatedAt, b.CreatedAt)
+	case storage.BookmarksSortFieldUpdated:
+		ret = compareUint64(a.UpdatedAt, b.UpdatedAt)
+	case storage.BookmarksSortFieldTitle:
+		ret = strings.Compare(a.Title, b.Title)
+	case storage.BookmarksSortFieldURL:
+		ret = strings.Compare(a.URL, b.URL)
+	}
+
+	if ret == 0 {
+		ret = a.ID - b.ID
+	}
+
+	if pageOpts.SortDesc {
+		ret = -ret
+	}
+
+	return ret
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (s *StorageMemory) GetBookmarksByURL(
+	tx *sql.Tx, canonicalURL string, ownerID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	ids := s.data.getSortedTaggableIDs(func(t *taggable) bool {
+		b, ok := s.data.bookmarks[t.id]
+		return ok && t.ownerID == ownerID && t.trashedAt == 0 && b.canonicalURL == canonicalURL
+	})
+
+	return s.getBookmarks(tx, ids, tagsFetchOpts)
+}
+
+func (s *StorageMemory) GetDuplicateBookmarks(
+	tx *sql.Tx, ownerID int,
+) ([]storage.DuplicateBookmarks, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ids := s.data.getSortedTaggableIDs(func(t *taggable) bool {
+		b, ok := s.data.bookmarks[t.id]
+		return ok && t.ownerID == ownerID && t.trashedAt == 0 && b.canonicalURL != ""
+	})
+
+	urlToIDs := map[string][]int{}
+	for _, id := range ids {
+		u := s.data.bookmarks[id].canonicalURL
+		urlToIDs[u] = append(urlToIDs[u], id)
+	}
+
+	duplicates := []storage.DuplicateBookmarks{}
+	for u, ids := range urlToIDs {
+		if len(ids) > 1 {
+			duplicates = append(duplicates, storage.DuplicateBookmarks{
+				CanonicalURL: u,
+				BookmarkIDs:  ids,
+			})
+		}
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].CanonicalURL < duplicates[j].CanonicalURL
+	})
+
+	return duplicates, nil
+}
+
+func (s *StorageMemory) GetAllBookmarkURLs(tx *sql.Tx) ([]storage.BookmarkURLData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ids := []int{}
+	for id := range s.data.bookmarks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	urls := []storage.BookmarkURLData{}
+	for _, id := range ids {
+		b := s.data.bookmarks[id]
+		urls = append(urls, storage.BookmarkURLData{
+			ID:           id,
+			URL:          b.url,
+			CanonicalURL: b.canonicalURL,
+		})
+	}
+
+	return urls, nil
+}
+
+func (s *StorageMemory) SetBookmarkCanonicalURL(
+	tx *sql.Tx, bookmarkID int, canonicalURL string,
+) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if b, ok := s.data.bookmarks[bookmarkID]; ok {
+		b.canonicalURL = canonicalURL
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) GetBookmarkByID(
+	tx *sql.Tx, bookmarkID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmark *storage.BookmarkDataWTags, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	if _, ok := s.data.bookmarks[bookmarkID]; !ok {
+		return nil, errors.Annotatef(storage.ErrBookmarkDoesNotExist, "id %d", bookmarkID)
+	}
+
+	bookmarks, err := s.getBookmarks(tx, []int{bookmarkID}, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &bookmarks[0], nil
+}
+
+func (s *StorageMemory) SearchBookmarks(
+	tx *sql.Tx, query string, ownerID int, tagIDs []int,
+	tagsFetchOpts *storage.TagsFetchOpts,
+) (results []storage.BookmarkSearchResult, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	q := textsearch.ParseQuery(query)
+	if q.IsEmpty() {
+		return nil, errors.Trace(storage.ErrSearchQueryEmpty)
+	}
+
+	matches := map[int]*textsearch.Result{}
+	ids := s.data.getSortedTaggableIDs(func(t *taggable) bool {
+		b, ok := s.data.bookmarks[t.id]
+		if !ok || t.ownerID != ownerID || t.trashedAt != 0 {
+			return false
+		}
+
+		tgbTagIDs := s.data.taggings[t.id]
+		for _, tagID := range tagIDs {
+			if _, ok := tgbTagIDs[tagID]; !ok {
+				return false
+			}
+		}
+
+		if m := q.Match(b.title, b.comment, b.url); m != nil {
+			matches[t.id] = m
+			return true
+		}
+
+		return false
+	})
+
+	bookmarks, err := s.getBookmarks(tx, ids, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	results = []storage.BookmarkSearchResult{}
+	for _, bkm := range bookmarks {
+		m := matches[bkm.ID]
+		results = append(results, storage.BookmarkSearchResult{
+			BookmarkDataWTags: bkm,
+			Rank:              m.Rank,
+			TitleSnippet:      m.TitleSnippet,
+			CommentSnippet:    m.CommentSnippet,
+		})
+	}
+
+	// Best matches first; ids are sorted already, so the stable sort keeps
+	// results with the same rank ordered by id
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Rank > results[j].Rank
+	})
+
+	return results, nil
+}
+
+// getBookmarks returns bookmarks with the given ids; ids of taggables which
+// are not bookmarks are ignored.
+func (s *StorageMemory) getBookmarks(
+	tx *sql.Tx, ids []int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, err error) {
+	bookmarks = []storage.BookmarkDataWTags{}
+	for _, id := range ids {
+		b, ok := s.data.bookmarks[id]
+		if !ok {
+			continue
+		}
+		t := s.data.taggables[id]
+
+		bkm := storage.BookmarkDataWTags{
+			BookmarkData: storage.BookmarkData{
+				ID:        id,
+				OwnerID:   t.ownerID,
+				CreatedAt: t.createdAt,
+				UpdatedAt: t.updatedAt,
+				TrashedAt: t.trashedAt,
+				URL:       b.url,
+				// SQL storages return it from GetBookmarkByID only
+				CanonicalURL: b.canonicalURL,
+				Title:        b.title,
+				Comment:      b.comment,
+			},
+		}
+
+		bkm.Tags, err = s.getTaggableTags(tx, id, tagsFetchOpts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		bookmarks = append(bookmarks, bkm)
+	}
+
+	return bookmarks, nil
+}
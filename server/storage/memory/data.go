@@ -0,0 +1,268 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"sort"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+)
+
+type tag struct {
+	id       int
+	ownerID  int
+	parentID int // 0 for the root tag
+	descr    string
+	// The first name is the primary one
+	names       []string
+	childrenCnt int
+}
+
+type taggable struct {
+	id        int
+	ownerID   int
+	ttype     storage.TaggableType
+	createdAt uint64
+	updatedAt uint64
+	// Zero unless the taggable is in the trash
+	trashedAt uint64
+}
+
+type bookmark struct {
+	url          string
+	canonicalURL string
+	title        string
+	comment      string
+}
+
+type note struct {
+	title  string
+	body   string
+	format storage.NoteFormat
+}
+
+type accessToken struct {
+	id         int
+	tokenHash  string
+	userID     int
+	descr      string
+	scope      storage.AccessTokenScope
+	rootTagID  int
+	createdAt  uint64
+	lastUsedAt uint64
+	expiresAt  uint64
+}
+
+type externalIdentity struct {
+	id        int
+	userID    int
+	provider  string
+	subject   string
+	email     string
+	createdAt uint64
+}
+
+type tagGrant struct {
+	id         int
+	tagID      int
+	granteeID  int
+	permission storage.TagGrantPermission
+	createdAt  uint64
+}
+
+type historyRecord struct {
+	id         int
+	ownerID    int
+	objectType storage.HistoryObjectType
+	objectID   int
+	createdAt  uint64
+	// JSON-encoded storage.HistoryDiff, like in the SQL storages
+	diff []byte
+}
+
+// memData is the whole contents of the storage. The maps are keyed by ids.
+type memData struct {
+	users     map[int]*storage.UserData
+	tags      map[int]*tag
+	taggables map[int]*taggable
+	bookmarks map[int]*bookmark
+	notes     map[int]*note
+	// Map from taggable id to the set of tag ids
+	taggings map[int]map[int]struct{}
+	// Ordered by id
+	accessTokens []accessToken
+	// Ordered by id
+	externalIdentities []externalIdentity
+	// Ordered by id
+	tagGrants []tagGrant
+	// Ordered by id
+	history []historyRecord
+
+	lastUserID     int
+	lastTagID      int
+	lastTaggableID int
+	lastHistoryID  int
+	lastTokenID    int
+
+	lastExternalIdentityID int
+	lastTagGrantID         int
+}
+
+func newMemData() *memData {
+	return &memData{
+		users:     make(map[int]*storage.UserData),
+		tags:      make(map[int]*tag),
+		taggables: make(map[int]*taggable),
+		bookmarks: make(map[int]*bookmark),
+		notes:     make(map[int]*note),
+		taggings:  make(map[int]map[int]struct{}),
+	}
+}
+
+// clone returns a deep copy of the data; it's used to roll back a
+// transaction.
+func (d *memData) clone() *memData {
+	ret := newMemData()
+
+	for id, v := range d.users {
+		u := *v
+		ret.users[id] = &u
+	}
+
+	for id, v := range d.tags {
+		t := *v
+		t.names = append([]string(nil), v.names...)
+		ret.tags[id] = &t
+	}
+
+	for id, v := range d.taggables {
+		t := *v
+		ret.taggables[id] = &t
+	}
+
+	for id, v := range d.bookmarks {
+		b := *v
+		ret.bookmarks[id] = &b
+	}
+
+	for id, v := range d.notes {
+		n := *v
+		ret.notes[id] = &n
+	}
+
+	for id, v := range d.taggings {
+		tagIDs := make(map[int]struct{}, len(v))
+		for tagID := range v {
+			tagIDs[tagID] = struct{}{}
+		}
+		ret.taggings[id] = tagIDs
+	}
+
+	ret.accessTokens = append([]accessToken(nil), d.accessTokens...)
+
+	ret.externalIdentities = append([]externalIdentity(nil), d.externalIdentities...)
+
+	ret.tagGrants = append([]tagGrant(nil), d.tagGrants...)
+
+	// Records are never modified, so it's fine to share diffs
+	ret.history = append([]historyRecord(nil), d.history...)
+
+	ret.lastUserID = d.lastUserID
+	ret.lastTagID = d.lastTagID
+	ret.lastTaggableID = d.lastTaggableID
+	ret.lastHistoryID = d.lastHistoryID
+	ret.lastTokenID = d.lastTokenID
+	ret.lastExternalIdentityID = d.lastExternalIdentityID
+	ret.lastTagGrantID = d.lastTagGrantID
+
+	return ret
+}
+
+// deleteTag deletes the tag with all its subtags, taggings, grants and access
+// tokens restricted to it. It's an equivalent of ON DELETE CASCADE.
+func (d *memData) deleteTag(tagID int) {
+	for _, t := range d.tags {
+		if t.parentID == tagID {
+			d.deleteTag(t.id)
+		}
+	}
+
+	for _, tagIDs := range d.taggings {
+		delete(tagIDs, tagID)
+	}
+
+	tokens := []accessToken{}
+	for _, tok := range d.accessTokens {
+		if tok.rootTagID != tagID {
+			tokens = append(tokens, tok)
+		}
+	}
+	d.accessTokens = tokens
+
+	grants := []tagGrant{}
+	for _, g := range d.tagGrants {
+		if g.tagID != tagID {
+			grants = append(grants, g)
+		}
+	}
+	d.tagGrants = grants
+
+	delete(d.tags, tagID)
+}
+
+// deleteTaggable deletes the taggable with its bookmark or note data and
+// taggings.
+func (d *memData) deleteTaggable(taggableID int) {
+	delete(d.taggings, taggableID)
+	delete(d.bookmarks, taggableID)
+	delete(d.notes, taggableID)
+	delete(d.taggables, taggableID)
+}
+
+// getSortedTags returns tags which satisfy the given filter, sorted by the
+// primary name.
+func (d *memData) getSortedTags(filter func(t *tag) bool) []*tag {
+	ret := []*tag{}
+	for _, t := range d.tags {
+		if filter(t) {
+			ret = append(ret, t)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].names[0] != ret[j].names[0] {
+			return ret[i].names[0] < ret[j].names[0]
+		}
+		return ret[i].id < ret[j].id
+	})
+
+	return ret
+}
+
+// getSortedTaggableIDs returns ids of taggables which satisfy the given
+// filter, in ascending order.
+func (d *memData) getSortedTaggableIDs(filter func(t *taggable) bool) []int {
+	var ret []int
+	for _, t := range d.taggables {
+		if filter(t) {
+			ret = append(ret, t.id)
+		}
+	}
+
+	sort.Ints(ret)
+	return ret
+}
+
+// skipTrashed returns the given taggable ids, except ids of trashed
+// taggables.
+func (d *memData) skipTrashed(ids []int) []int {
+	ret := []int{}
+	for _, id := range ids {
+		if t, ok := d.taggables[id]; ok && t.trashedAt == 0 {
+			ret = append(ret, id)
+		}
+	}
+
+	return ret
+}
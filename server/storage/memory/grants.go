@@ -0,0 +1,131 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"time"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) CreateTagGrant(
+	tx *sql.Tx, tgd *storage.TagGrantData,
+) (grantID int, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	perm := tgd.Permission
+	if perm == "" {
+		perm = storage.TagGrantPermissionDefault
+	}
+
+	if err := storage.ValidateTagGrantPermission(perm); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Mimic the unique and foreign key constraints of the SQL-backed storages
+	for _, g := range s.data.tagGrants {
+		if g.tagID == tgd.TagID && g.granteeID == tgd.GranteeID {
+			return 0, hh.MakeInternalServerError(errors.Errorf(
+				"grant of the tag %d to the user %d already exists",
+				tgd.TagID, tgd.GranteeID,
+			))
+		}
+	}
+
+	if _, ok := s.data.tags[tgd.TagID]; !ok {
+		return 0, hh.MakeInternalServerError(
+			errors.Errorf("tag %d does not exist", tgd.TagID),
+		)
+	}
+
+	if _, ok := s.data.users[tgd.GranteeID]; !ok {
+		return 0, hh.MakeInternalServerError(
+			errors.Errorf("user %d does not exist", tgd.GranteeID),
+		)
+	}
+
+	s.data.lastTagGrantID++
+	grantID = s.data.lastTagGrantID
+
+	s.data.tagGrants = append(s.data.tagGrants, tagGrant{
+		id:         grantID,
+		tagID:      tgd.TagID,
+		granteeID:  tgd.GranteeID,
+		permission: perm,
+		createdAt:  uint64(time.Now().Unix()),
+	})
+
+	return grantID, nil
+}
+
+func (s *StorageMemory) GetTagGrantsByOwner(
+	tx *sql.Tx, ownerID int,
+) ([]storage.TagGrantData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s.getTagGrants(func(g *tagGrant) bool {
+		return s.data.tags[g.tagID].ownerID == ownerID
+	}), nil
+}
+
+func (s *StorageMemory) GetTagGrantsByGrantee(
+	tx *sql.Tx, granteeID int,
+) ([]storage.TagGrantData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s.getTagGrants(func(g *tagGrant) bool {
+		return g.granteeID == granteeID
+	}), nil
+}
+
+func (s *StorageMemory) DeleteTagGrant(tx *sql.Tx, grantID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	for i, g := range s.data.tagGrants {
+		if g.id == grantID {
+			s.data.tagGrants = append(
+				s.data.tagGrants[:i:i], s.data.tagGrants[i+1:]...,
+			)
+			return nil
+		}
+	}
+
+	return errors.Trace(storage.ErrTagGrantDoesNotExist)
+}
+
+// getTagGrants returns grants which satisfy the given filter, ordered by id.
+func (s *StorageMemory) getTagGrants(
+	filter func(g *tagGrant) bool,
+) []storage.TagGrantData {
+	ret := []storage.TagGrantData{}
+	for i := range s.data.tagGrants {
+		g := &s.data.tagGrants[i]
+		if !filter(g) {
+			continue
+		}
+
+		ret = append(ret, storage.TagGrantData{
+			ID:         g.id,
+			TagID:      g.tagID,
+			OwnerID:    s.data.tags[g.tagID].ownerID,
+			GranteeID:  g.granteeID,
+			Permission: g.permission,
+			CreatedAt:  g.createdAt,
+		})
+	}
+
+	return ret
+}
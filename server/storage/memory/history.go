@@ -0,0 +1,98 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) GetHistory(
+	tx *sql.Tx, objectType storage.HistoryObjectType, objectID int,
+) ([]storage.HistoryRecord, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	records := []storage.HistoryRecord{}
+
+	for _, r := range s.data.history {
+		if r.objectType != objectType || r.objectID != objectID {
+			continue
+		}
+
+		rec := storage.HistoryRecord{
+			ID:         r.id,
+			OwnerID:    r.ownerID,
+			ObjectType: r.objectType,
+			ObjectID:   r.objectID,
+			CreatedAt:  r.createdAt,
+		}
+
+		if err := json.Unmarshal(r.diff, &rec.Diff); err != nil {
+			return nil, hh.MakeInternalServerError(errors.Annotatef(
+				err, "parsing diff of the history record %d", rec.ID,
+			))
+		}
+
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// addHistoryRecord adds a history record with the given diff, unless it's
+// empty.
+func (s *StorageMemory) addHistoryRecord(
+	ownerID int, objectType storage.HistoryObjectType, objectID int,
+	diff *storage.HistoryDiff,
+) error {
+	if diff.IsEmpty() {
+		return nil
+	}
+
+	diffData, err := json.Marshal(diff)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	s.data.lastHistoryID++
+	s.data.history = append(s.data.history, historyRecord{
+		id:         s.data.lastHistoryID,
+		ownerID:    ownerID,
+		objectType: objectType,
+		objectID:   objectID,
+		createdAt:  uint64(time.Now().Unix()),
+		diff:       diffData,
+	})
+
+	return nil
+}
+
+// addTaggingsHistoryRecord records the change of the taggings of the given
+// taggable, if there is any.
+func (s *StorageMemory) addTaggingsHistoryRecord(
+	taggableID int, oldTagIDs, newTagIDs []int,
+) error {
+	diff := storage.MakeTagIDsDiff(oldTagIDs, newTagIDs)
+	if diff.IsEmpty() {
+		return nil
+	}
+
+	t, ok := s.data.taggables[taggableID]
+	if !ok {
+		return hh.MakeInternalServerError(
+			errors.Errorf("taggable %d does not exist", taggableID),
+		)
+	}
+
+	return errors.Trace(
+		s.addHistoryRecord(t.ownerID, storage.HistoryObjectTaggable, taggableID, diff),
+	)
+}
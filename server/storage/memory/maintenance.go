@@ -0,0 +1,198 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+
+	"github.com/juju/errors"
+)
+
+// tagging is a single (taggable, tag) pair
+type tagging struct {
+	taggableID int
+	tagID      int
+}
+
+func (s *StorageMemory) CheckIntegrity(repair bool) (*storage.IntegrityReport, error) {
+	mode := storage.TxModeReadOnly
+	if repair {
+		mode = storage.TxModeReadWrite
+	}
+
+	report := storage.NewIntegrityReport()
+
+	err := s.TxOpt(
+		storage.TxILevelRepeatableRead, mode,
+		func(tx *sql.Tx) error {
+			s.checkChildrenCnt(report)
+
+			err := s.checkTaggings(tx, report)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			s.checkOnlyRootTagging(report)
+
+			report.Sort()
+
+			if repair {
+				if err := s.repairIntegrity(tx, report); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return report, nil
+}
+
+// repairIntegrity fixes all the repairable violations from the report, and
+// marks them as repaired.
+func (s *StorageMemory) repairIntegrity(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	for i := range report.Violations {
+		v := &report.Violations[i]
+
+		switch v.Kind {
+		case storage.IntegrityViolationChildrenCnt:
+			s.data.tags[v.TagID].childrenCnt = *v.ChildrenCntActual
+
+		case storage.IntegrityViolationMissingTagging:
+			s.data.taggings[v.TaggableID][v.TagID] = struct{}{}
+
+		case storage.IntegrityViolationRootOnlyTagging:
+			delete(s.data.taggings[v.TaggableID], v.TagID)
+			if len(s.data.taggings[v.TaggableID]) == 0 {
+				delete(s.data.taggings, v.TaggableID)
+			}
+
+		default:
+			continue
+		}
+
+		v.Repaired = true
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) checkTaggings(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+	users, err := s.GetUsers(tx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, user := range users {
+		missing := map[tagging]bool{}
+
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		th := taghier.New(&reg)
+
+		for _, t := range s.data.tags {
+			if t.ownerID == user.ID {
+				if err := th.Add(t.id); err != nil {
+					return errors.Annotatef(err, "user %d", user.ID)
+				}
+			}
+		}
+
+		// Make sure taghier contains just a single root
+		roots := th.GetRoots()
+		if len(roots) != 1 {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationTagRoots,
+				UserID:     user.ID,
+				RootTagIDs: roots,
+			})
+		}
+
+		// For each of the tags, make sure that there is a tagging for each
+		// tag in the current tag's path
+		for _, tagID := range th.GetAll() {
+			path := th.GetPath(tagID)
+
+			for taggableID, tgbTagIDs := range s.data.taggings {
+				if _, ok := tgbTagIDs[tagID]; !ok {
+					continue
+				}
+
+				for _, pathTagID := range path {
+					if _, ok := tgbTagIDs[pathTagID]; !ok {
+						missing[tagging{taggableID: taggableID, tagID: pathTagID}] = true
+					}
+				}
+			}
+		}
+
+		for t := range missing {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationMissingTagging,
+				UserID:     user.ID,
+				TagID:      t.tagID,
+				TaggableID: t.taggableID,
+			})
+		}
+	}
+
+	return nil
+}
+
+// It's illegal for the taggable to be tagged with the root tag only,
+// so checkOnlyRootTagging checks for these cases
+func (s *StorageMemory) checkOnlyRootTagging(report *storage.IntegrityReport) {
+	for _, t := range s.data.tags {
+		if t.parentID != 0 {
+			continue
+		}
+
+		for _, taggableID := range s.getTaggablesTaggedWithOnlyOneTag(t.id) {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationRootOnlyTagging,
+				UserID:     t.ownerID,
+				TagID:      t.id,
+				TaggableID: taggableID,
+			})
+		}
+	}
+}
+
+func (s *StorageMemory) checkChildrenCnt(report *storage.IntegrityReport) {
+	actual := make(map[int]int)
+	for _, t := range s.data.tags {
+		if t.parentID != 0 {
+			actual[t.parentID]++
+		}
+	}
+
+	for _, t := range s.data.tags {
+		if t.childrenCnt != actual[t.id] {
+			report.Add(storage.IntegrityViolation{
+				Kind:              storage.IntegrityViolationChildrenCnt,
+				UserID:            t.ownerID,
+				TagID:             t.id,
+				ChildrenCnt:       cptr.Int(t.childrenCnt),
+				ChildrenCntActual: cptr.Int(actual[t.id]),
+			})
+		}
+	}
+}
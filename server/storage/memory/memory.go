@@ -0,0 +1,114 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package memory implements storage.Storage which keeps all the data in
+// memory. It's mostly useful for tests: it needs no database server, and each
+// instance starts empty.
+//
+// storage.Storage methods take *sql.Tx, so in order to hand out those, the
+// package registers a dummy database/sql driver which doesn't support any
+// queries: the *sql.Tx is only used as a transaction handle, while the actual
+// data lives in memData.
+package memory // import "dmitryfrank.com/geekmarks/server/storage/memory"
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+const driverName = "geekmarks-memory"
+
+func init() {
+	sql.Register(driverName, memDriver{})
+}
+
+// Implements storage.Storage
+type StorageMemory struct {
+	db *sql.DB
+
+	// mu protects data: read-write transactions hold it exclusively, and
+	// read-only transactions share it.
+	mu   sync.RWMutex
+	data *memData
+
+	// txsMtx protects txs, which maps currently active transactions to their
+	// modes and contexts.
+	txsMtx sync.Mutex
+	txs    map[*sql.Tx]*memTx
+}
+
+type memTx struct {
+	mode storage.TxMode
+	ctx  context.Context
+}
+
+func New() (*StorageMemory, error) {
+	return &StorageMemory{
+		data: newMemData(),
+		txs:  make(map[*sql.Tx]*memTx),
+	}, nil
+}
+
+func (s *StorageMemory) Connect() error {
+	var err error
+	s.db, err = sql.Open(driverName, "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// ApplyMigrations does nothing: there is no schema to migrate.
+func (s *StorageMemory) ApplyMigrations() error {
+	return nil
+}
+
+// DropAllTables wipes all the data. It's used by tests.
+func (s *StorageMemory) DropAllTables() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data = newMemData()
+	return nil
+}
+
+// Dummy database/sql driver {{{
+
+type memDriver struct{}
+
+func (memDriver) Open(name string) (driver.Conn, error) {
+	return memConn{}, nil
+}
+
+type memConn struct{}
+
+func (memConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.Errorf("in-memory storage does not support SQL queries: %q", query)
+}
+
+func (memConn) Close() error {
+	return nil
+}
+
+func (memConn) Begin() (driver.Tx, error) {
+	return memDriverTx{}, nil
+}
+
+type memDriverTx struct{}
+
+func (memDriverTx) Commit() error {
+	return nil
+}
+
+func (memDriverTx) Rollback() error {
+	return nil
+}
+
+// }}}
@@ -0,0 +1,232 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package memory
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/storagetest"
+	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+func newConnectedStorage() (*StorageMemory, error) {
+	si, err := New()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = si.Connect()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return si, nil
+}
+
+func runWithStorage(t *testing.T, f func(si *StorageMemory) error) {
+	si, err := newConnectedStorage()
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = testutils.PrepareTestDB(t, si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = f(si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = storage.CheckIntegrity(si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+}
+
+func TestReadOnlyTx(t *testing.T) {
+	runWithStorage(t, func(si *StorageMemory) error {
+		err := si.TxOpt(
+			storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+			func(tx *sql.Tx) error {
+				_, err := si.CreateUser(tx, &storage.UserData{
+					Username: "test1",
+					Email:    "1@1.1",
+				})
+				return errors.Trace(err)
+			},
+		)
+		if err == nil {
+			return errors.Errorf("should not be able to create user in a read-only tx")
+		}
+
+		if _, _, err := testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Read-only transactions should be able to run concurrently
+		err = si.TxOpt(
+			storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+			func(tx *sql.Tx) error {
+				return si.TxOpt(
+					storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+					func(tx2 *sql.Tx) error {
+						users, err := si.GetUsers(tx2)
+						if err != nil {
+							return errors.Trace(err)
+						}
+						if len(users) != 1 {
+							return errors.Errorf("expected 1 user, got %d", len(users))
+						}
+						return nil
+					},
+				)
+			},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func TestInactiveTx(t *testing.T) {
+	runWithStorage(t, func(si *StorageMemory) error {
+		var staleTx *sql.Tx
+		err := si.Tx(func(tx *sql.Tx) error {
+			staleTx = tx
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.GetUsers(staleTx)
+		if err == nil {
+			return errors.Errorf("should not be able to use a finished transaction")
+		}
+
+		return nil
+	})
+}
+
+func TestOnDeleteCascade(t *testing.T) {
+	runWithStorage(t, func(si *StorageMemory) error {
+		var u1ID, u2ID int
+		var err error
+		if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+		if u2ID, _, err = testutils.CreateTestUser(si, "test2", "2@2.2"); err != nil {
+			return errors.Trace(err)
+		}
+
+		var u2BkmID int
+		err = si.Tx(func(tx *sql.Tx) error {
+			for _, userID := range []int{u1ID, u2ID} {
+				tagIDs, err := storagetest.MakeTagsHierarchy(tx, si, userID)
+				if err != nil {
+					return errors.Annotatef(err, "creating test tags hierarchy for user %d", userID)
+				}
+
+				bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+					OwnerID: userID,
+					URL:     "url1",
+				})
+				if err != nil {
+					return errors.Annotatef(err, "creating bookmark")
+				}
+
+				err = si.SetTaggings(
+					tx, bkmID, []int{tagIDs.Tag4ID}, storage.TaggingModeLeafs,
+				)
+				if err != nil {
+					return errors.Annotatef(err, "setting taggings")
+				}
+
+				u2BkmID = bkmID
+			}
+
+			return si.DeleteUser(tx, u1ID)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		d := si.data
+		if got := []int{
+			len(d.users), len(d.tags), len(d.taggables), len(d.bookmarks),
+			len(d.taggings), len(d.accessTokens),
+		}; !reflect.DeepEqual(got, []int{1, 9, 1, 1, 1, 1}) {
+			return errors.Errorf("unexpected items count after deleting user: %v", got)
+		}
+
+		if _, ok := d.taggings[u2BkmID]; !ok {
+			return errors.Errorf("taggings of the user 2 should be intact")
+		}
+
+		return nil
+	})
+}
+
+func TestRepairChildrenCnt(t *testing.T) {
+	runWithStorage(t, func(si *StorageMemory) error {
+		var u1ID int
+		var err error
+		if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		var rootTagID int
+		err = si.Tx(func(tx *sql.Tx) error {
+			var err error
+			rootTagID, err = si.GetRootTagID(tx, u1ID)
+			if err != nil {
+				return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+			}
+
+			si.data.tags[rootTagID].childrenCnt = 5
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		report, err := si.CheckIntegrity(true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		expected := []storage.IntegrityViolation{
+			{
+				Kind:              storage.IntegrityViolationChildrenCnt,
+				UserID:            u1ID,
+				TagID:             rootTagID,
+				ChildrenCnt:       cptr.Int(5),
+				ChildrenCntActual: cptr.Int(0),
+				Repaired:          true,
+			},
+		}
+		if !reflect.DeepEqual(report.Violations, expected) {
+			return errors.Errorf("expected violations %v, got %v", expected, report.Violations)
+		}
+
+		return nil
+	})
+}
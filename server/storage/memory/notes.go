@@ -0,0 +1,137 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"sort"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) CreateNote(tx *sql.Tx, nd *storage.NoteData) (noteID int, err error) {
+	if err := storage.ValidateNoteFormat(nd.Format); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	noteID, err = s.CreateTaggable(tx, &storage.TaggableData{
+		OwnerID: nd.OwnerID,
+		Type:    storage.TaggableTypeNote,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	s.data.notes[noteID] = &note{
+		title:  nd.Title,
+		body:   nd.Body,
+		format: nd.Format,
+	}
+
+	return noteID, nil
+}
+
+func (s *StorageMemory) UpdateNote(tx *sql.Tx, nd *storage.NoteData) (err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := storage.ValidateNoteFormat(nd.Format); err != nil {
+		return errors.Trace(err)
+	}
+
+	if n, ok := s.data.notes[nd.ID]; ok {
+		n.title = nd.Title
+		n.body = nd.Body
+		n.format = nd.Format
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) GetTaggedNotes(
+	tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *storage.TagsFetchOpts,
+) (notes []storage.NoteDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	taggableIDs, err := s.GetTaggedTaggableIDs(
+		tx, tagIDs, ownerID, []storage.TaggableType{storage.TaggableTypeNote},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	notes, err = s.getNotes(tx, s.data.skipTrashed(taggableIDs), tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Ids are sorted already, so the stable sort keeps notes created at the
+	// same time ordered by id
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].CreatedAt < notes[j].CreatedAt
+	})
+
+	return notes, nil
+}
+
+func (s *StorageMemory) GetNoteByID(
+	tx *sql.Tx, noteID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (note *storage.NoteDataWTags, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	if _, ok := s.data.notes[noteID]; !ok {
+		return nil, errors.Annotatef(storage.ErrNoteDoesNotExist, "id %d", noteID)
+	}
+
+	notes, err := s.getNotes(tx, []int{noteID}, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &notes[0], nil
+}
+
+// getNotes returns notes with the given ids; ids of taggables which are not
+// notes are ignored.
+func (s *StorageMemory) getNotes(
+	tx *sql.Tx, ids []int, tagsFetchOpts *storage.TagsFetchOpts,
+) (notes []storage.NoteDataWTags, err error) {
+	notes = []storage.NoteDataWTags{}
+	for _, id := range ids {
+		n, ok := s.data.notes[id]
+		if !ok {
+			continue
+		}
+		t := s.data.taggables[id]
+
+		note := storage.NoteDataWTags{
+			NoteData: storage.NoteData{
+				ID:        id,
+				OwnerID:   t.ownerID,
+				CreatedAt: t.createdAt,
+				UpdatedAt: t.updatedAt,
+				TrashedAt: t.trashedAt,
+				Title:     n.title,
+				Body:      n.body,
+				Format:    n.format,
+			},
+		}
+
+		note.Tags, err = s.getTaggableTags(tx, id, tagsFetchOpts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		notes = append(notes, note)
+	}
+
+	return notes, nil
+}
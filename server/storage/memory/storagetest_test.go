@@ -0,0 +1,19 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package memory
+
+import (
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func() (storage.Storage, error) {
+		return newConnectedStorage()
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"time"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) CreateTaggable(tx *sql.Tx, tgbd *storage.TaggableData) (tgbID int, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if _, ok := s.data.users[tgbd.OwnerID]; !ok {
+		return 0, hh.MakeInternalServerError(errors.Errorf(
+			"adding new taggable (owner_id: %d, type: %s): no such user",
+			tgbd.OwnerID, tgbd.Type,
+		))
+	}
+
+	s.data.lastTaggableID++
+	tgbID = s.data.lastTaggableID
+
+	now := uint64(time.Now().Unix())
+	s.data.taggables[tgbID] = &taggable{
+		id:        tgbID,
+		ownerID:   tgbd.OwnerID,
+		ttype:     tgbd.Type,
+		createdAt: now,
+		updatedAt: now,
+	}
+
+	return tgbID, nil
+}
+
+func (s *StorageMemory) DeleteTaggable(tx *sql.Tx, taggableID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	s.data.deleteTaggable(taggableID)
+
+	return nil
+}
+
+func (s *StorageMemory) GetTaggedTaggableIDs(
+	tx *sql.Tx, tagIDs []int, ownerID *int, ttypes []storage.TaggableType,
+) (taggableIDs []int, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// There is a different logic for two cases:
+	// - There is at least one tag given: we'll fetch taggables which are tagged
+	//   with all of the given tags (and possibly with any other tags)
+	// - There are no tags given: we'll fetch taggables which are untagged at all
+	taggableIDs = s.data.getSortedTaggableIDs(func(t *taggable) bool {
+		tgbTagIDs := s.data.taggings[t.id]
+
+		if len(tagIDs) > 0 {
+			for _, tagID := range tagIDs {
+				if _, ok := tgbTagIDs[tagID]; !ok {
+					return false
+				}
+			}
+		} else if len(tgbTagIDs) > 0 {
+			return false
+		}
+
+		if ownerID != nil && t.ownerID != *ownerID {
+			return false
+		}
+
+		if len(ttypes) > 0 {
+			typeMatches := false
+			for _, ttype := range ttypes {
+				if t.ttype == ttype {
+					typeMatches = true
+					break
+				}
+			}
+			if !typeMatches {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return taggableIDs, nil
+}
+
+// getTaggablesTaggedWithOnlyOneTag returns a slice of taggable ids tagged
+// with just one tag with given tagID. It is used to get taggables which are
+// tagged with root tag only.
+func (s *StorageMemory) getTaggablesTaggedWithOnlyOneTag(tagID int) []int {
+	return s.data.getSortedTaggableIDs(func(t *taggable) bool {
+		tgbTagIDs := s.data.taggings[t.id]
+		_, ok := tgbTagIDs[tagID]
+		return ok && len(tgbTagIDs) == 1
+	})
+}
+
+// getTaggableTags returns tags of the given taggable, as specified by
+// tagsFetchOpts.
+func (s *StorageMemory) getTaggableTags(
+	tx *sql.Tx, taggableID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bmTags []storage.BookmarkTagPath, err error) {
+	var bkmTagIDs []int
+
+	switch tagsFetchOpts.TagsFetchMode {
+	case storage.TagsFetchModeNone:
+		return nil, nil
+	case storage.TagsFetchModeLeafs, storage.TagsFetchModeAll:
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		thier := taghier.New(&reg)
+		for tagID := range s.data.taggings[taggableID] {
+			if err := thier.Add(tagID); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		if tagsFetchOpts.TagsFetchMode == storage.TagsFetchModeLeafs {
+			bkmTagIDs = thier.GetLeafs()
+		} else {
+			bkmTagIDs = thier.GetAll()
+		}
+	default:
+		return nil, hh.MakeInternalServerError(
+			errors.Errorf("wrong tags fetch mode %q", tagsFetchOpts.TagsFetchMode),
+		)
+	}
+
+	for _, tagID := range bkmTagIDs {
+		var tagPathItems []storage.BookmarkTagPathItem
+		switch tagsFetchOpts.TagNamesFetchMode {
+		case storage.TagNamesFetchModeNone:
+			// Nothing to do
+		case storage.TagNamesFetchModeFull:
+			tagPathItems = s.getTagPath(tagID)
+		default:
+			return nil, hh.MakeInternalServerError(
+				errors.Errorf("wrong tag names fetch mode %q", tagsFetchOpts.TagNamesFetchMode),
+			)
+		}
+
+		bmTags = append(bmTags, storage.BookmarkTagPath{
+			TagItems: tagPathItems,
+		})
+	}
+
+	return bmTags, nil
+}
+
+// getTagPath returns path items from the root tag to the given one.
+func (s *StorageMemory) getTagPath(tagID int) []storage.BookmarkTagPathItem {
+	var ret []storage.BookmarkTagPathItem
+	for t, ok := s.data.tags[tagID]; ok; t, ok = s.data.tags[t.parentID] {
+		ret = append([]storage.BookmarkTagPathItem{{
+			ID:   t.id,
+			Name: t.names[0],
+		}}, ret...)
+	}
+
+	return ret
+}
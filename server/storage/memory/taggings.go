@@ -0,0 +1,123 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"sort"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) GetTaggings(
+	tx *sql.Tx, taggableID int, tm storage.TaggingMode,
+) (tagIDs []int, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for tagID := range s.data.taggings[taggableID] {
+		tagIDs = append(tagIDs, tagID)
+	}
+	sort.Ints(tagIDs)
+
+	switch tm {
+	case storage.TaggingModeAll:
+		// tagIDs already contains all tag ids, return it
+		return tagIDs, nil
+
+	case storage.TaggingModeLeafs:
+		// We need to return only leafs
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		th := taghier.New(&reg)
+
+		for _, id := range tagIDs {
+			err := th.Add(id)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		return th.GetLeafs(), nil
+
+	default:
+		return nil, hh.MakeInternalServerError(
+			errors.Errorf("wrong tagging mode: %d", int(tm)),
+		)
+	}
+}
+
+func (s *StorageMemory) SetTaggings(
+	tx *sql.Tx, taggableID int, tagIDs []int, tm storage.TaggingMode,
+) (err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	var desired []int
+
+	// Get desired taggings
+	switch tm {
+	case storage.TaggingModeAll:
+		desired = tagIDs
+	case storage.TaggingModeLeafs:
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		th := taghier.New(&reg)
+
+		for _, id := range tagIDs {
+			err := th.Add(id)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		desired = th.GetAll()
+	}
+
+	// Mimic foreign keys of the SQL-backed storages
+	if _, ok := s.data.taggables[taggableID]; !ok && len(desired) > 0 {
+		return hh.MakeInternalServerError(
+			errors.Errorf("taggable %d does not exist", taggableID),
+		)
+	}
+	for _, tagID := range desired {
+		if _, ok := s.data.tags[tagID]; !ok {
+			return hh.MakeInternalServerError(
+				errors.Errorf("tag %d does not exist", tagID),
+			)
+		}
+	}
+
+	current := []int{}
+	for tagID := range s.data.taggings[taggableID] {
+		current = append(current, tagID)
+	}
+
+	if err := s.addTaggingsHistoryRecord(taggableID, current, desired); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(desired) == 0 {
+		delete(s.data.taggings, taggableID)
+		return nil
+	}
+
+	tgbTagIDs := make(map[int]struct{}, len(desired))
+	for _, tagID := range desired {
+		tgbTagIDs[tagID] = struct{}{}
+	}
+	s.data.taggings[taggableID] = tgbTagIDs
+
+	return nil
+}
@@ -0,0 +1,846 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) CreateTag(
+	tx *sql.Tx, td *storage.TagData,
+) (tagID int, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if len(td.Names) == 0 {
+		return 0, errors.Errorf("tag should have at least one name")
+	}
+
+	var parentID int
+
+	if td.ParentTagID != nil {
+		parentID = *td.ParentTagID
+	}
+
+	// check if given owner exists
+	{
+		_, err := s.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(td.OwnerID)})
+		if err != nil {
+			return 0, errors.Annotatef(err, "owner id %d", td.OwnerID)
+		}
+	}
+
+	if parentID > 0 {
+		// check if given parent tag id exists
+		parent, ok := s.data.tags[parentID]
+		if !ok {
+			return 0, errors.Errorf("Given parent tag id %d does not exist", parentID)
+		}
+
+		// increment children count of the parent
+		parent.childrenCnt++
+	} else {
+		// Each user can have just a single root tag
+		for _, t := range s.data.tags {
+			if t.ownerID == td.OwnerID && t.parentID == 0 {
+				return 0, hh.MakeInternalServerError(errors.Errorf(
+					"user %d already has a root tag", td.OwnerID,
+				))
+			}
+		}
+	}
+
+	description := ""
+	if td.Description != nil {
+		description = *td.Description
+	}
+
+	s.data.lastTagID++
+	tagID = s.data.lastTagID
+
+	s.data.tags[tagID] = &tag{
+		id:       tagID,
+		ownerID:  td.OwnerID,
+		parentID: parentID,
+		descr:    description,
+	}
+
+	// Add all names
+	for _, name := range td.Names {
+		if err := s.addTagName(
+			tagID, parentID, name,
+			(parentID == 0), // allowEmpty
+		); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	// Create all subtags
+	for _, subTag := range td.Subtags {
+		_, err := s.CreateTag(tx, &subTag)
+		if err != nil {
+			return 0, errors.Annotatef(err, "creating subtag")
+		}
+	}
+
+	return tagID, nil
+}
+
+func (s *StorageMemory) UpdateTag(
+	tx *sql.Tx, td *storage.TagData, leafPolicy storage.TaggableLeafPolicy,
+) (err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	oldTD, err := s.GetTag(tx, td.ID, &storage.GetTagOpts{GetNames: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.updateTagInternal(tx, td, leafPolicy); err != nil {
+		return errors.Trace(err)
+	}
+
+	newTD, err := s.GetTag(tx, td.ID, &storage.GetTagOpts{GetNames: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = s.addHistoryRecord(
+		oldTD.OwnerID, storage.HistoryObjectTag, td.ID,
+		storage.MakeTagDiff(oldTD, newTD),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) updateTagInternal(
+	tx *sql.Tx, td *storage.TagData, leafPolicy storage.TaggableLeafPolicy,
+) (err error) {
+
+	// Move tag, if needed {{{
+	if td.ParentTagID != nil {
+		// We need to move the tag under another tag
+
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		hierProto := taghier.New(&reg)
+
+		if err := hierProto.Add(td.ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := hierProto.Add(*td.ParentTagID); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Make sure that the new parent is not the current tag or one of its
+		// descendants
+		isSubnode, err := hierProto.IsSubnode(*td.ParentTagID, td.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if *td.ParentTagID == td.ID || isSubnode {
+			return errors.Errorf("tag cannot be moved under itself or one of its descendants")
+		}
+
+		oldParentID := hierProto.GetParent(td.ID)
+
+		// Get affected bookmarks (those tagged with the original tag id and its
+		// descendants)
+		taggableIDs, err := s.GetTaggedTaggableIDs(tx, []int{td.ID}, nil, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// For all the affected bookmarks, calculate the difference and apply
+		for _, taggableID := range taggableIDs {
+			// Get all taggings for the current bookmark
+			tagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Create a warmed-up copy of taghier instance, and feed all current tag
+			// IDs to it
+			hierCur := hierProto.MakeCopy()
+			for _, id := range tagIDs {
+				if err := hierCur.Add(id); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			var removeNewLeafs bool
+			switch leafPolicy {
+			case storage.TaggableLeafPolicyKeep:
+				removeNewLeafs = false
+			case storage.TaggableLeafPolicyDel:
+				removeNewLeafs = true
+			default:
+				return errors.Errorf("invalid leafPolicy: %q", leafPolicy)
+			}
+
+			// Perform the in-memory move, and delete all new leafs
+			if err := hierCur.Move(td.ID, *td.ParentTagID, removeNewLeafs); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Apply the taggings change
+			err = s.SetTaggings(tx, taggableID, hierCur.GetAll(), storage.TaggingModeAll)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Update parent of the moved tag, and children_cnt of the two parents
+		s.data.tags[td.ID].parentID = *td.ParentTagID
+		s.data.tags[oldParentID].childrenCnt--
+		s.data.tags[*td.ParentTagID].childrenCnt++
+	}
+	// }}}
+
+	// Update tag description, if needed {{{
+	if td.Description != nil {
+		if t, ok := s.data.tags[td.ID]; ok {
+			t.descr = *td.Description
+		}
+	}
+	// }}}
+
+	// Update tag names, if needed {{{
+	if td.Names != nil {
+		if len(td.Names) == 0 {
+			return errors.Errorf("tag should have at least one name")
+		}
+
+		t, ok := s.data.tags[td.ID]
+		if !ok {
+			return errors.Trace(storage.ErrTagDoesNotExist)
+		}
+
+		cur := make(map[string]struct{})
+		for _, name := range t.names {
+			cur[name] = struct{}{}
+		}
+
+		for _, name := range td.Names {
+			if _, ok := cur[name]; ok {
+				continue
+			}
+
+			if err := s.checkNewTagName(t.parentID, name, false); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Also add it to cur, so that duplicates in td.Names are detected
+			cur[name] = struct{}{}
+		}
+
+		t.names = append([]string(nil), td.Names...)
+	}
+	// }}}
+
+	return nil
+}
+
+func (s *StorageMemory) DeleteTag(
+	tx *sql.Tx, tagID int, leafPolicy storage.TaggableLeafPolicy, dryRun bool,
+) (result *storage.TagDeleteResult, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var removeNewLeafs bool
+	switch leafPolicy {
+	case storage.TaggableLeafPolicyKeep:
+		removeNewLeafs = false
+	case storage.TaggableLeafPolicyDel:
+		removeNewLeafs = true
+	default:
+		return nil, errors.Errorf("invalid leafPolicy: %q", leafPolicy)
+	}
+
+	td, err := s.GetTag(tx, tagID, &storage.GetTagOpts{GetNames: true})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Make sure the tag to be deleted is not the user's root tag
+	rootTagID, err := s.GetRootTagID(tx, td.OwnerID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if tagID == rootTagID {
+		glog.V(2).Infof("tried to delete the root tag")
+		return nil, errors.Errorf("cowardly refused to delete the root tag")
+	}
+
+	reg := thReg{
+		s:  s,
+		tx: tx,
+	}
+	hierProto := taghier.New(&reg)
+
+	if err := hierProto.Add(tagID); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Get affected taggables (those tagged with the tag being deleted and its
+	// descendants)
+	taggableIDs, err := s.GetTaggedTaggableIDs(tx, []int{tagID}, nil, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result = &storage.TagDeleteResult{
+		RetaggedIDs: []int{},
+		UntaggedIDs: []int{},
+	}
+
+	// For all the affected taggables, calculate the new taggings and apply
+	for _, taggableID := range taggableIDs {
+		tagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		hierCur := hierProto.MakeCopy()
+		for _, id := range tagIDs {
+			if err := hierCur.Add(id); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		// Perform the in-memory deletion, and delete all new leafs if needed
+		if err := hierCur.Delete(tagID, removeNewLeafs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// If only the root tag is left, the taggable becomes untagged
+		newTagIDs := hierCur.GetAll()
+		if len(newTagIDs) == 1 && newTagIDs[0] == rootTagID {
+			newTagIDs = []int{}
+		}
+
+		if len(newTagIDs) == 0 {
+			result.UntaggedIDs = append(result.UntaggedIDs, taggableID)
+		} else {
+			result.RetaggedIDs = append(result.RetaggedIDs, taggableID)
+		}
+
+		if !dryRun {
+			err = s.SetTaggings(tx, taggableID, newTagIDs, storage.TaggingModeAll)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+
+	sort.Ints(result.RetaggedIDs)
+	sort.Ints(result.UntaggedIDs)
+
+	if dryRun {
+		return result, nil
+	}
+
+	err = s.addHistoryRecord(
+		td.OwnerID, storage.HistoryObjectTag, tagID, &storage.HistoryDiff{
+			Names:   &storage.StringsChange{Old: td.Names, New: []string{}},
+			Deleted: true,
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Delete the tag with all the subtags and taggings
+	s.data.deleteTag(tagID)
+	s.data.tags[*td.ParentTagID].childrenCnt--
+
+	return result, nil
+}
+
+func (s *StorageMemory) MergeTags(tx *sql.Tx, srcTagID, dstTagID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	srcTD, err := s.GetTag(tx, srcTagID, &storage.GetTagOpts{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	dstTD, err := s.GetTag(tx, dstTagID, &storage.GetTagOpts{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if srcTD.OwnerID != dstTD.OwnerID {
+		return errors.Errorf("tags %d and %d belong to different users", srcTagID, dstTagID)
+	}
+
+	rootTagID, err := s.GetRootTagID(tx, srcTD.OwnerID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if srcTagID == rootTagID {
+		return errors.Errorf("cowardly refused to merge the root tag")
+	}
+
+	// Make sure that the target is not the source tag or one of its descendants
+	reg := thReg{
+		s:  s,
+		tx: tx,
+	}
+	hier := taghier.New(&reg)
+
+	if err := hier.Add(srcTagID); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := hier.Add(dstTagID); err != nil {
+		return errors.Trace(err)
+	}
+
+	isSubnode, err := hier.IsSubnode(dstTagID, srcTagID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if dstTagID == srcTagID || isSubnode {
+		return errors.Errorf("tag cannot be merged into itself or one of its descendants")
+	}
+
+	// Remember leaf taggings of the affected taggables (those tagged with the
+	// source tag and its descendants), before the hierarchy changes
+	taggableIDs, err := s.GetTaggedTaggableIDs(tx, []int{srcTagID}, nil, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	leafs := map[int][]int{}
+	for _, taggableID := range taggableIDs {
+		leafs[taggableID], err = s.GetTaggings(tx, taggableID, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	replacedBy := map[int]int{}
+	if err := s.mergeTagsInternal(srcTagID, dstTagID, replacedBy); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tag the affected taggables with the same leafs, but replacing the merged
+	// tags with their targets; SetTaggings will take care of the full paths
+	for _, taggableID := range taggableIDs {
+		newLeafs := []int{}
+		for _, tagID := range leafs[taggableID] {
+			if newTagID, ok := replacedBy[tagID]; ok {
+				tagID = newTagID
+			}
+
+			// Merging into the root tag leaves the taggable untagged
+			if tagID != rootTagID {
+				newLeafs = append(newLeafs, tagID)
+			}
+		}
+
+		err := s.SetTaggings(tx, taggableID, newLeafs, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// mergeTagsInternal merges the hierarchy of srcTagID into dstTagID, and
+// deletes srcTagID, without touching taggings of other tags. All the merged
+// (and thus deleted) tag ids are added to replacedBy.
+func (s *StorageMemory) mergeTagsInternal(
+	srcTagID, dstTagID int, replacedBy map[int]int,
+) error {
+	replacedBy[srcTagID] = dstTagID
+
+	src := s.data.tags[srcTagID]
+	dst := s.data.tags[dstTagID]
+
+	opts := &storage.GetTagOpts{GetNames: true}
+	dstSubtags := s.getSubtagsData(dstTagID, opts)
+
+	for _, srcSubtag := range s.getSubtagsData(srcTagID, opts) {
+		dstSubtag, err := storage.FindTagByNames(dstSubtags, srcSubtag.Names)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if dstSubtag != nil {
+			err := s.mergeTagsInternal(srcSubtag.ID, dstSubtag.ID, replacedBy)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+
+		// There's no such subtag in the target, so just move the subtag
+		s.data.tags[srcSubtag.ID].parentID = dstTagID
+		dst.childrenCnt++
+	}
+
+	// All the subtags are moved away, so the source tag can be deleted now
+	// (together with its taggings, which are going to be fixed by the caller)
+	s.data.deleteTag(srcTagID)
+	s.data.tags[src.parentID].childrenCnt--
+
+	// The root tag has no names to add to
+	if dst.parentID == 0 {
+		return nil
+	}
+
+	dstNames := map[string]struct{}{}
+	for _, name := range dst.names {
+		dstNames[name] = struct{}{}
+	}
+
+	// Add the names which the target tag doesn't have yet
+	for _, name := range src.names {
+		if _, ok := dstNames[name]; ok {
+			continue
+		}
+
+		if err := s.addTagName(dstTagID, dst.parentID, name, false); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) CopyTag(
+	tx *sql.Tx, srcTagID, parentTagID int, names []string, retag bool,
+) (tagID int, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Get the whole source subtree before creating anything, so that a tag can
+	// be copied under itself or one of its descendants
+	srcTD, err := s.GetTag(tx, srcTagID, &storage.GetTagOpts{
+		GetNames:   true,
+		GetSubtags: true,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	parentTD, err := s.GetTag(tx, parentTagID, &storage.GetTagOpts{})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if srcTD.OwnerID != parentTD.OwnerID {
+		return 0, errors.Errorf("tags %d and %d belong to different users", srcTagID, parentTagID)
+	}
+
+	rootTagID, err := s.GetRootTagID(tx, srcTD.OwnerID)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if srcTagID == rootTagID {
+		return 0, errors.Errorf("cowardly refused to copy the root tag")
+	}
+
+	if len(names) > 0 {
+		srcTD.Names = names
+	}
+
+	// Remember leaf taggings of the affected taggables (those tagged with the
+	// source tag and its descendants) before the copies appear
+	var taggableIDs []int
+	leafs := map[int][]int{}
+	if retag {
+		taggableIDs, err = s.GetTaggedTaggableIDs(tx, []int{srcTagID}, nil, nil)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		for _, taggableID := range taggableIDs {
+			leafs[taggableID], err = s.GetTaggings(tx, taggableID, storage.TaggingModeLeafs)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+	}
+
+	copiedTo := map[int]int{}
+	tagID, err = s.copyTagInternal(tx, srcTD, parentTagID, copiedTo)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Tag the affected taggables with the copies of their leafs as well;
+	// SetTaggings will take care of the full paths
+	for _, taggableID := range taggableIDs {
+		newLeafs := append([]int{}, leafs[taggableID]...)
+		for _, leafID := range leafs[taggableID] {
+			if copyID, ok := copiedTo[leafID]; ok {
+				newLeafs = append(newLeafs, copyID)
+			}
+		}
+
+		err := s.SetTaggings(tx, taggableID, newLeafs, storage.TaggingModeLeafs)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return tagID, nil
+}
+
+// copyTagInternal creates a copy of the given tag with all its subtags under
+// the tag parentTagID. Ids of all the created copies are added to copiedTo,
+// keyed by ids of the original tags.
+func (s *StorageMemory) copyTagInternal(
+	tx *sql.Tx, td *storage.TagData, parentTagID int, copiedTo map[int]int,
+) (tagID int, err error) {
+	tagID, err = s.CreateTag(tx, &storage.TagData{
+		OwnerID:     td.OwnerID,
+		ParentTagID: cptr.Int(parentTagID),
+		Description: td.Description,
+		Names:       td.Names,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	copiedTo[td.ID] = tagID
+
+	for i := range td.Subtags {
+		if _, err := s.copyTagInternal(tx, &td.Subtags[i], tagID, copiedTo); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return tagID, nil
+}
+
+func (s *StorageMemory) GetTagIDByPath(tx *sql.Tx, ownerID int, tagPath string) (int, error) {
+	names := strings.Split(tagPath, "/")
+	curTagID, err := s.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	for _, tagName := range names {
+		if tagName == "" {
+			// skip empty names
+			continue
+		}
+		var err error
+		curTagID, err = s.GetTagIDByName(tx, curTagID, tagName)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return curTagID, nil
+}
+
+func (s *StorageMemory) GetTagIDByName(
+	tx *sql.Tx, parentTagID int, tagName string,
+) (int, error) {
+	if err := s.checkTx(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	t := s.findTagByName(parentTagID, tagName)
+	if t == nil {
+		return 0, errors.Annotatef(storage.ErrTagDoesNotExist, "%q", tagName)
+	}
+
+	return t.id, nil
+}
+
+// GetRootTagID returns the id of the root tag for the given user.
+func (s *StorageMemory) GetRootTagID(tx *sql.Tx, ownerID int) (int, error) {
+	if err := s.checkTx(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	for _, t := range s.data.tags {
+		if t.ownerID == ownerID && t.parentID == 0 {
+			return t.id, nil
+		}
+	}
+
+	return 0, hh.MakeInternalServerError(
+		errors.Errorf("getting root tag id for the user id %d: not found", ownerID),
+	)
+}
+
+func (s *StorageMemory) GetTagNames(tx *sql.Tx, tagID int) ([]string, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	t, ok := s.data.tags[tagID]
+	if !ok {
+		return nil, nil
+	}
+
+	return append([]string(nil), t.names...), nil
+}
+
+func (s *StorageMemory) GetTag(
+	tx *sql.Tx, tagID int, opts *storage.GetTagOpts,
+) (*storage.TagData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	t, ok := s.data.tags[tagID]
+	if !ok {
+		return nil, storage.ErrTagDoesNotExist
+	}
+
+	td := s.makeTagData(t, opts)
+	return &td, nil
+}
+
+func (s *StorageMemory) GetTags(
+	tx *sql.Tx, parentTagID int, opts *storage.GetTagOpts,
+) ([]storage.TagData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return s.getSubtagsData(parentTagID, opts), nil
+}
+
+func (s *StorageMemory) makeTagData(t *tag, opts *storage.GetTagOpts) storage.TagData {
+	td := storage.TagData{
+		ID:          t.id,
+		OwnerID:     t.ownerID,
+		ParentTagID: cptr.Int(t.parentID),
+		Description: cptr.String(t.descr),
+	}
+
+	if opts.GetNames {
+		td.Names = append([]string(nil), t.names...)
+	}
+
+	if opts.GetSubtags && t.childrenCnt > 0 {
+		td.Subtags = s.getSubtagsData(t.id, opts)
+	}
+
+	return td
+}
+
+func (s *StorageMemory) getSubtagsData(
+	parentTagID int, opts *storage.GetTagOpts,
+) []storage.TagData {
+	var tagsData []storage.TagData
+	subtags := s.data.getSortedTags(func(t *tag) bool {
+		return t.parentID == parentTagID
+	})
+	for _, t := range subtags {
+		tagsData = append(tagsData, s.makeTagData(t, opts))
+	}
+
+	return tagsData
+}
+
+// findTagByName returns the tag with the given name under the given parent
+// tag, or nil if there is no such tag.
+func (s *StorageMemory) findTagByName(parentTagID int, name string) *tag {
+	// The root tag has the parent 0, but it can't be found by name, just like
+	// in SQL storages, where root tag has NULL parent_id.
+	if parentTagID == 0 {
+		return nil
+	}
+
+	for _, t := range s.data.tags {
+		if t.parentID != parentTagID {
+			continue
+		}
+		for _, n := range t.names {
+			if n == name {
+				return t
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkNewTagName returns an error if the given name is invalid, or the tag
+// with this name already exists under the given parent.
+func (s *StorageMemory) checkNewTagName(
+	parentTagID int, name string, allowEmpty bool,
+) error {
+	err := storage.ValidateTagName(name, allowEmpty)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if s.findTagByName(parentTagID, name) != nil {
+		return errors.Errorf("Tag with the name %q already exists", name)
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) addTagName(
+	tagID, parentTagID int, name string, allowEmpty bool,
+) error {
+	glog.V(3).Infof("Adding tag name %q for tag %d", name, tagID)
+
+	if err := s.checkNewTagName(parentTagID, name, allowEmpty); err != nil {
+		return errors.Trace(err)
+	}
+
+	t := s.data.tags[tagID]
+	t.names = append(t.names, name)
+
+	return nil
+}
+
+// taghier's registry implementation which looks up the storage {{{
+type thReg struct {
+	s  *StorageMemory
+	tx *sql.Tx
+}
+
+func (r *thReg) GetParent(id int) (int, error) {
+	td, err := r.s.GetTag(r.tx, id, &storage.GetTagOpts{
+		GetNames:   false,
+		GetSubtags: false,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return *td.ParentTagID, nil
+}
+
+// }}}
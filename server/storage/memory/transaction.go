@@ -0,0 +1,135 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"context"
+	"database/sql"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) Tx(fn func(*sql.Tx) error) error {
+	return s.TxOpt(storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn)
+}
+
+func (s *StorageMemory) TxOpt(
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	return s.TxOptCtx(context.Background(), ilevel, mode, fn)
+}
+
+func (s *StorageMemory) TxCtx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return s.TxOptCtx(ctx, storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn)
+}
+
+// TxOptCtx runs fn in a transaction. Read-write transactions are executed one
+// at a time, so they are always serializable, and ilevel is ignored.
+// Read-only transactions can run concurrently with each other. Once ctx is
+// done, all the methods called with the transaction fail, and it's rolled
+// back.
+//
+// NOTE: since read-write transactions are exclusive, starting a transaction
+// from within another one results in a deadlock.
+func (s *StorageMemory) TxOptCtx(
+	ctx context.Context,
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Annotate(err, "begin transaction")
+	}
+
+	var backup *memData
+
+	switch mode {
+	case storage.TxModeReadWrite:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		backup = s.data.clone()
+	case storage.TxModeReadOnly:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	default:
+		tx.Rollback()
+		return errors.Errorf("invalid transaction mode: %d", mode)
+	}
+
+	s.txsMtx.Lock()
+	s.txs[tx] = &memTx{mode: mode, ctx: ctx}
+	s.txsMtx.Unlock()
+
+	err = fn(tx)
+
+	s.txsMtx.Lock()
+	delete(s.txs, tx)
+	s.txsMtx.Unlock()
+
+	// Don't commit if the context is done by now, even if fn succeeded: the
+	// caller is not interested in the result anymore
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		if backup != nil {
+			s.data = backup
+		}
+		if err2 := tx.Rollback(); err2 != nil {
+			glog.Errorf("Transaction rollback failed: %+v", err2)
+		}
+		return errors.Trace(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Annotate(err, "commit transaction")
+	}
+	return nil
+}
+
+// checkTx returns an error if the given transaction is not active.
+func (s *StorageMemory) checkTx(tx *sql.Tx) error {
+	_, err := s.getTxMode(tx)
+	return errors.Trace(err)
+}
+
+// checkTxWritable returns an error if the given transaction is not active, or
+// it's read-only.
+func (s *StorageMemory) checkTxWritable(tx *sql.Tx) error {
+	mode, err := s.getTxMode(tx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if mode != storage.TxModeReadWrite {
+		return hh.MakeInternalServerError(
+			errors.Errorf("cannot modify data in a read-only transaction"),
+		)
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) getTxMode(tx *sql.Tx) (storage.TxMode, error) {
+	s.txsMtx.Lock()
+	defer s.txsMtx.Unlock()
+
+	t, ok := s.txs[tx]
+	if !ok {
+		return 0, hh.MakeInternalServerError(
+			errors.Errorf("transaction is not active"),
+		)
+	}
+
+	if err := t.ctx.Err(); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return t.mode, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func (s *StorageMemory) TrashTaggable(tx *sql.Tx, taggableID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	if t, ok := s.data.taggables[taggableID]; ok && t.trashedAt == 0 {
+		t.trashedAt = uint64(time.Now().Unix())
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) RestoreTaggable(tx *sql.Tx, taggableID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	// If it's a bookmark, check whether another bookmark with the same URL
+	// was created while this one was in the trash
+	bkm, err := s.GetBookmarkByID(tx, taggableID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err == nil {
+		if bkm.CanonicalURL != "" {
+			existingBkms, err := s.GetBookmarksByURL(tx, bkm.CanonicalURL, bkm.OwnerID, &storage.TagsFetchOpts{
+				TagsFetchMode:     storage.TagsFetchModeNone,
+				TagNamesFetchMode: storage.TagNamesFetchModeNone,
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if len(existingBkms) > 0 {
+				return errors.Errorf("bookmark with the url %q already exists", bkm.URL)
+			}
+		}
+	} else if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+		return errors.Trace(err)
+	}
+
+	if t, ok := s.data.taggables[taggableID]; ok {
+		t.trashedAt = 0
+	}
+
+	return nil
+}
+
+func (s *StorageMemory) GetTrashedTaggables(
+	tx *sql.Tx, ownerID int,
+) (taggables []storage.TaggableData, err error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	taggables = []storage.TaggableData{}
+	for _, t := range s.data.taggables {
+		if t.ownerID != ownerID || t.trashedAt == 0 {
+			continue
+		}
+
+		taggables = append(taggables, storage.TaggableData{
+			ID:        t.id,
+			OwnerID:   t.ownerID,
+			Type:      t.ttype,
+			CreatedAt: t.createdAt,
+			UpdatedAt: t.updatedAt,
+			TrashedAt: t.trashedAt,
+		})
+	}
+
+	sort.Slice(taggables, func(i, j int) bool {
+		if taggables[i].TrashedAt != taggables[j].TrashedAt {
+			return taggables[i].TrashedAt > taggables[j].TrashedAt
+		}
+		return taggables[i].ID > taggables[j].ID
+	})
+
+	return taggables, nil
+}
+
+func (s *StorageMemory) PurgeTrash(
+	tx *sql.Tx, ownerID *int, trashedBefore uint64,
+) (taggableIDs []int, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	taggableIDs = s.data.getSortedTaggableIDs(func(t *taggable) bool {
+		if t.trashedAt == 0 || t.trashedAt > trashedBefore {
+			return false
+		}
+
+		return ownerID == nil || t.ownerID == *ownerID
+	})
+
+	for _, id := range taggableIDs {
+		s.data.deleteTaggable(id)
+	}
+
+	if taggableIDs == nil {
+		taggableIDs = []int{}
+	}
+
+	return taggableIDs, nil
+}
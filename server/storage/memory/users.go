@@ -0,0 +1,442 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package memory
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/dchest/uniuri"
+	"github.com/juju/errors"
+)
+
+const (
+	accessTokenLen = 32
+)
+
+func (s *StorageMemory) GetUser(
+	tx *sql.Tx, args *storage.GetUserArgs,
+) (*storage.UserData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ud *storage.UserData
+	if args.ID != nil {
+		ud = s.data.users[*args.ID]
+	} else if args.Username != nil {
+		for _, u := range s.data.users {
+			if u.Username == *args.Username {
+				ud = u
+				break
+			}
+		}
+	} else if args.Email != nil {
+		for _, u := range s.data.users {
+			if u.Email == *args.Email {
+				ud = u
+				break
+			}
+		}
+	} else {
+		return nil, hh.MakeInternalServerError(errors.Errorf(
+			"neither id, username nor email is given to storage.GetUser()",
+		))
+	}
+
+	if ud == nil {
+		return nil, errors.Trace(storage.ErrUserDoesNotExist)
+	}
+
+	ret := *ud
+	return &ret, nil
+}
+
+func (s *StorageMemory) CreateUser(
+	tx *sql.Tx, ud *storage.UserData,
+) (userID int, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Mimic unique constraints of the SQL-backed storages
+	for _, u := range s.data.users {
+		if u.Username == ud.Username {
+			return 0, hh.MakeInternalServerError(
+				errors.Errorf("user with the username %q already exists", ud.Username),
+			)
+		}
+		if u.Email == ud.Email {
+			return 0, hh.MakeInternalServerError(
+				errors.Errorf("user with the email %q already exists", ud.Email),
+			)
+		}
+	}
+
+	s.data.lastUserID++
+	userID = s.data.lastUserID
+
+	s.data.users[userID] = &storage.UserData{
+		ID:       userID,
+		Username: ud.Username,
+		Password: ud.Password,
+		Email:    ud.Email,
+	}
+
+	// Also, create a root tag for the newly added user: no parent and an
+	// empty string name
+	_, err = s.CreateTag(tx, &storage.TagData{
+		OwnerID:     userID,
+		Description: cptr.String("Root pseudo-tag"),
+		Names:       []string{""},
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return userID, nil
+}
+
+func (s *StorageMemory) DeleteUser(tx *sql.Tx, userID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Delete everything which belongs to the user
+	for _, t := range s.data.taggables {
+		if t.ownerID == userID {
+			s.data.deleteTaggable(t.id)
+		}
+	}
+
+	for _, t := range s.data.tags {
+		if t.ownerID == userID && t.parentID == 0 {
+			s.data.deleteTag(t.id)
+		}
+	}
+
+	tokens := []accessToken{}
+	for _, tok := range s.data.accessTokens {
+		if tok.userID != userID {
+			tokens = append(tokens, tok)
+		}
+	}
+	s.data.accessTokens = tokens
+
+	eids := []externalIdentity{}
+	for _, eid := range s.data.externalIdentities {
+		if eid.userID != userID {
+			eids = append(eids, eid)
+		}
+	}
+	s.data.externalIdentities = eids
+
+	grants := []tagGrant{}
+	for _, g := range s.data.tagGrants {
+		if g.granteeID != userID {
+			grants = append(grants, g)
+		}
+	}
+	s.data.tagGrants = grants
+
+	history := []historyRecord{}
+	for _, r := range s.data.history {
+		if r.ownerID != userID {
+			history = append(history, r)
+		}
+	}
+	s.data.history = history
+
+	delete(s.data.users, userID)
+
+	return nil
+}
+
+func (s *StorageMemory) SetUserPassword(
+	tx *sql.Tx, userID int, passwordHash string,
+) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	ud, ok := s.data.users[userID]
+	if !ok {
+		return errors.Annotatef(storage.ErrUserDoesNotExist, "id %d", userID)
+	}
+
+	ud.Password = passwordHash
+
+	return nil
+}
+
+func (s *StorageMemory) GetUsers(tx *sql.Tx) ([]storage.UserData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ret []storage.UserData
+	for _, u := range s.data.users {
+		ret = append(ret, *u)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+
+	return ret, nil
+}
+
+func (s *StorageMemory) CreateAccessToken(
+	tx *sql.Tx, atd *storage.AccessTokenData,
+) (tokenID int, token string, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return 0, "", errors.Trace(err)
+	}
+
+	scope := atd.Scope
+	if scope == "" {
+		scope = storage.AccessTokenScopeDefault
+	}
+	if err := storage.ValidateAccessTokenScope(scope); err != nil {
+		return 0, "", errors.Trace(err)
+	}
+
+	if _, ok := s.data.users[atd.UserID]; !ok {
+		return 0, "", hh.MakeInternalServerError(errors.Errorf(
+			"failed to create access token (%q, user_id: %d): no such user",
+			atd.Descr, atd.UserID,
+		))
+	}
+
+	if atd.RootTagID != 0 {
+		if _, ok := s.data.tags[atd.RootTagID]; !ok {
+			return 0, "", hh.MakeInternalServerError(errors.Errorf(
+				"failed to create access token (%q, user_id: %d): no such tag %d",
+				atd.Descr, atd.UserID, atd.RootTagID,
+			))
+		}
+	}
+
+	token = uniuri.NewLen(accessTokenLen)
+	s.data.lastTokenID++
+	s.data.accessTokens = append(s.data.accessTokens, accessToken{
+		id:        s.data.lastTokenID,
+		tokenHash: storage.HashAccessToken(token),
+		userID:    atd.UserID,
+		descr:     atd.Descr,
+		scope:     scope,
+		rootTagID: atd.RootTagID,
+		createdAt: uint64(time.Now().Unix()),
+		expiresAt: atd.ExpiresAt,
+	})
+
+	return s.data.lastTokenID, token, nil
+}
+
+func (tok *accessToken) data() storage.AccessTokenData {
+	return storage.AccessTokenData{
+		ID:         tok.id,
+		UserID:     tok.userID,
+		Descr:      tok.descr,
+		Scope:      tok.scope,
+		RootTagID:  tok.rootTagID,
+		CreatedAt:  tok.createdAt,
+		LastUsedAt: tok.lastUsedAt,
+		ExpiresAt:  tok.expiresAt,
+	}
+}
+
+func (s *StorageMemory) GetAccessToken(
+	tx *sql.Tx, tokenID int,
+) (*storage.AccessTokenData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, tok := range s.data.accessTokens {
+		if tok.id == tokenID {
+			atd := tok.data()
+			return &atd, nil
+		}
+	}
+
+	return nil, errors.Trace(storage.ErrAccessTokenDoesNotExist)
+}
+
+func (s *StorageMemory) GetAccessTokens(
+	tx *sql.Tx, userID int,
+) ([]storage.AccessTokenData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := []storage.AccessTokenData{}
+	for _, tok := range s.data.accessTokens {
+		if tok.userID == userID {
+			ret = append(ret, tok.data())
+		}
+	}
+
+	return ret, nil
+}
+
+func (s *StorageMemory) DeleteAccessToken(tx *sql.Tx, tokenID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	for i, tok := range s.data.accessTokens {
+		if tok.id == tokenID {
+			s.data.accessTokens = append(
+				s.data.accessTokens[:i:i], s.data.accessTokens[i+1:]...,
+			)
+			return nil
+		}
+	}
+
+	return errors.Trace(storage.ErrAccessTokenDoesNotExist)
+}
+
+func (s *StorageMemory) GetUserByAccessToken(
+	tx *sql.Tx, token string,
+) (*storage.UserData, *storage.AccessTokenData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	now := uint64(time.Now().Unix())
+	tokenHash := storage.HashAccessToken(token)
+
+	for i := range s.data.accessTokens {
+		tok := &s.data.accessTokens[i]
+		if tok.tokenHash != tokenHash {
+			continue
+		}
+
+		if tok.expiresAt != 0 && tok.expiresAt <= now {
+			break
+		}
+
+		ud, err := s.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(tok.userID)})
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		if tok.lastUsedAt+storage.AccessTokenLastUsedResolution <= now {
+			if err := s.checkTxWritable(tx); err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			tok.lastUsedAt = now
+		}
+
+		atd := tok.data()
+		return ud, &atd, nil
+	}
+
+	return nil, nil, hh.MakeUnauthorizedError()
+}
+
+func (s *StorageMemory) GetExternalIdentities(
+	tx *sql.Tx, userID int,
+) ([]storage.ExternalIdentityData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := []storage.ExternalIdentityData{}
+	for _, eid := range s.data.externalIdentities {
+		if eid.userID == userID {
+			ret = append(ret, storage.ExternalIdentityData{
+				ID:        eid.id,
+				UserID:    eid.userID,
+				Provider:  eid.provider,
+				Subject:   eid.subject,
+				Email:     eid.email,
+				CreatedAt: eid.createdAt,
+			})
+		}
+	}
+
+	return ret, nil
+}
+
+func (s *StorageMemory) DeleteExternalIdentity(tx *sql.Tx, eidID int) error {
+	if err := s.checkTxWritable(tx); err != nil {
+		return errors.Trace(err)
+	}
+
+	for i, eid := range s.data.externalIdentities {
+		if eid.id == eidID {
+			s.data.externalIdentities = append(
+				s.data.externalIdentities[:i:i], s.data.externalIdentities[i+1:]...,
+			)
+			return nil
+		}
+	}
+
+	return errors.Trace(storage.ErrIdentityDoesNotExist)
+}
+
+func (s *StorageMemory) GetUserByExternalIdentity(
+	tx *sql.Tx, provider, subject string,
+) (*storage.UserData, error) {
+	if err := s.checkTx(tx); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, eid := range s.data.externalIdentities {
+		if eid.provider == provider && eid.subject == subject {
+			ud, err := s.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(eid.userID)})
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			return ud, nil
+		}
+	}
+
+	return nil, errors.Trace(storage.ErrUserDoesNotExist)
+}
+
+func (s *StorageMemory) CreateExternalIdentity(
+	tx *sql.Tx, eid *storage.ExternalIdentityData,
+) (eidID int, err error) {
+	if err := s.checkTxWritable(tx); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Mimic the unique and foreign key constraints of the SQL-backed storages
+	for _, e := range s.data.externalIdentities {
+		if e.provider == eid.Provider && e.subject == eid.Subject {
+			return 0, hh.MakeInternalServerError(errors.Errorf(
+				"external identity %q at %q already exists", eid.Subject, eid.Provider,
+			))
+		}
+	}
+
+	if _, ok := s.data.users[eid.UserID]; !ok {
+		return 0, hh.MakeInternalServerError(
+			errors.Errorf("user %d does not exist", eid.UserID),
+		)
+	}
+
+	s.data.lastExternalIdentityID++
+	eidID = s.data.lastExternalIdentityID
+
+	s.data.externalIdentities = append(s.data.externalIdentities, externalIdentity{
+		id:        eidID,
+		userID:    eid.UserID,
+		provider:  eid.Provider,
+		subject:   eid.Subject,
+		email:     eid.Email,
+		createdAt: uint64(time.Now().Unix()),
+	})
+
+	return eidID, nil
+}
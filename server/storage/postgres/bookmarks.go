@@ -16,9 +16,11 @@ import (
 )
 
 func (s *StoragePostgres) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (bkmID int, err error) {
-	// If URL is not empty, check whether the bookmark with the same URL already exists
-	if bd.URL != "" {
-		existingBkms, err := s.GetBookmarksByURL(tx, bd.URL, bd.OwnerID, &storage.TagsFetchOpts{
+	// If URL is not empty, check whether the bookmark with the same canonical
+	// URL already exists
+	canonicalURL := bd.GetCanonicalURL()
+	if canonicalURL != "" {
+		existingBkms, err := s.GetBookmarksByURL(tx, canonicalURL, bd.OwnerID, &storage.TagsFetchOpts{
 			TagsFetchMode:     storage.TagsFetchModeNone,
 			TagNamesFetchMode: storage.TagNamesFetchModeNone,
 		})
@@ -40,8 +42,8 @@ func (s *StoragePostgres) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (
 	}
 
 	_, err = tx.Exec(
-		"INSERT INTO bookmarks (id, url, title, comment) VALUES ($1, $2, $3, $4)",
-		bkmID, bd.URL, bd.Title, bd.Comment,
+		"INSERT INTO bookmarks (id, url, canonical_url, title, comment) VALUES ($1, $2, $3, $4, $5)",
+		bkmID, bd.URL, canonicalURL, bd.Title, bd.Comment,
 	)
 	if err != nil {
 		return 0, errors.Trace(err)
@@ -51,9 +53,22 @@ func (s *StoragePostgres) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (
 }
 
 func (s *StoragePostgres) UpdateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (err error) {
-	// If URL is not empty, check whether the bookmark with the same URL already exists
-	if bd.URL != "" {
-		existingBkms, err := s.GetBookmarksByURL(tx, bd.URL, bd.OwnerID, &storage.TagsFetchOpts{
+	// The old version is needed for the history
+	oldBkm, err := s.GetBookmarkByID(tx, bd.ID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// If the canonical URL is changed and is not empty, check whether the
+	// bookmark with the same canonical URL already exists. If it's not changed,
+	// then we don't check it, so that the bookmarks which became duplicates
+	// after the canonicalization rules were changed can still be edited.
+	canonicalURL := bd.GetCanonicalURL()
+	if canonicalURL != "" && canonicalURL != oldBkm.CanonicalURL {
+		existingBkms, err := s.GetBookmarksByURL(tx, canonicalURL, bd.OwnerID, &storage.TagsFetchOpts{
 			TagsFetchMode:     storage.TagsFetchModeNone,
 			TagNamesFetchMode: storage.TagNamesFetchModeNone,
 		})
@@ -61,14 +76,22 @@ func (s *StoragePostgres) UpdateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (
 			return errors.Trace(err)
 		}
 
-		if len(existingBkms) > 0 && existingBkms[0].ID != bd.ID {
+		if len(existingBkms) > 0 {
 			return errors.Errorf("bookmark with the url %q already exists", bd.URL)
 		}
 	}
 
 	_, err = tx.Exec(
-		"UPDATE bookmarks SET url = $1, title = $2, comment = $3 WHERE id = $4",
-		bd.URL, bd.Title, bd.Comment, bd.ID,
+		"UPDATE bookmarks SET url = $1, canonical_url = $2, title = $3, comment = $4 WHERE id = $5",
+		bd.URL, canonicalURL, bd.Title, bd.Comment, bd.ID,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = s.addHistoryRecord(
+		tx, oldBkm.OwnerID, storage.HistoryObjectTaggable, bd.ID,
+		storage.MakeBookmarkDiff(&oldBkm.BookmarkData, bd),
 	)
 	if err != nil {
 		return errors.Trace(err)
@@ -95,54 +118,164 @@ func setDefaultTagFetchOpts(tagsFetchOpts *storage.TagsFetchOpts) *storage.TagsF
 
 func (s *StoragePostgres) GetTaggedBookmarks(
 	tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *storage.TagsFetchOpts,
-) (bookmarks []storage.BookmarkDataWTags, err error) {
-	bookmarks = []storage.BookmarkDataWTags{}
+	pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	args := []interface{}{}
+
+	// There is a different logic for two cases:
+	// - There is at least one tag given: we'll fetch bookmarks which are tagged
+	//   with all of the given tags (and possibly with any other tags)
+	// - There are no tags given: we'll fetch bookmarks which are untagged at all
+	from := "FROM taggables t JOIN bookmarks b ON t.id = b.id "
+	where := "WHERE 1=1 "
+	if len(tagIDs) > 0 {
+		for k, tagID := range tagIDs {
+			args = append(args, tagID)
+			from += fmt.Sprintf(
+				"JOIN taggings tg%d ON (tg%d.taggable_id = t.id AND tg%d.tag_id = $%d) ",
+				k, k, k, len(args),
+			)
+		}
+	} else {
+		from += "LEFT JOIN taggings tg ON (tg.taggable_id = t.id) "
+		where += "AND tg.taggable_id IS NULL "
+	}
+
+	if ownerID != nil {
+		args = append(args, *ownerID)
+		where += fmt.Sprintf("AND t.owner_id = $%d ", len(args))
+	}
+
+	return s.getBookmarksPage(tx, from, where, args, tagsFetchOpts, pageOpts)
+}
 
+func (s *StoragePostgres) GetBookmarksByTagQuery(
+	tx *sql.Tx, query *storage.TagQuery, ownerID int,
+	tagsFetchOpts *storage.TagsFetchOpts, pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
 	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
 
-	// TODO: currently, two queries are performed: first, we get the list of IDs,
-	// and then, we fetch bookmarks with those IDs. We'll probably need to refactor
-	// this.
-	taggableIDs, err := s.GetTaggedTaggableIDs(
-		tx, tagIDs, ownerID, []storage.TaggableType{storage.TaggableTypeBookmark},
-	)
+	if err := query.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args := []interface{}{}
+
+	cond, err := compileTagQuery(query, "t", &args)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	if len(taggableIDs) > 0 {
-		args := []interface{}{}
-		for _, id := range taggableIDs {
-			args = append(args, id)
-		}
+	from := "FROM taggables t JOIN bookmarks b ON t.id = b.id "
+	where := "WHERE " + cond + " "
 
-		tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
-		if err != nil {
-			return nil, hh.MakeInternalServerError(err)
+	args = append(args, ownerID)
+	where += fmt.Sprintf("AND t.owner_id = $%d ", len(args))
+
+	return s.getBookmarksPage(tx, from, where, args, tagsFetchOpts, pageOpts)
+}
+
+// getBookmarksPage returns a page of bookmarks selected by the given FROM and
+// WHERE clauses, which can refer to taggables as t and to bookmarks as b.
+// Trashed bookmarks are skipped.
+func (s *StoragePostgres) getBookmarksPage(
+	tx *sql.Tx, from, where string, args []interface{},
+	tagsFetchOpts *storage.TagsFetchOpts, pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	pageOpts, err = storage.PrepareBookmarksPageOpts(pageOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	where += "AND t.trashed_ts IS NULL "
+
+	page = &storage.BookmarksPage{}
+
+	err = tx.QueryRow("SELECT COUNT(t.id) "+from+where, args...).Scan(&page.TotalCnt)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	// Strings are compared byte-wise, regardless of the database collation, so
+	// that the order is the same as in other storages.
+	var sortExpr string
+	switch pageOpts.SortField {
+	case storage.BookmarksSortFieldCreated:
+		sortExpr = "CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER)"
+	case storage.BookmarksSortFieldUpdated:
+		sortExpr = "CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER)"
+	case storage.BookmarksSortFieldTitle:
+		sortExpr = `b.title COLLATE "C"`
+	case storage.BookmarksSortFieldURL:
+		sortExpr = `b.url COLLATE "C"`
+	}
+
+	dir, cmp := "ASC", ">"
+	if pageOpts.SortDesc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if c := pageOpts.Cursor; c != nil {
+		var cursorVal interface{} = c.Str
+		if pageOpts.SortField == storage.BookmarksSortFieldCreated ||
+			pageOpts.SortField == storage.BookmarksSortFieldUpdated {
+			cursorVal = int64(c.Time)
 		}
 
-		rows, err := tx.Query(fmt.Sprintf(`
+		args = append(args, cursorVal, c.ID)
+		where += fmt.Sprintf(
+			"AND (%s %s $%d OR (%s = $%d AND t.id %s $%d)) ",
+			sortExpr, cmp, len(args)-1, sortExpr, len(args)-1, cmp, len(args),
+		)
+	}
+
+	limit := ""
+	if pageOpts.Limit > 0 {
+		// Fetch one more bookmark, to know whether there is a next page
+		args = append(args, pageOpts.Limit+1)
+		limit = fmt.Sprintf("LIMIT $%d", len(args))
+	}
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`
 SELECT t.id, b.url, b.title, b.comment, t.owner_id,
        CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
        CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
        %s as tagsjson
-  FROM taggables t
-  JOIN bookmarks b ON t.id = b.id
-  WHERE t.id IN (`+getPlaceholdersString(1, len(taggableIDs))+`)
-	`, tagsJsonFieldQuery), args...,
+  %s
+  %s
+  ORDER BY %s %s, t.id %s
+  %s
+	`, tagsJsonFieldQuery, from, where, sortExpr, dir, dir, limit), args...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	page.Bookmarks, err = rowsToBookmarks(rows, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if pageOpts.Limit > 0 && len(page.Bookmarks) > pageOpts.Limit {
+		page.Bookmarks = page.Bookmarks[:pageOpts.Limit]
+		page.NextCursor = storage.MakeBookmarksCursor(
+			&page.Bookmarks[pageOpts.Limit-1].BookmarkData, pageOpts,
 		)
-		if err != nil {
-			return nil, hh.MakeInternalServerError(err)
-		}
-		defer rows.Close()
-		return rowsToBookmarks(rows, tagsFetchOpts)
 	}
 
-	return bookmarks, nil
+	return page, nil
 }
 
 func (s *StoragePostgres) GetBookmarksByURL(
-	tx *sql.Tx, url string, ownerID int, tagsFetchOpts *storage.TagsFetchOpts,
+	tx *sql.Tx, canonicalURL string, ownerID int, tagsFetchOpts *storage.TagsFetchOpts,
 ) (bookmarks []storage.BookmarkDataWTags, err error) {
 	bookmarks = []storage.BookmarkDataWTags{}
 
@@ -160,8 +293,8 @@ SELECT t.id, b.url, b.title, b.comment, t.owner_id,
        %s as tagsjson
   FROM taggables t
   JOIN bookmarks b ON t.id = b.id
-  WHERE t.owner_id = $1 AND b.url = $2
-	`, tagsJsonFieldQuery), ownerID, url,
+  WHERE t.owner_id = $1 AND b.canonical_url = $2 AND t.trashed_ts IS NULL
+	`, tagsJsonFieldQuery), ownerID, canonicalURL,
 	)
 	if err != nil {
 		return nil, hh.MakeInternalServerError(err)
@@ -170,6 +303,96 @@ SELECT t.id, b.url, b.title, b.comment, t.owner_id,
 	return rowsToBookmarks(rows, tagsFetchOpts)
 }
 
+func (s *StoragePostgres) GetDuplicateBookmarks(
+	tx *sql.Tx, ownerID int,
+) (duplicates []storage.DuplicateBookmarks, err error) {
+	duplicates = []storage.DuplicateBookmarks{}
+
+	rows, err := tx.Query(`
+SELECT b.canonical_url, b.id
+  FROM bookmarks b
+  JOIN taggables t ON t.id = b.id
+  WHERE t.owner_id = $1 AND t.trashed_ts IS NULL AND b.canonical_url IN (
+    SELECT b2.canonical_url
+      FROM bookmarks b2
+      JOIN taggables t2 ON t2.id = b2.id
+      WHERE t2.owner_id = $2 AND t2.trashed_ts IS NULL AND b2.canonical_url != ''
+      GROUP BY b2.canonical_url
+      HAVING COUNT(*) > 1
+  )
+  ORDER BY b.canonical_url, b.id
+	`, ownerID, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var canonicalURL string
+		var id int
+		if err := rows.Scan(&canonicalURL, &id); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		if len(duplicates) == 0 || duplicates[len(duplicates)-1].CanonicalURL != canonicalURL {
+			duplicates = append(duplicates, storage.DuplicateBookmarks{
+				CanonicalURL: canonicalURL,
+			})
+		}
+
+		last := &duplicates[len(duplicates)-1]
+		last.BookmarkIDs = append(last.BookmarkIDs, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return duplicates, nil
+}
+
+func (s *StoragePostgres) GetAllBookmarkURLs(
+	tx *sql.Tx,
+) (urls []storage.BookmarkURLData, err error) {
+	urls = []storage.BookmarkURLData{}
+
+	rows, err := tx.Query(
+		"SELECT id, url, canonical_url FROM bookmarks ORDER BY id",
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u storage.BookmarkURLData
+		if err := rows.Scan(&u.ID, &u.URL, &u.CanonicalURL); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		urls = append(urls, u)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return urls, nil
+}
+
+func (s *StoragePostgres) SetBookmarkCanonicalURL(
+	tx *sql.Tx, bookmarkID int, canonicalURL string,
+) error {
+	_, err := tx.Exec(
+		"UPDATE bookmarks SET canonical_url = $1 WHERE id = $2",
+		canonicalURL, bookmarkID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	return nil
+}
+
 func (s *StoragePostgres) GetBookmarkByID(
 	tx *sql.Tx, bookmarkID int, tagsFetchOpts *storage.TagsFetchOpts,
 ) (bookmark *storage.BookmarkDataWTags, err error) {
@@ -184,17 +407,18 @@ func (s *StoragePostgres) GetBookmarkByID(
 	}
 
 	err = tx.QueryRow(fmt.Sprintf(`
-SELECT t.id, b.url, b.title, b.comment, t.owner_id,
+SELECT t.id, b.url, b.canonical_url, b.title, b.comment, t.owner_id,
        CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
        CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
+       COALESCE(CAST(EXTRACT(EPOCH FROM t.trashed_ts) AS INTEGER), 0),
        %s as tagsjson
   FROM taggables t
   JOIN bookmarks b ON t.id = b.id
   WHERE t.id = $1
 	`, tagsJsonFieldQuery), bookmarkID,
 	).Scan(
-		&bkm.ID, &bkm.URL, &bkm.Title, &bkm.Comment, &bkm.OwnerID,
-		&bkm.CreatedAt, &bkm.UpdatedAt,
+		&bkm.ID, &bkm.URL, &bkm.CanonicalURL, &bkm.Title, &bkm.Comment, &bkm.OwnerID,
+		&bkm.CreatedAt, &bkm.UpdatedAt, &bkm.TrashedAt,
 		&tagBriefData,
 	)
 	if err != nil {
@@ -219,6 +443,108 @@ SELECT t.id, b.url, b.title, b.comment, t.owner_id,
 	return &bkm, nil
 }
 
+func (s *StoragePostgres) SearchBookmarks(
+	tx *sql.Tx, query string, ownerID int, tagIDs []int,
+	tagsFetchOpts *storage.TagsFetchOpts,
+) (results []storage.BookmarkSearchResult, err error) {
+	results = []storage.BookmarkSearchResult{}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	// The query might have no words other than stop words, which would just
+	// match nothing; tell the caller about it instead.
+	var nodesCnt int
+	err = tx.QueryRow(
+		"SELECT numnode(plainto_tsquery('english', $1))", query,
+	).Scan(&nodesCnt)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	if nodesCnt == 0 {
+		return nil, errors.Trace(storage.ErrSearchQueryEmpty)
+	}
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	titleHeadlineOpts := fmt.Sprintf(
+		"HighlightAll=TRUE, StartSel=%s, StopSel=%s",
+		storage.SearchHighlightStart, storage.SearchHighlightStop,
+	)
+	commentHeadlineOpts := fmt.Sprintf(
+		"MaxWords=35, MinWords=15, StartSel=%s, StopSel=%s",
+		storage.SearchHighlightStart, storage.SearchHighlightStop,
+	)
+
+	args := []interface{}{query, ownerID, titleHeadlineOpts, commentHeadlineOpts}
+
+	taggingsJoins := ""
+	for k, tagID := range tagIDs {
+		args = append(args, tagID)
+		taggingsJoins += fmt.Sprintf(
+			"JOIN taggings tg%d ON (tg%d.taggable_id = t.id AND tg%d.tag_id = $%d) ",
+			k, k, k, len(args),
+		)
+	}
+
+	rows, err := tx.Query(fmt.Sprintf(`
+SELECT t.id, b.url, b.title, b.comment, t.owner_id,
+       CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
+       CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
+       %s as tagsjson,
+       ts_rank(b.tsv, q) AS rank,
+       ts_headline('english', %s, q, $3),
+       ts_headline('english', %s, q, $4)
+  FROM taggables t
+  JOIN bookmarks b ON t.id = b.id
+  %s
+  CROSS JOIN plainto_tsquery('english', $1) q
+  WHERE t.owner_id = $2 AND b.tsv @@ q AND t.trashed_ts IS NULL
+  ORDER BY rank DESC, t.id
+	`, tagsJsonFieldQuery, escapeSnippetTextSQL("b.title"),
+		escapeSnippetTextSQL("b.comment"), taggingsJoins), args...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		res := storage.BookmarkSearchResult{}
+		var tagBriefData []byte
+		err := rows.Scan(
+			&res.ID, &res.URL, &res.Title, &res.Comment, &res.OwnerID,
+			&res.CreatedAt, &res.UpdatedAt,
+			&tagBriefData,
+			&res.Rank, &res.TitleSnippet, &res.CommentSnippet,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		res.Tags, err = parseTagBrief(tagBriefData, tagsFetchOpts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// escapeSnippetTextSQL returns an SQL expression which escapes the given text
+// expression just like storage.EscapeSnippetText does; ts_headline keeps the
+// HTML tags in the text as is, so it should be applied to the escaped text.
+func escapeSnippetTextSQL(expr string) string {
+	return fmt.Sprintf(
+		"replace(replace(replace(%s, '&', '&amp;'), '<', '&lt;'), '>', '&gt;')",
+		expr,
+	)
+}
+
 func getPlaceholdersString(start, cnt int) string {
 	ret := ""
 
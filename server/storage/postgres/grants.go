@@ -0,0 +1,106 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+const tagGrantFields = `
+  g.id, g.tag_id, t.owner_id, g.grantee_id, g.permission,
+  CAST(EXTRACT(EPOCH FROM g.created_ts) AS INTEGER)
+`
+
+func (s *StoragePostgres) CreateTagGrant(
+	tx *sql.Tx, tgd *storage.TagGrantData,
+) (grantID int, err error) {
+	perm := tgd.Permission
+	if perm == "" {
+		perm = storage.TagGrantPermissionDefault
+	}
+
+	if err := storage.ValidateTagGrantPermission(perm); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	err = tx.QueryRow(`
+INSERT INTO tag_grants (tag_id, grantee_id, permission)
+  VALUES ($1, $2, $3)
+  RETURNING id`,
+		tgd.TagID, tgd.GranteeID, string(perm),
+	).Scan(&grantID)
+	if err != nil {
+		return 0, interrors.WrapInternalErrorf(
+			err, "failed to create grant (tag_id: %d, grantee_id: %d)",
+			tgd.TagID, tgd.GranteeID,
+		)
+	}
+
+	return grantID, nil
+}
+
+func (s *StoragePostgres) GetTagGrantsByOwner(
+	tx *sql.Tx, ownerID int,
+) ([]storage.TagGrantData, error) {
+	return s.getTagGrants(tx, "t.owner_id = $1", ownerID)
+}
+
+func (s *StoragePostgres) GetTagGrantsByGrantee(
+	tx *sql.Tx, granteeID int,
+) ([]storage.TagGrantData, error) {
+	return s.getTagGrants(tx, "g.grantee_id = $1", granteeID)
+}
+
+func (s *StoragePostgres) DeleteTagGrant(tx *sql.Tx, grantID int) error {
+	res, err := tx.Exec("DELETE FROM tag_grants WHERE id = $1", grantID)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Trace(storage.ErrTagGrantDoesNotExist)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) getTagGrants(
+	tx *sql.Tx, cond string, args ...interface{},
+) ([]storage.TagGrantData, error) {
+	ret := []storage.TagGrantData{}
+
+	rows, err := tx.Query(
+		"SELECT "+tagGrantFields+` FROM tag_grants g
+JOIN tags t ON t.id = g.tag_id
+WHERE `+cond+" ORDER BY g.id",
+		args...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var tgd storage.TagGrantData
+		if err := rows.Scan(
+			&tgd.ID, &tgd.TagID, &tgd.OwnerID, &tgd.GranteeID, &tgd.Permission,
+			&tgd.CreatedAt,
+		); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		ret = append(ret, tgd)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+	_ "github.com/lib/pq"
+)
+
+func (s *StoragePostgres) GetHistory(
+	tx *sql.Tx, objectType storage.HistoryObjectType, objectID int,
+) (records []storage.HistoryRecord, err error) {
+	records = []storage.HistoryRecord{}
+
+	rows, err := tx.Query(`
+SELECT id, owner_id, object_type, object_id,
+       CAST(EXTRACT(EPOCH FROM created_ts) AS INTEGER),
+       diff
+  FROM history
+  WHERE object_type = $1 AND object_id = $2
+  ORDER BY id
+	`, string(objectType), objectID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec := storage.HistoryRecord{}
+		var objType string
+		var diffData []byte
+		err := rows.Scan(
+			&rec.ID, &rec.OwnerID, &objType, &rec.ObjectID, &rec.CreatedAt, &diffData,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		rec.ObjectType = storage.HistoryObjectType(objType)
+
+		if err := json.Unmarshal(diffData, &rec.Diff); err != nil {
+			return nil, hh.MakeInternalServerError(errors.Annotatef(
+				err, "parsing diff of the history record %d", rec.ID,
+			))
+		}
+
+		records = append(records, rec)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return records, nil
+}
+
+// addHistoryRecord adds a history record with the given diff, unless it's
+// empty.
+func (s *StoragePostgres) addHistoryRecord(
+	tx *sql.Tx, ownerID int, objectType storage.HistoryObjectType, objectID int,
+	diff *storage.HistoryDiff,
+) error {
+	if diff.IsEmpty() {
+		return nil
+	}
+
+	diffData, err := json.Marshal(diff)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO history (owner_id, object_type, object_id, diff) VALUES ($1, $2, $3, $4)",
+		ownerID, string(objectType), objectID, string(diffData),
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "adding history record for %s %d", objectType, objectID,
+		))
+	}
+
+	return nil
+}
+
+// addTaggingsHistoryRecord records the change of the taggings of the given
+// taggable, if there is any.
+func (s *StoragePostgres) addTaggingsHistoryRecord(
+	tx *sql.Tx, taggableID int, oldTagIDs, newTagIDs []int,
+) error {
+	diff := storage.MakeTagIDsDiff(oldTagIDs, newTagIDs)
+	if diff.IsEmpty() {
+		return nil
+	}
+
+	var ownerID int
+	err := tx.QueryRow(
+		"SELECT owner_id FROM taggables WHERE id = $1", taggableID,
+	).Scan(&ownerID)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "getting owner of the taggable %d", taggableID,
+		))
+	}
+
+	return errors.Trace(
+		s.addHistoryRecord(tx, ownerID, storage.HistoryObjectTaggable, taggableID, diff),
+	)
+}
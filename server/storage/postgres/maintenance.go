@@ -8,53 +8,115 @@ import (
 	"fmt"
 
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
 
-type childrenCheck struct {
-	id                int
-	childrenCnt       int
-	childrenCntActual int
+// tagging is a single (taggable, tag) pair
+type tagging struct {
+	taggableID int
+	tagID      int
 }
 
-func (cc *childrenCheck) String() string {
-	return fmt.Sprintf("id=%d, childrenCnt=%d, childrenCntActual=%d",
-		cc.id, cc.childrenCnt, cc.childrenCntActual,
-	)
+// tagOwner is a tag id with the id of its owner
+type tagOwner struct {
+	tagID   int
+	ownerID int
 }
 
-func (s *StoragePostgres) CheckIntegrity() error {
+func (s *StoragePostgres) CheckIntegrity(repair bool) (*storage.IntegrityReport, error) {
+	ilevel, mode := storage.TxILevelRepeatableRead, storage.TxModeReadOnly
+	if repair {
+		ilevel, mode = storage.TxILevelSerializable, storage.TxModeReadWrite
+	}
+
+	var report *storage.IntegrityReport
+
 	err := s.TxOpt(
-		storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+		ilevel, mode,
 		func(tx *sql.Tx) error {
-			err := s.checkChildrenCnt(tx)
+			// The transaction might be retried, so start from scratch
+			report = storage.NewIntegrityReport()
+
+			err := s.checkChildrenCnt(tx, report)
 			if err != nil {
 				return errors.Trace(err)
 			}
 
-			err = s.checkTaggings(tx)
+			err = s.checkTaggings(tx, report)
 			if err != nil {
 				return errors.Trace(err)
 			}
 
-			err = s.checkOnlyRootTagging(tx)
+			err = s.checkOnlyRootTagging(tx, report)
 			if err != nil {
 				return errors.Trace(err)
 			}
 
+			report.Sort()
+
+			if repair {
+				if err := s.repairIntegrity(tx, report); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
 			return nil
 		})
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
+	}
+
+	return report, nil
+}
+
+// repairIntegrity fixes all the repairable violations from the report, and
+// marks them as repaired.
+func (s *StoragePostgres) repairIntegrity(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+	for i := range report.Violations {
+		v := &report.Violations[i]
+
+		switch v.Kind {
+		case storage.IntegrityViolationChildrenCnt:
+			_, err := tx.Exec(
+				"UPDATE tags SET children_cnt = $1 WHERE id = $2",
+				*v.ChildrenCntActual, v.TagID,
+			)
+			if err != nil {
+				return errors.Annotatef(err, "recounting children of the tag %d", v.TagID)
+			}
+
+		case storage.IntegrityViolationMissingTagging:
+			if err := s.addTaggings(tx, v.TaggableID, []int{v.TagID}); err != nil {
+				return errors.Annotatef(
+					err, "adding tagging (taggable %d, tag %d)", v.TaggableID, v.TagID,
+				)
+			}
+
+		case storage.IntegrityViolationRootOnlyTagging:
+			if err := s.deleteTaggings(tx, v.TaggableID, []int{v.TagID}); err != nil {
+				return errors.Annotatef(
+					err, "deleting tagging (taggable %d, tag %d)", v.TaggableID, v.TagID,
+				)
+			}
+
+		default:
+			continue
+		}
+
+		v.Repaired = true
 	}
 
 	return nil
 }
 
-func (s *StoragePostgres) checkTaggings(tx *sql.Tx) error {
+func (s *StoragePostgres) checkTaggings(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
 
 	// Get all users, for each of them:
 	// - Get all user's tags
@@ -70,6 +132,8 @@ func (s *StoragePostgres) checkTaggings(tx *sql.Tx) error {
 	}
 
 	for _, user := range users {
+		missing := map[tagging]bool{}
+
 		reg := thReg{
 			s:  s,
 			tx: tx,
@@ -107,11 +171,12 @@ func (s *StoragePostgres) checkTaggings(tx *sql.Tx) error {
 
 		// Make sure taghier contains just a single root
 		roots := th.GetRoots()
-		if rootsCnt := len(roots); rootsCnt != 1 {
-			return errors.Errorf(
-				"user %d: tag roots count is %d (should be 1). tag roots: %q",
-				user.ID, rootsCnt, roots,
-			)
+		if len(roots) != 1 {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationTagRoots,
+				UserID:     user.ID,
+				RootTagIDs: roots,
+			})
 		}
 
 		// For each of the tags, make sure that there is a tagging for each
@@ -131,16 +196,29 @@ func (s *StoragePostgres) checkTaggings(tx *sql.Tx) error {
 			//}
 			//}
 
-			if err := s.checkFullTaggingsPath(tx, path); err != nil {
+			if err := s.checkFullTaggingsPath(tx, path, missing); err != nil {
 				return errors.Annotatef(err, "user %d", user.ID)
 			}
 		}
+
+		for t := range missing {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationMissingTagging,
+				UserID:     user.ID,
+				TagID:      t.tagID,
+				TaggableID: t.taggableID,
+			})
+		}
 	}
 
 	return nil
 }
 
-func (s *StoragePostgres) checkFullTaggingsPath(tx *sql.Tx, path []int) error {
+// checkFullTaggingsPath adds to missing the taggings of the tags from the
+// path which are missing for the taggables tagged with the leaf of the path.
+func (s *StoragePostgres) checkFullTaggingsPath(
+	tx *sql.Tx, path []int, missing map[tagging]bool,
+) error {
 	var taggableIDs []int
 
 	// If there is less than 2 items in the path, there's no need to check
@@ -217,11 +295,18 @@ func (s *StoragePostgres) checkFullTaggingsPath(tx *sql.Tx, path []int) error {
 		return errors.Annotatef(err, "closing rows")
 	}
 
-	if len(taggableIDs) > 0 {
-		return errors.Errorf(
-			"for the tag %d (full path: %v) some intermediate taggings are missing for the following tags: %v",
-			path[0], path, taggableIDs,
-		)
+	// For each of the broken taggables, find out which taggings are missing
+	for _, taggableID := range taggableIDs {
+		tagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, pathTagID := range path[1:] {
+			if !containsInt(tagIDs, pathTagID) {
+				missing[tagging{taggableID: taggableID, tagID: pathTagID}] = true
+			}
+		}
 	}
 
 	return nil
@@ -229,47 +314,53 @@ func (s *StoragePostgres) checkFullTaggingsPath(tx *sql.Tx, path []int) error {
 
 // It's illegal for the taggable to be tagged with the root tag only,
 // so checkOnlyRootTagging checks for these cases
-func (s *StoragePostgres) checkOnlyRootTagging(tx *sql.Tx) error {
-	// Get all root tags
-	rootTagIDs := []int{}
-	rows, err := tx.Query("SELECT id FROM tags WHERE parent_id IS NULL")
+func (s *StoragePostgres) checkOnlyRootTagging(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+	// Get all root tags, with their owners
+	rootTags := []tagOwner{}
+	rows, err := tx.Query("SELECT id, owner_id FROM tags WHERE parent_id IS NULL")
 	if err != nil {
 		return errors.Trace(err)
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var cur int
-		err := rows.Scan(&cur)
+		var cur tagOwner
+		err := rows.Scan(&cur.tagID, &cur.ownerID)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		rootTagIDs = append(rootTagIDs, cur)
+		rootTags = append(rootTags, cur)
 	}
 	rows.Close()
 
 	// For each of the root tags, make sure there's no taggables tagged only
 	// with this one tag
-	for _, rootTagID := range rootTagIDs {
-		badIDs, err := s.getTaggablesTaggedWithOnlyOneTag(tx, rootTagID)
+	for _, rootTag := range rootTags {
+		badIDs, err := s.getTaggablesTaggedWithOnlyOneTag(tx, rootTag.tagID)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		if len(badIDs) > 0 {
-			return errors.Errorf(
-				"some taggables (ids: %v) are tagged with root tag only (id: %d), this is illegal",
-				badIDs, rootTagID,
-			)
+		for _, taggableID := range badIDs {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationRootOnlyTagging,
+				UserID:     rootTag.ownerID,
+				TagID:      rootTag.tagID,
+				TaggableID: taggableID,
+			})
 		}
 	}
 
 	return nil
 }
 
-func (s *StoragePostgres) checkChildrenCnt(tx *sql.Tx) error {
+func (s *StoragePostgres) checkChildrenCnt(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
 	rows, err := tx.Query(`
-SELECT id, children_cnt, children_cnt_actual
+SELECT id, owner_id, children_cnt, children_cnt_actual
   FROM
-    (SELECT id, children_cnt,
+    (SELECT id, owner_id, children_cnt,
             (SELECT COUNT(id) FROM tags WHERE parent_id = t.id) AS children_cnt_actual
           FROM tags t) T
   WHERE children_cnt != children_cnt_actual
@@ -279,24 +370,30 @@ SELECT id, children_cnt, children_cnt_actual
 		return errors.Trace(err)
 	}
 
-	failures := []childrenCheck{}
-	str := ""
-
 	defer rows.Close()
 	for rows.Next() {
-		var cur childrenCheck
-		err := rows.Scan(&cur.id, &cur.childrenCnt, &cur.childrenCntActual)
+		v := storage.IntegrityViolation{
+			Kind: storage.IntegrityViolationChildrenCnt,
+		}
+		err := rows.Scan(&v.TagID, &v.UserID, &v.ChildrenCnt, &v.ChildrenCntActual)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
-		failures = append(failures, cur)
-		str += cur.String() + "\n"
+		report.Add(v)
 	}
-
-	if len(str) > 0 {
-		return errors.Errorf("children count integrity is broken: %s", str)
+	if err := rows.Close(); err != nil {
+		return errors.Annotatef(err, "closing rows")
 	}
 
 	return nil
 }
+
+func containsInt(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
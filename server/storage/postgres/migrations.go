@@ -9,8 +9,11 @@ import (
 	"github.com/juju/errors"
 
 	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/storage"
 )
 
+// NOTE: when editing the up func of a migration, change its checksum as well,
+// see dfmigrate.Migrations.AddMigration.
 func initMigrations() (*dfmigrate.Migrations, error) {
 	mig := &dfmigrate.Migrations{}
 	var err error
@@ -18,6 +21,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 	// 001: Initial structure {{{
 	err = mig.AddMigration(
 		1, "Initial structure",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -124,6 +128,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 	// NULL parent is going to be used for root tag for each user
 	err = mig.AddMigration(
 		2, "Drop parent_id NOT NULL",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -148,6 +153,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 	// 003: Move owner_id to taggables {{{
 	err = mig.AddMigration(
 		3, "Move owner_id to taggables",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -212,6 +218,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 	// 004: Add ON DELETE {{{
 	err = mig.AddMigration(
 		4, "Add ON DELETE",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -322,6 +329,7 @@ ALTER TABLE "taggings" ADD
 	// 005: Use natural key for tag names {{{
 	err = mig.AddMigration(
 		5, "Use natural key for tag names",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -384,6 +392,7 @@ ALTER TABLE "tag_names" ADD PRIMARY KEY (id);
 	// 006: Add tag description {{{
 	err = mig.AddMigration(
 		6, "Add tag description",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -418,6 +427,7 @@ ALTER TABLE "tags" DROP COLUMN "descr";
 	// 007: Allow only one tag with NULL parent {{{
 	err = mig.AddMigration(
 		7, "Allow only one tag with NULL parent",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -469,6 +479,7 @@ CREATE TRIGGER check_dup_null BEFORE INSERT OR UPDATE ON tags
 	// 008: Use enum for taggable type {{{
 	err = mig.AddMigration(
 		8, "Use enum for taggable type",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -530,6 +541,7 @@ DROP TYPE taggable_type;
 	// 009: Add auto-updating timestamps to taggables {{{
 	err = mig.AddMigration(
 		9, "Add auto-updating timestamps to taggables",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -608,6 +620,7 @@ ALTER TABLE taggables
 	// 010: Use natural key for taggings {{{
 	err = mig.AddMigration(
 		10, "Use natural key for taggings",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -670,6 +683,7 @@ ALTER TABLE "taggings" ADD PRIMARY KEY (id);
 	// 011: Add title to bookmarks {{{
 	err = mig.AddMigration(
 		11, "Add title to bookmarks",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -704,6 +718,7 @@ ALTER TABLE "bookmarks" DROP COLUMN "title" RESTRICT;
 	// 012: Add indexes {{{
 	err = mig.AddMigration(
 		12, "Add indexes",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -774,6 +789,7 @@ CREATE INDEX ON "tags" ("owner_id")
 	// 013: Add primary flag to tag names {{{
 	err = mig.AddMigration(
 		13, "Add primary flag to tag names",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -814,6 +830,7 @@ ALTER TABLE "tag_names" DROP COLUMN "primary"
 	// 014: Add gm_tag_brief type {{{
 	err = mig.AddMigration(
 		14, "Add gm_tag_brief type",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -846,6 +863,7 @@ DROP TYPE gm_tag_brief
 	// 015: Fix check_dup_null() {{{
 	err = mig.AddMigration(
 		15, "Fix check_dup_null()",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -885,6 +903,7 @@ $check_dup_null$ LANGUAGE plpgsql;
 	// 016: Add children column to tags table {{{
 	err = mig.AddMigration(
 		16, "Add children column to tags table",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -924,6 +943,7 @@ ALTER TABLE "tags" DROP COLUMN "children_cnt"
 	// 017: Add access_tokens table {{{
 	err = mig.AddMigration(
 		17, "Add access_tokens table",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -961,6 +981,7 @@ DROP TABLE "access_tokens"
 	// 018: Add google_auth table {{{
 	err = mig.AddMigration(
 		18, "Add google_auth table",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -999,6 +1020,7 @@ DROP TABLE "google_auth"
 	// 019: Add description to tokens {{{
 	err = mig.AddMigration(
 		19, "Add description to tokens",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -1031,6 +1053,7 @@ DROP TABLE "google_auth"
 	// 020: Make username and email unique {{{
 	err = mig.AddMigration(
 		20, "Add description to tokens",
+		1, // checksum
 
 		// ---------- UP ----------
 		func(tx *sql.Tx) error {
@@ -1074,6 +1097,608 @@ DROP TABLE "google_auth"
 		return nil, errors.Trace(err)
 	}
 	// }}}
+	// 021: Add full-text search of bookmarks {{{
+	err = mig.AddMigration(
+		21, "Add full-text search of bookmarks",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+ALTER TABLE "bookmarks" ADD COLUMN "tsv" TSVECTOR
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Words of the url are separated by all kinds of punctuation, which the
+			// parser would otherwise treat as a part of a single url token.
+			_, err = tx.Exec(`
+CREATE OR REPLACE FUNCTION bookmarks_tsv_update() RETURNS trigger AS $bookmarks_tsv_update$
+  BEGIN
+    NEW.tsv :=
+      setweight(to_tsvector('english', NEW.title), 'A') ||
+      setweight(to_tsvector('english', NEW.comment), 'B') ||
+      setweight(to_tsvector('english', regexp_replace(NEW.url, '[^[:alnum:]]+', ' ', 'g')), 'C');
+    RETURN NEW;
+  END;
+$bookmarks_tsv_update$ LANGUAGE plpgsql;
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE TRIGGER bookmarks_tsv_update BEFORE INSERT OR UPDATE OF title, comment, url
+  ON "bookmarks" FOR EACH ROW EXECUTE PROCEDURE bookmarks_tsv_update();
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Fire the trigger for existing bookmarks
+			_, err = tx.Exec(`
+UPDATE "bookmarks" SET title = title
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX bookmarks_tsv_idx ON "bookmarks" USING GIN ("tsv")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+DROP TRIGGER bookmarks_tsv_update ON "bookmarks"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+DROP FUNCTION bookmarks_tsv_update()
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// The index is dropped together with the column
+			_, err = tx.Exec(`
+ALTER TABLE "bookmarks" DROP COLUMN "tsv"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+	// 022: Add notes {{{
+	err = mig.AddMigration(
+		22, "Add notes",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// ALTER TYPE ... ADD VALUE can't be used inside a transaction (at least
+			// before Postgres 12), so the enum is recreated instead.
+			_, err = tx.Exec(`
+ALTER TYPE taggable_type RENAME TO taggable_type_old;
+CREATE TYPE taggable_type AS ENUM ('bookmark', 'note');
+ALTER TABLE taggables ALTER COLUMN "type" TYPE taggable_type USING "type"::text::taggable_type;
+DROP TYPE taggable_type_old;
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+				CREATE TABLE notes (
+					id INTEGER NOT NULL PRIMARY KEY,
+					title TEXT NOT NULL,
+					body TEXT NOT NULL,
+					format VARCHAR(30) NOT NULL,
+					FOREIGN KEY (id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+DELETE FROM taggables WHERE "type" = 'note'
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+DROP TABLE "notes"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+ALTER TYPE taggable_type RENAME TO taggable_type_old;
+CREATE TYPE taggable_type AS ENUM ('bookmark');
+ALTER TABLE taggables ALTER COLUMN "type" TYPE taggable_type USING "type"::text::taggable_type;
+DROP TYPE taggable_type_old;
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 023: Add trash {{{
+	err = mig.AddMigration(
+		23, "Add trash",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// Trashed taggables have non-NULL trashed_ts
+			_, err = tx.Exec(`
+ALTER TABLE "taggables"
+  ADD COLUMN "trashed_ts" TIMESTAMPTZ NULL
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX taggables_trashed_ts_idx ON taggables (trashed_ts)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			// The index is dropped together with the column
+			_, err = tx.Exec(`
+ALTER TABLE "taggables" DROP COLUMN "trashed_ts"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 024: Add history {{{
+	err = mig.AddMigration(
+		24, "Add history",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// Records are never modified; diff is a JSON-encoded
+			// storage.HistoryDiff. There is no foreign key for object_id, since it
+			// might refer to different tables, and history of deleted tags should
+			// be kept.
+			_, err = tx.Exec(`
+CREATE TABLE history (
+  id SERIAL PRIMARY KEY,
+  owner_id INTEGER NOT NULL,
+  object_type VARCHAR(30) NOT NULL,
+  object_id INTEGER NOT NULL,
+  created_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  diff TEXT NOT NULL,
+  FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX history_object_idx ON history (object_type, object_id)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+DROP TABLE "history"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 025: Add canonical urls {{{
+	err = mig.AddMigration(
+		25, "Add canonical urls",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// Canonical urls are calculated by the server, with configurable rules;
+			// here we just initialize them with the urls as is, and the server
+			// updates them on startup.
+			_, err = tx.Exec(`
+ALTER TABLE "bookmarks"
+  ADD COLUMN "canonical_url" TEXT NOT NULL DEFAULT ''
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+UPDATE bookmarks SET canonical_url = url
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX bookmarks_canonical_url_idx ON bookmarks (canonical_url)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			// The index is dropped together with the column
+			_, err = tx.Exec(`
+ALTER TABLE "bookmarks" DROP COLUMN "canonical_url"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 026: Hash access tokens, add expiry {{{
+	err = mig.AddMigration(
+		26, "Hash access tokens, add expiry",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// Only the sha256 of a token is stored from now on. Postgres 9.6 can't
+			// compute it without pgcrypto, so existing tokens are hashed here, one
+			// by one.
+			_, err = tx.Exec(`
+ALTER TABLE "access_tokens"
+  ADD COLUMN "id" SERIAL,
+  ADD COLUMN "token_hash" VARCHAR(64),
+  ADD COLUMN "last_used_ts" TIMESTAMPTZ,
+  ADD COLUMN "expires_ts" TIMESTAMPTZ
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			rows, err := tx.Query(`SELECT "id", "token" FROM "access_tokens"`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			defer rows.Close()
+
+			tokens := map[int]string{}
+			for rows.Next() {
+				var id int
+				var token string
+				if err := rows.Scan(&id, &token); err != nil {
+					return errors.Trace(err)
+				}
+				tokens[id] = token
+			}
+			if err := rows.Close(); err != nil {
+				return errors.Trace(err)
+			}
+
+			for id, token := range tokens {
+				_, err = tx.Exec(
+					`UPDATE "access_tokens" SET "token_hash" = $1 WHERE "id" = $2`,
+					storage.HashAccessToken(token), id,
+				)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			// Dropping the column drops the old primary key as well
+			_, err = tx.Exec(`
+ALTER TABLE "access_tokens" DROP COLUMN "token"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+ALTER TABLE "access_tokens"
+  ALTER COLUMN "token_hash" SET NOT NULL,
+  ADD UNIQUE ("token_hash"),
+  ADD PRIMARY KEY ("id")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX access_tokens_user_id_idx ON access_tokens (user_id)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			// Tokens can't be restored from the hashes, so they are dropped
+			_, err = tx.Exec(`
+DROP TABLE "access_tokens"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+				CREATE TABLE access_tokens (
+					token VARCHAR(32) NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					created_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					descr TEXT NOT NULL DEFAULT '',
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 027: Add scopes to access tokens {{{
+	err = mig.AddMigration(
+		27, "Add scopes to access tokens",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+ALTER TABLE "access_tokens" ADD COLUMN "scope" VARCHAR(16) NOT NULL DEFAULT 'write'
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// A token restricted to a subtree is useless without its root, so it's
+			// deleted together with the tag.
+			_, err = tx.Exec(`
+ALTER TABLE "access_tokens" ADD COLUMN "root_tag_id" INTEGER NULL
+  REFERENCES tags(id) ON DELETE CASCADE
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+ALTER TABLE "access_tokens" DROP COLUMN "root_tag_id"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+ALTER TABLE "access_tokens" DROP COLUMN "scope"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 028: Replace google_auth with provider-agnostic external_identities {{{
+	err = mig.AddMigration(
+		28, "Replace google_auth with provider-agnostic external_identities",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+CREATE TABLE external_identities (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email TEXT NOT NULL,
+  created_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (provider, subject)
+)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX external_identities_user_id_idx ON external_identities (user_id)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+INSERT INTO external_identities (user_id, provider, subject, email, created_ts)
+  SELECT user_id, 'google', google_user_id, email, created_ts FROM google_auth
+  ORDER BY created_ts
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+DROP TABLE "google_auth"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			// Identities at providers other than Google are lost.
+			_, err = tx.Exec(`
+CREATE TABLE google_auth (
+  google_user_id TEXT NOT NULL PRIMARY KEY,
+  user_id INTEGER NOT NULL,
+  email TEXT NOT NULL,
+  created_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+INSERT INTO google_auth (google_user_id, user_id, email, created_ts)
+  SELECT subject, user_id, email, created_ts FROM external_identities
+  WHERE provider = 'google'
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+DROP TABLE "external_identities"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 029: Add tag_grants {{{
+	err = mig.AddMigration(
+		29, "Add tag_grants",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+CREATE TABLE tag_grants (
+  id SERIAL PRIMARY KEY,
+  tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+  grantee_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  permission TEXT NOT NULL,
+  created_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (tag_id, grantee_id)
+)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX tag_grants_grantee_id_idx ON tag_grants (grantee_id)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			_, err = tx.Exec(`
+DROP TABLE "tag_grants"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
 
 	return mig, nil
 }
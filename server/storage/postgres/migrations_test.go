@@ -0,0 +1,175 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package postgres
+
+import (
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+func (s *StoragePostgres) getTableNames() ([]string, error) {
+	var tables []string
+	rows, err := s.db.Query(
+		`SELECT table_name
+			FROM information_schema.tables
+			WHERE table_schema='public'
+			AND table_type='BASE TABLE'
+			ORDER BY table_name`,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		tables = append(tables, name)
+	}
+
+	return tables, errors.Trace(rows.Close())
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	runWithRealDB(t, func(si *StoragePostgres) error {
+		status, err := si.MigrationStatus()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		latestID := status.LatestID
+		if status.CurrentID != latestID {
+			return errors.Errorf(
+				"all migrations should be applied, but current is %d, latest is %d",
+				status.CurrentID, latestID,
+			)
+		}
+
+		// Dry run should return the steps in reverse order, and do nothing
+		steps, err := si.Migrate(0, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(steps) != latestID ||
+			steps[0].ID != latestID || steps[0].Direction != dfmigrate.DirectionDown ||
+			steps[len(steps)-1].ID != 1 {
+			return errors.Errorf("wrong steps to revert everything: %v", steps)
+		}
+
+		status, err = si.MigrationStatus()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if status.CurrentID != latestID {
+			return errors.Errorf("dry run should not change anything, but current is %d", status.CurrentID)
+		}
+
+		// Revert everything: only the migrations state table should be left
+		if _, err := si.Migrate(0, false); err != nil {
+			return errors.Trace(err)
+		}
+
+		tables, err := si.getTableNames()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(tables, []string{"dfmigrate_state"}) {
+			return errors.Errorf("there should be no tables left, but got %v", tables)
+		}
+
+		status, err = si.MigrationStatus()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if status.CurrentID != 0 || status.Migrations[0].Applied {
+			return errors.Errorf("no migrations should be applied, got %+v", status)
+		}
+
+		// And apply everything back
+		steps, err = si.Migrate(latestID, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(steps) != latestID || steps[0].Direction != dfmigrate.DirectionUp {
+			return errors.Errorf("wrong steps to apply everything: %v", steps)
+		}
+
+		if _, _, err := testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func TestModifiedMigration(t *testing.T) {
+	runWithRealDB(t, func(si *StoragePostgres) error {
+		var cnt int
+		err := si.db.QueryRow(
+			"SELECT COUNT(*) FROM dfmigrate_state WHERE param LIKE 'checksum_%'",
+		).Scan(&cnt)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		status, err := si.MigrationStatus()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if cnt != status.LatestID {
+			return errors.Errorf("expected %d checksums, got %d", status.LatestID, cnt)
+		}
+
+		// Checksums missing for migrations applied before they were introduced
+		// should be just saved
+		if _, err := si.db.Exec(
+			"DELETE FROM dfmigrate_state WHERE param = 'checksum_1'",
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.ApplyMigrations(); err != nil {
+			return errors.Annotatef(err, "applying migrations with a missing checksum")
+		}
+
+		// Pretend that the migration 1 was edited after it had been applied
+		if _, err := si.db.Exec(
+			"UPDATE dfmigrate_state SET value = value + 1 WHERE param = 'checksum_1'",
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.ApplyMigrations(); err == nil {
+			return errors.Errorf("should refuse to run with a modified migration")
+		}
+
+		if _, err := si.Migrate(0, true); err == nil {
+			return errors.Errorf("should refuse to revert a modified migration")
+		}
+
+		status, err = si.MigrationStatus()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !status.Migrations[0].Modified {
+			return errors.Errorf("migration 1 should be reported as modified")
+		}
+
+		// Restore the checksum, so that the test cleanup succeeds
+		if _, err := si.db.Exec(
+			"UPDATE dfmigrate_state SET value = value - 1 WHERE param = 'checksum_1'",
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		return errors.Trace(si.ApplyMigrations())
+	})
+}
@@ -5,26 +5,40 @@ package postgres // import "dmitryfrank.com/geekmarks/server/storage/postgres"
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
 
 	"github.com/juju/errors"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Implements storage.Storage
 type StoragePostgres struct {
-	postgresURL string
-	db          *sql.DB
+	postgresURL      string
+	statementTimeout time.Duration
+	db               *sql.DB
 }
 
-func New(postgresURL string) (*StoragePostgres, error) {
+// New creates a new Postgres-backed storage. If statementTimeout is not zero,
+// then every statement (except those of migrations) which takes longer than
+// that is aborted by the server.
+func New(postgresURL string, statementTimeout time.Duration) (*StoragePostgres, error) {
 	return &StoragePostgres{
-		postgresURL: postgresURL,
+		postgresURL:      postgresURL,
+		statementTimeout: statementTimeout,
 	}, nil
 }
 
 func (s *StoragePostgres) Connect() error {
-	var err error
-	s.db, err = sql.Open("postgres", s.postgresURL)
+	dsn, err := getDSN(s.postgresURL, s.statementTimeout)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	s.db, err = sql.Open("postgres", dsn)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -32,16 +46,111 @@ func (s *StoragePostgres) Connect() error {
 	return nil
 }
 
+// openMigrationDB opens a separate database handle for migrations, without
+// the statement timeout: a migration can legitimately take long on a large
+// database. The caller should close it.
+func (s *StoragePostgres) openMigrationDB() (*sql.DB, error) {
+	dsn, err := getDSN(s.postgresURL, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return db, nil
+}
+
 func (s *StoragePostgres) ApplyMigrations() error {
 	mig, err := initMigrations()
 	if err != nil {
 		return errors.Trace(err)
 	}
 
-	err = mig.MigrateToLatest(s.db)
+	db, err := s.openMigrationDB()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+
+	err = mig.MigrateToLatest(db)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
 	return nil
 }
+
+func (s *StoragePostgres) Migrate(targetID int, dryRun bool) ([]dfmigrate.Step, error) {
+	mig, err := initMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	db, err := s.openMigrationDB()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer db.Close()
+
+	steps, err := mig.Plan(db, targetID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if dryRun {
+		return steps, nil
+	}
+
+	err = mig.Migrate(db, targetID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return steps, nil
+}
+
+func (s *StoragePostgres) MigrationStatus() (*dfmigrate.Status, error) {
+	mig, err := initMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	db, err := s.openMigrationDB()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer db.Close()
+
+	status, err := mig.Status(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return status, nil
+}
+
+// getDSN returns a data source name for lib/pq with the statement_timeout
+// runtime parameter added, if statementTimeout is not zero. URLs are converted
+// to the "key=value" form first, since lib/pq passes all unknown keys to the
+// server as runtime parameters.
+func getDSN(postgresURL string, statementTimeout time.Duration) (string, error) {
+	dsn := postgresURL
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return "", errors.Annotatef(err, "parsing postgres url")
+		}
+	}
+
+	if statementTimeout > 0 {
+		dsn = strings.TrimSpace(fmt.Sprintf(
+			"%s statement_timeout=%d", dsn, statementTimeout/time.Millisecond,
+		))
+	}
+
+	return dsn, nil
+}
@@ -9,12 +9,13 @@ import (
 	"database/sql"
 	"flag"
 	"os"
+	"reflect"
 	"testing"
 
 	"dmitryfrank.com/geekmarks/server/cptr"
-	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/storage"
 	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/dimonomid/interrors"
 
 	"github.com/juju/errors"
 )
@@ -25,18 +26,28 @@ var (
 			"given in an environment variable GM_POSTGRES_URL.")
 )
 
-func runWithRealDB(t *testing.T, f func(si *StoragePostgres) error) {
+// newConnectedStorage returns a storage connected to the database given by
+// the flag or the environment variable.
+func newConnectedStorage() (*StoragePostgres, error) {
 	pgURL := *postgresURL
 	if pgURL == "" {
 		pgURL = os.Getenv("GM_POSTGRES_URL")
 	}
-	si, err := New(pgURL)
+	si, err := New(pgURL, 0)
 	if err != nil {
-		t.Errorf("%s", interrors.ErrorStack(err))
-		return
+		return nil, errors.Trace(err)
 	}
 
 	err = si.Connect()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return si, nil
+}
+
+func runWithRealDB(t *testing.T, f func(si *StoragePostgres) error) {
+	si, err := newConnectedStorage()
 	if err != nil {
 		t.Errorf("%s", interrors.ErrorStack(err))
 		return
@@ -110,3 +121,49 @@ func TestTransactionRollback(t *testing.T) {
 		return nil
 	})
 }
+
+func TestRepairChildrenCnt(t *testing.T) {
+	runWithRealDB(t, func(si *StoragePostgres) error {
+		var u1ID int
+		var err error
+		if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		var rootTagID int
+		err = si.Tx(func(tx *sql.Tx) error {
+			var err error
+			rootTagID, err = si.GetRootTagID(tx, u1ID)
+			if err != nil {
+				return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+			}
+
+			_, err = tx.Exec("UPDATE tags SET children_cnt = 5 WHERE id = $1", rootTagID)
+			return errors.Trace(err)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		report, err := si.CheckIntegrity(true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		expected := []storage.IntegrityViolation{
+			{
+				Kind:              storage.IntegrityViolationChildrenCnt,
+				UserID:            u1ID,
+				TagID:             rootTagID,
+				ChildrenCnt:       cptr.Int(5),
+				ChildrenCntActual: cptr.Int(0),
+				Repaired:          true,
+			},
+		}
+		if !reflect.DeepEqual(report.Violations, expected) {
+			return errors.Errorf("expected violations %v, got %v", expected, report.Violations)
+		}
+
+		return nil
+	})
+}
@@ -11,7 +11,7 @@ import (
 
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
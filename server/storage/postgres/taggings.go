@@ -8,7 +8,7 @@ import (
 
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
@@ -104,6 +104,10 @@ func (s *StoragePostgres) SetTaggings(
 	s.addTaggings(tx, taggableID, diff.Add)
 	s.deleteTaggings(tx, taggableID, diff.Delete)
 
+	if err := s.addTaggingsHistoryRecord(tx, taggableID, current, desired); err != nil {
+		return errors.Trace(err)
+	}
+
 	return nil
 }
 
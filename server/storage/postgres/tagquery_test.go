@@ -0,0 +1,60 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package postgres
+
+import (
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+)
+
+func TestCompileTagQuery(t *testing.T) {
+	q := &storage.TagQuery{
+		Op: storage.TagQueryOpAnd,
+		Operands: []storage.TagQuery{
+			{Op: storage.TagQueryOpTag, TagID: 10},
+			{
+				Op: storage.TagQueryOpOr,
+				Operands: []storage.TagQuery{
+					{Op: storage.TagQueryOpTag, TagID: 20},
+					{Op: storage.TagQueryOpTag, TagID: 30},
+				},
+			},
+			{
+				Op: storage.TagQueryOpNot,
+				Operands: []storage.TagQuery{
+					{Op: storage.TagQueryOpTag, TagID: 40},
+				},
+			},
+		},
+	}
+
+	// There is already one arg, so the placeholders should start from $2
+	args := []interface{}{1}
+	cond, err := compileTagQuery(q, "t", &args)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tagCond := "EXISTS (SELECT 1 FROM taggings WHERE taggable_id = t.id AND tag_id = "
+	expected := "(" +
+		tagCond + "$2) AND (" +
+		tagCond + "$3) OR " +
+		tagCond + "$4)) AND NOT " +
+		tagCond + "$5))"
+	if cond != expected {
+		t.Errorf("expected condition:\n%s\ngot:\n%s", expected, cond)
+	}
+
+	if expectedArgs := []interface{}{1, 10, 20, 30, 40}; !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("expected args %v, got %v", expectedArgs, args)
+	}
+
+	if _, err := compileTagQuery(&storage.TagQuery{Op: "foo"}, "t", &args); err == nil {
+		t.Errorf("expected an error for an invalid op")
+	}
+}
@@ -7,13 +7,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 
 	"dmitryfrank.com/geekmarks/server/cptr"
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 	"github.com/golang/glog"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
@@ -105,6 +106,34 @@ func (s *StoragePostgres) CreateTag(
 
 func (s *StoragePostgres) UpdateTag(
 	tx *sql.Tx, td *storage.TagData, leafPolicy storage.TaggableLeafPolicy,
+) (err error) {
+	oldTD, err := s.GetTag(tx, td.ID, &storage.GetTagOpts{GetNames: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.updateTagInternal(tx, td, leafPolicy); err != nil {
+		return errors.Trace(err)
+	}
+
+	newTD, err := s.GetTag(tx, td.ID, &storage.GetTagOpts{GetNames: true})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = s.addHistoryRecord(
+		tx, oldTD.OwnerID, storage.HistoryObjectTag, td.ID,
+		storage.MakeTagDiff(oldTD, newTD),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) updateTagInternal(
+	tx *sql.Tx, td *storage.TagData, leafPolicy storage.TaggableLeafPolicy,
 ) (err error) {
 	// Move tag, if needed {{{
 	if td.ParentTagID != nil {
@@ -193,7 +222,7 @@ func (s *StoragePostgres) UpdateTag(
 		)
 		if err != nil {
 			return hh.MakeInternalServerError(errors.Annotatef(
-				err, "updating tag parent_id (id: %d, parent_id: %q)",
+				err, "updating tag parent_id (id: %d, parent_id: %d)",
 				td.ID, *td.ParentTagID,
 			))
 		}
@@ -227,7 +256,7 @@ func (s *StoragePostgres) UpdateTag(
 		if err != nil {
 			return hh.MakeInternalServerError(errors.Annotatef(
 				err, "updating tag description (id: %d, description: %q)",
-				td.ID, td.Description,
+				td.ID, *td.Description,
 			))
 		}
 	}
@@ -287,64 +316,426 @@ func (s *StoragePostgres) UpdateTag(
 }
 
 func (s *StoragePostgres) DeleteTag(
-	tx *sql.Tx, tagID int, leafPolicy storage.TaggableLeafPolicy,
-) (err error) {
-	// TODO: so far only "keep new leaf" policy is implemented for tag deletion
-	if leafPolicy != storage.TaggableLeafPolicyKeep {
-		return errors.Annotatef(
-			storage.ErrNotImplemented,
-			"so far, only \"keep new leaf\" policy is implemented",
-		)
+	tx *sql.Tx, tagID int, leafPolicy storage.TaggableLeafPolicy, dryRun bool,
+) (result *storage.TagDeleteResult, err error) {
+	var removeNewLeafs bool
+	switch leafPolicy {
+	case storage.TaggableLeafPolicyKeep:
+		removeNewLeafs = false
+	case storage.TaggableLeafPolicyDel:
+		removeNewLeafs = true
+	default:
+		return nil, errors.Errorf("invalid leafPolicy: %q", leafPolicy)
 	}
 
-	td, err := s.GetTag(tx, tagID, &storage.GetTagOpts{})
+	td, err := s.GetTag(tx, tagID, &storage.GetTagOpts{GetNames: true})
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
 	// Make sure the tag to be deleted is not the user's root tag
 	rootTagID, err := s.GetRootTagID(tx, td.OwnerID)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	if tagID == rootTagID {
 		glog.V(2).Infof("tried to delete the root tag")
-		return errors.Errorf("cowardly refused to delete the root tag")
+		return nil, errors.Errorf("cowardly refused to delete the root tag")
+	}
+
+	reg := thReg{
+		s:  s,
+		tx: tx,
+	}
+	hierProto := taghier.New(&reg)
+
+	if err := hierProto.Add(tagID); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Get affected taggables (those tagged with the tag being deleted and its
+	// descendants)
+	taggableIDs, err := s.GetTaggedTaggableIDs(tx, []int{tagID}, nil, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result = &storage.TagDeleteResult{
+		RetaggedIDs: []int{},
+		UntaggedIDs: []int{},
+	}
+
+	// For all the affected taggables, calculate the new taggings and apply
+	for _, taggableID := range taggableIDs {
+		tagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		hierCur := hierProto.MakeCopy()
+		for _, id := range tagIDs {
+			if err := hierCur.Add(id); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		// Perform the in-memory deletion, and delete all new leafs if needed
+		if err := hierCur.Delete(tagID, removeNewLeafs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// If only the root tag is left, the taggable becomes untagged
+		newTagIDs := hierCur.GetAll()
+		if len(newTagIDs) == 1 && newTagIDs[0] == rootTagID {
+			newTagIDs = []int{}
+		}
+
+		if len(newTagIDs) == 0 {
+			result.UntaggedIDs = append(result.UntaggedIDs, taggableID)
+		} else {
+			result.RetaggedIDs = append(result.RetaggedIDs, taggableID)
+		}
+
+		if !dryRun {
+			err = s.SetTaggings(tx, taggableID, newTagIDs, storage.TaggingModeAll)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+
+	sort.Ints(result.RetaggedIDs)
+	sort.Ints(result.UntaggedIDs)
+
+	if dryRun {
+		return result, nil
+	}
+
+	err = s.addHistoryRecord(
+		tx, td.OwnerID, storage.HistoryObjectTag, tagID, &storage.HistoryDiff{
+			Names:   &storage.StringsChange{Old: td.Names, New: []string{}},
+			Deleted: true,
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	// Here we just delete the subject tag; all the subtags and taggings
-	// will be deleted automatically thanks to ON DELETE CASCADE
+	// Here we just delete the subject tag; all the subtags will be deleted
+	// automatically thanks to ON DELETE CASCADE
 	_, err = tx.Exec("DELETE FROM tags WHERE id = $1", tagID)
 	if err != nil {
-		return hh.MakeInternalServerError(errors.Annotatef(
+		return nil, hh.MakeInternalServerError(errors.Annotatef(
 			err, "deleting the tag with id %d", tagID,
 		))
 	}
 
 	_, err = tx.Exec("UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = $1", td.ParentTagID)
 	if err != nil {
-		return hh.MakeInternalServerError(errors.Annotatef(
+		return nil, hh.MakeInternalServerError(errors.Annotatef(
 			err, "decrementing children_cnt of the tag with id %d", td.ParentTagID,
 		))
 	}
 
-	// if ParentTagID is a root tag for the user, then we should find
-	// bookmarks tagged with only this flag, and make them untagged
-	// (remove tagging by the root tag)
-	if *td.ParentTagID == rootTagID {
-		tgbIDs, err := s.getTaggablesTaggedWithOnlyOneTag(tx, rootTagID)
+	return result, nil
+}
+
+func (s *StoragePostgres) MergeTags(tx *sql.Tx, srcTagID, dstTagID int) error {
+	srcTD, err := s.GetTag(tx, srcTagID, &storage.GetTagOpts{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	dstTD, err := s.GetTag(tx, dstTagID, &storage.GetTagOpts{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if srcTD.OwnerID != dstTD.OwnerID {
+		return errors.Errorf("tags %d and %d belong to different users", srcTagID, dstTagID)
+	}
+
+	rootTagID, err := s.GetRootTagID(tx, srcTD.OwnerID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if srcTagID == rootTagID {
+		return errors.Errorf("cowardly refused to merge the root tag")
+	}
+
+	// Make sure that the target is not the source tag or one of its descendants
+	reg := thReg{
+		s:  s,
+		tx: tx,
+	}
+	hier := taghier.New(&reg)
+
+	if err := hier.Add(srcTagID); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := hier.Add(dstTagID); err != nil {
+		return errors.Trace(err)
+	}
+
+	isSubnode, err := hier.IsSubnode(dstTagID, srcTagID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if dstTagID == srcTagID || isSubnode {
+		return errors.Errorf("tag cannot be merged into itself or one of its descendants")
+	}
+
+	// Remember leaf taggings of the affected taggables (those tagged with the
+	// source tag and its descendants), before the hierarchy changes
+	taggableIDs, err := s.GetTaggedTaggableIDs(tx, []int{srcTagID}, nil, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	leafs := map[int][]int{}
+	for _, taggableID := range taggableIDs {
+		leafs[taggableID], err = s.GetTaggings(tx, taggableID, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	replacedBy := map[int]int{}
+	if err := s.mergeTagsInternal(tx, srcTagID, dstTagID, replacedBy); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tag the affected taggables with the same leafs, but replacing the merged
+	// tags with their targets; SetTaggings will take care of the full paths
+	for _, taggableID := range taggableIDs {
+		newLeafs := []int{}
+		for _, tagID := range leafs[taggableID] {
+			if newTagID, ok := replacedBy[tagID]; ok {
+				tagID = newTagID
+			}
+
+			// Merging into the root tag leaves the taggable untagged
+			if tagID != rootTagID {
+				newLeafs = append(newLeafs, tagID)
+			}
+		}
+
+		err := s.SetTaggings(tx, taggableID, newLeafs, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// mergeTagsInternal merges the hierarchy of srcTagID into dstTagID, and
+// deletes srcTagID, without touching taggings of other tags. All the merged
+// (and thus deleted) tag ids are added to replacedBy.
+func (s *StoragePostgres) mergeTagsInternal(
+	tx *sql.Tx, srcTagID, dstTagID int, replacedBy map[int]int,
+) error {
+	replacedBy[srcTagID] = dstTagID
+
+	srcTD, err := s.GetTag(tx, srcTagID, &storage.GetTagOpts{
+		GetNames:   true,
+		GetSubtags: true,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	dstTD, err := s.GetTag(tx, dstTagID, &storage.GetTagOpts{
+		GetNames:   true,
+		GetSubtags: true,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, srcSubtag := range srcTD.Subtags {
+		dstSubtag, err := storage.FindTagByNames(dstTD.Subtags, srcSubtag.Names)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		for _, curTgbID := range tgbIDs {
-			err := s.SetTaggings(tx, curTgbID, []int{}, storage.TaggingModeAll)
+
+		if dstSubtag != nil {
+			err := s.mergeTagsInternal(tx, srcSubtag.ID, dstSubtag.ID, replacedBy)
 			if err != nil {
 				return errors.Trace(err)
 			}
+			continue
+		}
+
+		// There's no such subtag in the target, so just move the subtag
+		_, err = tx.Exec(
+			"UPDATE tags SET parent_id = $1 WHERE id = $2", dstTagID, srcSubtag.ID,
+		)
+		if err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "updating tag parent_id (id: %d, parent_id: %d)",
+				srcSubtag.ID, dstTagID,
+			))
+		}
+
+		_, err = tx.Exec(
+			"UPDATE tags SET children_cnt = children_cnt + 1 WHERE id = $1", dstTagID,
+		)
+		if err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "incrementing children_cnt of the tag %d", dstTagID,
+			))
+		}
+	}
+
+	// All the subtags are moved away, so the source tag can be deleted now
+	// (together with its taggings, which are going to be fixed by the caller)
+	_, err = tx.Exec("DELETE FROM tags WHERE id = $1", srcTagID)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "deleting the tag with id %d", srcTagID,
+		))
+	}
+
+	_, err = tx.Exec("UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = $1", srcTD.ParentTagID)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "decrementing children_cnt of the tag with id %d", *srcTD.ParentTagID,
+		))
+	}
+
+	// The root tag has no names to add to
+	if *dstTD.ParentTagID == 0 {
+		return nil
+	}
+
+	dstNames := map[string]struct{}{}
+	for _, name := range dstTD.Names {
+		dstNames[name] = struct{}{}
+	}
+
+	// Add the names which the target tag doesn't have yet
+	for _, name := range srcTD.Names {
+		if _, ok := dstNames[name]; ok {
+			continue
+		}
+
+		if err := s.addTagName(
+			tx, dstTagID, *dstTD.ParentTagID, name,
+			false, // not primary
+			false, // do not allow empty
+		); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) CopyTag(
+	tx *sql.Tx, srcTagID, parentTagID int, names []string, retag bool,
+) (tagID int, err error) {
+	// Get the whole source subtree before creating anything, so that a tag can
+	// be copied under itself or one of its descendants
+	srcTD, err := s.GetTag(tx, srcTagID, &storage.GetTagOpts{
+		GetNames:   true,
+		GetSubtags: true,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	parentTD, err := s.GetTag(tx, parentTagID, &storage.GetTagOpts{})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if srcTD.OwnerID != parentTD.OwnerID {
+		return 0, errors.Errorf("tags %d and %d belong to different users", srcTagID, parentTagID)
+	}
+
+	rootTagID, err := s.GetRootTagID(tx, srcTD.OwnerID)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if srcTagID == rootTagID {
+		return 0, errors.Errorf("cowardly refused to copy the root tag")
+	}
+
+	if len(names) > 0 {
+		srcTD.Names = names
+	}
+
+	// Remember leaf taggings of the affected taggables (those tagged with the
+	// source tag and its descendants) before the copies appear
+	var taggableIDs []int
+	leafs := map[int][]int{}
+	if retag {
+		taggableIDs, err = s.GetTaggedTaggableIDs(tx, []int{srcTagID}, nil, nil)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		for _, taggableID := range taggableIDs {
+			leafs[taggableID], err = s.GetTaggings(tx, taggableID, storage.TaggingModeLeafs)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
 		}
 	}
 
-	return err
+	copiedTo := map[int]int{}
+	tagID, err = s.copyTagInternal(tx, srcTD, parentTagID, copiedTo)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Tag the affected taggables with the copies of their leafs as well;
+	// SetTaggings will take care of the full paths
+	for _, taggableID := range taggableIDs {
+		newLeafs := append([]int{}, leafs[taggableID]...)
+		for _, leafID := range leafs[taggableID] {
+			if copyID, ok := copiedTo[leafID]; ok {
+				newLeafs = append(newLeafs, copyID)
+			}
+		}
+
+		err := s.SetTaggings(tx, taggableID, newLeafs, storage.TaggingModeLeafs)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return tagID, nil
+}
+
+// copyTagInternal creates a copy of the given tag with all its subtags under
+// the tag parentTagID. Ids of all the created copies are added to copiedTo,
+// keyed by ids of the original tags.
+func (s *StoragePostgres) copyTagInternal(
+	tx *sql.Tx, td *storage.TagData, parentTagID int, copiedTo map[int]int,
+) (tagID int, err error) {
+	tagID, err = s.CreateTag(tx, &storage.TagData{
+		OwnerID:     td.OwnerID,
+		ParentTagID: cptr.Int(parentTagID),
+		Description: td.Description,
+		Names:       td.Names,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	copiedTo[td.ID] = tagID
+
+	for i := range td.Subtags {
+		if _, err := s.copyTagInternal(tx, &td.Subtags[i], tagID, copiedTo); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return tagID, nil
 }
 
 func (s *StoragePostgres) GetTagIDByPath(tx *sql.Tx, ownerID int, tagPath string) (int, error) {
@@ -656,7 +1047,7 @@ func (s *StoragePostgres) addTagName(
 	tx *sql.Tx, tagID, parentTagID int, name string, primary, allowEmpty bool,
 ) error {
 	glog.V(3).Infof(
-		"Adding tag name %q for tag %d, primary: %q", name, tagID, primary,
+		"Adding tag name %q for tag %d, primary: %v", name, tagID, primary,
 	)
 
 	err := storage.ValidateTagName(name, allowEmpty)
@@ -708,7 +1099,7 @@ func (s *StoragePostgres) setTagNamePrimary(
 	tx *sql.Tx, tagID int, name string, primary bool,
 ) error {
 	glog.V(3).Infof(
-		"Setting primariness of tag name %q from tag %d, primary: %q",
+		"Setting primariness of tag name %q from tag %d, primary: %v",
 		name, tagID, primary,
 	)
 
@@ -718,7 +1109,7 @@ func (s *StoragePostgres) setTagNamePrimary(
 	)
 	if err != nil {
 		return hh.MakeInternalServerError(errors.Annotatef(
-			err, "updating tag name primariness: %q for tag with id %d, primary: %q",
+			err, "updating tag name primariness: %q for tag with id %d, primary: %v",
 			name, tagID, primary,
 		))
 	}
@@ -4,8 +4,10 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"math/rand"
 	"net"
 	"time"
 
@@ -13,7 +15,7 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/juju/errors"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 func (s *StoragePostgres) Tx(fn func(*sql.Tx) error) error {
@@ -23,13 +25,73 @@ func (s *StoragePostgres) Tx(fn func(*sql.Tx) error) error {
 func (s *StoragePostgres) TxOpt(
 	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
 ) error {
-	if ilevel != storage.TxILevelReadCommitted && mode == storage.TxModeReadWrite {
-		// TODO: implement retrying of read-write transactions in case of
-		// (RepeatableRead or Serializable) and ReadWrite, and write tests which
-		// concurrently do lots of updates
-		return errors.Errorf("read-write mode is currently supported only for \"Read Committed\" isolation level")
+	return s.TxOptCtx(context.Background(), ilevel, mode, fn)
+}
+
+func (s *StoragePostgres) TxCtx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return s.TxOptCtx(ctx, storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn)
+}
+
+const (
+	// Max number of attempts to run a transaction which keeps failing because
+	// of concurrent transactions
+	txMaxAttempts = 10
+
+	txRetryMinDelay = 5 * time.Millisecond
+	txRetryMaxDelay = 500 * time.Millisecond
+)
+
+// TxOptCtx runs fn in a transaction. If ilevel is above "Read Committed",
+// then serialization failures and deadlocks cause the whole transaction to be
+// retried (with exponential backoff), so fn may be called multiple times.
+//
+// The transaction is begun with the given context, and lib/pq watches it for
+// the whole transaction lifetime: once the context is done, the statement
+// being executed is cancelled on the server side, and the transaction is
+// rolled back.
+func (s *StoragePostgres) TxOptCtx(
+	ctx context.Context,
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	if ilevel == storage.TxILevelReadCommitted {
+		return s.txOnce(ctx, ilevel, mode, fn)
 	}
 
+	delay := txRetryMinDelay
+	for attempt := 1; ; attempt++ {
+		err := s.txOnce(ctx, ilevel, mode, fn)
+		if err == nil || !isSerializationFailure(err) {
+			return err
+		}
+
+		if attempt >= txMaxAttempts {
+			return errors.Annotatef(err, "giving up after %d attempts", attempt)
+		}
+
+		glog.V(2).Infof(
+			"Transaction attempt %d failed because of a concurrent one, retrying: %s",
+			attempt, err,
+		)
+
+		// Sleep from delay/2 to delay, so that concurrent transactions which
+		// failed together don't retry together as well
+		select {
+		case <-time.After(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))):
+		case <-ctx.Done():
+			return errors.Annotatef(ctx.Err(), "retrying transaction (%s)", err)
+		}
+
+		delay *= 2
+		if delay > txRetryMaxDelay {
+			delay = txRetryMaxDelay
+		}
+	}
+}
+
+func (s *StoragePostgres) txOnce(
+	ctx context.Context,
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
 	var tx *sql.Tx
 	var err error
 
@@ -39,7 +101,7 @@ func (s *StoragePostgres) TxOpt(
 	// hack: we keep retrying to connect for 10 seconds.
 	timeoutChan := time.After(10 * time.Second)
 	for {
-		tx, err = s.db.Begin()
+		tx, err = s.db.BeginTx(ctx, nil)
 		if err != nil {
 			err2 := errors.Annotate(err, "begin transaction")
 			pqerr, ok := err.(*net.OpError)
@@ -50,6 +112,8 @@ func (s *StoragePostgres) TxOpt(
 					select {
 					case <-timeoutChan:
 						return errors.Annotate(err2, "time is out")
+					case <-ctx.Done():
+						return errors.Annotate(err2, ctx.Err().Error())
 					case <-time.After(1 * time.Second):
 						continue
 					}
@@ -65,12 +129,14 @@ func (s *StoragePostgres) TxOpt(
 		if _, err := tx.Exec(
 			fmt.Sprintf("SET TRANSACTION ISOLATION LEVEL %s", ilevelToString(ilevel)),
 		); err != nil {
+			tx.Rollback()
 			return errors.Annotate(err, "set isolation level")
 		}
 	}
 
 	if mode == storage.TxModeReadOnly {
 		if _, err := tx.Exec("SET TRANSACTION READ ONLY"); err != nil {
+			tx.Rollback()
 			return errors.Annotate(err, "set isolation level")
 		}
 	}
@@ -78,7 +144,9 @@ func (s *StoragePostgres) TxOpt(
 
 	err = fn(tx)
 	if err != nil {
-		if err2 := tx.Rollback(); err2 != nil {
+		// If the context is done, the transaction is already rolled back by
+		// database/sql, and we get ErrTxDone here
+		if err2 := tx.Rollback(); err2 != nil && err2 != sql.ErrTxDone {
 			glog.Errorf("Transaction rollback failed: %+v", err2)
 		}
 		return errors.Trace(err)
@@ -91,6 +159,38 @@ func (s *StoragePostgres) TxOpt(
 	return nil
 }
 
+// isSerializationFailure returns whether the given error (possibly wrapped
+// into other errors) is caused by a serialization failure or a deadlock, i.e.
+// whether the transaction can succeed if retried.
+func isSerializationFailure(err error) bool {
+	for err != nil {
+		if pqErr, ok := err.(*pq.Error); ok {
+			return pqErr.Code == "40001" || pqErr.Code == "40P01"
+		}
+
+		// Juju errors keep the wrapped error as Underlying(); so do internal
+		// errors, whose Cause() is the public error instead of the original one.
+		// So we try Underlying() first, and only then Cause().
+		if wrapper, ok := err.(interface {
+			Underlying() error
+		}); ok {
+			if next := wrapper.Underlying(); next != nil && next != err {
+				err = next
+				continue
+			}
+		}
+
+		if cause := errors.Cause(err); cause != err {
+			err = cause
+			continue
+		}
+
+		return false
+	}
+
+	return false
+}
+
 func ilevelToString(ilevel storage.TxILevel) string {
 	switch ilevel {
 	case storage.TxILevelReadCommitted:
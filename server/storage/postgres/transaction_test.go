@@ -0,0 +1,35 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package postgres
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/lib/pq"
+)
+
+func TestIsSerializationFailure(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("foo"), false},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{errors.Trace(&pq.Error{Code: "40001"}), true},
+		{errors.Annotatef(errors.Trace(&pq.Error{Code: "40P01"}), "foo"), true},
+		{errors.Annotatef(errors.Trace(&pq.Error{Code: "23505"}), "foo"), false},
+	}
+
+	for i, tc := range testCases {
+		if got := isSerializationFailure(tc.err); got != tc.want {
+			t.Errorf("#%d (%v): want %v, got %v", i, tc.err, tc.want, got)
+		}
+	}
+}
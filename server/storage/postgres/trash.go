@@ -0,0 +1,141 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+	_ "github.com/lib/pq"
+)
+
+func (s *StoragePostgres) TrashTaggable(tx *sql.Tx, taggableID int) error {
+	_, err := tx.Exec(
+		"UPDATE taggables SET trashed_ts = NOW() WHERE id = $1 AND trashed_ts IS NULL",
+		taggableID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "trashing taggable with id %d", taggableID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) RestoreTaggable(tx *sql.Tx, taggableID int) error {
+	// If it's a bookmark, check whether another bookmark with the same URL
+	// was created while this one was in the trash
+	bkm, err := s.GetBookmarkByID(tx, taggableID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err == nil {
+		if bkm.CanonicalURL != "" {
+			existingBkms, err := s.GetBookmarksByURL(tx, bkm.CanonicalURL, bkm.OwnerID, &storage.TagsFetchOpts{
+				TagsFetchMode:     storage.TagsFetchModeNone,
+				TagNamesFetchMode: storage.TagNamesFetchModeNone,
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if len(existingBkms) > 0 {
+				return errors.Errorf("bookmark with the url %q already exists", bkm.URL)
+			}
+		}
+	} else if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+		return errors.Trace(err)
+	}
+
+	_, err = tx.Exec(
+		"UPDATE taggables SET trashed_ts = NULL WHERE id = $1", taggableID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "restoring taggable with id %d", taggableID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) GetTrashedTaggables(
+	tx *sql.Tx, ownerID int,
+) (taggables []storage.TaggableData, err error) {
+	taggables = []storage.TaggableData{}
+
+	rows, err := tx.Query(`
+SELECT id, owner_id, "type",
+       CAST(EXTRACT(EPOCH FROM created_ts) AS INTEGER),
+       CAST(EXTRACT(EPOCH FROM updated_ts) AS INTEGER),
+       CAST(EXTRACT(EPOCH FROM trashed_ts) AS INTEGER)
+  FROM taggables
+  WHERE owner_id = $1 AND trashed_ts IS NOT NULL
+  ORDER BY CAST(EXTRACT(EPOCH FROM trashed_ts) AS INTEGER) DESC, id DESC
+	`, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tgb := storage.TaggableData{}
+		var ttype string
+		err := rows.Scan(
+			&tgb.ID, &tgb.OwnerID, &ttype, &tgb.CreatedAt, &tgb.UpdatedAt, &tgb.TrashedAt,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		tgb.Type = storage.TaggableType(ttype)
+
+		taggables = append(taggables, tgb)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return taggables, nil
+}
+
+func (s *StoragePostgres) PurgeTrash(
+	tx *sql.Tx, ownerID *int, trashedBefore uint64,
+) (taggableIDs []int, err error) {
+	taggableIDs = []int{}
+
+	args := []interface{}{trashedBefore}
+	where := "WHERE CAST(EXTRACT(EPOCH FROM trashed_ts) AS INTEGER) <= $1 "
+	if ownerID != nil {
+		args = append(args, *ownerID)
+		where += fmt.Sprintf("AND owner_id = $%d ", len(args))
+	}
+
+	// Taggings and bookmarks (or notes) are deleted by the cascade
+	rows, err := tx.Query("DELETE FROM taggables "+where+"RETURNING id", args...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		taggableIDs = append(taggableIDs, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	sort.Ints(taggableIDs)
+
+	return taggableIDs, nil
+}
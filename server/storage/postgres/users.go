@@ -32,9 +32,12 @@ func (s *StoragePostgres) GetUser(
 	} else if args.Username != nil {
 		where = "username = $1"
 		queryArgs = append(queryArgs, *args.Username)
+	} else if args.Email != nil {
+		where = "email = $1"
+		queryArgs = append(queryArgs, *args.Email)
 	} else {
 		return nil, hh.MakeInternalServerError(errors.Errorf(
-			"neither id nor username is given to storage.GetUser()",
+			"neither id, username nor email is given to storage.GetUser()",
 		))
 	}
 
@@ -89,6 +92,27 @@ func (s *StoragePostgres) DeleteUser(tx *sql.Tx, userID int) error {
 	return nil
 }
 
+func (s *StoragePostgres) SetUserPassword(
+	tx *sql.Tx, userID int, passwordHash string,
+) error {
+	res, err := tx.Exec(
+		"UPDATE users SET password = $1 WHERE id = $2", passwordHash, userID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Annotatef(storage.ErrUserDoesNotExist, "id %d", userID)
+	}
+
+	return nil
+}
+
 func (s *StoragePostgres) GetUsers(tx *sql.Tx) ([]storage.UserData, error) {
 	var ret []storage.UserData
 
@@ -112,73 +136,224 @@ func (s *StoragePostgres) GetUsers(tx *sql.Tx) ([]storage.UserData, error) {
 	return ret, nil
 }
 
-func (s *StoragePostgres) GetAccessToken(
-	tx *sql.Tx, userID int, descr string, createIfNotExist bool,
-) (token string, err error) {
+func (s *StoragePostgres) CreateAccessToken(
+	tx *sql.Tx, atd *storage.AccessTokenData,
+) (tokenID int, token string, err error) {
+	scope := atd.Scope
+	if scope == "" {
+		scope = storage.AccessTokenScopeDefault
+	}
+	if err := storage.ValidateAccessTokenScope(scope); err != nil {
+		return 0, "", errors.Trace(err)
+	}
 
-	err = tx.QueryRow(
-		"SELECT token FROM access_tokens WHERE user_id = $1 and descr = $2",
-		userID, descr,
-	).Scan(&token)
-	if err != nil && errors.Cause(err) != sql.ErrNoRows {
-		// Some unexpected error
-		return "", hh.MakeInternalServerError(err)
+	rootTagID := sql.NullInt64{}
+	if atd.RootTagID != 0 {
+		rootTagID = sql.NullInt64{Int64: int64(atd.RootTagID), Valid: true}
+	}
+
+	expiresAt := sql.NullInt64{}
+	if atd.ExpiresAt != 0 {
+		expiresAt = sql.NullInt64{Int64: int64(atd.ExpiresAt), Valid: true}
+	}
+
+	token = uniuri.NewLen(accessTokenLen)
+	err = tx.QueryRow(`
+INSERT INTO access_tokens (
+  user_id, token_hash, descr, scope, root_tag_id, expires_ts
+) VALUES ($1, $2, $3, $4, $5, TO_TIMESTAMP($6))
+  RETURNING id`,
+		atd.UserID, storage.HashAccessToken(token), atd.Descr, string(scope),
+		rootTagID, expiresAt,
+	).Scan(&tokenID)
+	if err != nil {
+		return 0, "", interrors.WrapInternalErrorf(
+			err, "failed to create access token (%q, user_id: %d)",
+			atd.Descr, atd.UserID,
+		)
+	}
+
+	return tokenID, token, nil
+}
+
+const accessTokenFields = `
+  id, user_id, descr, scope, COALESCE(root_tag_id, 0),
+  CAST(EXTRACT(EPOCH FROM created_ts) AS INTEGER),
+  COALESCE(CAST(EXTRACT(EPOCH FROM last_used_ts) AS INTEGER), 0),
+  COALESCE(CAST(EXTRACT(EPOCH FROM expires_ts) AS INTEGER), 0)
+`
+
+func scanAccessToken(
+	scan func(dest ...interface{}) error,
+) (*storage.AccessTokenData, error) {
+	var atd storage.AccessTokenData
+	err := scan(
+		&atd.ID, &atd.UserID, &atd.Descr, &atd.Scope, &atd.RootTagID,
+		&atd.CreatedAt, &atd.LastUsedAt, &atd.ExpiresAt,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
+	return &atd, nil
+}
 
-	if token == "" {
-		// Token does not exist
-		if createIfNotExist {
-			// Let's create one
-			token = uniuri.NewLen(accessTokenLen)
-			_, err := tx.Exec(
-				"INSERT INTO access_tokens (user_id, token, descr) VALUES ($1, $2, $3)",
-				userID, token, descr,
+func (s *StoragePostgres) GetAccessToken(
+	tx *sql.Tx, tokenID int,
+) (*storage.AccessTokenData, error) {
+	atd, err := scanAccessToken(tx.QueryRow(
+		"SELECT "+accessTokenFields+" FROM access_tokens WHERE id = $1", tokenID,
+	).Scan)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, interrors.WrapInternalError(
+				err, storage.ErrAccessTokenDoesNotExist,
 			)
-			if err != nil {
-				return "", interrors.WrapInternalErrorf(
-					err, "failed to create access token %q (%q, user_id: %d)",
-					token, descr, userID,
-				)
-			}
-		} else {
-			return "", errors.Errorf("token with the descr %q does not exist", descr)
 		}
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return atd, nil
+}
+
+func (s *StoragePostgres) GetAccessTokens(
+	tx *sql.Tx, userID int,
+) ([]storage.AccessTokenData, error) {
+	ret := []storage.AccessTokenData{}
+
+	rows, err := tx.Query(
+		"SELECT "+accessTokenFields+" FROM access_tokens WHERE user_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		atd, err := scanAccessToken(rows.Scan)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		ret = append(ret, *atd)
+	}
+
+	return ret, nil
+}
+
+func (s *StoragePostgres) DeleteAccessToken(tx *sql.Tx, tokenID int) error {
+	res, err := tx.Exec("DELETE FROM access_tokens WHERE id = $1", tokenID)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Trace(storage.ErrAccessTokenDoesNotExist)
 	}
 
-	return token, nil
+	return nil
 }
 
 func (s *StoragePostgres) GetUserByAccessToken(
 	tx *sql.Tx, token string,
-) (*storage.UserData, error) {
+) (*storage.UserData, *storage.AccessTokenData, error) {
 	var ud storage.UserData
+	var tokenID int
 
 	err := tx.QueryRow(`
-SELECT u.id, u.username, u.password, u.email FROM users u
+SELECT u.id, u.username, u.password, u.email, tok.id FROM users u
 JOIN access_tokens tok ON tok.user_id = u.id
-WHERE tok.token = $1`, token,
-	).Scan(&ud.ID, &ud.Username, &ud.Password, &ud.Email)
+WHERE tok.token_hash = $1 AND (tok.expires_ts IS NULL OR tok.expires_ts > NOW())`,
+		storage.HashAccessToken(token),
+	).Scan(&ud.ID, &ud.Username, &ud.Password, &ud.Email, &tokenID)
 	if err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
-			// TODO: annotate error with the id or name
-			return nil, hh.MakeUnauthorizedError()
+			return nil, nil, hh.MakeUnauthorizedError()
 		}
 		// Some unexpected error
+		return nil, nil, hh.MakeInternalServerError(err)
+	}
+
+	_, err = tx.Exec(`
+UPDATE access_tokens SET last_used_ts = NOW()
+  WHERE id = $1 AND (
+    last_used_ts IS NULL OR
+    last_used_ts <= NOW() - $2 * INTERVAL '1 second'
+  )`, tokenID, storage.AccessTokenLastUsedResolution,
+	)
+	if err != nil {
+		return nil, nil, hh.MakeInternalServerError(err)
+	}
+
+	atd, err := s.GetAccessToken(tx, tokenID)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return &ud, atd, nil
+}
+
+const externalIdentityFields = `
+  id, user_id, provider, subject, email,
+  CAST(EXTRACT(EPOCH FROM created_ts) AS INTEGER)
+`
+
+func (s *StoragePostgres) GetExternalIdentities(
+	tx *sql.Tx, userID int,
+) ([]storage.ExternalIdentityData, error) {
+	ret := []storage.ExternalIdentityData{}
+
+	rows, err := tx.Query(
+		"SELECT "+externalIdentityFields+" FROM external_identities WHERE user_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
 		return nil, hh.MakeInternalServerError(err)
 	}
 
-	return &ud, nil
+	defer rows.Close()
+	for rows.Next() {
+		var eid storage.ExternalIdentityData
+		if err := rows.Scan(
+			&eid.ID, &eid.UserID, &eid.Provider, &eid.Subject, &eid.Email, &eid.CreatedAt,
+		); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		ret = append(ret, eid)
+	}
+
+	return ret, nil
 }
 
-func (s *StoragePostgres) GetUserByGoogleUserID(
-	tx *sql.Tx, googleUserID string,
+func (s *StoragePostgres) DeleteExternalIdentity(tx *sql.Tx, eidID int) error {
+	res, err := tx.Exec("DELETE FROM external_identities WHERE id = $1", eidID)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Trace(storage.ErrIdentityDoesNotExist)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) GetUserByExternalIdentity(
+	tx *sql.Tx, provider, subject string,
 ) (*storage.UserData, error) {
 	var ud storage.UserData
 
 	err := tx.QueryRow(`
 SELECT u.id, u.username, u.password, u.email FROM users u
-JOIN google_auth google ON google.user_id = u.id
-WHERE google.google_user_id = $1`, googleUserID,
+JOIN external_identities eid ON eid.user_id = u.id
+WHERE eid.provider = $1 AND eid.subject = $2`, provider, subject,
 	).Scan(&ud.ID, &ud.Username, &ud.Password, &ud.Email)
 	if err != nil {
 		if errors.Cause(err) == sql.ErrNoRows {
@@ -192,15 +367,21 @@ WHERE google.google_user_id = $1`, googleUserID,
 	return &ud, nil
 }
 
-func (s *StoragePostgres) CreateGoogleUser(
-	tx *sql.Tx, userID int, googleUserID, email string,
-) error {
-	_, err := tx.Exec(`
-  INSERT INTO google_auth (google_user_id, user_id, email) VALUES ($1, $2, $3)
-`, googleUserID, userID, email)
+func (s *StoragePostgres) CreateExternalIdentity(
+	tx *sql.Tx, eid *storage.ExternalIdentityData,
+) (eidID int, err error) {
+	err = tx.QueryRow(`
+INSERT INTO external_identities (user_id, provider, subject, email)
+  VALUES ($1, $2, $3, $4)
+  RETURNING id`,
+		eid.UserID, eid.Provider, eid.Subject, eid.Email,
+	).Scan(&eidID)
 	if err != nil {
-		return hh.MakeInternalServerError(err)
+		return 0, interrors.WrapInternalErrorf(
+			err, "failed to create external identity (%q, %q, user_id: %d)",
+			eid.Provider, eid.Subject, eid.UserID,
+		)
 	}
 
-	return nil
+	return eidID, nil
 }
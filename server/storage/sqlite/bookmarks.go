@@ -0,0 +1,576 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/textsearch"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (bkmID int, err error) {
+	// If URL is not empty, check whether the bookmark with the same canonical
+	// URL already exists
+	canonicalURL := bd.GetCanonicalURL()
+	if canonicalURL != "" {
+		existingBkms, err := s.GetBookmarksByURL(tx, canonicalURL, bd.OwnerID, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeNone,
+			TagNamesFetchMode: storage.TagNamesFetchModeNone,
+		})
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if len(existingBkms) > 0 {
+			return 0, errors.Errorf("bookmark with the url %q already exists", bd.URL)
+		}
+	}
+
+	bkmID, err = s.CreateTaggable(tx, &storage.TaggableData{
+		OwnerID: bd.OwnerID,
+		Type:    storage.TaggableTypeBookmark,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	_, err = tx.ExecContext(
+		s.txCtx(tx), "INSERT INTO bookmarks (id, url, canonical_url, title, comment) VALUES (?, ?, ?, ?, ?)",
+		bkmID, bd.URL, canonicalURL, bd.Title, bd.Comment,
+	)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return bkmID, nil
+}
+
+func (s *StorageSQLite) UpdateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (err error) {
+	// The old version is needed for the history
+	oldBkm, err := s.GetBookmarkByID(tx, bd.ID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// If the canonical URL is changed and is not empty, check whether the
+	// bookmark with the same canonical URL already exists. If it's not changed,
+	// then we don't check it, so that the bookmarks which became duplicates
+	// after the canonicalization rules were changed can still be edited.
+	canonicalURL := bd.GetCanonicalURL()
+	if canonicalURL != "" && canonicalURL != oldBkm.CanonicalURL {
+		existingBkms, err := s.GetBookmarksByURL(tx, canonicalURL, bd.OwnerID, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeNone,
+			TagNamesFetchMode: storage.TagNamesFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(existingBkms) > 0 {
+			return errors.Errorf("bookmark with the url %q already exists", bd.URL)
+		}
+	}
+
+	_, err = tx.ExecContext(
+		s.txCtx(tx), "UPDATE bookmarks SET url = ?, canonical_url = ?, title = ?, comment = ? WHERE id = ?",
+		bd.URL, canonicalURL, bd.Title, bd.Comment, bd.ID,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = s.addHistoryRecord(
+		tx, oldBkm.OwnerID, storage.HistoryObjectTaggable, bd.ID,
+		storage.MakeBookmarkDiff(&oldBkm.BookmarkData, bd),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func setDefaultTagFetchOpts(tagsFetchOpts *storage.TagsFetchOpts) *storage.TagsFetchOpts {
+	if tagsFetchOpts == nil {
+		tagsFetchOpts = &storage.TagsFetchOpts{}
+	}
+
+	if tagsFetchOpts.TagsFetchMode == "" {
+		tagsFetchOpts.TagsFetchMode = storage.TagsFetchModeDefault
+	}
+
+	if tagsFetchOpts.TagNamesFetchMode == "" {
+		tagsFetchOpts.TagNamesFetchMode = storage.TagNamesFetchModeDefault
+	}
+
+	return tagsFetchOpts
+}
+
+func (s *StorageSQLite) GetTaggedBookmarks(
+	tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *storage.TagsFetchOpts,
+	pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	args := []interface{}{}
+
+	// There is a different logic for two cases:
+	// - There is at least one tag given: we'll fetch bookmarks which are tagged
+	//   with all of the given tags (and possibly with any other tags)
+	// - There are no tags given: we'll fetch bookmarks which are untagged at all
+	from := "FROM taggables t JOIN bookmarks b ON t.id = b.id "
+	where := "WHERE 1=1 "
+	if len(tagIDs) > 0 {
+		for k, tagID := range tagIDs {
+			from += fmt.Sprintf(
+				"JOIN taggings tg%d ON (tg%d.taggable_id = t.id AND tg%d.tag_id = ?) ",
+				k, k, k,
+			)
+			args = append(args, tagID)
+		}
+	} else {
+		from += "LEFT JOIN taggings tg ON (tg.taggable_id = t.id) "
+		where += "AND tg.taggable_id IS NULL "
+	}
+
+	if ownerID != nil {
+		where += "AND t.owner_id = ? "
+		args = append(args, *ownerID)
+	}
+
+	return s.getBookmarksPage(tx, from, where, args, tagsFetchOpts, pageOpts)
+}
+
+func (s *StorageSQLite) GetBookmarksByTagQuery(
+	tx *sql.Tx, query *storage.TagQuery, ownerID int,
+	tagsFetchOpts *storage.TagsFetchOpts, pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	if err := query.Validate(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args := []interface{}{}
+
+	cond, err := compileTagQuery(query, "t", &args)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	from := "FROM taggables t JOIN bookmarks b ON t.id = b.id "
+	where := "WHERE " + cond + " "
+
+	args = append(args, ownerID)
+	where += "AND t.owner_id = ? "
+
+	return s.getBookmarksPage(tx, from, where, args, tagsFetchOpts, pageOpts)
+}
+
+// getBookmarksPage returns a page of bookmarks selected by the given FROM and
+// WHERE clauses, which can refer to taggables as t and to bookmarks as b.
+// Trashed bookmarks are skipped.
+func (s *StorageSQLite) getBookmarksPage(
+	tx *sql.Tx, from, where string, args []interface{},
+	tagsFetchOpts *storage.TagsFetchOpts, pageOpts *storage.BookmarksPageOpts,
+) (page *storage.BookmarksPage, err error) {
+	pageOpts, err = storage.PrepareBookmarksPageOpts(pageOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	where += "AND t.trashed_ts IS NULL "
+
+	page = &storage.BookmarksPage{}
+
+	err = tx.QueryRowContext(
+		s.txCtx(tx), "SELECT COUNT(t.id) "+from+where, args...,
+	).Scan(&page.TotalCnt)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	var sortCol string
+	switch pageOpts.SortField {
+	case storage.BookmarksSortFieldCreated:
+		sortCol = "t.created_ts"
+	case storage.BookmarksSortFieldUpdated:
+		sortCol = "t.updated_ts"
+	case storage.BookmarksSortFieldTitle:
+		sortCol = "b.title"
+	case storage.BookmarksSortFieldURL:
+		sortCol = "b.url"
+	}
+
+	dir, cmp := "ASC", ">"
+	if pageOpts.SortDesc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if c := pageOpts.Cursor; c != nil {
+		var cursorVal interface{} = c.Str
+		if sortCol == "t.created_ts" || sortCol == "t.updated_ts" {
+			cursorVal = int64(c.Time)
+		}
+
+		where += fmt.Sprintf(
+			"AND (%s %s ? OR (%s = ? AND t.id %s ?)) ", sortCol, cmp, sortCol, cmp,
+		)
+		args = append(args, cursorVal, cursorVal, c.ID)
+	}
+
+	limit := ""
+	if pageOpts.Limit > 0 {
+		// Fetch one more bookmark, to know whether there is a next page
+		limit = "LIMIT ?"
+		args = append(args, pageOpts.Limit+1)
+	}
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rows, err := tx.QueryContext(s.txCtx(tx), fmt.Sprintf(`
+SELECT t.id, b.url, b.title, b.comment, t.owner_id,
+       t.created_ts, t.updated_ts,
+       %s as tagsjson
+  %s
+  %s
+  ORDER BY %s %s, t.id %s
+  %s
+	`, tagsJsonFieldQuery, from, where, sortCol, dir, dir, limit), args...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	page.Bookmarks, err = rowsToBookmarks(rows, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if pageOpts.Limit > 0 && len(page.Bookmarks) > pageOpts.Limit {
+		page.Bookmarks = page.Bookmarks[:pageOpts.Limit]
+		page.NextCursor = storage.MakeBookmarksCursor(
+			&page.Bookmarks[pageOpts.Limit-1].BookmarkData, pageOpts,
+		)
+	}
+
+	return page, nil
+}
+
+func (s *StorageSQLite) GetBookmarksByURL(
+	tx *sql.Tx, canonicalURL string, ownerID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, err error) {
+	bookmarks = []storage.BookmarkDataWTags{}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rows, err := tx.QueryContext(s.txCtx(tx), fmt.Sprintf(`
+SELECT t.id, b.url, b.title, b.comment, t.owner_id,
+       t.created_ts, t.updated_ts,
+       %s as tagsjson
+  FROM taggables t
+  JOIN bookmarks b ON t.id = b.id
+  WHERE t.owner_id = ? AND b.canonical_url = ? AND t.trashed_ts IS NULL
+	`, tagsJsonFieldQuery), ownerID, canonicalURL,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+	return rowsToBookmarks(rows, tagsFetchOpts)
+}
+
+// SearchBookmarks doesn't use any full-text search capabilities of sqlite
+// (which might be not compiled in): all owner's bookmarks (tagged with all the
+// tagIDs) are fetched and matched against the query by textsearch.
+func (s *StorageSQLite) SearchBookmarks(
+	tx *sql.Tx, query string, ownerID int, tagIDs []int,
+	tagsFetchOpts *storage.TagsFetchOpts,
+) (results []storage.BookmarkSearchResult, err error) {
+	results = []storage.BookmarkSearchResult{}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	q := textsearch.ParseQuery(query)
+	if q.IsEmpty() {
+		return nil, errors.Trace(storage.ErrSearchQueryEmpty)
+	}
+
+	// First, find matching bookmarks
+	args := []interface{}{}
+	candQuery := "SELECT b.id, b.title, b.comment, b.url FROM bookmarks b "
+	for k, tagID := range tagIDs {
+		candQuery += fmt.Sprintf(
+			"JOIN taggings t%d ON (t%d.taggable_id = b.id AND t%d.tag_id = ?) ",
+			k, k, k,
+		)
+		args = append(args, tagID)
+	}
+	candQuery += "JOIN taggables tg ON tg.id = b.id WHERE tg.owner_id = ? AND tg.trashed_ts IS NULL ORDER BY b.id"
+	args = append(args, ownerID)
+
+	rows, err := tx.QueryContext(s.txCtx(tx), candQuery, args...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	matches := map[int]*textsearch.Result{}
+	ids := []interface{}{}
+	for rows.Next() {
+		var id int
+		var title, comment, url string
+		if err := rows.Scan(&id, &title, &comment, &url); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		if m := q.Match(title, comment, url); m != nil {
+			matches[id] = m
+			ids = append(ids, id)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	// Then, fetch them in full
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rows, err = tx.QueryContext(s.txCtx(tx), fmt.Sprintf(`
+SELECT t.id, b.url, b.title, b.comment, t.owner_id,
+       t.created_ts, t.updated_ts,
+       %s as tagsjson
+  FROM taggables t
+  JOIN bookmarks b ON t.id = b.id
+  WHERE t.id IN (`+getPlaceholdersString(len(ids))+`)
+  ORDER BY t.id
+	`, tagsJsonFieldQuery), ids...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	bookmarks, err := rowsToBookmarks(rows, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, bkm := range bookmarks {
+		m := matches[bkm.ID]
+		results = append(results, storage.BookmarkSearchResult{
+			BookmarkDataWTags: bkm,
+			Rank:              m.Rank,
+			TitleSnippet:      m.TitleSnippet,
+			CommentSnippet:    m.CommentSnippet,
+		})
+	}
+
+	// Best matches first; the stable sort keeps results with the same rank
+	// ordered by id
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Rank > results[j].Rank
+	})
+
+	return results, nil
+}
+
+func (s *StorageSQLite) GetDuplicateBookmarks(
+	tx *sql.Tx, ownerID int,
+) (duplicates []storage.DuplicateBookmarks, err error) {
+	duplicates = []storage.DuplicateBookmarks{}
+
+	rows, err := tx.QueryContext(s.txCtx(tx), `
+SELECT b.canonical_url, b.id
+  FROM bookmarks b
+  JOIN taggables t ON t.id = b.id
+  WHERE t.owner_id = ? AND t.trashed_ts IS NULL AND b.canonical_url IN (
+    SELECT b2.canonical_url
+      FROM bookmarks b2
+      JOIN taggables t2 ON t2.id = b2.id
+      WHERE t2.owner_id = ? AND t2.trashed_ts IS NULL AND b2.canonical_url != ''
+      GROUP BY b2.canonical_url
+      HAVING COUNT(*) > 1
+  )
+  ORDER BY b.canonical_url, b.id
+	`, ownerID, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var canonicalURL string
+		var id int
+		if err := rows.Scan(&canonicalURL, &id); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		if len(duplicates) == 0 || duplicates[len(duplicates)-1].CanonicalURL != canonicalURL {
+			duplicates = append(duplicates, storage.DuplicateBookmarks{
+				CanonicalURL: canonicalURL,
+			})
+		}
+
+		last := &duplicates[len(duplicates)-1]
+		last.BookmarkIDs = append(last.BookmarkIDs, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return duplicates, nil
+}
+
+func (s *StorageSQLite) GetAllBookmarkURLs(
+	tx *sql.Tx,
+) (urls []storage.BookmarkURLData, err error) {
+	urls = []storage.BookmarkURLData{}
+
+	rows, err := tx.QueryContext(
+		s.txCtx(tx), "SELECT id, url, canonical_url FROM bookmarks ORDER BY id",
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u storage.BookmarkURLData
+		if err := rows.Scan(&u.ID, &u.URL, &u.CanonicalURL); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		urls = append(urls, u)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return urls, nil
+}
+
+func (s *StorageSQLite) SetBookmarkCanonicalURL(
+	tx *sql.Tx, bookmarkID int, canonicalURL string,
+) error {
+	_, err := tx.ExecContext(
+		s.txCtx(tx), "UPDATE bookmarks SET canonical_url = ? WHERE id = ?",
+		canonicalURL, bookmarkID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetBookmarkByID(
+	tx *sql.Tx, bookmarkID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmark *storage.BookmarkDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	bkm := storage.BookmarkDataWTags{}
+	var tagBriefData []byte
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	err = tx.QueryRowContext(s.txCtx(tx), fmt.Sprintf(`
+SELECT t.id, b.url, b.canonical_url, b.title, b.comment, t.owner_id,
+       t.created_ts, t.updated_ts, COALESCE(t.trashed_ts, 0),
+       %s as tagsjson
+  FROM taggables t
+  JOIN bookmarks b ON t.id = b.id
+  WHERE t.id = ?
+	`, tagsJsonFieldQuery), bookmarkID,
+	).Scan(
+		&bkm.ID, &bkm.URL, &bkm.CanonicalURL, &bkm.Title, &bkm.Comment, &bkm.OwnerID,
+		&bkm.CreatedAt, &bkm.UpdatedAt, &bkm.TrashedAt,
+		&tagBriefData,
+	)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, errors.Annotatef(
+				interrors.WrapInternalError(
+					err,
+					storage.ErrBookmarkDoesNotExist,
+				),
+				"id %d", bookmarkID,
+			)
+		}
+		// Some unexpected error
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	bkm.Tags, err = parseTagBrief(tagBriefData, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &bkm, nil
+}
+
+func getPlaceholdersString(cnt int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", cnt), ",")
+}
+
+// rowsToBookmarks expects each row to contain the following fields, in this
+// order:
+//
+// id, url, title, comment, owner_id, created_time, updated_time, tags_data.
+// For some details on what is tags_data, see parseTagBrief().
+func rowsToBookmarks(
+	rows *sql.Rows, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, err error) {
+	bookmarks = []storage.BookmarkDataWTags{}
+	for rows.Next() {
+		bkm := storage.BookmarkDataWTags{}
+		var tagBriefData []byte
+		err := rows.Scan(
+			&bkm.ID, &bkm.URL, &bkm.Title, &bkm.Comment, &bkm.OwnerID,
+			&bkm.CreatedAt, &bkm.UpdatedAt,
+			&tagBriefData,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		bkm.Tags, err = parseTagBrief(tagBriefData, tagsFetchOpts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		bookmarks = append(bookmarks, bkm)
+	}
+	return bookmarks, nil
+}
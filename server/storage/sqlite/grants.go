@@ -0,0 +1,112 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+const tagGrantFields = `
+  g.id, g.tag_id, t.owner_id, g.grantee_id, g.permission, g.created_ts
+`
+
+func (s *StorageSQLite) CreateTagGrant(
+	tx *sql.Tx, tgd *storage.TagGrantData,
+) (grantID int, err error) {
+	perm := tgd.Permission
+	if perm == "" {
+		perm = storage.TagGrantPermissionDefault
+	}
+
+	if err := storage.ValidateTagGrantPermission(perm); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	res, err := tx.ExecContext(s.txCtx(tx), `
+INSERT INTO tag_grants (tag_id, grantee_id, permission)
+  VALUES (?, ?, ?)`,
+		tgd.TagID, tgd.GranteeID, string(perm),
+	)
+	if err != nil {
+		return 0, interrors.WrapInternalErrorf(
+			err, "failed to create grant (tag_id: %d, grantee_id: %d)",
+			tgd.TagID, tgd.GranteeID,
+		)
+	}
+
+	grantID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return grantID, nil
+}
+
+func (s *StorageSQLite) GetTagGrantsByOwner(
+	tx *sql.Tx, ownerID int,
+) ([]storage.TagGrantData, error) {
+	return s.getTagGrants(tx, "t.owner_id = ?", ownerID)
+}
+
+func (s *StorageSQLite) GetTagGrantsByGrantee(
+	tx *sql.Tx, granteeID int,
+) ([]storage.TagGrantData, error) {
+	return s.getTagGrants(tx, "g.grantee_id = ?", granteeID)
+}
+
+func (s *StorageSQLite) DeleteTagGrant(tx *sql.Tx, grantID int) error {
+	res, err := tx.ExecContext(
+		s.txCtx(tx), "DELETE FROM tag_grants WHERE id = ?", grantID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Trace(storage.ErrTagGrantDoesNotExist)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) getTagGrants(
+	tx *sql.Tx, cond string, args ...interface{},
+) ([]storage.TagGrantData, error) {
+	ret := []storage.TagGrantData{}
+
+	rows, err := tx.QueryContext(
+		s.txCtx(tx),
+		"SELECT "+tagGrantFields+` FROM tag_grants g
+JOIN tags t ON t.id = g.tag_id
+WHERE `+cond+" ORDER BY g.id",
+		args...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var tgd storage.TagGrantData
+		if err := rows.Scan(
+			&tgd.ID, &tgd.TagID, &tgd.OwnerID, &tgd.GranteeID, &tgd.Permission,
+			&tgd.CreatedAt,
+		); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		ret = append(ret, tgd)
+	}
+
+	return ret, nil
+}
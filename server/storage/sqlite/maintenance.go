@@ -0,0 +1,396 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+
+	"github.com/juju/errors"
+)
+
+// tagging is a single (taggable, tag) pair
+type tagging struct {
+	taggableID int
+	tagID      int
+}
+
+// tagOwner is a tag id with the id of its owner
+type tagOwner struct {
+	tagID   int
+	ownerID int
+}
+
+func (s *StorageSQLite) CheckIntegrity(repair bool) (*storage.IntegrityReport, error) {
+	ilevel, mode := storage.TxILevelRepeatableRead, storage.TxModeReadOnly
+	if repair {
+		ilevel, mode = storage.TxILevelSerializable, storage.TxModeReadWrite
+	}
+
+	var report *storage.IntegrityReport
+
+	err := s.TxOpt(
+		ilevel, mode,
+		func(tx *sql.Tx) error {
+			// The transaction might be retried, so start from scratch
+			report = storage.NewIntegrityReport()
+
+			err := s.checkChildrenCnt(tx, report)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = s.checkTaggings(tx, report)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = s.checkOnlyRootTagging(tx, report)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			report.Sort()
+
+			if repair {
+				if err := s.repairIntegrity(tx, report); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return report, nil
+}
+
+// repairIntegrity fixes all the repairable violations from the report, and
+// marks them as repaired.
+func (s *StorageSQLite) repairIntegrity(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+	for i := range report.Violations {
+		v := &report.Violations[i]
+
+		switch v.Kind {
+		case storage.IntegrityViolationChildrenCnt:
+			_, err := tx.ExecContext(
+				s.txCtx(tx), "UPDATE tags SET children_cnt = ? WHERE id = ?",
+				*v.ChildrenCntActual, v.TagID,
+			)
+			if err != nil {
+				return errors.Annotatef(err, "recounting children of the tag %d", v.TagID)
+			}
+
+		case storage.IntegrityViolationMissingTagging:
+			if err := s.addTaggings(tx, v.TaggableID, []int{v.TagID}); err != nil {
+				return errors.Annotatef(
+					err, "adding tagging (taggable %d, tag %d)", v.TaggableID, v.TagID,
+				)
+			}
+
+		case storage.IntegrityViolationRootOnlyTagging:
+			if err := s.deleteTaggings(tx, v.TaggableID, []int{v.TagID}); err != nil {
+				return errors.Annotatef(
+					err, "deleting tagging (taggable %d, tag %d)", v.TaggableID, v.TagID,
+				)
+			}
+
+		default:
+			continue
+		}
+
+		v.Repaired = true
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) checkTaggings(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+
+	// Get all users, for each of them:
+	// - Get all user's tags
+	// - Feed all of them to taghier
+	// - Make sure that the taghier contains just a single root
+	// - For each of the tag, theck that all taggings contain the full path to
+	//   the tag
+
+	// Check all users
+	users, err := s.GetUsers(tx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, user := range users {
+		missing := map[tagging]bool{}
+
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		th := taghier.New(&reg)
+
+		// Get all user's tags and feed them to the taghier
+		rows, err := tx.QueryContext(s.txCtx(tx), "SELECT id FROM tags WHERE owner_id = ?", user.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var tagIDs []int
+
+		defer rows.Close()
+		for rows.Next() {
+			var curID int
+
+			err := rows.Scan(&curID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// NOTE: we can't call th.Add() right here, because it will also hit a
+			// database, and iterating through more than one Rows at a time is an
+			// error
+			tagIDs = append(tagIDs, curID)
+		}
+
+		for _, curID := range tagIDs {
+			th.Add(curID)
+		}
+
+		// Now, th contains all tags for the current user
+
+		// Make sure taghier contains just a single root
+		roots := th.GetRoots()
+		if len(roots) != 1 {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationTagRoots,
+				UserID:     user.ID,
+				RootTagIDs: roots,
+			})
+		}
+
+		// For each of the tags, make sure that there is a tagging for each
+		// tag in the current tag's path
+		for _, tag := range th.GetAll() {
+			path := th.GetPath(tag)
+
+			// This commented code intentionally breaks integrity, so that I can be
+			// sure that checkFullTaggingsPath works. I'm leaving it here for now.
+
+			//if len(path) >= 4 {
+			//_, err := tx.Exec(
+			//"DELETE FROM taggings WHERE tag_id = ?", path[2],
+			//)
+			//if err != nil {
+			//return errors.Trace(err)
+			//}
+			//}
+
+			if err := s.checkFullTaggingsPath(tx, path, missing); err != nil {
+				return errors.Annotatef(err, "user %d", user.ID)
+			}
+		}
+
+		for t := range missing {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationMissingTagging,
+				UserID:     user.ID,
+				TagID:      t.tagID,
+				TaggableID: t.taggableID,
+			})
+		}
+	}
+
+	return nil
+}
+
+// checkFullTaggingsPath adds to missing the taggings of the tags from the
+// path which are missing for the taggables tagged with the leaf of the path.
+func (s *StorageSQLite) checkFullTaggingsPath(
+	tx *sql.Tx, path []int, missing map[tagging]bool,
+) error {
+	var taggableIDs []int
+
+	// If there is less than 2 items in the path, there's no need to check
+	// anything
+	if len(path) < 2 {
+		return nil
+	}
+
+	// Reverse path so that it goes from the leaf to the root
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+
+	// Build query which finds taggable_ids which are tagged with path[0], but
+	// not tagged with any of the other path items.
+	//
+	// E.g. if path is {300, 200, 100}, the query will be:
+	//
+	// SELECT t.taggable_id FROM taggings t
+	//   LEFT JOIN taggings t1 ON
+	//     (t1.taggable_id=t.taggable_id AND t1.tag_id=200)
+	//   LEFT JOIN taggings t2 ON
+	//     (t2.taggable_id=t.taggable_id AND t2.tag_id=100)
+	//   WHERE t.tag_id=300 AND (t1.taggable_id IS NULL OR t2.taggable_id IS NULL)
+	//
+	// So if the result is not empty, it means that the integrity is broken.
+	args := []interface{}{}
+	query := "SELECT t.taggable_id FROM taggings t "
+
+	subq := ""
+
+	for k, tagID := range path {
+		// First tag is a leaf, its id will be in a WHERE clause later
+		if k == 0 {
+			continue
+		}
+
+		query += fmt.Sprintf(` LEFT JOIN taggings t%d
+        ON (t%d.taggable_id=t.taggable_id AND t%d.tag_id=?) `,
+			k, k, k,
+		)
+
+		if subq != "" {
+			subq += " OR "
+		}
+		subq += fmt.Sprintf("t%d.taggable_id IS NULL", k)
+
+		args = append(args, tagID)
+	}
+
+	query += fmt.Sprintf("WHERE t.tag_id=? AND (%s)", subq)
+	args = append(args, path[0])
+
+	// Execute it
+	rows, err := tx.QueryContext(s.txCtx(tx), query, args...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var taggableID int
+		err := rows.Scan(&taggableID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		taggableIDs = append(taggableIDs, taggableID)
+	}
+	if err := rows.Close(); err != nil {
+		return errors.Annotatef(err, "closing rows")
+	}
+
+	// For each of the broken taggables, find out which taggings are missing
+	for _, taggableID := range taggableIDs {
+		tagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, pathTagID := range path[1:] {
+			if !containsInt(tagIDs, pathTagID) {
+				missing[tagging{taggableID: taggableID, tagID: pathTagID}] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// It's illegal for the taggable to be tagged with the root tag only,
+// so checkOnlyRootTagging checks for these cases
+func (s *StorageSQLite) checkOnlyRootTagging(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+	// Get all root tags, with their owners
+	rootTags := []tagOwner{}
+	rows, err := tx.QueryContext(
+		s.txCtx(tx), "SELECT id, owner_id FROM tags WHERE parent_id IS NULL",
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cur tagOwner
+		err := rows.Scan(&cur.tagID, &cur.ownerID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		rootTags = append(rootTags, cur)
+	}
+	rows.Close()
+
+	// For each of the root tags, make sure there's no taggables tagged only
+	// with this one tag
+	for _, rootTag := range rootTags {
+		badIDs, err := s.getTaggablesTaggedWithOnlyOneTag(tx, rootTag.tagID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, taggableID := range badIDs {
+			report.Add(storage.IntegrityViolation{
+				Kind:       storage.IntegrityViolationRootOnlyTagging,
+				UserID:     rootTag.ownerID,
+				TagID:      rootTag.tagID,
+				TaggableID: taggableID,
+			})
+		}
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) checkChildrenCnt(
+	tx *sql.Tx, report *storage.IntegrityReport,
+) error {
+	rows, err := tx.QueryContext(s.txCtx(tx), `
+SELECT id, owner_id, children_cnt, children_cnt_actual
+  FROM
+    (SELECT id, owner_id, children_cnt,
+            (SELECT COUNT(id) FROM tags WHERE parent_id = t.id) AS children_cnt_actual
+          FROM tags t) T
+  WHERE children_cnt != children_cnt_actual
+`,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		v := storage.IntegrityViolation{
+			Kind: storage.IntegrityViolationChildrenCnt,
+		}
+		err := rows.Scan(&v.TagID, &v.UserID, &v.ChildrenCnt, &v.ChildrenCntActual)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		report.Add(v)
+	}
+	if err := rows.Close(); err != nil {
+		return errors.Annotatef(err, "closing rows")
+	}
+
+	return nil
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
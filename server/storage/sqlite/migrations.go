@@ -0,0 +1,674 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/juju/errors"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/storage"
+)
+
+// NOTE: SQLite migrations don't have to mirror Postgres migrations one by one:
+// the first one creates the schema which is equivalent to what Postgres has
+// after all of its migrations up to 020 are applied.
+//
+// When editing the up func of a migration, change its checksum as well, see
+// dfmigrate.Migrations.AddMigration.
+func initMigrations() (*dfmigrate.Migrations, error) {
+	mig := &dfmigrate.Migrations{}
+	var err error
+
+	// 001: Initial structure {{{
+	err = mig.AddMigration(
+		1, "Initial structure",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE users (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					username VARCHAR(50),
+					password VARCHAR(100),
+					email VARCHAR(50),
+					CONSTRAINT users_username_unique UNIQUE (username),
+					CONSTRAINT users_email_unique UNIQUE (email)
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE tags (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					parent_id INTEGER,
+					owner_id INTEGER NOT NULL,
+					descr TEXT NOT NULL DEFAULT '',
+					children_cnt INTEGER NOT NULL DEFAULT 0,
+					FOREIGN KEY (parent_id) REFERENCES tags(id) ON DELETE CASCADE,
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Postgres uses a trigger check_dup_null() for that; in SQLite, partial
+			// unique index does the job.
+			if _, err := tx.Exec(`
+				CREATE UNIQUE INDEX tags_single_root ON tags (owner_id) WHERE parent_id IS NULL
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE tag_names (
+					tag_id INTEGER NOT NULL,
+					name VARCHAR(30) NOT NULL,
+					"primary" BOOLEAN NOT NULL DEFAULT 0,
+					PRIMARY KEY (tag_id, name),
+					FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Timestamps are stored as unix time in seconds
+			if _, err := tx.Exec(`
+				CREATE TABLE taggables (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					owner_id INTEGER NOT NULL,
+					"type" VARCHAR(30) NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					updated_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TRIGGER trg_set_updated_ts AFTER UPDATE ON taggables
+				FOR EACH ROW WHEN NEW.updated_ts = OLD.updated_ts
+				BEGIN
+					UPDATE taggables
+						SET updated_ts = CAST(STRFTIME('%s', 'now') AS INTEGER)
+						WHERE id = NEW.id;
+				END
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE bookmarks (
+					id INTEGER NOT NULL PRIMARY KEY,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					comment TEXT NOT NULL,
+					FOREIGN KEY (id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE taggings (
+					taggable_id INTEGER NOT NULL,
+					tag_id INTEGER NOT NULL,
+					PRIMARY KEY (taggable_id, tag_id),
+					FOREIGN KEY (taggable_id) REFERENCES taggables(id) ON DELETE CASCADE,
+					FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE access_tokens (
+					token VARCHAR(32) NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					descr TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE google_auth (
+					google_user_id TEXT NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					email TEXT NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			for _, q := range []string{
+				`CREATE INDEX taggings_taggable_id_idx ON taggings (taggable_id)`,
+				`CREATE INDEX taggings_tag_id_idx ON taggings (tag_id)`,
+				`CREATE INDEX tag_names_tag_id_idx ON tag_names (tag_id)`,
+				`CREATE INDEX taggables_owner_id_idx ON taggables (owner_id)`,
+				`CREATE INDEX taggables_type_idx ON taggables ("type")`,
+				`CREATE INDEX tags_parent_id_idx ON tags (parent_id)`,
+				`CREATE INDEX tags_owner_id_idx ON tags (owner_id)`,
+			} {
+				if _, err := tx.Exec(q); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			for _, table := range []string{
+				"google_auth", "access_tokens", "taggings", "bookmarks", "taggables",
+				"tag_names", "tags", "users",
+			} {
+				if _, err := tx.Exec(`DROP TABLE ` + table); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+	// 002: Add notes {{{
+	err = mig.AddMigration(
+		2, "Add notes",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE notes (
+					id INTEGER NOT NULL PRIMARY KEY,
+					title TEXT NOT NULL,
+					body TEXT NOT NULL,
+					format VARCHAR(30) NOT NULL,
+					FOREIGN KEY (id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DELETE FROM taggables WHERE "type" = 'note'`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`DROP TABLE notes`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 003: Add trash {{{
+	err = mig.AddMigration(
+		3, "Add trash",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// Trashed taggables have non-NULL trashed_ts (unix time in seconds)
+			if _, err := tx.Exec(`
+				ALTER TABLE taggables ADD COLUMN trashed_ts INTEGER NULL
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX taggables_trashed_ts_idx ON taggables (trashed_ts)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DROP INDEX taggables_trashed_ts_idx`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`ALTER TABLE taggables DROP COLUMN trashed_ts`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 004: Add history {{{
+	err = mig.AddMigration(
+		4, "Add history",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// See the Postgres migration 024
+			if _, err := tx.Exec(`
+				CREATE TABLE history (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					owner_id INTEGER NOT NULL,
+					object_type VARCHAR(30) NOT NULL,
+					object_id INTEGER NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					diff TEXT NOT NULL,
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX history_object_idx ON history (object_type, object_id)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DROP TABLE history`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 005: Add canonical urls {{{
+	err = mig.AddMigration(
+		5, "Add canonical urls",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// See the Postgres migration 025
+			if _, err := tx.Exec(`
+				ALTER TABLE bookmarks ADD COLUMN canonical_url TEXT NOT NULL DEFAULT ''
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`UPDATE bookmarks SET canonical_url = url`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX bookmarks_canonical_url_idx ON bookmarks (canonical_url)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DROP INDEX bookmarks_canonical_url_idx`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`ALTER TABLE bookmarks DROP COLUMN canonical_url`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 006: Hash access tokens, add expiry {{{
+	err = mig.AddMigration(
+		6, "Hash access tokens, add expiry",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			// See the Postgres migration 026
+			if _, err := tx.Exec(`
+				ALTER TABLE access_tokens ADD COLUMN token_hash TEXT
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			rows, err := tx.Query(`SELECT rowid, token FROM access_tokens`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			defer rows.Close()
+
+			tokens := map[int64]string{}
+			for rows.Next() {
+				var rowid int64
+				var token string
+				if err := rows.Scan(&rowid, &token); err != nil {
+					return errors.Trace(err)
+				}
+				tokens[rowid] = token
+			}
+			if err := rows.Close(); err != nil {
+				return errors.Trace(err)
+			}
+
+			for rowid, token := range tokens {
+				if _, err := tx.Exec(
+					`UPDATE access_tokens SET token_hash = ? WHERE rowid = ?`,
+					storage.HashAccessToken(token), rowid,
+				); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			// SQLite can't drop a primary key column, so the table is recreated
+			// without the plain tokens.
+			if _, err := tx.Exec(`
+				CREATE TABLE access_tokens_new (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					token_hash TEXT NOT NULL UNIQUE,
+					user_id INTEGER NOT NULL,
+					descr TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					last_used_ts INTEGER,
+					expires_ts INTEGER,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				INSERT INTO access_tokens_new (token_hash, user_id, descr, created_ts)
+				SELECT token_hash, user_id, descr, created_ts
+				FROM access_tokens ORDER BY rowid
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`DROP TABLE access_tokens`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				ALTER TABLE access_tokens_new RENAME TO access_tokens
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX access_tokens_user_id_idx ON access_tokens (user_id)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			// Tokens can't be restored from the hashes, so they are dropped. The
+			// index is dropped together with the table.
+			if _, err := tx.Exec(`DROP TABLE access_tokens`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE access_tokens (
+					token VARCHAR(32) NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					descr TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 007: Add scopes to access tokens {{{
+	err = mig.AddMigration(
+		7, "Add scopes to access tokens",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`
+				ALTER TABLE access_tokens ADD COLUMN scope TEXT NOT NULL DEFAULT 'write'
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			// See the Postgres migration 027
+			if _, err := tx.Exec(`
+				ALTER TABLE access_tokens ADD COLUMN root_tag_id INTEGER NULL
+				  REFERENCES tags(id) ON DELETE CASCADE
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			// SQLite can't drop a column with a foreign key, so the table is
+			// recreated without the new columns.
+			if _, err := tx.Exec(`
+				CREATE TABLE access_tokens_new (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					token_hash TEXT NOT NULL UNIQUE,
+					user_id INTEGER NOT NULL,
+					descr TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					last_used_ts INTEGER,
+					expires_ts INTEGER,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				INSERT INTO access_tokens_new (
+				  id, token_hash, user_id, descr, created_ts, last_used_ts, expires_ts
+				) SELECT
+				  id, token_hash, user_id, descr, created_ts, last_used_ts, expires_ts
+				FROM access_tokens
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`DROP TABLE access_tokens`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				ALTER TABLE access_tokens_new RENAME TO access_tokens
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX access_tokens_user_id_idx ON access_tokens (user_id)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 008: Replace google_auth with provider-agnostic external_identities {{{
+	err = mig.AddMigration(
+		8, "Replace google_auth with provider-agnostic external_identities",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE external_identities (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					user_id INTEGER NOT NULL,
+					provider TEXT NOT NULL,
+					subject TEXT NOT NULL,
+					email TEXT NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					UNIQUE (provider, subject),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX external_identities_user_id_idx ON external_identities (user_id)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				INSERT INTO external_identities (user_id, provider, subject, email, created_ts)
+				  SELECT user_id, 'google', google_user_id, email, created_ts FROM google_auth
+				  ORDER BY created_ts
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`DROP TABLE google_auth`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			// See the Postgres migration 028
+			if _, err := tx.Exec(`
+				CREATE TABLE google_auth (
+					google_user_id TEXT NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					email TEXT NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				INSERT INTO google_auth (google_user_id, user_id, email, created_ts)
+				  SELECT subject, user_id, email, created_ts FROM external_identities
+				  WHERE provider = 'google'
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`DROP TABLE external_identities`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 009: Add tag_grants {{{
+	err = mig.AddMigration(
+		9, "Add tag_grants",
+		1, // checksum
+
+		// ---------- UP ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE tag_grants (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					tag_id INTEGER NOT NULL,
+					grantee_id INTEGER NOT NULL,
+					permission TEXT NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER)),
+					UNIQUE (tag_id, grantee_id),
+					FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE,
+					FOREIGN KEY (grantee_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX tag_grants_grantee_id_idx ON tag_grants (grantee_id)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DROP TABLE tag_grants`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	return mig, nil
+}
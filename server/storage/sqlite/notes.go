@@ -0,0 +1,185 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) CreateNote(tx *sql.Tx, nd *storage.NoteData) (noteID int, err error) {
+	if err := storage.ValidateNoteFormat(nd.Format); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	noteID, err = s.CreateTaggable(tx, &storage.TaggableData{
+		OwnerID: nd.OwnerID,
+		Type:    storage.TaggableTypeNote,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	_, err = tx.ExecContext(
+		s.txCtx(tx), "INSERT INTO notes (id, title, body, format) VALUES (?, ?, ?, ?)",
+		noteID, nd.Title, nd.Body, string(nd.Format),
+	)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return noteID, nil
+}
+
+func (s *StorageSQLite) UpdateNote(tx *sql.Tx, nd *storage.NoteData) (err error) {
+	if err := storage.ValidateNoteFormat(nd.Format); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = tx.ExecContext(
+		s.txCtx(tx), "UPDATE notes SET title = ?, body = ?, format = ? WHERE id = ?",
+		nd.Title, nd.Body, string(nd.Format), nd.ID,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetTaggedNotes(
+	tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *storage.TagsFetchOpts,
+) (notes []storage.NoteDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	args := []interface{}{}
+
+	// See GetTaggedBookmarks
+	from := "FROM taggables t JOIN notes n ON t.id = n.id "
+	where := "WHERE t.trashed_ts IS NULL "
+	if len(tagIDs) > 0 {
+		for k, tagID := range tagIDs {
+			from += fmt.Sprintf(
+				"JOIN taggings tg%d ON (tg%d.taggable_id = t.id AND tg%d.tag_id = ?) ",
+				k, k, k,
+			)
+			args = append(args, tagID)
+		}
+	} else {
+		from += "LEFT JOIN taggings tg ON (tg.taggable_id = t.id) "
+		where += "AND tg.taggable_id IS NULL "
+	}
+
+	if ownerID != nil {
+		where += "AND t.owner_id = ? "
+		args = append(args, *ownerID)
+	}
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rows, err := tx.QueryContext(s.txCtx(tx), fmt.Sprintf(`
+SELECT t.id, n.title, n.body, n.format, t.owner_id,
+       t.created_ts, t.updated_ts, COALESCE(t.trashed_ts, 0),
+       %s as tagsjson
+  %s
+  %s
+  ORDER BY t.created_ts, t.id
+	`, tagsJsonFieldQuery, from, where), args...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	return rowsToNotes(rows, tagsFetchOpts)
+}
+
+func (s *StorageSQLite) GetNoteByID(
+	tx *sql.Tx, noteID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (note *storage.NoteDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rows, err := tx.QueryContext(s.txCtx(tx), fmt.Sprintf(`
+SELECT t.id, n.title, n.body, n.format, t.owner_id,
+       t.created_ts, t.updated_ts, COALESCE(t.trashed_ts, 0),
+       %s as tagsjson
+  FROM taggables t
+  JOIN notes n ON t.id = n.id
+  WHERE t.id = ?
+	`, tagsJsonFieldQuery), noteID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	notes, err := rowsToNotes(rows, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(notes) == 0 {
+		return nil, errors.Annotatef(
+			interrors.WrapInternalError(
+				sql.ErrNoRows,
+				storage.ErrNoteDoesNotExist,
+			),
+			"id %d", noteID,
+		)
+	}
+
+	return &notes[0], nil
+}
+
+// rowsToNotes expects each row to contain the following fields, in this
+// order:
+//
+// id, title, body, format, owner_id, created_time, updated_time, trashed_time,
+// tags_data.
+// For some details on what is tags_data, see parseTagBrief().
+func rowsToNotes(
+	rows *sql.Rows, tagsFetchOpts *storage.TagsFetchOpts,
+) (notes []storage.NoteDataWTags, err error) {
+	notes = []storage.NoteDataWTags{}
+	for rows.Next() {
+		note := storage.NoteDataWTags{}
+		var format string
+		var tagBriefData []byte
+		err := rows.Scan(
+			&note.ID, &note.Title, &note.Body, &format, &note.OwnerID,
+			&note.CreatedAt, &note.UpdatedAt, &note.TrashedAt,
+			&tagBriefData,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		note.Format = storage.NoteFormat(format)
+
+		note.Tags, err = parseTagBrief(tagBriefData, tagsFetchOpts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		notes = append(notes, note)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return notes, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite // import "dmitryfrank.com/geekmarks/server/storage/sqlite"
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+
+	"github.com/juju/errors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Implements storage.Storage
+type StorageSQLite struct {
+	path string
+	db   *sql.DB
+
+	// Contexts of the active transactions, see txCtx
+	txCtxs    map[*sql.Tx]context.Context
+	txCtxsMtx sync.Mutex
+}
+
+// New creates a new SQLite-backed storage. The path is a path to the database
+// file; it will be created if it does not exist. A special path ":memory:"
+// results in a private in-memory database, which lives until the process
+// exits.
+func New(path string) (*StorageSQLite, error) {
+	if path == "" {
+		return nil, errors.Errorf("path to the SQLite database is required")
+	}
+
+	return &StorageSQLite{
+		path:   path,
+		txCtxs: make(map[*sql.Tx]context.Context),
+	}, nil
+}
+
+func (s *StorageSQLite) Connect() error {
+	var err error
+	s.db, err = sql.Open("sqlite3", getDSN(s.path))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// SQLite serializes writers anyway, and having a single connection saves
+	// us from "database is locked" errors when concurrent transactions try to
+	// upgrade their locks. It also makes ":memory:" work, since every new
+	// connection to ":memory:" opens a new empty database.
+	s.db.SetMaxOpenConns(1)
+
+	return nil
+}
+
+func (s *StorageSQLite) ApplyMigrations() error {
+	mig, err := initMigrations()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = mig.MigrateToLatest(s.db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) Migrate(targetID int, dryRun bool) ([]dfmigrate.Step, error) {
+	mig, err := initMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	steps, err := mig.Plan(s.db, targetID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if dryRun {
+		return steps, nil
+	}
+
+	err = mig.Migrate(s.db, targetID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return steps, nil
+}
+
+func (s *StorageSQLite) MigrationStatus() (*dfmigrate.Status, error) {
+	mig, err := initMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	status, err := mig.Status(s.db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return status, nil
+}
+
+// DropAllTables drops every table in the database, so that the next call to
+// ApplyMigrations starts from scratch. It's used by tests.
+func (s *StorageSQLite) DropAllTables() error {
+	return s.Tx(func(tx *sql.Tx) error {
+		var tables []string
+		rows, err := tx.QueryContext(
+			s.txCtx(tx), "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'",
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return errors.Trace(err)
+			}
+			tables = append(tables, name)
+		}
+		if err := rows.Close(); err != nil {
+			return errors.Annotatef(err, "closing rows")
+		}
+
+		// Foreign keys can't be disabled inside a transaction, so we defer them
+		// till commit instead: by that time, all the tables are gone.
+		if _, err := tx.ExecContext(s.txCtx(tx), "PRAGMA defer_foreign_keys = ON"); err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, name := range tables {
+			if _, err := tx.ExecContext(s.txCtx(tx), `DROP TABLE "`+name+`"`); err != nil {
+				return errors.Annotatef(err, "dropping table %q", name)
+			}
+		}
+
+		return nil
+	})
+}
+
+// getDSN returns a data source name for the go-sqlite3 driver, with foreign
+// keys enabled (they are disabled in SQLite by default, and we heavily rely
+// on ON DELETE CASCADE).
+func getDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_foreign_keys=1&_busy_timeout=10000"
+}
@@ -0,0 +1,316 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package sqlite
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/storagetest"
+	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+var (
+	sqlitePath = flag.String("geekmarks.sqlite.path", "",
+		"Path to the SQLite database file. Alternatively, can be given in an "+
+			"environment variable GM_SQLITE_PATH. If neither is given, an "+
+			"in-memory database is used.")
+)
+
+// newConnectedStorage returns a storage connected to the database given by
+// the flag or the environment variable, or to an in-memory one.
+func newConnectedStorage() (*StorageSQLite, error) {
+	path := *sqlitePath
+	if path == "" {
+		path = os.Getenv("GM_SQLITE_PATH")
+	}
+	if path == "" {
+		path = ":memory:"
+	}
+	si, err := New(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = si.Connect()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return si, nil
+}
+
+func runWithRealDB(t *testing.T, f func(si *StorageSQLite) error) {
+	si, err := newConnectedStorage()
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = testutils.PrepareTestDB(t, si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = f(si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = storage.CheckIntegrity(si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = testutils.CleanupTestDB(t)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	runWithRealDB(t, func(si *StorageSQLite) error {
+		var u1ID int
+		var err error
+		if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		var rootTagID int
+		err = si.Tx(func(tx *sql.Tx) error {
+			var err error
+			rootTagID, err = si.GetRootTagID(tx, u1ID)
+			if err != nil {
+				return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+			}
+
+			_, err = si.CreateTag(tx, &storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(rootTagID),
+				Description: cptr.String("test tag2"),
+				Names:       []string{"normal_name", "123"},
+			})
+			return errors.Trace(err)
+		})
+		if err == nil || errors.Cause(err) != storage.ErrTagNameInvalid {
+			return errors.Errorf("should not be able to create tag with the name 123")
+		}
+
+		err = si.Tx(func(tx *sql.Tx) error {
+			var cnt int
+			err := tx.QueryRow(
+				"SELECT COUNT(name) FROM tag_names WHERE name = ?", "normal_name",
+			).Scan(&cnt)
+			if err != nil {
+				return errors.Annotatef(err, "getting count of tag names")
+			}
+			if cnt > 0 {
+				return errors.Errorf("there should be 0 tag names, but there is %d", cnt)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func TestReadOnlyTx(t *testing.T) {
+	runWithRealDB(t, func(si *StorageSQLite) error {
+		err := si.TxOpt(
+			storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+			func(tx *sql.Tx) error {
+				_, err := si.CreateUser(tx, &storage.UserData{
+					Username: "test1",
+					Email:    "1@1.1",
+				})
+				return errors.Trace(err)
+			},
+		)
+		if err == nil {
+			return errors.Errorf("should not be able to create user in a read-only tx")
+		}
+
+		// Read-only mode should not leak to the subsequent transactions
+		if _, _, err := testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func TestDoubleRootTags(t *testing.T) {
+	runWithRealDB(t, func(si *StorageSQLite) error {
+		var u1ID int
+		var err error
+		if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.Tx(func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO tags (owner_id) VALUES (?)", u1ID)
+			return errors.Trace(err)
+		})
+		if err == nil {
+			return errors.Errorf("should not be able to create second root tag")
+		}
+
+		return nil
+	})
+}
+
+func TestOnDeleteCascade(t *testing.T) {
+	runWithRealDB(t, func(si *StorageSQLite) error {
+		var u1ID, u2ID int
+		var err error
+		if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+		if u2ID, _, err = testutils.CreateTestUser(si, "test2", "2@2.2"); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.Tx(func(tx *sql.Tx) error {
+			for _, userID := range []int{u1ID, u2ID} {
+				tagIDs, err := storagetest.MakeTagsHierarchy(tx, si, userID)
+				if err != nil {
+					return errors.Annotatef(err, "creating test tags hierarchy for user %d", userID)
+				}
+
+				bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+					OwnerID: userID,
+					URL:     "url1",
+				})
+				if err != nil {
+					return errors.Annotatef(err, "creating bookmark")
+				}
+
+				err = si.SetTaggings(
+					tx, bkmID, []int{tagIDs.Tag4ID}, storage.TaggingModeLeafs,
+				)
+				if err != nil {
+					return errors.Annotatef(err, "setting taggings")
+				}
+			}
+
+			// Grants to the deleted user, and grants of the deleted user's tags,
+			// should be deleted as well
+			for _, ids := range [][2]int{{u1ID, u2ID}, {u2ID, u1ID}} {
+				rootTagID, err := si.GetRootTagID(tx, ids[0])
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				_, err = si.CreateTagGrant(tx, &storage.TagGrantData{
+					TagID: rootTagID, GranteeID: ids[1],
+				})
+				if err != nil {
+					return errors.Annotatef(err, "creating grant")
+				}
+			}
+
+			return si.DeleteUser(tx, u1ID)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.Tx(func(tx *sql.Tx) error {
+			for _, tc := range []struct {
+				table    string
+				expected int
+			}{
+				{"tags", 9},
+				{"tag_names", 17},
+				{"taggables", 1},
+				{"bookmarks", 1},
+				{"taggings", 4},
+				{"access_tokens", 1},
+				{"tag_grants", 0},
+			} {
+				var cnt int
+				err := tx.QueryRow("SELECT COUNT(*) FROM " + tc.table).Scan(&cnt)
+				if err != nil {
+					return errors.Annotatef(err, "counting rows in %s", tc.table)
+				}
+				if cnt != tc.expected {
+					return errors.Errorf(
+						"%s: expected %d rows, got %d", tc.table, tc.expected, cnt,
+					)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func TestRepairChildrenCnt(t *testing.T) {
+	runWithRealDB(t, func(si *StorageSQLite) error {
+		var u1ID int
+		var err error
+		if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		var rootTagID int
+		err = si.Tx(func(tx *sql.Tx) error {
+			var err error
+			rootTagID, err = si.GetRootTagID(tx, u1ID)
+			if err != nil {
+				return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+			}
+
+			_, err = tx.Exec("UPDATE tags SET children_cnt = 5 WHERE id = ?", rootTagID)
+			return errors.Trace(err)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		report, err := si.CheckIntegrity(true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		expected := []storage.IntegrityViolation{
+			{
+				Kind:              storage.IntegrityViolationChildrenCnt,
+				UserID:            u1ID,
+				TagID:             rootTagID,
+				ChildrenCnt:       cptr.Int(5),
+				ChildrenCntActual: cptr.Int(0),
+				Repaired:          true,
+			},
+		}
+		if !reflect.DeepEqual(report.Violations, expected) {
+			return errors.Errorf("expected violations %v, got %v", expected, report.Violations)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) GetTaggings(
+	tx *sql.Tx, taggableID int, tm storage.TaggingMode,
+) (tagIDs []int, err error) {
+	rows, err := tx.QueryContext(s.txCtx(tx), "SELECT tag_id FROM taggings WHERE taggable_id = ?", taggableID)
+	if err != nil {
+		return nil, errors.Annotatef(
+			hh.MakeInternalServerError(err),
+			"getting tag ids for taggable %d", taggableID,
+		)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tagID int
+		err := rows.Scan(&tagID)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	switch tm {
+	case storage.TaggingModeAll:
+		// tagIDs already contains all tag ids, return it
+		return tagIDs, nil
+
+	case storage.TaggingModeLeafs:
+		// We need to return only leafs
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		th := taghier.New(&reg)
+
+		for _, id := range tagIDs {
+			err := th.Add(id)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		return th.GetLeafs(), nil
+
+	default:
+		return nil, hh.MakeInternalServerError(
+			errors.Errorf("wrong tagging mode: %d", int(tm)),
+		)
+	}
+}
+
+func (s *StorageSQLite) SetTaggings(
+	tx *sql.Tx, taggableID int, tagIDs []int, tm storage.TaggingMode,
+) (err error) {
+	var desired []int
+
+	// Get desired taggings
+	switch tm {
+	case storage.TaggingModeAll:
+		desired = tagIDs
+	case storage.TaggingModeLeafs:
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		th := taghier.New(&reg)
+
+		for _, id := range tagIDs {
+			err := th.Add(id)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		desired = th.GetAll()
+	}
+
+	// Get current taggings
+	current, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Calculate difference between the two
+	diff := taghier.GetDiff(current, desired)
+
+	// Apply the difference
+	s.addTaggings(tx, taggableID, diff.Add)
+	s.deleteTaggings(tx, taggableID, diff.Delete)
+
+	if err := s.addTaggingsHistoryRecord(tx, taggableID, current, desired); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) addTaggings(
+	tx *sql.Tx, taggableID int, tagIDsToAdd []int,
+) (err error) {
+	for _, tagID := range tagIDsToAdd {
+		_, err := tx.ExecContext(
+			s.txCtx(tx), "INSERT INTO taggings (taggable_id, tag_id) VALUES (?, ?)",
+			taggableID, tagID,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (s *StorageSQLite) deleteTaggings(
+	tx *sql.Tx, taggableID int, tagIDsToDelete []int,
+) (err error) {
+	for _, tagID := range tagIDsToDelete {
+		_, err := tx.ExecContext(
+			s.txCtx(tx), "DELETE FROM taggings WHERE taggable_id = ? and tag_id = ?",
+			taggableID, tagID,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"fmt"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// compileTagQuery returns an SQL condition which is true for taggables (with
+// the given alias) matching the query. Tag ids are appended to args, and are
+// referred to as ? placeholders. Since taggings contain all the tags a
+// taggable is tagged with, including ancestors of the tags given by the user,
+// matching a tag is just a lookup of a single tagging.
+func compileTagQuery(
+	q *storage.TagQuery, taggablesAlias string, args *[]interface{},
+) (string, error) {
+	switch q.Op {
+	case storage.TagQueryOpTag:
+		*args = append(*args, q.TagID)
+		return fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM taggings WHERE taggable_id = %s.id AND tag_id = ?)",
+			taggablesAlias,
+		), nil
+
+	case storage.TagQueryOpAnd, storage.TagQueryOpOr:
+		parts := []string{}
+		for i := range q.Operands {
+			part, err := compileTagQuery(&q.Operands[i], taggablesAlias, args)
+			if err != nil {
+				return "", errors.Trace(err)
+			}
+			parts = append(parts, part)
+		}
+
+		sqlOp := " AND "
+		if q.Op == storage.TagQueryOpOr {
+			sqlOp = " OR "
+		}
+
+		return "(" + strings.Join(parts, sqlOp) + ")", nil
+
+	case storage.TagQueryOpNot:
+		part, err := compileTagQuery(&q.Operands[0], taggablesAlias, args)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+
+		return "NOT " + part, nil
+	}
+
+	return "", errors.Errorf("invalid tag query op %q", q.Op)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) Tx(fn func(*sql.Tx) error) error {
+	return s.TxOpt(storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn)
+}
+
+func (s *StorageSQLite) TxOpt(
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	return s.TxOptCtx(context.Background(), ilevel, mode, fn)
+}
+
+func (s *StorageSQLite) TxCtx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return s.TxOptCtx(ctx, storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn)
+}
+
+// TxOptCtx runs fn in a transaction. SQLite transactions are always
+// serializable, so ilevel is accepted for compatibility only; mode is
+// honoured by switching the connection to the query-only mode for the
+// duration of the transaction.
+func (s *StorageSQLite) TxOptCtx(
+	ctx context.Context,
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	// NOTE: we don't use BeginTx(ctx): when the context of a transaction is
+	// done, database/sql discards its connection (since go-sqlite3 can't
+	// reset a session), and with a single connection to ":memory:" it means
+	// losing the whole database. Instead, every statement is executed with
+	// the context (see txCtx), and an interrupted statement just fails.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Annotate(err, "begin transaction")
+	}
+
+	s.txCtxsMtx.Lock()
+	s.txCtxs[tx] = ctx
+	s.txCtxsMtx.Unlock()
+
+	defer func() {
+		s.txCtxsMtx.Lock()
+		delete(s.txCtxs, tx)
+		s.txCtxsMtx.Unlock()
+	}()
+
+	if mode == storage.TxModeReadOnly {
+		if _, err := tx.Exec("PRAGMA query_only = ON"); err != nil {
+			tx.Rollback()
+			return errors.Annotate(err, "set read-only mode")
+		}
+	}
+
+	err = fn(tx)
+
+	// query_only is a property of the connection, not of the transaction, so
+	// we have to reset it before the connection gets back to the pool.
+	if mode == storage.TxModeReadOnly {
+		if _, err2 := tx.Exec("PRAGMA query_only = OFF"); err2 != nil {
+			glog.Errorf("Failed to reset read-only mode: %+v", err2)
+		}
+	}
+
+	// Don't commit if the context is done by now, even if fn succeeded: the
+	// caller is not interested in the result anymore
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		if err2 := tx.Rollback(); err2 != nil {
+			glog.Errorf("Transaction rollback failed: %+v", err2)
+		}
+		return errors.Trace(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Annotate(err, "commit transaction")
+	}
+	return nil
+}
+
+// txCtx returns the context the given transaction was started with; every
+// statement should be executed with it, so that a long statement is
+// interrupted once the context is done.
+func (s *StorageSQLite) txCtx(tx *sql.Tx) context.Context {
+	s.txCtxsMtx.Lock()
+	defer s.txCtxsMtx.Unlock()
+
+	if ctx, ok := s.txCtxs[tx]; ok {
+		return ctx
+	}
+
+	return context.Background()
+}
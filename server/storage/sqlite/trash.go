@@ -0,0 +1,144 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) TrashTaggable(tx *sql.Tx, taggableID int) error {
+	_, err := tx.ExecContext(
+		s.txCtx(tx), `
+UPDATE taggables SET trashed_ts = CAST(STRFTIME('%s', 'now') AS INTEGER)
+  WHERE id = ? AND trashed_ts IS NULL
+		`, taggableID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "trashing taggable with id %d", taggableID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) RestoreTaggable(tx *sql.Tx, taggableID int) error {
+	// If it's a bookmark, check whether another bookmark with the same URL
+	// was created while this one was in the trash
+	bkm, err := s.GetBookmarkByID(tx, taggableID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err == nil {
+		if bkm.CanonicalURL != "" {
+			existingBkms, err := s.GetBookmarksByURL(tx, bkm.CanonicalURL, bkm.OwnerID, &storage.TagsFetchOpts{
+				TagsFetchMode:     storage.TagsFetchModeNone,
+				TagNamesFetchMode: storage.TagNamesFetchModeNone,
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if len(existingBkms) > 0 {
+				return errors.Errorf("bookmark with the url %q already exists", bkm.URL)
+			}
+		}
+	} else if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+		return errors.Trace(err)
+	}
+
+	_, err = tx.ExecContext(
+		s.txCtx(tx), "UPDATE taggables SET trashed_ts = NULL WHERE id = ?", taggableID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "restoring taggable with id %d", taggableID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetTrashedTaggables(
+	tx *sql.Tx, ownerID int,
+) (taggables []storage.TaggableData, err error) {
+	taggables = []storage.TaggableData{}
+
+	rows, err := tx.QueryContext(s.txCtx(tx), `
+SELECT id, owner_id, "type", created_ts, updated_ts, trashed_ts
+  FROM taggables
+  WHERE owner_id = ? AND trashed_ts IS NOT NULL
+  ORDER BY trashed_ts DESC, id DESC
+	`, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tgb := storage.TaggableData{}
+		var ttype string
+		err := rows.Scan(
+			&tgb.ID, &tgb.OwnerID, &ttype, &tgb.CreatedAt, &tgb.UpdatedAt, &tgb.TrashedAt,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		tgb.Type = storage.TaggableType(ttype)
+
+		taggables = append(taggables, tgb)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return taggables, nil
+}
+
+func (s *StorageSQLite) PurgeTrash(
+	tx *sql.Tx, ownerID *int, trashedBefore uint64,
+) (taggableIDs []int, err error) {
+	taggableIDs = []int{}
+
+	args := []interface{}{trashedBefore}
+	where := "WHERE trashed_ts <= ? "
+	if ownerID != nil {
+		where += "AND owner_id = ? "
+		args = append(args, *ownerID)
+	}
+
+	rows, err := tx.QueryContext(
+		s.txCtx(tx), "SELECT id FROM taggables "+where+"ORDER BY id", args...,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		taggableIDs = append(taggableIDs, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	// Taggings and bookmarks (or notes) are deleted by the cascade
+	_, err = tx.ExecContext(s.txCtx(tx), "DELETE FROM taggables "+where, args...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(errors.Annotatef(
+			err, "purging trash",
+		))
+	}
+
+	return taggableIDs, nil
+}
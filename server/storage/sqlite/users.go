@@ -0,0 +1,436 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/dchest/uniuri"
+	"github.com/juju/errors"
+)
+
+const (
+	accessTokenLen = 32
+)
+
+func (s *StorageSQLite) GetUser(
+	tx *sql.Tx, args *storage.GetUserArgs,
+) (*storage.UserData, error) {
+	var ud storage.UserData
+	queryArgs := []interface{}{}
+	where := ""
+	if args.ID != nil {
+		where = "id = ?"
+		queryArgs = append(queryArgs, *args.ID)
+	} else if args.Username != nil {
+		where = "username = ?"
+		queryArgs = append(queryArgs, *args.Username)
+	} else if args.Email != nil {
+		where = "email = ?"
+		queryArgs = append(queryArgs, *args.Email)
+	} else {
+		return nil, hh.MakeInternalServerError(errors.Errorf(
+			"neither id, username nor email is given to storage.GetUser()",
+		))
+	}
+
+	var username, password, email sql.NullString
+	err := tx.QueryRowContext(
+		s.txCtx(tx), "SELECT id, username, password, email FROM users WHERE "+where,
+		queryArgs...,
+	).Scan(&ud.ID, &username, &password, &email)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, interrors.WrapInternalError(err, storage.ErrUserDoesNotExist)
+		}
+		// Some unexpected error
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	ud.Username, ud.Password, ud.Email = username.String, password.String, email.String
+
+	return &ud, nil
+}
+
+func (s *StorageSQLite) CreateUser(
+	tx *sql.Tx, ud *storage.UserData,
+) (userID int, err error) {
+	res, err := tx.ExecContext(
+		s.txCtx(tx), "INSERT INTO users (username, password, email) VALUES (?, ?, ?)",
+		ud.Username, ud.Password, ud.Email,
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(err)
+	}
+
+	userID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Also, create a root tag for the newly added user: NULL parent_id and an
+	// empty string name
+	_, err = s.CreateTag(tx, &storage.TagData{
+		OwnerID:     userID,
+		Description: cptr.String("Root pseudo-tag"),
+		Names:       []string{""},
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return userID, nil
+}
+
+func (s *StorageSQLite) DeleteUser(tx *sql.Tx, userID int) error {
+	_, err := tx.ExecContext(
+		s.txCtx(tx), "DELETE FROM users WHERE id = ?", userID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	return nil
+}
+
+func (s *StorageSQLite) SetUserPassword(
+	tx *sql.Tx, userID int, passwordHash string,
+) error {
+	res, err := tx.ExecContext(
+		s.txCtx(tx), "UPDATE users SET password = ? WHERE id = ?", passwordHash, userID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Annotatef(storage.ErrUserDoesNotExist, "id %d", userID)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetUsers(tx *sql.Tx) ([]storage.UserData, error) {
+	var ret []storage.UserData
+
+	rows, err := tx.QueryContext(
+		s.txCtx(tx), "SELECT id, username, password, email FROM users",
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var cur storage.UserData
+		var username, password, email sql.NullString
+		err := rows.Scan(&cur.ID, &username, &password, &email)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		cur.Username, cur.Password, cur.Email = username.String, password.String, email.String
+		ret = append(ret, cur)
+	}
+
+	return ret, nil
+}
+
+func (s *StorageSQLite) CreateAccessToken(
+	tx *sql.Tx, atd *storage.AccessTokenData,
+) (tokenID int, token string, err error) {
+	scope := atd.Scope
+	if scope == "" {
+		scope = storage.AccessTokenScopeDefault
+	}
+	if err := storage.ValidateAccessTokenScope(scope); err != nil {
+		return 0, "", errors.Trace(err)
+	}
+
+	rootTagID := sql.NullInt64{}
+	if atd.RootTagID != 0 {
+		rootTagID = sql.NullInt64{Int64: int64(atd.RootTagID), Valid: true}
+	}
+
+	expiresAt := sql.NullInt64{}
+	if atd.ExpiresAt != 0 {
+		expiresAt = sql.NullInt64{Int64: int64(atd.ExpiresAt), Valid: true}
+	}
+
+	token = uniuri.NewLen(accessTokenLen)
+	res, err := tx.ExecContext(s.txCtx(tx), `
+INSERT INTO access_tokens (
+  user_id, token_hash, descr, scope, root_tag_id, expires_ts
+) VALUES (?, ?, ?, ?, ?, ?)`,
+		atd.UserID, storage.HashAccessToken(token), atd.Descr, string(scope),
+		rootTagID, expiresAt,
+	)
+	if err != nil {
+		return 0, "", interrors.WrapInternalErrorf(
+			err, "failed to create access token (%q, user_id: %d)",
+			atd.Descr, atd.UserID,
+		)
+	}
+
+	tokenID, err = lastInsertID(res)
+	if err != nil {
+		return 0, "", errors.Trace(err)
+	}
+
+	return tokenID, token, nil
+}
+
+const accessTokenFields = `
+  id, user_id, descr, scope, COALESCE(root_tag_id, 0), created_ts,
+  COALESCE(last_used_ts, 0), COALESCE(expires_ts, 0)
+`
+
+func scanAccessToken(
+	scan func(dest ...interface{}) error,
+) (*storage.AccessTokenData, error) {
+	var atd storage.AccessTokenData
+	err := scan(
+		&atd.ID, &atd.UserID, &atd.Descr, &atd.Scope, &atd.RootTagID,
+		&atd.CreatedAt, &atd.LastUsedAt, &atd.ExpiresAt,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &atd, nil
+}
+
+func (s *StorageSQLite) GetAccessToken(
+	tx *sql.Tx, tokenID int,
+) (*storage.AccessTokenData, error) {
+	atd, err := scanAccessToken(tx.QueryRowContext(
+		s.txCtx(tx),
+		"SELECT "+accessTokenFields+" FROM access_tokens WHERE id = ?", tokenID,
+	).Scan)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, interrors.WrapInternalError(
+				err, storage.ErrAccessTokenDoesNotExist,
+			)
+		}
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return atd, nil
+}
+
+func (s *StorageSQLite) GetAccessTokens(
+	tx *sql.Tx, userID int,
+) ([]storage.AccessTokenData, error) {
+	ret := []storage.AccessTokenData{}
+
+	rows, err := tx.QueryContext(
+		s.txCtx(tx),
+		"SELECT "+accessTokenFields+" FROM access_tokens WHERE user_id = ? ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		atd, err := scanAccessToken(rows.Scan)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		ret = append(ret, *atd)
+	}
+
+	return ret, nil
+}
+
+func (s *StorageSQLite) DeleteAccessToken(tx *sql.Tx, tokenID int) error {
+	res, err := tx.ExecContext(
+		s.txCtx(tx), "DELETE FROM access_tokens WHERE id = ?", tokenID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Trace(storage.ErrAccessTokenDoesNotExist)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetUserByAccessToken(
+	tx *sql.Tx, token string,
+) (*storage.UserData, *storage.AccessTokenData, error) {
+	var tokenID, userID int
+
+	err := tx.QueryRowContext(s.txCtx(tx), `
+SELECT id, user_id FROM access_tokens
+WHERE token_hash = ? AND (
+  expires_ts IS NULL OR expires_ts > CAST(STRFTIME('%s', 'now') AS INTEGER)
+)`, storage.HashAccessToken(token),
+	).Scan(&tokenID, &userID)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, nil, hh.MakeUnauthorizedError()
+		}
+		// Some unexpected error
+		return nil, nil, hh.MakeInternalServerError(err)
+	}
+
+	ud, err := s.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(userID)})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	_, err = tx.ExecContext(s.txCtx(tx), `
+UPDATE access_tokens SET last_used_ts = CAST(STRFTIME('%s', 'now') AS INTEGER)
+  WHERE id = ? AND (
+    last_used_ts IS NULL OR
+    last_used_ts <= CAST(STRFTIME('%s', 'now') AS INTEGER) - ?
+  )`, tokenID, storage.AccessTokenLastUsedResolution,
+	)
+	if err != nil {
+		return nil, nil, hh.MakeInternalServerError(err)
+	}
+
+	atd, err := s.GetAccessToken(tx, tokenID)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return ud, atd, nil
+}
+
+const externalIdentityFields = `
+  id, user_id, provider, subject, email, created_ts
+`
+
+func (s *StorageSQLite) GetExternalIdentities(
+	tx *sql.Tx, userID int,
+) ([]storage.ExternalIdentityData, error) {
+	ret := []storage.ExternalIdentityData{}
+
+	rows, err := tx.QueryContext(
+		s.txCtx(tx),
+		"SELECT "+externalIdentityFields+" FROM external_identities WHERE user_id = ? ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var eid storage.ExternalIdentityData
+		if err := rows.Scan(
+			&eid.ID, &eid.UserID, &eid.Provider, &eid.Subject, &eid.Email, &eid.CreatedAt,
+		); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		ret = append(ret, eid)
+	}
+
+	return ret, nil
+}
+
+func (s *StorageSQLite) DeleteExternalIdentity(tx *sql.Tx, eidID int) error {
+	res, err := tx.ExecContext(
+		s.txCtx(tx), "DELETE FROM external_identities WHERE id = ?", eidID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return errors.Trace(storage.ErrIdentityDoesNotExist)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetUserByExternalIdentity(
+	tx *sql.Tx, provider, subject string,
+) (*storage.UserData, error) {
+	ud, err := s.getUserByJoin(tx, `
+JOIN external_identities eid ON eid.user_id = u.id
+WHERE eid.provider = ? AND eid.subject = ?`, provider, subject,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ud, nil
+}
+
+func (s *StorageSQLite) CreateExternalIdentity(
+	tx *sql.Tx, eid *storage.ExternalIdentityData,
+) (eidID int, err error) {
+	res, err := tx.ExecContext(s.txCtx(tx), `
+INSERT INTO external_identities (user_id, provider, subject, email)
+  VALUES (?, ?, ?, ?)`,
+		eid.UserID, eid.Provider, eid.Subject, eid.Email,
+	)
+	if err != nil {
+		return 0, interrors.WrapInternalErrorf(
+			err, "failed to create external identity (%q, %q, user_id: %d)",
+			eid.Provider, eid.Subject, eid.UserID,
+		)
+	}
+
+	eidID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return eidID, nil
+}
+
+// getUserByJoin selects a single user from the "users u" table, with the
+// given join and where clauses appended to the query.
+func (s *StorageSQLite) getUserByJoin(
+	tx *sql.Tx, joinWhere string, args ...interface{},
+) (*storage.UserData, error) {
+	var ud storage.UserData
+	var username, password, email sql.NullString
+
+	err := tx.QueryRowContext(
+		s.txCtx(tx), "SELECT u.id, u.username, u.password, u.email FROM users u "+joinWhere,
+		args...,
+	).Scan(&ud.ID, &username, &password, &email)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, interrors.WrapInternalError(err, storage.ErrUserDoesNotExist)
+		}
+		// Some unexpected error
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	ud.Username, ud.Password, ud.Email = username.String, password.String, email.String
+
+	return &ud, nil
+}
+
+func lastInsertID(res sql.Result) (int, error) {
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(err, "getting last insert id"))
+	}
+	return int(id), nil
+}
@@ -1,24 +1,36 @@
 package storage // import "dmitryfrank.com/geekmarks/server/storage"
 
 import (
+	"context"
 	"database/sql"
 	"strconv"
 	"strings"
 	"unicode"
 
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+
 	"github.com/juju/errors"
 )
 
 var (
-	ErrUserDoesNotExist     = errors.New("user does not exist")
-	ErrTagDoesNotExist      = errors.New("tag does not exist")
-	ErrTagNameInvalid       = errors.New("")
-	ErrBookmarkDoesNotExist = errors.New("bookmark does not exist")
-	ErrNotImplemented       = errors.New("not implemented")
+	ErrUserDoesNotExist        = errors.New("user does not exist")
+	ErrTagDoesNotExist         = errors.New("tag does not exist")
+	ErrTagNameInvalid          = errors.New("")
+	ErrBookmarkDoesNotExist    = errors.New("bookmark does not exist")
+	ErrNoteDoesNotExist        = errors.New("note does not exist")
+	ErrAccessTokenDoesNotExist = errors.New("access token does not exist")
+	ErrIdentityDoesNotExist    = errors.New("identity does not exist")
+	ErrTagGrantDoesNotExist    = errors.New("grant does not exist")
+	ErrNotImplemented          = errors.New("not implemented")
+	ErrSearchQueryEmpty        = errors.New("search query is empty")
 )
 
 type TaggableType string
 
+// NoteFormat tells clients how to render the body of a note; the storage
+// doesn't care.
+type NoteFormat string
+
 type TagsFetchMode string
 type TagNamesFetchMode string
 
@@ -28,6 +40,11 @@ type TaggableLeafPolicy string
 
 const (
 	TaggableTypeBookmark TaggableType = "bookmark"
+	TaggableTypeNote     TaggableType = "note"
+
+	NoteFormatPlain    NoteFormat = "plain"
+	NoteFormatMarkdown NoteFormat = "markdown"
+	NoteFormatDefault             = NoteFormatPlain
 
 	TagsFetchModeNone    TagsFetchMode = "none"
 	TagsFetchModeLeafs   TagsFetchMode = "leafs"
@@ -42,6 +59,22 @@ const (
 	TaggableLeafPolicyDel  TaggableLeafPolicy = "del_new_leaf"
 )
 
+// Matched words in the snippets returned by SearchBookmarks are wrapped in
+// these, so snippets are HTML; the rest of the text is escaped with
+// EscapeSnippetText.
+const (
+	SearchHighlightStart = "<b>"
+	SearchHighlightStop  = "</b>"
+)
+
+var snippetTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// EscapeSnippetText escapes the text of a bookmark for a search snippet, so
+// that only the highlighting is interpreted as HTML.
+func EscapeSnippetText(s string) string {
+	return snippetTextEscaper.Replace(s)
+}
+
 // TaggingMode is used for GetTaggings(), SetTaggings: specifies whether given
 // argument/returned value should contain all tags (including all supertags),
 // or leafs only.
@@ -52,19 +85,66 @@ const (
 	TaggingModeLeafs
 )
 
-// Either ID or Username should be given.
+// Either ID, Username or Email should be given.
 type GetUserArgs struct {
 	ID       *int
 	Username *string
+	Email    *string
 }
 
 type UserData struct {
 	ID       int
 	Username string
+	// Password is a hash of the password (see server's hashPassword), or an
+	// empty string if the user can't log in with a password.
 	Password string
 	Email    string
 }
 
+type AccessTokenData struct {
+	ID     int
+	UserID int
+	Descr  string
+	// If empty on creation, AccessTokenScopeDefault is used.
+	Scope AccessTokenScope
+	// If not zero, the token only gives access to the subtree of this tag:
+	// the tag itself and its descendants, and taggables tagged with them.
+	RootTagID int
+	// Unix timestamps. Zero LastUsedAt means that the token was never used, and
+	// zero ExpiresAt means that the token never expires.
+	CreatedAt  uint64
+	LastUsedAt uint64
+	ExpiresAt  uint64
+}
+
+// ExternalIdentityData is an identity of a user at an external auth provider
+// (Google, or an OpenID Connect issuer), which the user can log in with.
+type ExternalIdentityData struct {
+	ID     int
+	UserID int
+	// Name of the auth provider, as in /api/auth/:provider
+	Provider string
+	// Id of the user at the provider; unique per provider.
+	Subject string
+	Email   string
+	// Unix timestamp
+	CreatedAt uint64
+}
+
+// TagGrantData is a grant which shares the subtree of a tag (the tag itself
+// and its descendants, and taggables tagged with them) with another user.
+type TagGrantData struct {
+	ID    int
+	TagID int
+	// Owner of the tag; ignored on creation.
+	OwnerID   int
+	GranteeID int
+	// If empty on creation, TagGrantPermissionDefault is used.
+	Permission TagGrantPermission
+	// Unix timestamp
+	CreatedAt uint64
+}
+
 type TagData struct {
 	ID          int
 	OwnerID     int
@@ -85,6 +165,8 @@ type TaggableData struct {
 	Type      TaggableType
 	CreatedAt uint64
 	UpdatedAt uint64
+	// Zero unless the taggable is in the trash
+	TrashedAt uint64
 }
 
 type BookmarkData struct {
@@ -93,9 +175,38 @@ type BookmarkData struct {
 	OwnerID   int
 	CreatedAt uint64
 	UpdatedAt uint64
+	// See TaggableData.TrashedAt
+	TrashedAt uint64
 	URL       string
-	Title     string
-	Comment   string
+	// Canonical form of URL (see package urlcanon), used for the uniqueness
+	// check and for the lookup by url. If it's empty on creation or update, URL
+	// is used as is. It's returned by GetBookmarkByID only.
+	CanonicalURL string
+	Title        string
+	Comment      string
+}
+
+// GetCanonicalURL returns CanonicalURL, or URL if the former is empty.
+func (bd *BookmarkData) GetCanonicalURL() string {
+	if bd.CanonicalURL != "" {
+		return bd.CanonicalURL
+	}
+	return bd.URL
+}
+
+// BookmarkURLData is used to update canonical URLs of all bookmarks, see
+// GetAllBookmarkURLs.
+type BookmarkURLData struct {
+	ID           int
+	URL          string
+	CanonicalURL string
+}
+
+// DuplicateBookmarks is a set of bookmarks with the same canonical URL.
+type DuplicateBookmarks struct {
+	CanonicalURL string
+	// Sorted in ascending order
+	BookmarkIDs []int
 }
 
 type BookmarkDataWTags struct {
@@ -103,6 +214,37 @@ type BookmarkDataWTags struct {
 	Tags []BookmarkTagPath
 }
 
+type NoteData struct {
+	// Like in BookmarkData, TaggableData is not embedded here
+	ID        int
+	OwnerID   int
+	CreatedAt uint64
+	UpdatedAt uint64
+	// See TaggableData.TrashedAt
+	TrashedAt uint64
+	Title     string
+	Body      string
+	Format    NoteFormat
+}
+
+// NoteDataWTags is a note with its tags; BookmarkTagPath is used for tags of
+// any taggables, not only bookmarks.
+type NoteDataWTags struct {
+	NoteData
+	Tags []BookmarkTagPath
+}
+
+// BookmarkSearchResult is a bookmark found by SearchBookmarks. Rank is only
+// meaningful for comparison with other results of the same search; the higher
+// the better. Snippets are parts of the title and comment with matched words
+// highlighted, see SearchHighlightStart and SearchHighlightStop.
+type BookmarkSearchResult struct {
+	BookmarkDataWTags
+	Rank           float64
+	TitleSnippet   string
+	CommentSnippet string
+}
+
 type BookmarkTagPath struct {
 	TagItems []BookmarkTagPathItem
 }
@@ -112,6 +254,62 @@ type BookmarkTagPathItem struct {
 	Name string
 }
 
+type BookmarksSortField string
+
+const (
+	BookmarksSortFieldCreated BookmarksSortField = "created"
+	BookmarksSortFieldUpdated BookmarksSortField = "updated"
+	BookmarksSortFieldTitle   BookmarksSortField = "title"
+	BookmarksSortFieldURL     BookmarksSortField = "url"
+	BookmarksSortFieldDefault                    = BookmarksSortFieldCreated
+)
+
+// BookmarksPageOpts specifies which part of the matching bookmarks, and in
+// what order, GetTaggedBookmarks should return. Bookmarks with equal sort
+// keys are ordered by ids (in the same direction), so the order is always
+// stable.
+type BookmarksPageOpts struct {
+	// If empty, BookmarksSortFieldDefault is used.
+	SortField BookmarksSortField
+	SortDesc  bool
+	// Max number of bookmarks to return; 0 means no limit.
+	Limit int
+	// If not nil, only bookmarks after the cursor are returned. It should be
+	// the NextCursor of the previous page, requested with the same sorting.
+	Cursor *BookmarksCursor
+}
+
+// BookmarksCursor is a position in a sorted list of bookmarks: the sort key
+// and the id of the last bookmark on a page.
+type BookmarksCursor struct {
+	SortField BookmarksSortField
+	SortDesc  bool
+	ID        int
+	// Depending on the SortField, either Time (creation or update time) or
+	// Str (title or url) is used.
+	Time uint64
+	Str  string
+}
+
+type BookmarksPage struct {
+	Bookmarks []BookmarkDataWTags
+	// Number of all the matching bookmarks, regardless of the cursor and
+	// limit.
+	TotalCnt int
+	// Nil if there are no more bookmarks after this page.
+	NextCursor *BookmarksCursor
+}
+
+// TagDeleteResult describes how taggables are affected by the deletion of a
+// tag. Both slices contain only taggables which were tagged with the deleted
+// tag or any of its descendants, and are sorted.
+type TagDeleteResult struct {
+	// Taggables which stay tagged with some other tags.
+	RetaggedIDs []int
+	// Taggables which become untagged.
+	UntaggedIDs []int
+}
+
 type TagsFetchOpts struct {
 	TagsFetchMode     TagsFetchMode
 	TagNamesFetchMode TagNamesFetchMode
@@ -137,26 +335,95 @@ type Storage interface {
 	Connect() error
 	ApplyMigrations() error
 	Tx(fn func(*sql.Tx) error) error
+	// TxOpt runs fn in a transaction with the given isolation level and
+	// access mode. Above TxILevelReadCommitted, a transaction which fails
+	// because of a concurrent one may be retried, i.e. fn may be called more
+	// than once; so it should not have side effects other than via tx.
 	TxOpt(ilevel TxILevel, mode TxMode, fn func(*sql.Tx) error) error
+	// TxCtx and TxOptCtx are like Tx and TxOpt, but the transaction is bound
+	// to the given context: all the methods below which are called with this
+	// transaction are cancelled together with the context, and the transaction
+	// is rolled back. Tx and TxOpt use context.Background().
+	TxCtx(ctx context.Context, fn func(*sql.Tx) error) error
+	TxOptCtx(
+		ctx context.Context, ilevel TxILevel, mode TxMode, fn func(*sql.Tx) error,
+	) error
 
 	//-- Users
 	GetUser(tx *sql.Tx, args *GetUserArgs) (*UserData, error)
 	CreateUser(tx *sql.Tx, ud *UserData) (userID int, err error)
 	DeleteUser(tx *sql.Tx, userID int) error
+	// SetUserPassword sets the password hash of the user; an empty hash means
+	// that the user can't log in with a password anymore.
+	SetUserPassword(tx *sql.Tx, userID int, passwordHash string) error
 	GetUsers(tx *sql.Tx) ([]UserData, error)
-	GetAccessToken(
-		tx *sql.Tx, userID int, descr string, createIfNotExist bool,
-	) (token string, err error)
-	GetUserByAccessToken(tx *sql.Tx, token string) (*UserData, error)
-	GetUserByGoogleUserID(tx *sql.Tx, googleUserID string) (*UserData, error)
-	CreateGoogleUser(tx *sql.Tx, userID int, googleUserID, email string) error
+	// CreateAccessToken creates a new token for atd.UserID, with atd.Descr,
+	// atd.Scope, atd.RootTagID and atd.ExpiresAt; other fields are ignored. Only
+	// a hash of the token is stored, so the token itself is returned just once,
+	// from here. If the root tag gets deleted, the token is deleted as well.
+	CreateAccessToken(
+		tx *sql.Tx, atd *AccessTokenData,
+	) (tokenID int, token string, err error)
+	GetAccessToken(tx *sql.Tx, tokenID int) (*AccessTokenData, error)
+	// GetAccessTokens returns all tokens of the user (including expired ones),
+	// ordered by id.
+	GetAccessTokens(tx *sql.Tx, userID int) ([]AccessTokenData, error)
+	DeleteAccessToken(tx *sql.Tx, tokenID int) error
+	// GetUserByAccessToken returns the owner of the token and the token data,
+	// and updates the token's last used time (at most once in
+	// AccessTokenLastUsedResolution). If the token does not exist or is
+	// expired, an unauthorized error is returned.
+	GetUserByAccessToken(
+		tx *sql.Tx, token string,
+	) (*UserData, *AccessTokenData, error)
+	// GetUserByExternalIdentity returns the user which the identity at the
+	// given provider belongs to, or ErrUserDoesNotExist.
+	GetUserByExternalIdentity(
+		tx *sql.Tx, provider, subject string,
+	) (*UserData, error)
+	// CreateExternalIdentity associates the identity eid.Provider, eid.Subject
+	// with the user eid.UserID; eid.ID is ignored.
+	CreateExternalIdentity(
+		tx *sql.Tx, eid *ExternalIdentityData,
+	) (eidID int, err error)
+	// GetExternalIdentities returns all identities of the user, ordered by id.
+	GetExternalIdentities(tx *sql.Tx, userID int) ([]ExternalIdentityData, error)
+	DeleteExternalIdentity(tx *sql.Tx, eidID int) error
+	// CreateTagGrant shares the tag tgd.TagID with the user tgd.GranteeID, with
+	// tgd.Permission; other fields are ignored. There can be just one grant per
+	// tag and grantee. If the tag or the grantee gets deleted, the grant is
+	// deleted as well.
+	CreateTagGrant(tx *sql.Tx, tgd *TagGrantData) (grantID int, err error)
+	// GetTagGrantsByOwner returns all grants for the tags of the user, ordered
+	// by id.
+	GetTagGrantsByOwner(tx *sql.Tx, ownerID int) ([]TagGrantData, error)
+	// GetTagGrantsByGrantee returns all grants given to the user, ordered by
+	// id.
+	GetTagGrantsByGrantee(tx *sql.Tx, granteeID int) ([]TagGrantData, error)
+	DeleteTagGrant(tx *sql.Tx, grantID int) error
 
 	//-- Tags
 	CreateTag(tx *sql.Tx, td *TagData) (tagID int, err error)
 	// leafPolicy is used if only td.ParentTagID is not nil, i.e. if the tag
 	// should be moved.
 	UpdateTag(tx *sql.Tx, td *TagData, leafPolicy TaggableLeafPolicy) (err error)
-	DeleteTag(tx *sql.Tx, tagID int, leafPolicy TaggableLeafPolicy) (err error)
+	// If dryRun is true, nothing is deleted, and the result just tells what
+	// would happen to the taggables.
+	DeleteTag(
+		tx *sql.Tx, tagID int, leafPolicy TaggableLeafPolicy, dryRun bool,
+	) (result *TagDeleteResult, err error)
+	// MergeTags moves all taggings, subtags and names of the tag srcTagID to
+	// the tag dstTagID, and deletes srcTagID. Subtags of srcTagID which have the
+	// same name as some subtag of dstTagID are merged into it recursively.
+	MergeTags(tx *sql.Tx, srcTagID, dstTagID int) error
+	// CopyTag recursively copies the tag srcTagID, with all its names,
+	// descriptions and subtags, under the tag parentTagID, and returns the id of
+	// the copy. If names is not empty, the copy gets these names instead of the
+	// names of srcTagID. If retag is true, taggables tagged with the original
+	// tags get tagged with their copies as well.
+	CopyTag(
+		tx *sql.Tx, srcTagID, parentTagID int, names []string, retag bool,
+	) (tagID int, err error)
 	GetTagIDByPath(tx *sql.Tx, ownerID int, tagPath string) (int, error)
 	GetTagIDByName(tx *sql.Tx, parentTagID int, tagName string) (int, error)
 	GetRootTagID(tx *sql.Tx, ownerID int) (int, error)
@@ -171,24 +438,84 @@ type Storage interface {
 	CreateTaggable(tx *sql.Tx, tgbd *TaggableData) (tgbID int, err error)
 	CreateBookmark(tx *sql.Tx, bd *BookmarkData) (bkmID int, err error)
 	UpdateBookmark(tx *sql.Tx, bd *BookmarkData) (err error)
+	// NOTE: unlike other getters, GetTaggedTaggableIDs returns trashed
+	// taggables as well, since it's used to maintain taggings.
 	GetTaggedTaggableIDs(
 		tx *sql.Tx, tagIDs []int, ownerID *int, ttypes []TaggableType,
 	) (taggableIDs []int, err error)
 
 	// tagsFetchOpts might be nil, or any of the options might be empty strings:
 	// in this case, defaults will be used: TagsFetchModeLeafs and
-	// TagNamesFetchModeFull.
+	// TagNamesFetchModeFull. pageOpts might be nil as well, which means all
+	// bookmarks in the default order.
 	GetTaggedBookmarks(
 		tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *TagsFetchOpts,
-	) (bookmarks []BookmarkDataWTags, err error)
+		pageOpts *BookmarksPageOpts,
+	) (page *BookmarksPage, err error)
+	// GetBookmarksByTagQuery is like GetTaggedBookmarks, but returns bookmarks
+	// matching the given boolean tag query.
+	GetBookmarksByTagQuery(
+		tx *sql.Tx, query *TagQuery, ownerID int,
+		tagsFetchOpts *TagsFetchOpts, pageOpts *BookmarksPageOpts,
+	) (page *BookmarksPage, err error)
+	// GetBookmarksByURL returns bookmarks with the given canonical URL.
 	GetBookmarksByURL(
-		tx *sql.Tx, url string, ownerID int, tagsFetchOpts *TagsFetchOpts,
+		tx *sql.Tx, canonicalURL string, ownerID int, tagsFetchOpts *TagsFetchOpts,
 	) (bookmarks []BookmarkDataWTags, err error)
+	// GetBookmarkByID returns trashed bookmarks as well, with non-zero
+	// TrashedAt.
 	GetBookmarkByID(
 		tx *sql.Tx, bookmarkID int, tagsFetchOpts *TagsFetchOpts,
 	) (bookmark *BookmarkDataWTags, err error)
+	// SearchBookmarks returns bookmarks of the given owner whose title, comment
+	// or url contain all words from the query, best matches first. If tagIDs
+	// are given, only bookmarks tagged with all of them are searched. If the
+	// query has no words to search for, ErrSearchQueryEmpty is returned.
+	SearchBookmarks(
+		tx *sql.Tx, query string, ownerID int, tagIDs []int,
+		tagsFetchOpts *TagsFetchOpts,
+	) (results []BookmarkSearchResult, err error)
+	// GetDuplicateBookmarks returns sets of non-trashed bookmarks of the given
+	// owner which have the same non-empty canonical URL, ordered by the URL.
+	GetDuplicateBookmarks(tx *sql.Tx, ownerID int) ([]DuplicateBookmarks, error)
+	// GetAllBookmarkURLs returns urls of all bookmarks of all users, including
+	// trashed ones, ordered by id.
+	GetAllBookmarkURLs(tx *sql.Tx) ([]BookmarkURLData, error)
+	// SetBookmarkCanonicalURL sets the canonical URL of the bookmark; it's
+	// used when the canonicalization rules change, so it doesn't check for
+	// duplicates.
+	SetBookmarkCanonicalURL(tx *sql.Tx, bookmarkID int, canonicalURL string) error
+	CreateNote(tx *sql.Tx, nd *NoteData) (noteID int, err error)
+	UpdateNote(tx *sql.Tx, nd *NoteData) (err error)
+	// GetTaggedNotes is like GetTaggedBookmarks, but returns notes, and always
+	// all of them, in the order of creation.
+	GetTaggedNotes(
+		tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *TagsFetchOpts,
+	) (notes []NoteDataWTags, err error)
+	// Like GetBookmarkByID, GetNoteByID returns trashed notes as well.
+	GetNoteByID(
+		tx *sql.Tx, noteID int, tagsFetchOpts *TagsFetchOpts,
+	) (note *NoteDataWTags, err error)
 	DeleteTaggable(tx *sql.Tx, taggableID int) error
 
+	//-- Trash
+	// TrashTaggable moves the taggable to the trash: it keeps its taggings, but
+	// it's not returned by any getters except GetBookmarkByID, GetNoteByID and
+	// GetTaggedTaggableIDs.
+	TrashTaggable(tx *sql.Tx, taggableID int) error
+	// RestoreTaggable takes the taggable out of the trash. A bookmark can't be
+	// restored if its owner already has another bookmark with the same url.
+	RestoreTaggable(tx *sql.Tx, taggableID int) error
+	// GetTrashedTaggables returns trashed taggables of the given owner, the
+	// most recently trashed ones first.
+	GetTrashedTaggables(tx *sql.Tx, ownerID int) ([]TaggableData, error)
+	// PurgeTrash deletes taggables which were trashed at or before the given
+	// unix time (of the given owner only, if ownerID is not nil), and returns
+	// their ids, sorted.
+	PurgeTrash(
+		tx *sql.Tx, ownerID *int, trashedBefore uint64,
+	) (taggableIDs []int, err error)
+
 	//-- Taggings
 	GetTaggings(
 		tx *sql.Tx, taggableID int, tm TaggingMode,
@@ -197,8 +524,129 @@ type Storage interface {
 		tx *sql.Tx, taggableID int, tagIDs []int, tm TaggingMode,
 	) error
 
+	//-- History
+	// GetHistory returns the history records of the given object, oldest
+	// first. The records are added by UpdateBookmark, SetTaggings, UpdateTag and
+	// DeleteTag, in the same transaction.
+	GetHistory(
+		tx *sql.Tx, objectType HistoryObjectType, objectID int,
+	) ([]HistoryRecord, error)
+
 	//-- Maintenance
-	CheckIntegrity() error
+	// CheckIntegrity checks the invariants of the whole storage and returns
+	// all the violations found; the error is only returned if the check itself
+	// fails. If repair is true, the repairable violations are also fixed, all
+	// in a single transaction; otherwise nothing is changed, so the report
+	// serves as a dry run of the repair.
+	CheckIntegrity(repair bool) (*IntegrityReport, error)
+}
+
+// Migrator is implemented by storages whose schema is maintained by
+// migrations, i.e. the SQL-backed ones.
+type Migrator interface {
+	// Migrate applies or reverts migrations so that targetID becomes the
+	// current one (0 means reverting everything), and returns the steps taken.
+	// If dryRun is true, the steps are only returned, not performed.
+	Migrate(targetID int, dryRun bool) ([]dfmigrate.Step, error)
+	MigrationStatus() (*dfmigrate.Status, error)
+}
+
+// PrepareBookmarksPageOpts returns a copy of the given opts (which might be
+// nil) with defaults applied, or an error if the opts are invalid.
+func PrepareBookmarksPageOpts(opts *BookmarksPageOpts) (*BookmarksPageOpts, error) {
+	ret := BookmarksPageOpts{}
+	if opts != nil {
+		ret = *opts
+	}
+
+	if ret.SortField == "" {
+		ret.SortField = BookmarksSortFieldDefault
+	}
+
+	switch ret.SortField {
+	case BookmarksSortFieldCreated, BookmarksSortFieldUpdated,
+		BookmarksSortFieldTitle, BookmarksSortFieldURL:
+		// ok
+	default:
+		return nil, errors.Errorf("invalid sort field %q", ret.SortField)
+	}
+
+	if ret.Limit < 0 {
+		return nil, errors.Errorf("invalid limit %d", ret.Limit)
+	}
+
+	if ret.Cursor != nil {
+		if ret.Cursor.SortField != ret.SortField || ret.Cursor.SortDesc != ret.SortDesc {
+			return nil, errors.Errorf("the cursor was made for a different sort order")
+		}
+	}
+
+	return &ret, nil
+}
+
+// MakeBookmarksCursor returns a cursor pointing at the given bookmark, in the
+// order specified by opts.
+func MakeBookmarksCursor(bkm *BookmarkData, opts *BookmarksPageOpts) *BookmarksCursor {
+	c := &BookmarksCursor{
+		SortField: opts.SortField,
+		SortDesc:  opts.SortDesc,
+		ID:        bkm.ID,
+	}
+
+	switch opts.SortField {
+	case BookmarksSortFieldCreated:
+		c.Time = bkm.CreatedAt
+	case BookmarksSortFieldUpdated:
+		c.Time = bkm.UpdatedAt
+	case BookmarksSortFieldTitle:
+		c.Str = bkm.Title
+	case BookmarksSortFieldURL:
+		c.Str = bkm.URL
+	}
+
+	return c
+}
+
+// FindTagByNames returns the tag from tags which has any of the given names,
+// or nil if there is no such tag. If names match more than one tag, it's an
+// error.
+func FindTagByNames(tags []TagData, names []string) (*TagData, error) {
+	var ret *TagData
+
+	for i := range tags {
+		for _, tagName := range tags[i].Names {
+			for _, name := range names {
+				if name != tagName {
+					continue
+				}
+
+				if ret != nil && ret.ID != tags[i].ID {
+					return nil, errors.Errorf(
+						"names %q match more than one tag: %d and %d",
+						names, ret.ID, tags[i].ID,
+					)
+				}
+
+				ret = &tags[i]
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// ValidateNoteFormat returns an error if the given note format is not one of
+// the known ones.
+func ValidateNoteFormat(format NoteFormat) error {
+	switch format {
+	case NoteFormatPlain, NoteFormatMarkdown:
+		return nil
+	}
+
+	return errors.Errorf(
+		"invalid note format %q, valid values are: %q, %q",
+		format, NoteFormatPlain, NoteFormatMarkdown,
+	)
 }
 
 func ValidateTagName(name string, allowEmpty bool) error {
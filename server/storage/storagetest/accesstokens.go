@@ -0,0 +1,246 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+func testAccessTokens(t *testing.T, si storage.Storage) error {
+	u1ID, u1Token, err := testutils.CreateTestUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, _, err := testutils.CreateTestUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	now := uint64(time.Now().Unix())
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		tok2ID, tok2, err := si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID:    u1ID,
+			Descr:     "expires later",
+			ExpiresAt: now + 3600,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, tok3, err := si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID:    u1ID,
+			Descr:     "expired",
+			ExpiresAt: now - 1,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if tok2 == u1Token || tok2 == tok3 {
+			return errors.Errorf("tokens should be unique: %q, %q, %q", u1Token, tok2, tok3)
+		}
+
+		for _, tok := range []string{u1Token, tok2} {
+			if err := expectTokenOwner(tx, si, tok, u1ID); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		for _, tok := range []string{tok3, "unknown"} {
+			if err := expectTokenUnauthorized(tx, si, tok); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Tokens are listed in the order of creation, with the expired ones
+		tokens, err := si.GetAccessTokens(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		descrs := []string{}
+		for _, tok := range tokens {
+			descrs = append(descrs, tok.Descr)
+		}
+		expectedDescrs := []string{
+			"test token for a test user", "expires later", "expired",
+		}
+		if !reflect.DeepEqual(descrs, expectedDescrs) {
+			return errors.Errorf(
+				"token descriptions: expected %q, got %q", expectedDescrs, descrs,
+			)
+		}
+
+		tok, err := si.GetAccessToken(tx, tok2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if tok.UserID != u1ID || tok.ExpiresAt != now+3600 {
+			return errors.Errorf("unexpected token data: %+v", tok)
+		}
+		if tok.CreatedAt == 0 || tok.LastUsedAt < tok.CreatedAt {
+			return errors.Errorf("token should have CreatedAt and LastUsedAt set: %+v", tok)
+		}
+
+		if tokens[2].LastUsedAt != 0 {
+			return errors.Errorf("expired token should not be marked as used: %+v", tokens[2])
+		}
+
+		tokens, err = si.GetAccessTokens(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(tokens) != 1 {
+			return errors.Errorf("user 2 should have 1 token, got %+v", tokens)
+		}
+
+		// Revoke the token
+		if err := si.DeleteAccessToken(tx, tok2ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTokenUnauthorized(tx, si, tok2); err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.GetAccessToken(tx, tok2ID)
+		if errors.Cause(err) != storage.ErrAccessTokenDoesNotExist {
+			return errors.Errorf("expected ErrAccessTokenDoesNotExist, got %v", err)
+		}
+
+		err = si.DeleteAccessToken(tx, tok2ID)
+		if errors.Cause(err) != storage.ErrAccessTokenDoesNotExist {
+			return errors.Errorf("expected ErrAccessTokenDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := testAccessTokenScopes(si, u1ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func testAccessTokenScopes(si storage.Storage, userID int) error {
+	err := si.Tx(func(tx *sql.Tx) error {
+		rootTagID, err := si.GetRootTagID(tx, userID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		tagID, err := si.CreateTag(tx, &storage.TagData{
+			OwnerID:     userID,
+			ParentTagID: cptr.Int(rootTagID),
+			Names:       []string{"shared"},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, _, err = si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID: userID,
+			Descr:  "invalid",
+			Scope:  storage.AccessTokenScope("admin"),
+		})
+		if err == nil {
+			return errors.Errorf("token with an invalid scope should not be created")
+		}
+
+		tokID, tok, err := si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID:    userID,
+			Descr:     "read-only subtree",
+			Scope:     storage.AccessTokenScopeRead,
+			RootTagID: tagID,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		ud, atd, err := si.GetUserByAccessToken(tx, tok)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ud.ID != userID || atd.ID != tokID {
+			return errors.Errorf("unexpected token owner %+v or data %+v", ud, atd)
+		}
+		if atd.Scope != storage.AccessTokenScopeRead || atd.RootTagID != tagID {
+			return errors.Errorf("unexpected token scope: %+v", atd)
+		}
+
+		// By default, tokens have the write scope and are not restricted
+		tokens, err := si.GetAccessTokens(tx, userID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if tokens[0].Scope != storage.AccessTokenScopeWrite || tokens[0].RootTagID != 0 {
+			return errors.Errorf("unexpected default token scope: %+v", tokens[0])
+		}
+
+		// Once the root tag is deleted, the token is deleted as well
+		_, err = si.DeleteTag(tx, tagID, storage.TaggableLeafPolicyKeep, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTokenUnauthorized(tx, si, tok); err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.GetAccessToken(tx, tokID)
+		if errors.Cause(err) != storage.ErrAccessTokenDoesNotExist {
+			return errors.Errorf("expected ErrAccessTokenDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func expectTokenOwner(
+	tx *sql.Tx, si storage.Storage, token string, userID int,
+) error {
+	ud, _, err := si.GetUserByAccessToken(tx, token)
+	if err != nil {
+		return errors.Annotatef(err, "token %q", token)
+	}
+
+	if ud.ID != userID {
+		return errors.Errorf("token %q: expected user %d, got %d", token, userID, ud.ID)
+	}
+
+	return nil
+}
+
+func expectTokenUnauthorized(tx *sql.Tx, si storage.Storage, token string) error {
+	_, _, err := si.GetUserByAccessToken(tx, token)
+	if err == nil || hh.GetHTTPErrorCode(err) != http.StatusUnauthorized {
+		return errors.Errorf("token %q: expected unauthorized error, got %v", token, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testTagGrants(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 3)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID, u3ID := userIDs[0], userIDs[1], userIDs[2]
+
+	var tagIDs *TagIDs
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		tagIDs, err = MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, tgd := range []storage.TagGrantData{
+			{TagID: tagIDs.Tag1ID, GranteeID: u2ID},
+			{TagID: tagIDs.Tag5ID, GranteeID: u3ID},
+			{TagID: tagIDs.Tag7ID, GranteeID: u2ID, Permission: storage.TagGrantPermissionRead},
+		} {
+			if _, err := si.CreateTagGrant(tx, &tgd); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// There can be just one grant per tag and grantee
+	err = si.Tx(func(tx *sql.Tx) error {
+		_, err := si.CreateTagGrant(tx, &storage.TagGrantData{
+			TagID: tagIDs.Tag1ID, GranteeID: u2ID,
+		})
+		return err
+	})
+	if err == nil {
+		return errors.Errorf("creating a duplicate grant should fail")
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		_, err := si.CreateTagGrant(tx, &storage.TagGrantData{
+			TagID: tagIDs.Tag2ID, GranteeID: u2ID, Permission: "write",
+		})
+		return err
+	})
+	if err == nil {
+		return errors.Errorf("creating a grant with an invalid permission should fail")
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		grants, err := si.GetTagGrantsByOwner(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(grants) != 3 ||
+			grants[0].TagID != tagIDs.Tag1ID || grants[0].GranteeID != u2ID ||
+			grants[1].TagID != tagIDs.Tag5ID || grants[1].GranteeID != u3ID ||
+			grants[2].TagID != tagIDs.Tag7ID || grants[2].GranteeID != u2ID ||
+			grants[0].OwnerID != u1ID || grants[0].CreatedAt == 0 ||
+			grants[0].Permission != storage.TagGrantPermissionRead {
+			return errors.Errorf("wrong grants of user %d: %+v", u1ID, grants)
+		}
+
+		grants, err = si.GetTagGrantsByGrantee(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(grants) != 2 ||
+			grants[0].TagID != tagIDs.Tag1ID || grants[1].TagID != tagIDs.Tag7ID ||
+			grants[0].OwnerID != u1ID {
+			return errors.Errorf("wrong grants to user %d: %+v", u2ID, grants)
+		}
+
+		grants, err = si.GetTagGrantsByOwner(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(grants) != 0 {
+			return errors.Errorf("user %d should have no grants, got %+v", u2ID, grants)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Deleting grants
+	err = si.Tx(func(tx *sql.Tx) error {
+		grants, err := si.GetTagGrantsByGrantee(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.DeleteTagGrant(tx, grants[0].ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.DeleteTagGrant(tx, grants[0].ID)
+		if errors.Cause(err) != storage.ErrTagGrantDoesNotExist {
+			return errors.Errorf("expected ErrTagGrantDoesNotExist, got %v", err)
+		}
+
+		grants, err = si.GetTagGrantsByGrantee(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(grants) != 1 || grants[0].TagID != tagIDs.Tag7ID {
+			return errors.Errorf("wrong grants to user %d: %+v", u2ID, grants)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Grants are deleted together with the tag (even if it's a descendant of
+	// the deleted one), and with the grantee
+	err = si.Tx(func(tx *sql.Tx) error {
+		_, err := si.DeleteTag(tx, tagIDs.Tag3ID, storage.TaggableLeafPolicyKeep, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.DeleteUser(tx, u2ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		grants, err := si.GetTagGrantsByOwner(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(grants) != 0 {
+			return errors.Errorf("all grants should be deleted, got %+v", grants)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
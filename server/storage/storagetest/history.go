@@ -0,0 +1,212 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testHistory(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, _, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		rootTag, err := si.GetTag(tx, tagIDs.RootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u1ID := rootTag.OwnerID
+
+		// Initial taggings are recorded
+		initialTagIDs, err := si.GetTaggings(tx, bkm1ID, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectHistory(tx, si, storage.HistoryObjectTaggable, bkm1ID, []storage.HistoryDiff{
+			{TagIDs: &storage.TagIDsChange{Added: initialTagIDs, Removed: []int{}}},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Update the bookmark twice; the second update doesn't change anything,
+		// so it's not recorded
+		for i := 0; i < 2; i++ {
+			err = si.UpdateBookmark(tx, &storage.BookmarkData{
+				ID:      bkm1ID,
+				OwnerID: u1ID,
+				URL:     "url1",
+				Title:   "title1",
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		err = expectHistory(tx, si, storage.HistoryObjectTaggable, bkm1ID, []storage.HistoryDiff{
+			{TagIDs: &storage.TagIDsChange{Added: initialTagIDs, Removed: []int{}}},
+			{Title: &storage.StringChange{Old: "", New: "title1"}},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Update tags
+		err = si.UpdateTag(tx, &storage.TagData{
+			ID:          tagIDs.Tag7ID,
+			Description: cptr.String("descr"),
+		}, storage.TaggableLeafPolicyKeep)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.UpdateTag(tx, &storage.TagData{
+			ID:          tagIDs.Tag5ID,
+			ParentTagID: cptr.Int(tagIDs.Tag2ID),
+		}, storage.TaggableLeafPolicyDel)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectHistory(tx, si, storage.HistoryObjectTag, tagIDs.Tag7ID, []storage.HistoryDiff{
+			{Description: &storage.StringChange{Old: "test tag", New: "descr"}},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectHistory(tx, si, storage.HistoryObjectTag, tagIDs.Tag5ID, []storage.HistoryDiff{
+			{ParentTagID: &storage.IntChange{Old: tagIDs.Tag3ID, New: tagIDs.Tag2ID}},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Moving of tag5 has removed tag3, which became a new leaf, from bookmark
+		// 2 (tagged with tag6), and it's recorded too
+		bkm2History, err := si.GetHistory(tx, storage.HistoryObjectTaggable, bkm2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkm2History) != 2 || bkm2History[1].Diff.TagIDs == nil {
+			return errors.Errorf("wrong history of bookmark 2: %+v", bkm2History)
+		}
+
+		// Delete tag4, which bookmark 1 is tagged with
+		tag4, err := si.GetTag(tx, tagIDs.Tag4ID, &storage.GetTagOpts{GetNames: true})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.DeleteTag(tx, tagIDs.Tag4ID, storage.TaggableLeafPolicyKeep, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectHistory(tx, si, storage.HistoryObjectTag, tagIDs.Tag4ID, []storage.HistoryDiff{
+			{
+				Names:   &storage.StringsChange{Old: tag4.Names, New: []string{}},
+				Deleted: true,
+			},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectHistory(tx, si, storage.HistoryObjectTaggable, bkm1ID, []storage.HistoryDiff{
+			{TagIDs: &storage.TagIDsChange{Added: initialTagIDs, Removed: []int{}}},
+			{Title: &storage.StringChange{Old: "", New: "title1"}},
+			{TagIDs: &storage.TagIDsChange{Added: []int{}, Removed: []int{tagIDs.Tag4ID}}},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Reverting to the first revision restores the title and the taggings
+		records, err := si.GetHistory(tx, storage.HistoryObjectTaggable, bkm1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		curTagIDs, err := si.GetTaggings(tx, bkm1ID, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm, err := si.GetBookmarkByID(tx, bkm1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bd := bkm.BookmarkData
+		revertedTagIDs := storage.RevertBookmark(&bd, curTagIDs, records[1:])
+		if bd.Title != "" || bd.URL != "url1" {
+			return errors.Errorf("wrong reverted bookmark: %+v", bd)
+		}
+		if !reflect.DeepEqual(revertedTagIDs, initialTagIDs) {
+			return errors.Errorf(
+				"wrong reverted taggings: expected %v, got %v", initialTagIDs, revertedTagIDs,
+			)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// expectHistory checks that the given object has history records with the
+// given diffs, in the given order.
+func expectHistory(
+	tx *sql.Tx, si storage.Storage,
+	objectType storage.HistoryObjectType, objectID int,
+	expected []storage.HistoryDiff,
+) error {
+	records, err := si.GetHistory(tx, objectType, objectID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	got := []storage.HistoryDiff{}
+	lastID := 0
+	for _, r := range records {
+		if r.ObjectType != objectType || r.ObjectID != objectID {
+			return errors.Errorf("got history record of another object: %+v", r)
+		}
+		if r.ID <= lastID {
+			return errors.Errorf("history records are not ordered by id: %+v", records)
+		}
+		lastID = r.ID
+		got = append(got, r.Diff)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		// Diffs consist of pointers, so print them as JSON
+		expectedJSON, _ := json.Marshal(expected)
+		gotJSON, _ := json.Marshal(got)
+		return errors.Errorf(
+			"%s %d: history expected: %s, got: %s",
+			objectType, objectID, expectedJSON, gotJSON,
+		)
+	}
+
+	return nil
+}
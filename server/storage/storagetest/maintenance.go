@@ -0,0 +1,191 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+func testCheckIntegrity(t *testing.T, si storage.Storage) error {
+	var u1ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	var tagIDs *TagIDs
+	var bkmID int
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		tagIDs, err = MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		bkmID, err = si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url1",
+		})
+		if err != nil {
+			return errors.Annotatef(err, "creating bookmark")
+		}
+
+		return errors.Trace(
+			si.SetTaggings(tx, bkmID, []int{tagIDs.Tag4ID}, storage.TaggingModeLeafs),
+		)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := storage.CheckIntegrity(si); err != nil {
+		return errors.Annotatef(err, "integrity of a valid storage")
+	}
+
+	report, err := si.CheckIntegrity(false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(report.Violations) != 0 {
+		return errors.Errorf("valid storage: expected no violations, got %v", report.Violations)
+	}
+
+	// Each of the taggings below (set in TaggingModeAll, i.e. as they are)
+	// breaks integrity
+	badTaggings := []struct {
+		tagIDs []int
+		descr  string
+		// Expected violations, without UserID and TaggableID
+		violations []storage.IntegrityViolation
+		// Expected taggings after the repair
+		repairedTagIDs []int
+	}{
+		{
+			tagIDs: []int{tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag4ID},
+			descr:  "a missing intermediate tag",
+			violations: []storage.IntegrityViolation{
+				{Kind: storage.IntegrityViolationMissingTagging, TagID: tagIDs.Tag3ID},
+			},
+			repairedTagIDs: []int{
+				tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag3ID, tagIDs.Tag4ID,
+			},
+		},
+		{
+			tagIDs: []int{tagIDs.Tag8ID},
+			descr:  "a missing root tag",
+			violations: []storage.IntegrityViolation{
+				{Kind: storage.IntegrityViolationMissingTagging, TagID: tagIDs.RootTagID},
+				{Kind: storage.IntegrityViolationMissingTagging, TagID: tagIDs.Tag7ID},
+			},
+			repairedTagIDs: []int{tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID},
+		},
+		{
+			tagIDs: []int{tagIDs.RootTagID},
+			descr:  "the root tag only",
+			violations: []storage.IntegrityViolation{
+				{Kind: storage.IntegrityViolationRootOnlyTagging, TagID: tagIDs.RootTagID},
+			},
+			repairedTagIDs: []int{},
+		},
+	}
+
+	for _, bt := range badTaggings {
+		err = si.Tx(func(tx *sql.Tx) error {
+			return si.SetTaggings(tx, bkmID, bt.tagIDs, storage.TaggingModeAll)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := storage.CheckIntegrity(si); err == nil {
+			return errors.Errorf("integrity check should fail with %s", bt.descr)
+		}
+
+		for i := range bt.violations {
+			bt.violations[i].UserID = u1ID
+			bt.violations[i].TaggableID = bkmID
+		}
+
+		// Dry run: violations are reported, but nothing is changed
+		report, err := si.CheckIntegrity(false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(report.Violations, bt.violations) {
+			return errors.Errorf(
+				"%s: expected violations %v, got %v", bt.descr, bt.violations, report.Violations,
+			)
+		}
+		if err := checkTaggings(si, bkmID, bt.tagIDs); err != nil {
+			return errors.Annotatef(err, "%s: after the dry run", bt.descr)
+		}
+
+		// Repair
+		for i := range bt.violations {
+			bt.violations[i].Repaired = true
+		}
+
+		report, err = si.CheckIntegrity(true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(report.Violations, bt.violations) {
+			return errors.Errorf(
+				"%s: expected repaired violations %v, got %v",
+				bt.descr, bt.violations, report.Violations,
+			)
+		}
+		if err := report.Err(); err != nil {
+			return errors.Annotatef(err, "%s: report after the repair", bt.descr)
+		}
+		if err := checkTaggings(si, bkmID, bt.repairedTagIDs); err != nil {
+			return errors.Annotatef(err, "%s: after the repair", bt.descr)
+		}
+
+		if err := storage.CheckIntegrity(si); err != nil {
+			return errors.Annotatef(err, "integrity after repairing %s", bt.descr)
+		}
+
+		// Restore the original taggings
+		err = si.Tx(func(tx *sql.Tx) error {
+			return si.SetTaggings(tx, bkmID, []int{tagIDs.Tag4ID}, storage.TaggingModeLeafs)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+func checkTaggings(si storage.Storage, taggableID int, expected []int) error {
+	return errors.Trace(si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := si.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		sort.Ints(tagIDs)
+		expected = append([]int{}, expected...)
+		sort.Ints(expected)
+
+		if len(tagIDs) != 0 || len(expected) != 0 {
+			if !reflect.DeepEqual(tagIDs, expected) {
+				return errors.Errorf("taggings: expected %v, got %v", expected, tagIDs)
+			}
+		}
+
+		return nil
+	}))
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+func testNotes(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, _, _, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, _, err := testutils.CreateTestUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		rootTag, err := si.GetTag(tx, tagIDs.RootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u1ID := rootTag.OwnerID
+
+		if _, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note",
+			Format:  "html",
+		}); err == nil {
+			return errors.Errorf("should not be able to create a note with an invalid format")
+		}
+
+		note1ID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note1",
+			Body:    "body1",
+			Format:  storage.NoteFormatPlain,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		note2ID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note2",
+			Body:    "*body2*",
+			Format:  storage.NoteFormatMarkdown,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		note3ID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u2ID,
+			Title:   "note3",
+			Format:  storage.NoteFormatPlain,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(tx, note1ID, []int{tagIDs.Tag4ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(tx, note2ID, []int{tagIDs.Tag6ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		note, err := si.GetNoteByID(tx, note2ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if note.ID != note2ID || note.OwnerID != u1ID ||
+			note.Title != "note2" || note.Body != "*body2*" ||
+			note.Format != storage.NoteFormatMarkdown {
+			return errors.Errorf("wrong note: %+v", note.NoteData)
+		}
+
+		if len(note.Tags) != 1 || note.Tags[0].TagItems[len(note.Tags[0].TagItems)-1].ID != tagIDs.Tag6ID {
+			return errors.Errorf("wrong note tags: %+v", note.Tags)
+		}
+
+		// Bookmarks are not notes, and vice versa
+		_, err = si.GetNoteByID(tx, bkm1ID, nil)
+		if errors.Cause(err) != storage.ErrNoteDoesNotExist {
+			return errors.Errorf("expected ErrNoteDoesNotExist, got %v", err)
+		}
+
+		_, err = si.GetBookmarkByID(tx, note1ID, nil)
+		if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+			return errors.Errorf("expected ErrBookmarkDoesNotExist, got %v", err)
+		}
+
+		page, err := si.GetTaggedBookmarks(tx, []int{tagIDs.Tag3ID}, cptr.Int(u1ID), nil, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, bkm := range page.Bookmarks {
+			if bkm.ID == note1ID || bkm.ID == note2ID {
+				return errors.Errorf("notes should not be returned as bookmarks")
+			}
+		}
+
+		for _, tc := range []struct {
+			tagIDs  []int
+			ownerID *int
+			noteIDs []int
+		}{
+			{[]int{tagIDs.Tag3ID}, cptr.Int(u1ID), []int{note1ID, note2ID}},
+			{[]int{tagIDs.Tag5ID}, cptr.Int(u1ID), []int{note2ID}},
+			{[]int{tagIDs.Tag2ID}, cptr.Int(u1ID), []int{}},
+			{[]int{}, cptr.Int(u1ID), []int{}},
+			{[]int{}, cptr.Int(u2ID), []int{note3ID}},
+			{[]int{}, nil, []int{note3ID}},
+		} {
+			if err := expectTaggedNotes(tx, si, tc.tagIDs, tc.ownerID, tc.noteIDs); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		err = si.UpdateNote(tx, &storage.NoteData{
+			ID:     note1ID,
+			Title:  "note1 updated",
+			Body:   "# body1",
+			Format: storage.NoteFormatMarkdown,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		note, err = si.GetNoteByID(tx, note1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if note.Title != "note1 updated" || note.Body != "# body1" ||
+			note.Format != storage.NoteFormatMarkdown {
+			return errors.Errorf("wrong updated note: %+v", note.NoteData)
+		}
+
+		if err := si.UpdateNote(tx, &storage.NoteData{
+			ID:     note1ID,
+			Format: "html",
+		}); err == nil {
+			return errors.Errorf("should not be able to set an invalid format")
+		}
+
+		if err := si.DeleteTaggable(tx, note1ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.GetNoteByID(tx, note1ID, nil)
+		if errors.Cause(err) != storage.ErrNoteDoesNotExist {
+			return errors.Errorf("expected ErrNoteDoesNotExist, got %v", err)
+		}
+
+		err = expectTaggedNotes(tx, si, []int{tagIDs.Tag3ID}, cptr.Int(u1ID), []int{note2ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func expectTaggedNotes(
+	tx *sql.Tx, si storage.Storage, tagIDs []int, ownerID *int, expected []int,
+) error {
+	notes, err := si.GetTaggedNotes(tx, tagIDs, ownerID, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	noteIDs := []int{}
+	for _, note := range notes {
+		noteIDs = append(noteIDs, note.ID)
+	}
+
+	if !reflect.DeepEqual(noteIDs, expected) {
+		return errors.Errorf(
+			"notes tagged with %v: expected %v, got %v", tagIDs, expected, noteIDs,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testSearchBookmarks(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID := userIDs[0], userIDs[1]
+
+	return si.Tx(func(tx *sql.Tx) error {
+		u1TagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		createBookmark := func(bd *storage.BookmarkData, tagIDs []int) (int, error) {
+			bkmID, err := si.CreateBookmark(tx, bd)
+			if err != nil {
+				return 0, errors.Annotatef(err, "creating bookmark")
+			}
+
+			err = si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+
+			return bkmID, nil
+		}
+
+		bkm1ID, err := createBookmark(&storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "http://learn.example.com",
+			Title:   "Learning Golang",
+		}, []int{u1TagIDs.Tag3ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm2ID, err := createBookmark(&storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "http://tutorial.example.com",
+			Title:   "Misc",
+			Comment: "A nice golang tutorial",
+		}, []int{u1TagIDs.Tag1ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm3ID, err := createBookmark(&storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "http://golang.org/doc",
+			Title:   "Docs",
+		}, []int{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm4ID, err := createBookmark(&storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "http://rust.example.com",
+			Title:   "Rust",
+			Comment: "Systems programming",
+		}, []int{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Bookmarks of other users should never be found
+		_, err = createBookmark(&storage.BookmarkData{
+			OwnerID: u2ID,
+			URL:     "http://golang.org",
+			Title:   "Golang",
+		}, []int{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		search := func(query string, tagIDs []int) ([]storage.BookmarkSearchResult, error) {
+			return si.SearchBookmarks(tx, query, u1ID, tagIDs, nil)
+		}
+
+		expectResults := func(query string, tagIDs []int, expectedIDs []int) error {
+			results, err := search(query, tagIDs)
+			if err != nil {
+				return errors.Annotatef(err, "searching for %q", query)
+			}
+
+			gotIDs := []int{}
+			for _, r := range results {
+				gotIDs = append(gotIDs, r.ID)
+			}
+
+			// Unlike checkTgb, the order matters here
+			if !reflect.DeepEqual(gotIDs, expectedIDs) {
+				return errors.Errorf(
+					"searching for %q, tags %v: expected %v, got %v",
+					query, tagIDs, expectedIDs, gotIDs,
+				)
+			}
+
+			return nil
+		}
+
+		// Title matches go first, then comment ones, then url ones
+		if err := expectResults("golang", nil, []int{bkm1ID, bkm2ID, bkm3ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// All words should match, case does not matter
+		if err := expectResults("GOLANG Tutorial", nil, []int{bkm2ID}); err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectResults("rust", nil, []int{bkm4ID}); err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectResults("rust golang", nil, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Search can be limited to tagged bookmarks
+		err = expectResults("golang", []int{u1TagIDs.Tag1ID}, []int{bkm1ID, bkm2ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = expectResults("golang", []int{u1TagIDs.Tag3ID}, []int{bkm1ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = expectResults("rust", []int{u1TagIDs.Tag1ID}, []int{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Check snippets and tags of the found bookmarks
+		results, err := search("golang", []int{u1TagIDs.Tag1ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if expected := "Learning <b>Golang</b>"; results[0].TitleSnippet != expected {
+			return errors.Errorf(
+				"expected title snippet %q, got %q", expected, results[0].TitleSnippet,
+			)
+		}
+
+		if expected := "A nice <b>golang</b> tutorial"; results[1].CommentSnippet != expected {
+			return errors.Errorf(
+				"expected comment snippet %q, got %q", expected, results[1].CommentSnippet,
+			)
+		}
+
+		if len(results[0].Tags) != 1 {
+			return errors.Errorf("expected bookmark to have 1 tag, got %v", results[0].Tags)
+		}
+
+		if !(results[0].Rank > results[1].Rank) {
+			return errors.Errorf(
+				"expected rank %v to be greater than %v", results[0].Rank, results[1].Rank,
+			)
+		}
+
+		// Snippets are HTML, so the text of the bookmarks is escaped
+		bkm5ID, err := createBookmark(&storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "http://zig.example.com",
+			Title:   "Zig <script>alert(1)</script> & C",
+		}, []int{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		results, err = search("zig", nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(results) != 1 || results[0].ID != bkm5ID {
+			return errors.Errorf("expected to find bookmark %d, got %+v", bkm5ID, results)
+		}
+
+		expected := "<b>Zig</b> &lt;script&gt;alert(1)&lt;/script&gt; &amp; C"
+		if results[0].TitleSnippet != expected {
+			return errors.Errorf(
+				"expected title snippet %q, got %q", expected, results[0].TitleSnippet,
+			)
+		}
+
+		// A query without words is an error
+		for _, q := range []string{"", "  ", "-- !"} {
+			_, err := search(q, nil)
+			if errors.Cause(err) != storage.ErrSearchQueryEmpty {
+				return errors.Errorf(
+					"searching for %q: expected %q, got %v", q, storage.ErrSearchQueryEmpty, err,
+				)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,319 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+// Package storagetest contains a conformance test suite which every
+// implementation of storage.Storage is expected to pass. Backends call Run
+// from their own tests, giving it a factory of connected storage instances.
+package storagetest // import "dmitryfrank.com/geekmarks/server/storage/storagetest"
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+// Factory returns a new connected storage instance. The suite prepares the
+// database (drops everything and applies migrations) by itself, before each
+// test.
+type Factory func() (storage.Storage, error)
+
+type testCase struct {
+	name string
+	f    func(t *testing.T, si storage.Storage) error
+}
+
+var testCases = []testCase{
+	{"TransactionRollback", testTransactionRollback},
+	{"TransactionContext", testTransactionContext},
+	{"GetTagIDByPath", testGetTagIDByPath},
+	{"GetTag", testGetTag},
+	{"InvalidTagNames", testInvalidTagNames},
+	{"CreateTag", testCreateTag},
+	{"MoveTagKeepNewLeaf", testMoveTagKeepNewLeaf},
+	{"MoveTagDelNewLeaf", testMoveTagDelNewLeaf},
+	{"MoveTagUnderDescendant", testMoveTagUnderDescendant},
+	{"DeleteTagKeepNewLeaf", testDeleteTagKeepNewLeaf},
+	{"DeleteTagDelNewLeaf", testDeleteTagDelNewLeaf},
+	{"MergeTags", testMergeTags},
+	{"MergeTagsRecursive", testMergeTagsRecursive},
+	{"CopyTag", testCopyTag},
+	{"Taggables", testTaggables},
+	{"TaggingModes", testTaggingModes},
+	{"Untagged", testUntagged},
+	{"BookmarkURLUniqueness", testBookmarkURLUniqueness},
+	{"CanonicalURLs", testCanonicalURLs},
+	{"SearchBookmarks", testSearchBookmarks},
+	{"BookmarksPagination", testBookmarksPagination},
+	{"BookmarksByTagQuery", testBookmarksByTagQuery},
+	{"Notes", testNotes},
+	{"Trash", testTrash},
+	{"History", testHistory},
+	{"CheckIntegrity", testCheckIntegrity},
+	{"Users", testUsers},
+	{"ExternalIdentities", testExternalIdentities},
+	{"AccessTokens", testAccessTokens},
+	{"TagGrants", testTagGrants},
+}
+
+// Run runs the whole suite against storages returned by the given factory;
+// every test gets a fresh storage with an empty database.
+func Run(t *testing.T, factory Factory) {
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			runTest(t, factory, tc.f)
+		})
+	}
+}
+
+func runTest(
+	t *testing.T, factory Factory, f func(t *testing.T, si storage.Storage) error,
+) {
+	si, err := factory()
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = testutils.PrepareTestDB(t, si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = f(t, si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = storage.CheckIntegrity(si)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+
+	err = testutils.CleanupTestDB(t)
+	if err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+		return
+	}
+}
+
+func testTransactionRollback(t *testing.T, si storage.Storage) error {
+	var u1ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	var rootTagID int
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		rootTagID, err = si.GetRootTagID(tx, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+		}
+
+		_, err = si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: &rootTagID,
+			Names:       []string{"normal_name"},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// The second tag fails, and the first one should be rolled back
+		// together with it
+		_, err = si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: &rootTagID,
+			Names:       []string{"normal_name2", "123"},
+		})
+		return errors.Trace(err)
+	})
+	if err == nil || errors.Cause(err) != storage.ErrTagNameInvalid {
+		return errors.Errorf("should not be able to create tag with the name 123")
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		for _, name := range []string{"normal_name", "normal_name2"} {
+			tagID, err := si.GetTagIDByName(tx, rootTagID, name)
+			if errors.Cause(err) != storage.ErrTagDoesNotExist {
+				return errors.Errorf(
+					"tag %q should not exist, but got id %d, err: %v", name, tagID, err,
+				)
+			}
+		}
+
+		subtags, err := si.GetTags(tx, rootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(subtags) != 0 {
+			return errors.Errorf("root tag should have no subtags, but got %v", subtags)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func testTransactionContext(t *testing.T, si storage.Storage) error {
+	var u1ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	var rootTagID int
+	err = si.TxCtx(context.Background(), func(tx *sql.Tx) error {
+		var err error
+		rootTagID, err = si.GetRootTagID(tx, u1ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	createTag := func(tx *sql.Tx, name string) error {
+		_, err := si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: &rootTagID,
+			Names:       []string{name},
+		})
+		return errors.Trace(err)
+	}
+
+	// Context is done before the transaction starts: depending on the storage,
+	// either the transaction can't be started, or the first query fails
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = si.TxCtx(ctx, func(tx *sql.Tx) error {
+		return createTag(tx, "tag1")
+	})
+	if err == nil {
+		return errors.Errorf("transaction with a cancelled context should fail")
+	}
+
+	// Context is done in the middle of the transaction: the next query should
+	// fail, and the previous one should be rolled back
+	ctx, cancel = context.WithCancel(context.Background())
+	err = si.TxCtx(ctx, func(tx *sql.Tx) error {
+		if err := createTag(tx, "tag2"); err != nil {
+			return errors.Trace(err)
+		}
+
+		cancel()
+
+		return createTag(tx, "tag3")
+	})
+	if err == nil {
+		return errors.Errorf("query after the context is cancelled should fail")
+	}
+
+	// Context is done after all the queries: the transaction should not be
+	// committed
+	ctx, cancel = context.WithCancel(context.Background())
+	err = si.TxCtx(ctx, func(tx *sql.Tx) error {
+		if err := createTag(tx, "tag4"); err != nil {
+			return errors.Trace(err)
+		}
+
+		cancel()
+		return nil
+	})
+	if err == nil {
+		return errors.Errorf("transaction should not commit after the context is cancelled")
+	}
+
+	// The storage should still work, and none of the tags above should exist
+	err = si.Tx(func(tx *sql.Tx) error {
+		for _, name := range []string{"tag1", "tag2", "tag3", "tag4"} {
+			tagID, err := si.GetTagIDByName(tx, rootTagID, name)
+			if errors.Cause(err) != storage.ErrTagDoesNotExist {
+				return errors.Errorf(
+					"tag %q should not exist, but got id %d, err: %v", name, tagID, err,
+				)
+			}
+		}
+
+		return errors.Trace(createTag(tx, "tag5"))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// createTestUsers creates users test1, test2, etc, and returns their ids.
+// NOTE: it should be called outside of any transaction: some storages
+// serialize read-write transactions, so nesting them would deadlock.
+func createTestUsers(si storage.Storage, cnt int) ([]int, error) {
+	userIDs := []int{}
+	for i := 1; i <= cnt; i++ {
+		userID, _, err := testutils.CreateTestUser(
+			si, fmt.Sprintf("test%d", i), fmt.Sprintf("%d@%d.%d", i, i, i),
+		)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, nil
+}
+
+func checkTgb(got, expected []int) error {
+	if expected == nil {
+		expected = []int{}
+	}
+
+	if got == nil {
+		got = []int{}
+	}
+
+	sort.Ints(expected)
+	sort.Ints(got)
+
+	if !reflect.DeepEqual(got, expected) {
+		return errors.Errorf("taggables mismatch: expected %v, got %v", expected, got)
+	}
+
+	return nil
+}
+
+// expectTaggings checks that the taggings of the given taggable, fetched in
+// the given mode, match the expected ones (the order doesn't matter).
+func expectTaggings(
+	tx *sql.Tx, si storage.Storage, taggableID int, tm storage.TaggingMode,
+	expected []int,
+) error {
+	got, err := si.GetTaggings(tx, taggableID, tm)
+	if err != nil {
+		return errors.Annotatef(err, "getting taggings of %d", taggableID)
+	}
+
+	if err := checkTgb(got, expected); err != nil {
+		return errors.Annotatef(err, "taggings of %d (mode %d)", taggableID, tm)
+	}
+
+	return nil
+}
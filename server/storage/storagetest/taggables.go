@@ -0,0 +1,959 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+func testTaggables(t *testing.T, si storage.Storage) error {
+	var u1ID, u2ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+	if u2ID, _, err = testutils.CreateTestUser(si, "test2", "2@2.2"); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		u1TagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		_, err = MakeTagsHierarchy(tx, si, u2ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user2")
+		}
+
+		bkm1ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url1",
+			Title:   "title1",
+			Comment: "comment1",
+		})
+		if err != nil {
+			return errors.Annotatef(err, "creating bookmark")
+		}
+
+		bkm2ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url2",
+			Title:   "title2",
+			Comment: "comment2",
+		})
+		if err != nil {
+			return errors.Annotatef(err, "creating bookmark")
+		}
+
+		// tag bkm1 with tag1/tag3
+		err = si.SetTaggings(
+			tx, bkm1ID, []int{u1TagIDs.Tag3ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// tag bkm2 with tag1
+		err = si.SetTaggings(
+			tx, bkm2ID, []int{u1TagIDs.Tag1ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Tagged with tag3: should return bkm1
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag3ID}, nil, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{bkm1ID}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		// Tagged bookmarks with tag3: should return bkm1
+		{
+			page, err := si.GetTaggedBookmarks(
+				tx, []int{u1TagIDs.Tag3ID}, nil, nil, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			bkms := page.Bookmarks
+			if len(bkms) != 1 {
+				return errors.Errorf("should get 1 bookmark")
+			}
+
+			if bkms[0].URL != "url1" {
+				return errors.Errorf("URL: expected url1, got %q", bkms[0].URL)
+			}
+
+			if bkms[0].Title != "title1" {
+				return errors.Errorf("Title: expected title1, got %q", bkms[0].Title)
+			}
+
+			if bkms[0].Comment != "comment1" {
+				return errors.Errorf("Comment: expected comment1, got %q", bkms[0].Comment)
+			}
+		}
+
+		// Tagged with tag1: should return bkm1, bkm2
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag1ID}, nil, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{bkm1ID, bkm2ID}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		// Tagged with tag1, tag3: should return bkm1
+		// (also we specify taggable type: bookmark; which shouldn't make any difference)
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag1ID, u1TagIDs.Tag3ID}, nil, []storage.TaggableType{storage.TaggableTypeBookmark},
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{bkm1ID}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		// Tagged with tag1, tag3, tag8: should return nothing
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag1ID, u1TagIDs.Tag3ID, u1TagIDs.Tag8ID}, nil, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		// tag bkm1 with tag1/tag3, tag7/tag8 (i.e. add tag7/tag8)
+		err = si.SetTaggings(
+			tx, bkm1ID, []int{u1TagIDs.Tag3ID, u1TagIDs.Tag8ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Tagged with tag1, tag3: should return bkm1
+		// (also we specify user id, which should not make any difference)
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag1ID, u1TagIDs.Tag3ID}, &u1ID, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{bkm1ID}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		// Tagged with tag1, tag3, tag8: should return bkm1
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag1ID, u1TagIDs.Tag3ID, u1TagIDs.Tag8ID}, nil, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{bkm1ID}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		// tag bkm1 with tag1, tag7/tag8 (i.e. remove tag3)
+		err = si.SetTaggings(
+			tx, bkm1ID, []int{u1TagIDs.Tag1ID, u1TagIDs.Tag8ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Tagged with tag1, tag3, tag8: should return nothing
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag1ID, u1TagIDs.Tag3ID, u1TagIDs.Tag8ID}, nil, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		// Tagged with tag1, tag8: should return bkm1
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(
+				tx, []int{u1TagIDs.Tag1ID, u1TagIDs.Tag8ID}, nil, nil,
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{bkm1ID}); err != nil {
+				t.Errorf("%s", errors.Trace(err))
+			}
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testTaggingModes(t *testing.T, si storage.Storage) error {
+	var u1ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url1",
+		})
+		if err != nil {
+			return errors.Annotatef(err, "creating bookmark")
+		}
+
+		cases := []struct {
+			// Taggings to set, and the mode
+			set   []int
+			setTM storage.TaggingMode
+
+			// Expected taggings in both modes
+			leafs []int
+			all   []int
+		}{
+			// Leafs: all the intermediary tags should be added
+			{
+				set:   []int{tagIDs.Tag4ID, tagIDs.Tag8ID},
+				setTM: storage.TaggingModeLeafs,
+				leafs: []int{tagIDs.Tag4ID, tagIDs.Tag8ID},
+				all: []int{
+					tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag3ID, tagIDs.Tag4ID,
+					tagIDs.Tag7ID, tagIDs.Tag8ID,
+				},
+			},
+			// Leafs: a tag which is an ancestor of another given tag is not a leaf
+			{
+				set:   []int{tagIDs.Tag3ID, tagIDs.Tag6ID},
+				setTM: storage.TaggingModeLeafs,
+				leafs: []int{tagIDs.Tag6ID},
+				all: []int{
+					tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag3ID, tagIDs.Tag5ID,
+					tagIDs.Tag6ID,
+				},
+			},
+			// All: the given tags are set as they are
+			{
+				set:   []int{tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag2ID},
+				setTM: storage.TaggingModeAll,
+				leafs: []int{tagIDs.Tag1ID, tagIDs.Tag2ID},
+				all:   []int{tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag2ID},
+			},
+			// Untag in both modes
+			{
+				set:   []int{},
+				setTM: storage.TaggingModeLeafs,
+				leafs: []int{},
+				all:   []int{},
+			},
+			{
+				set:   []int{tagIDs.RootTagID, tagIDs.Tag2ID},
+				setTM: storage.TaggingModeAll,
+				leafs: []int{tagIDs.Tag2ID},
+				all:   []int{tagIDs.RootTagID, tagIDs.Tag2ID},
+			},
+			{
+				set:   []int{},
+				setTM: storage.TaggingModeAll,
+				leafs: []int{},
+				all:   []int{},
+			},
+		}
+
+		for i, c := range cases {
+			if err := si.SetTaggings(tx, bkmID, c.set, c.setTM); err != nil {
+				return errors.Annotatef(err, "case %d", i)
+			}
+
+			err := expectTaggings(tx, si, bkmID, storage.TaggingModeLeafs, c.leafs)
+			if err != nil {
+				return errors.Annotatef(err, "case %d", i)
+			}
+
+			err = expectTaggings(tx, si, bkmID, storage.TaggingModeAll, c.all)
+			if err != nil {
+				return errors.Annotatef(err, "case %d", i)
+			}
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testUntagged(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID := userIDs[0], userIDs[1]
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		var bkmIDs []int
+		for i, ownerID := range []int{u1ID, u1ID, u2ID} {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: ownerID,
+				URL:     fmt.Sprintf("url%d", i+1),
+			})
+			if err != nil {
+				return errors.Annotatef(err, "creating bookmark")
+			}
+			bkmIDs = append(bkmIDs, bkmID)
+		}
+
+		// tag bkm1 with tag2, others remain untagged
+		err = si.SetTaggings(
+			tx, bkmIDs[0], []int{tagIDs.Tag2ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		check := func(ownerID *int, ttypes []storage.TaggableType, expected []int) error {
+			taggableIDs, err := si.GetTaggedTaggableIDs(tx, nil, ownerID, ttypes)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return errors.Trace(checkTgb(taggableIDs, expected))
+		}
+
+		// Untagged of any user: bkm2, bkm3
+		if err := check(nil, nil, []int{bkmIDs[1], bkmIDs[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Untagged of the user1: bkm2
+		if err := check(&u1ID, nil, []int{bkmIDs[1]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Untagged bookmarks of the user2: bkm3
+		bkmType := []storage.TaggableType{storage.TaggableTypeBookmark}
+		if err := check(&u2ID, bkmType, []int{bkmIDs[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// An empty (but non-nil) tags slice means the same
+		{
+			taggableIDs, err := si.GetTaggedTaggableIDs(tx, []int{}, &u1ID, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkTgb(taggableIDs, []int{bkmIDs[1]}); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Untagged bookmarks, with the data
+		{
+			page, err := si.GetTaggedBookmarks(tx, nil, &u1ID, nil, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			bkms := page.Bookmarks
+			if len(bkms) != 1 || bkms[0].ID != bkmIDs[1] || bkms[0].URL != "url2" {
+				return errors.Errorf("expected untagged bookmark url2, got %v", bkms)
+			}
+			if len(bkms[0].Tags) != 0 {
+				return errors.Errorf("untagged bookmark should have no tags, got %v", bkms[0].Tags)
+			}
+		}
+
+		// After untagging bkm1 and tagging bkm2, the set should change accordingly
+		if err := si.SetTaggings(tx, bkmIDs[0], []int{}, storage.TaggingModeLeafs); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(
+			tx, bkmIDs[1], []int{tagIDs.Tag8ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := check(&u1ID, nil, []int{bkmIDs[0]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testBookmarkURLUniqueness(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID := userIDs[0], userIDs[1]
+
+	createBookmark := func(ownerID int, url string) (bkmID int, err error) {
+		err = si.Tx(func(tx *sql.Tx) error {
+			var err error
+			bkmID, err = si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: ownerID,
+				URL:     url,
+				Title:   "title",
+			})
+			return errors.Trace(err)
+		})
+		return bkmID, errors.Trace(err)
+	}
+
+	updateBookmark := func(bkmID, ownerID int, url, title string) error {
+		return si.Tx(func(tx *sql.Tx) error {
+			return si.UpdateBookmark(tx, &storage.BookmarkData{
+				ID:      bkmID,
+				OwnerID: ownerID,
+				URL:     url,
+				Title:   title,
+			})
+		})
+	}
+
+	bkm1ID, err := createBookmark(u1ID, "url1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := createBookmark(u1ID, "url1"); err == nil {
+		return errors.Errorf("should not be able to create two bookmarks with the same url")
+	}
+
+	// Another user is free to have a bookmark with the same url
+	if _, err := createBookmark(u2ID, "url1"); err != nil {
+		return errors.Annotatef(err, "creating bookmark with the same url for another user")
+	}
+
+	// Empty urls don't count
+	for i := 0; i < 2; i++ {
+		if _, err := createBookmark(u1ID, ""); err != nil {
+			return errors.Annotatef(err, "creating bookmark with an empty url")
+		}
+	}
+
+	bkm2ID, err := createBookmark(u1ID, "url2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := updateBookmark(bkm2ID, u1ID, "url1", "title2"); err == nil {
+		return errors.Errorf("should not be able to change bookmark url to an existing one")
+	}
+
+	// Keeping the own url is fine
+	if err := updateBookmark(bkm2ID, u1ID, "url2", "title2"); err != nil {
+		return errors.Annotatef(err, "updating bookmark keeping its url")
+	}
+
+	// And so is changing it to the one which is not used anymore
+	if err := updateBookmark(bkm1ID, u1ID, "url3", "title1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := updateBookmark(bkm2ID, u1ID, "url1", "title2"); err != nil {
+		return errors.Annotatef(err, "changing bookmark url to the one not used anymore")
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		for url, expectedID := range map[string]int{"url1": bkm2ID, "url3": bkm1ID} {
+			bkms, err := si.GetBookmarksByURL(tx, url, u1ID, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(bkms) != 1 || bkms[0].ID != expectedID {
+				return errors.Errorf(
+					"expected one bookmark %d with the url %q, got %v", expectedID, url, bkms,
+				)
+			}
+		}
+
+		bkm, err := si.GetBookmarkByID(tx, bkm2ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if bkm.Title != "title2" {
+			return errors.Errorf("Title: expected title2, got %q", bkm.Title)
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testCanonicalURLs(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID := userIDs[0], userIDs[1]
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		bkm1ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:      u1ID,
+			URL:          "http://x.com/a",
+			CanonicalURL: "x.com/a",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Uniqueness is checked by the canonical url
+		_, err = si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:      u1ID,
+			URL:          "https://x.com/a/",
+			CanonicalURL: "x.com/a",
+		})
+		if err == nil {
+			return errors.Errorf("should not be able to create two bookmarks with the same canonical url")
+		}
+
+		// Without a canonical url, the url is used as is
+		bkm2ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "https://x.com/a/",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm3ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:      u2ID,
+			URL:          "http://x.com/a",
+			CanonicalURL: "x.com/a",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkms, err := si.GetBookmarksByURL(tx, "x.com/a", u1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkms) != 1 || bkms[0].ID != bkm1ID || bkms[0].URL != "http://x.com/a" {
+			return errors.Errorf("expected bookmark %d by the canonical url, got %v", bkm1ID, bkms)
+		}
+
+		bkm, err := si.GetBookmarkByID(tx, bkm2ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if bkm.CanonicalURL != "https://x.com/a/" {
+			return errors.Errorf("wrong canonical url: %q", bkm.CanonicalURL)
+		}
+
+		urls, err := si.GetAllBookmarkURLs(tx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		expectedURLs := []storage.BookmarkURLData{
+			{ID: bkm1ID, URL: "http://x.com/a", CanonicalURL: "x.com/a"},
+			{ID: bkm2ID, URL: "https://x.com/a/", CanonicalURL: "https://x.com/a/"},
+			{ID: bkm3ID, URL: "http://x.com/a", CanonicalURL: "x.com/a"},
+		}
+		if !reflect.DeepEqual(urls, expectedURLs) {
+			return errors.Errorf("bookmark urls: expected %v, got %v", expectedURLs, urls)
+		}
+
+		duplicates, err := si.GetDuplicateBookmarks(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(duplicates) != 0 {
+			return errors.Errorf("expected no duplicates, got %v", duplicates)
+		}
+
+		// Canonicalization rules have changed, and bookmark 2 becomes a duplicate
+		// of bookmark 1
+		if err := si.SetBookmarkCanonicalURL(tx, bkm2ID, "x.com/a"); err != nil {
+			return errors.Trace(err)
+		}
+
+		duplicates, err = si.GetDuplicateBookmarks(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		expectedDuplicates := []storage.DuplicateBookmarks{
+			{CanonicalURL: "x.com/a", BookmarkIDs: []int{bkm1ID, bkm2ID}},
+		}
+		if !reflect.DeepEqual(duplicates, expectedDuplicates) {
+			return errors.Errorf("duplicates: expected %v, got %v", expectedDuplicates, duplicates)
+		}
+
+		// Duplicates can still be edited, as long as the url is not changed
+		err = si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:           bkm2ID,
+			OwnerID:      u1ID,
+			URL:          "https://x.com/a/",
+			CanonicalURL: "x.com/a",
+			Title:        "title2",
+		})
+		if err != nil {
+			return errors.Annotatef(err, "updating a duplicate bookmark")
+		}
+
+		// Trashed bookmarks are not duplicates
+		if err := si.TrashTaggable(tx, bkm1ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		duplicates, err = si.GetDuplicateBookmarks(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(duplicates) != 0 {
+			return errors.Errorf("expected no duplicates, got %v", duplicates)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func testBookmarksPagination(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID := userIDs[0]
+
+	return si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy")
+		}
+
+		// Bookmarks tagged with tag1, plus an untagged one which should never be
+		// returned
+		bkmIDs := []int{}
+		for i, title := range []string{"b", "a", "C", "a", "untagged"} {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: u1ID,
+				URL:     fmt.Sprintf("url%d", 4-i),
+				Title:   title,
+			})
+			if err != nil {
+				return errors.Annotatef(err, "creating bookmark")
+			}
+			bkmIDs = append(bkmIDs, bkmID)
+
+			if title != "untagged" {
+				err = si.SetTaggings(
+					tx, bkmID, []int{tagIDs.Tag1ID}, storage.TaggingModeLeafs,
+				)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
+		getPage := func(opts *storage.BookmarksPageOpts) (*storage.BookmarksPage, []int, error) {
+			page, err := si.GetTaggedBookmarks(
+				tx, []int{tagIDs.Tag1ID}, &u1ID, nil, opts,
+			)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+
+			ids := []int{}
+			for _, bkm := range page.Bookmarks {
+				ids = append(ids, bkm.ID)
+			}
+
+			return page, ids, nil
+		}
+
+		for _, tc := range []struct {
+			sortField   storage.BookmarksSortField
+			sortDesc    bool
+			expectedIDs []int
+		}{
+			{"", false, []int{bkmIDs[0], bkmIDs[1], bkmIDs[2], bkmIDs[3]}},
+			{storage.BookmarksSortFieldCreated, true, []int{bkmIDs[3], bkmIDs[2], bkmIDs[1], bkmIDs[0]}},
+			// Titles are compared byte-wise, and equal ones are ordered by ids
+			{storage.BookmarksSortFieldTitle, false, []int{bkmIDs[2], bkmIDs[1], bkmIDs[3], bkmIDs[0]}},
+			{storage.BookmarksSortFieldTitle, true, []int{bkmIDs[0], bkmIDs[3], bkmIDs[1], bkmIDs[2]}},
+			{storage.BookmarksSortFieldURL, false, []int{bkmIDs[3], bkmIDs[2], bkmIDs[1], bkmIDs[0]}},
+			// Bookmarks were last updated in the order of creation (some of them
+			// might be updated in the same second, and then ids are compared)
+			{storage.BookmarksSortFieldUpdated, false, []int{bkmIDs[0], bkmIDs[1], bkmIDs[2], bkmIDs[3]}},
+		} {
+			// All at once
+			page, ids, err := getPage(&storage.BookmarksPageOpts{
+				SortField: tc.sortField,
+				SortDesc:  tc.sortDesc,
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if !reflect.DeepEqual(ids, tc.expectedIDs) {
+				return errors.Errorf(
+					"sort by %q (desc: %v): expected %v, got %v",
+					tc.sortField, tc.sortDesc, tc.expectedIDs, ids,
+				)
+			}
+
+			if page.TotalCnt != 4 || page.NextCursor != nil {
+				return errors.Errorf(
+					"expected 4 bookmarks in total and no cursor, got %d and %v",
+					page.TotalCnt, page.NextCursor,
+				)
+			}
+
+			// And by pages of 3 bookmarks
+			allIDs := []int{}
+			opts := &storage.BookmarksPageOpts{
+				SortField: tc.sortField,
+				SortDesc:  tc.sortDesc,
+				Limit:     3,
+			}
+			for pageNum := 0; ; pageNum++ {
+				if pageNum > 2 {
+					return errors.Errorf("too many pages")
+				}
+
+				page, ids, err := getPage(opts)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				if page.TotalCnt != 4 {
+					return errors.Errorf("expected 4 bookmarks in total, got %d", page.TotalCnt)
+				}
+
+				allIDs = append(allIDs, ids...)
+
+				if page.NextCursor == nil {
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+
+			if !reflect.DeepEqual(allIDs, tc.expectedIDs) {
+				return errors.Errorf(
+					"sort by %q (desc: %v), paged: expected %v, got %v",
+					tc.sortField, tc.sortDesc, tc.expectedIDs, allIDs,
+				)
+			}
+		}
+
+		// The cursor can only be used with the same sort order
+		page, _, err := getPage(&storage.BookmarksPageOpts{
+			SortField: storage.BookmarksSortFieldTitle,
+			Limit:     1,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, _, err = getPage(&storage.BookmarksPageOpts{
+			SortField: storage.BookmarksSortFieldTitle,
+			SortDesc:  true,
+			Cursor:    page.NextCursor,
+		})
+		if err == nil {
+			return errors.Errorf("using a cursor with a different sort order should fail")
+		}
+
+		_, _, err = getPage(&storage.BookmarksPageOpts{SortField: "foo"})
+		if err == nil {
+			return errors.Errorf("sorting by an invalid field should fail")
+		}
+
+		return nil
+	})
+}
+
+func testBookmarksByTagQuery(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID := userIDs[0], userIDs[1]
+
+	return si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		u2TagIDs, err := MakeTagsHierarchy(tx, si, u2ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user2")
+		}
+
+		createBookmark := func(ownerID int, url string, tagIDs []int) (int, error) {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: ownerID,
+				URL:     url,
+			})
+			if err != nil {
+				return 0, errors.Annotatef(err, "creating bookmark")
+			}
+
+			err = si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+
+			return bkmID, nil
+		}
+
+		bkmIDs := []int{}
+		for i, tags := range [][]int{
+			{tagIDs.Tag4ID},
+			{tagIDs.Tag2ID},
+			{tagIDs.Tag6ID, tagIDs.Tag8ID},
+			{},
+			{tagIDs.Tag1ID},
+		} {
+			bkmID, err := createBookmark(u1ID, fmt.Sprintf("url%d", i), tags)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			bkmIDs = append(bkmIDs, bkmID)
+		}
+		bkmA, bkmB, bkmC, bkmD, bkmE := bkmIDs[0], bkmIDs[1], bkmIDs[2], bkmIDs[3], bkmIDs[4]
+
+		// Bookmarks of other users should never be returned
+		if _, err := createBookmark(u2ID, "url", []int{u2TagIDs.Tag1ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		tag := func(tagID int) storage.TagQuery {
+			return storage.TagQuery{Op: storage.TagQueryOpTag, TagID: tagID}
+		}
+		and := func(operands ...storage.TagQuery) storage.TagQuery {
+			return storage.TagQuery{Op: storage.TagQueryOpAnd, Operands: operands}
+		}
+		or := func(operands ...storage.TagQuery) storage.TagQuery {
+			return storage.TagQuery{Op: storage.TagQueryOpOr, Operands: operands}
+		}
+		not := func(operand storage.TagQuery) storage.TagQuery {
+			return storage.TagQuery{Op: storage.TagQueryOpNot, Operands: []storage.TagQuery{operand}}
+		}
+
+		for _, tc := range []struct {
+			query       storage.TagQuery
+			expectedIDs []int
+		}{
+			// Tagging with a tag implies tagging with its ancestors
+			{tag(tagIDs.Tag1ID), []int{bkmA, bkmC, bkmE}},
+			{and(tag(tagIDs.Tag1ID), not(tag(tagIDs.Tag3ID))), []int{bkmE}},
+			{
+				and(tag(tagIDs.Tag3ID), or(tag(tagIDs.Tag4ID), tag(tagIDs.Tag8ID))),
+				[]int{bkmA, bkmC},
+			},
+			{not(tag(tagIDs.Tag1ID)), []int{bkmB, bkmD}},
+			{or(tag(tagIDs.Tag2ID), tag(tagIDs.Tag8ID)), []int{bkmB, bkmC}},
+			{not(or(tag(tagIDs.Tag1ID), tag(tagIDs.Tag2ID))), []int{bkmD}},
+			{not(not(tag(tagIDs.Tag2ID))), []int{bkmB}},
+			// Tags of other users just don't match anything
+			{tag(u2TagIDs.Tag1ID), []int{}},
+		} {
+			query := tc.query
+			page, err := si.GetBookmarksByTagQuery(tx, &query, u1ID, nil, nil)
+			if err != nil {
+				return errors.Annotatef(err, "query %s", query.String())
+			}
+
+			ids := []int{}
+			for _, bkm := range page.Bookmarks {
+				ids = append(ids, bkm.ID)
+			}
+
+			if !reflect.DeepEqual(ids, tc.expectedIDs) {
+				return errors.Errorf(
+					"query %s: expected %v, got %v", query.String(), tc.expectedIDs, ids,
+				)
+			}
+
+			if page.TotalCnt != len(tc.expectedIDs) {
+				return errors.Errorf(
+					"query %s: expected total count %d, got %d",
+					query.String(), len(tc.expectedIDs), page.TotalCnt,
+				)
+			}
+		}
+
+		// Paging works as well
+		query := tag(tagIDs.Tag1ID)
+		page, err := si.GetBookmarksByTagQuery(
+			tx, &query, u1ID, nil, &storage.BookmarksPageOpts{Limit: 2},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(page.Bookmarks) != 2 || page.TotalCnt != 3 || page.NextCursor == nil {
+			return errors.Errorf(
+				"expected 2 bookmarks of 3 and a cursor, got %d of %d and %v",
+				len(page.Bookmarks), page.TotalCnt, page.NextCursor,
+			)
+		}
+
+		// Invalid queries are rejected
+		query = storage.TagQuery{
+			Op: storage.TagQueryOpAnd, Operands: []storage.TagQuery{tag(tagIDs.Tag1ID)},
+		}
+		if _, err := si.GetBookmarksByTagQuery(tx, &query, u1ID, nil, nil); err == nil {
+			return errors.Errorf("expected an error for an invalid query")
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,1279 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+// TagIDs contains ids of the tags created by MakeTagsHierarchy.
+type TagIDs struct {
+	RootTagID, Tag1ID, Tag2ID, Tag3ID, Tag4ID, Tag5ID, Tag6ID, Tag7ID, Tag8ID int
+}
+
+// MakeTagsHierarchy creates the following tag hierarchy for the given user:
+// /
+// ├── tag1
+// │   └── tag3
+// │       ├── tag4
+// │       └── tag5
+// │           └── tag6
+// ├── tag2
+// └── tag7
+//
+//	   └── tag8
+func MakeTagsHierarchy(
+	tx *sql.Tx, si storage.Storage, ownerID int,
+) (ids *TagIDs, err error) {
+	rootTagID, err := si.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return nil, errors.Annotatef(err, "getting root tag for user %d", ownerID)
+	}
+
+	u1Tag1ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(rootTagID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag1", "tag1_alias"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag1 for user %d", ownerID)
+	}
+
+	u1Tag2ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(rootTagID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag2", "tag2_alias"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag2 for user %d", ownerID)
+	}
+
+	u1Tag3ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(u1Tag1ID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag3", "tag3_alias"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag3 for user %d", ownerID)
+	}
+
+	u1Tag4ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(u1Tag3ID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag4_alias", "tag4"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag4 for user %d", ownerID)
+	}
+
+	u1Tag5ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(u1Tag3ID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag5", "tag5_alias"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag5 for user %d", ownerID)
+	}
+
+	u1Tag6ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(u1Tag5ID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag6", "tag6_alias"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag6 for user %d", ownerID)
+	}
+
+	u1Tag7ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(rootTagID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag7", "tag7_alias"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag7 for user %d", ownerID)
+	}
+
+	u1Tag8ID, err := si.CreateTag(tx, &storage.TagData{
+		OwnerID:     ownerID,
+		ParentTagID: cptr.Int(u1Tag7ID),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag8", "tag8_alias"},
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating tag8 for user %d", ownerID)
+	}
+
+	return &TagIDs{
+		RootTagID: rootTagID,
+		Tag1ID:    u1Tag1ID,
+		Tag2ID:    u1Tag2ID,
+		Tag3ID:    u1Tag3ID,
+		Tag4ID:    u1Tag4ID,
+		Tag5ID:    u1Tag5ID,
+		Tag6ID:    u1Tag6ID,
+		Tag7ID:    u1Tag7ID,
+		Tag8ID:    u1Tag8ID,
+	}, nil
+}
+
+// Data created by MakeTagsHierarchy for the first user
+var tagsDataCreated = []storage.TagData{
+	{
+		ID:          2,
+		OwnerID:     1,
+		ParentTagID: cptr.Int(1),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag1", "tag1_alias"},
+		Subtags: []storage.TagData{
+			{
+				ID:          4,
+				OwnerID:     1,
+				ParentTagID: cptr.Int(2),
+				Description: cptr.String("test tag"),
+				Names:       []string{"tag3", "tag3_alias"},
+				Subtags: []storage.TagData{
+					{
+						ID:          5,
+						OwnerID:     1,
+						ParentTagID: cptr.Int(4),
+						Description: cptr.String("test tag"),
+						Names:       []string{"tag4_alias", "tag4"},
+					},
+					{
+						ID:          6,
+						OwnerID:     1,
+						ParentTagID: cptr.Int(4),
+						Description: cptr.String("test tag"),
+						Names:       []string{"tag5", "tag5_alias"},
+						Subtags: []storage.TagData{
+							{
+								ID:          7,
+								OwnerID:     1,
+								ParentTagID: cptr.Int(6),
+								Description: cptr.String("test tag"),
+								Names:       []string{"tag6", "tag6_alias"},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		ID:          3,
+		OwnerID:     1,
+		ParentTagID: cptr.Int(1),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag2", "tag2_alias"},
+	},
+	{
+		ID:          8,
+		OwnerID:     1,
+		ParentTagID: cptr.Int(1),
+		Description: cptr.String("test tag"),
+		Names:       []string{"tag7", "tag7_alias"},
+		Subtags: []storage.TagData{
+			{
+				ID:          9,
+				OwnerID:     1,
+				ParentTagID: cptr.Int(8),
+				Description: cptr.String("test tag"),
+				Names:       []string{"tag8", "tag8_alias"},
+			},
+		},
+	},
+}
+
+func expectPath(tx *sql.Tx, si storage.Storage, userID int, path string, expectedID int) error {
+	tagID, err := si.GetTagIDByPath(tx, userID, path)
+	if err != nil {
+		return errors.Annotatef(err, "getting tag id by path %q for user %d", path, userID)
+	}
+	if tagID != expectedID {
+		return errors.Errorf(
+			"GetTagIDByPath(%d, %q) should return %d, but got %d",
+			userID, path, expectedID, tagID,
+		)
+	}
+	return nil
+}
+
+func expectPathNotFound(tx *sql.Tx, si storage.Storage, userID int, path string) error {
+	tagID, err := si.GetTagIDByPath(tx, userID, path)
+	if errors.Cause(err) != storage.ErrTagDoesNotExist {
+		return errors.Errorf(
+			"cause of the error returned by GetTagIDByPath(%d, %q) should be ErrTagDoesNotExist (%q), but got %q, and returned id %d",
+			userID, path, storage.ErrTagDoesNotExist, errors.Cause(err), tagID,
+		)
+	}
+	return nil
+}
+
+func testGetTagIDByPath(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID := userIDs[0], userIDs[1]
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		u1TagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		u2TagIDs, err := MakeTagsHierarchy(tx, si, u2ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user2")
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag1/tag3/tag5/tag6", u1TagIDs.Tag6ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "tag1/tag3/tag5/tag6", u1TagIDs.Tag6ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "tag1/tag3_alias/tag5/tag6_alias", u1TagIDs.Tag6ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag1/tag3/tag5", u1TagIDs.Tag5ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag1/tag3/", u1TagIDs.Tag3ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "tag1", u1TagIDs.Tag1ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "", u1TagIDs.RootTagID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/", u1TagIDs.RootTagID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPathNotFound(tx, si, u1ID, "/tag2/tag3"); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u2ID, "/tag1/tag3/tag5/tag6", u2TagIDs.Tag6ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testGetTag(t *testing.T, si storage.Storage) error {
+	var u1ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		tagsData, err := si.GetTags(tx, tagIDs.RootTagID, &storage.GetTagOpts{
+			GetNames:   true,
+			GetSubtags: true,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if !reflect.DeepEqual(tagsData, tagsDataCreated) {
+			t.Logf("%v", tagsData)
+			t.Logf("%v", tagsDataCreated)
+			return errors.Errorf("not equal")
+		}
+
+		td, err := si.GetTag(tx, tagIDs.Tag4ID, &storage.GetTagOpts{GetNames: true})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if !reflect.DeepEqual(td.Names, []string{"tag4_alias", "tag4"}) {
+			return errors.Errorf("wrong names of tag4: %v", td.Names)
+		}
+
+		if *td.ParentTagID != tagIDs.Tag3ID {
+			return errors.Errorf(
+				"wrong parent of tag4: expected %d, got %d", tagIDs.Tag3ID, *td.ParentTagID,
+			)
+		}
+
+		_, err = si.GetTag(tx, tagIDs.Tag8ID+100, &storage.GetTagOpts{})
+		if errors.Cause(err) != storage.ErrTagDoesNotExist {
+			return errors.Errorf(
+				"getting nonexistent tag should result in ErrTagDoesNotExist, but got %v", err,
+			)
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testInvalidTagNames(t *testing.T, si storage.Storage) error {
+	var u1ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	var rootTagID int
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		rootTagID, err = si.GetRootTagID(tx, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	invalidNames := []struct {
+		name, descr string
+	}{
+		{"123", "the name 123"},
+		{"foo bar", "a space in the name"},
+		{"foo\tbar", "a tab in the name"},
+		{"foo,bar", "a comma in the name"},
+		{"foo/bar", "a slash in the name"},
+		{string([]byte{'a', 0x01, 'b', 'c'}), "non-printable chars in the name"},
+	}
+
+	for _, n := range invalidNames {
+		err = si.Tx(func(tx *sql.Tx) error {
+			_, err = si.CreateTag(tx, &storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(rootTagID),
+				Description: cptr.String("test tag"),
+				Names:       []string{n.name},
+			})
+			return errors.Trace(err)
+		})
+		if err == nil || errors.Cause(err) != storage.ErrTagNameInvalid {
+			return errors.Errorf("should not be able to create tag with %s", n.descr)
+		}
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		_, err = si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: cptr.Int(rootTagID),
+			Names:       []string{"foo"},
+		})
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Annotatef(err, "should be able to create a tag without a description")
+	}
+
+	return nil
+}
+
+func testCreateTag(t *testing.T, si storage.Storage) error {
+	var u1ID int
+	var err error
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return errors.Trace(err)
+	}
+
+	var tagIDs *TagIDs
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		tagIDs, err = MakeTagsHierarchy(tx, si, u1ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Annotatef(err, "creating test tags hierarchy for user1")
+	}
+
+	// Each of the cases below should fail, and leave the storage intact
+	badTags := []struct {
+		td    storage.TagData
+		descr string
+	}{
+		{
+			td: storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(tagIDs.RootTagID),
+				Names:       []string{"tag1"},
+			},
+			descr: "a duplicate name",
+		},
+		{
+			td: storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(tagIDs.RootTagID),
+				Names:       []string{"foo", "tag2_alias"},
+			},
+			descr: "a duplicate alias",
+		},
+		{
+			td: storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(tagIDs.RootTagID),
+				Names:       []string{},
+			},
+			descr: "no names",
+		},
+		{
+			td: storage.TagData{
+				OwnerID: u1ID,
+				Names:   []string{""},
+			},
+			descr: "no parent (i.e. a second root tag)",
+		},
+		{
+			td: storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(tagIDs.Tag8ID + 100),
+				Names:       []string{"foo"},
+			},
+			descr: "a nonexistent parent",
+		},
+	}
+
+	for _, bt := range badTags {
+		err = si.Tx(func(tx *sql.Tx) error {
+			_, err := si.CreateTag(tx, &bt.td)
+			return errors.Trace(err)
+		})
+		if err == nil {
+			return errors.Errorf("should not be able to create a tag with %s", bt.descr)
+		}
+	}
+
+	// The same name is fine under a different parent
+	err = si.Tx(func(tx *sql.Tx) error {
+		tagID, err := si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: cptr.Int(tagIDs.Tag2ID),
+			Names:       []string{"tag1"},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag2/tag1", tagID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func testMergeTags(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		if err := si.MergeTags(tx, tagIDs.Tag3ID, tagIDs.Tag7ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		rootTag, err := si.GetTag(tx, tagIDs.RootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u1ID := rootTag.OwnerID
+
+		// Subtags of tag3 are moved under tag7, and tag7 gets all the names of
+		// tag3
+		for path, tagID := range map[string]int{
+			"/tag7/tag5/tag6": tagIDs.Tag6ID,
+			"/tag7/tag4":      tagIDs.Tag4ID,
+			"/tag7/tag8":      tagIDs.Tag8ID,
+			"/tag3":           tagIDs.Tag7ID,
+			"/tag3_alias":     tagIDs.Tag7ID,
+		} {
+			if err := expectPath(tx, si, u1ID, path, tagID); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := expectPathNotFound(tx, si, u1ID, "/tag1/tag3"); err != nil {
+			return errors.Trace(err)
+		}
+
+		if _, err := si.GetTag(tx, tagIDs.Tag3ID, &storage.GetTagOpts{}); errors.Cause(err) != storage.ErrTagDoesNotExist {
+			return errors.Errorf("tag3 should not exist, but got err: %v", err)
+		}
+
+		tag7, err := si.GetTag(tx, tagIDs.Tag7ID, &storage.GetTagOpts{GetNames: true})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// The primary name of the target stays the same
+		if tag7.Names[0] != "tag7" || len(tag7.Names) != 4 {
+			return errors.Errorf("wrong names of tag7: %v", tag7.Names)
+		}
+
+		// Taggings with tag3 become taggings with tag7, and tag1 is not a leaf
+		// anymore, so it's gone
+		expected := []struct {
+			tgbID  int
+			tagIDs []int
+		}{
+			{bkm1ID, []int{tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag4ID}},
+			{bkm2ID, []int{
+				tagIDs.RootTagID, tagIDs.Tag2ID, tagIDs.Tag7ID, tagIDs.Tag5ID, tagIDs.Tag6ID,
+			}},
+			{bkm3ID, []int{tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID}},
+		}
+
+		for _, e := range expected {
+			if err := expectTaggings(tx, si, e.tgbID, storage.TaggingModeAll, e.tagIDs); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Invalid merges
+	for _, ids := range [][2]int{
+		{tagIDs.Tag1ID, tagIDs.Tag1ID},
+		{tagIDs.Tag7ID, tagIDs.Tag8ID},
+		{tagIDs.Tag7ID, tagIDs.Tag6ID},
+		{tagIDs.RootTagID, tagIDs.Tag2ID},
+	} {
+		err := si.Tx(func(tx *sql.Tx) error {
+			return si.MergeTags(tx, ids[0], ids[1])
+		})
+		if err == nil {
+			return errors.Errorf("should not be able to merge tag %d into %d", ids[0], ids[1])
+		}
+	}
+
+	return nil
+}
+
+func testMergeTagsRecursive(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, _, err := testutils.CreateTestUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		rootTag, err := si.GetTag(tx, tagIDs.RootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u1ID := rootTag.OwnerID
+
+		// Create /tag7/tag3/tag5_alias, which should get merged with
+		// /tag1/tag3/tag5
+		tag9ID, err := si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: cptr.Int(tagIDs.Tag7ID),
+			Names:       []string{"tag3"},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		tag10ID, err := si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: cptr.Int(tag9ID),
+			Names:       []string{"tag5_alias"},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm4ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url4",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(tx, bkm4ID, []int{tag10ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Tags of other users can't be merged
+		u2RootTagID, err := si.GetRootTagID(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := si.MergeTags(tx, tagIDs.Tag1ID, u2RootTagID); err == nil {
+			return errors.Errorf("should not be able to merge into a tag of another user")
+		}
+
+		if err := si.MergeTags(tx, tagIDs.Tag1ID, tagIDs.Tag7ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		for path, tagID := range map[string]int{
+			"/tag7/tag3/tag5/tag6":   tagIDs.Tag6ID,
+			"/tag7/tag3_alias/tag4":  tagIDs.Tag4ID,
+			"/tag1/tag3/tag5_alias":  tag10ID,
+			"/tag7/tag3/tag5_alias":  tag10ID,
+			"/tag7_alias/tag3":       tag9ID,
+			"/tag1_alias/tag3_alias": tag9ID,
+			"/tag7/tag8":             tagIDs.Tag8ID,
+		} {
+			if err := expectPath(tx, si, u1ID, path, tagID); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		for _, tagID := range []int{tagIDs.Tag1ID, tagIDs.Tag3ID, tagIDs.Tag5ID} {
+			_, err := si.GetTag(tx, tagID, &storage.GetTagOpts{})
+			if errors.Cause(err) != storage.ErrTagDoesNotExist {
+				return errors.Errorf("tag %d should not exist, but got err: %v", tagID, err)
+			}
+		}
+
+		expected := []struct {
+			tgbID  int
+			tagIDs []int
+		}{
+			{bkm1ID, []int{tagIDs.RootTagID, tagIDs.Tag7ID, tag9ID, tagIDs.Tag4ID}},
+			{bkm2ID, []int{
+				tagIDs.RootTagID, tagIDs.Tag2ID, tagIDs.Tag7ID, tag9ID, tag10ID, tagIDs.Tag6ID,
+			}},
+			{bkm3ID, []int{tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID}},
+			{bkm4ID, []int{tagIDs.RootTagID, tagIDs.Tag7ID, tag9ID, tag10ID}},
+		}
+
+		for _, e := range expected {
+			if err := expectTaggings(tx, si, e.tgbID, storage.TaggingModeAll, e.tagIDs); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testCopyTag(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, _, err := testutils.CreateTestUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		rootTag, err := si.GetTag(tx, tagIDs.RootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u1ID := rootTag.OwnerID
+
+		err = si.UpdateTag(tx, &storage.TagData{
+			ID:          tagIDs.Tag5ID,
+			Description: cptr.String("tag5 description"),
+		}, storage.TaggableLeafPolicyKeep)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Copy tag3 under tag7, without retagging
+		copyID, err := si.CopyTag(tx, tagIDs.Tag3ID, tagIDs.Tag7ID, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag7/tag3_alias", copyID); err != nil {
+			return errors.Trace(err)
+		}
+
+		// The original subtree is intact
+		for path, tagID := range map[string]int{
+			"/tag1/tag3":           tagIDs.Tag3ID,
+			"/tag1/tag3/tag4":      tagIDs.Tag4ID,
+			"/tag1/tag3/tag5/tag6": tagIDs.Tag6ID,
+		} {
+			if err := expectPath(tx, si, u1ID, path, tagID); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		copiedTag5ID, err := si.GetTagIDByPath(tx, u1ID, "/tag7/tag3/tag5")
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		copiedTag5, err := si.GetTag(tx, copiedTag5ID, &storage.GetTagOpts{
+			GetNames:   true,
+			GetSubtags: true,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if copiedTag5ID == tagIDs.Tag5ID {
+			return errors.Errorf("tag5 was not copied")
+		}
+
+		if *copiedTag5.Description != "tag5 description" {
+			return errors.Errorf("wrong description of the copy: %q", *copiedTag5.Description)
+		}
+
+		if !reflect.DeepEqual(copiedTag5.Names, []string{"tag5", "tag5_alias"}) {
+			return errors.Errorf("wrong names of the copy: %v", copiedTag5.Names)
+		}
+
+		if len(copiedTag5.Subtags) != 1 || copiedTag5.Subtags[0].Names[0] != "tag6" {
+			return errors.Errorf("wrong subtags of the copy: %v", copiedTag5.Subtags)
+		}
+
+		// Taggings are not changed
+		expected := []struct {
+			tgbID  int
+			tagIDs []int
+		}{
+			{bkm1ID, []int{tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag3ID, tagIDs.Tag4ID}},
+			{bkm2ID, []int{
+				tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag2ID, tagIDs.Tag3ID,
+				tagIDs.Tag5ID, tagIDs.Tag6ID,
+			}},
+			{bkm3ID, []int{tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID}},
+		}
+
+		for _, e := range expected {
+			if err := expectTaggings(tx, si, e.tgbID, storage.TaggingModeAll, e.tagIDs); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Copy tag3 under tag2 with another name, with retagging
+		copyID, err = si.CopyTag(tx, tagIDs.Tag3ID, tagIDs.Tag2ID, []string{"tag3_copy"}, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag2/tag3_copy", copyID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPathNotFound(tx, si, u1ID, "/tag2/tag3"); err != nil {
+			return errors.Trace(err)
+		}
+
+		copiedTag4ID, err := si.GetTagIDByPath(tx, u1ID, "/tag2/tag3_copy/tag4")
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		copiedTag6ID, err := si.GetTagIDByPath(tx, u1ID, "/tag2/tag3_copy/tag5/tag6")
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		expected = []struct {
+			tgbID  int
+			tagIDs []int
+		}{
+			{bkm1ID, []int{tagIDs.Tag4ID, copiedTag4ID}},
+			// tag2 is not a leaf anymore, since the copy of tag6 is under it
+			{bkm2ID, []int{tagIDs.Tag6ID, copiedTag6ID}},
+			{bkm3ID, []int{tagIDs.Tag8ID}},
+		}
+
+		for _, e := range expected {
+			if err := expectTaggings(tx, si, e.tgbID, storage.TaggingModeLeafs, e.tagIDs); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// A tag can be copied under its own descendant
+		copyID, err = si.CopyTag(tx, tagIDs.Tag7ID, tagIDs.Tag8ID, nil, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag7/tag8/tag7", copyID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPathNotFound(tx, si, u1ID, "/tag7/tag8/tag7/tag8/tag7"); err != nil {
+			return errors.Trace(err)
+		}
+
+		copiedTag8ID, err := si.GetTagIDByPath(tx, u1ID, "/tag7/tag8/tag7/tag8")
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectTaggings(
+			tx, si, bkm3ID, storage.TaggingModeLeafs, []int{copiedTag8ID},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Tags of other users can't be used as a parent
+		u2RootTagID, err := si.GetRootTagID(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if _, err := si.CopyTag(tx, tagIDs.Tag1ID, u2RootTagID, nil, false); err == nil {
+			return errors.Errorf("should not be able to copy a tag under a tag of another user")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Invalid copies
+	for _, args := range []struct {
+		srcTagID, parentTagID int
+		names                 []string
+	}{
+		// The root tag
+		{tagIDs.RootTagID, tagIDs.Tag2ID, nil},
+		// The name is taken by the source tag itself
+		{tagIDs.Tag3ID, tagIDs.Tag1ID, nil},
+		// The name is taken by another tag
+		{tagIDs.Tag3ID, tagIDs.RootTagID, []string{"tag2"}},
+	} {
+		err := si.Tx(func(tx *sql.Tx) error {
+			_, err := si.CopyTag(tx, args.srcTagID, args.parentTagID, args.names, false)
+			return err
+		})
+		if err == nil {
+			return errors.Errorf(
+				"should not be able to copy tag %d under %d with names %v",
+				args.srcTagID, args.parentTagID, args.names,
+			)
+		}
+	}
+
+	return nil
+}
+
+func expectTagDeleteResult(
+	result *storage.TagDeleteResult, retaggedIDs, untaggedIDs []int,
+) error {
+	if !reflect.DeepEqual(result.RetaggedIDs, retaggedIDs) {
+		return errors.Errorf(
+			"retagged taggables: expected %v, got %v", retaggedIDs, result.RetaggedIDs,
+		)
+	}
+
+	if !reflect.DeepEqual(result.UntaggedIDs, untaggedIDs) {
+		return errors.Errorf(
+			"untagged taggables: expected %v, got %v", untaggedIDs, result.UntaggedIDs,
+		)
+	}
+
+	return nil
+}
+
+// prepareMoveOrDeleteTest creates a user with the tags hierarchy (see
+// MakeTagsHierarchy) and three bookmarks, tagged as follows:
+// - bkm1: tag4
+// - bkm2: tag2, tag6
+// - bkm3: tag8
+func prepareMoveOrDeleteTest(
+	si storage.Storage,
+) (tagIDs *TagIDs, bkm1ID, bkm2ID, bkm3ID int, err error) {
+	var u1ID int
+	if u1ID, _, err = testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		return nil, 0, 0, 0, errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		tagIDs, err = MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		bkmTags := [][]int{
+			{tagIDs.Tag4ID},
+			{tagIDs.Tag2ID, tagIDs.Tag6ID},
+			{tagIDs.Tag8ID},
+		}
+		bkmIDs := []*int{&bkm1ID, &bkm2ID, &bkm3ID}
+
+		for i, tags := range bkmTags {
+			*bkmIDs[i], err = si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: u1ID,
+				URL:     fmt.Sprintf("url%d", i+1),
+			})
+			if err != nil {
+				return errors.Annotatef(err, "creating bookmark")
+			}
+
+			err = si.SetTaggings(tx, *bkmIDs[i], tags, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, 0, errors.Trace(err)
+	}
+
+	return tagIDs, bkm1ID, bkm2ID, bkm3ID, nil
+}
+
+// moveTag3UnderTag7 moves tag3 under tag7 with the given leaf policy, and
+// checks that the tag is indeed accessible by the new path.
+func moveTag3UnderTag7(
+	si storage.Storage, tagIDs *TagIDs, leafPolicy storage.TaggableLeafPolicy,
+) error {
+	err := si.Tx(func(tx *sql.Tx) error {
+		err := si.UpdateTag(tx, &storage.TagData{
+			ID:          tagIDs.Tag3ID,
+			ParentTagID: cptr.Int(tagIDs.Tag7ID),
+		}, leafPolicy)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		rootTag, err := si.GetTag(tx, tagIDs.RootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u1ID := rootTag.OwnerID
+
+		if err := expectPath(tx, si, u1ID, "/tag7/tag3/tag5/tag6", tagIDs.Tag6ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPathNotFound(tx, si, u1ID, "/tag1/tag3"); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testMoveTagKeepNewLeaf(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := moveTag3UnderTag7(si, tagIDs, storage.TaggableLeafPolicyKeep); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		// tag1 became a new leaf of bkm1 and bkm2, and should be kept
+		expected := []struct {
+			tgbID  int
+			tm     storage.TaggingMode
+			tagIDs []int
+		}{
+			{bkm1ID, storage.TaggingModeLeafs, []int{tagIDs.Tag1ID, tagIDs.Tag4ID}},
+			{bkm1ID, storage.TaggingModeAll, []int{
+				tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag7ID, tagIDs.Tag3ID, tagIDs.Tag4ID,
+			}},
+			{bkm2ID, storage.TaggingModeLeafs, []int{
+				tagIDs.Tag1ID, tagIDs.Tag2ID, tagIDs.Tag6ID,
+			}},
+			{bkm2ID, storage.TaggingModeAll, []int{
+				tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag2ID, tagIDs.Tag7ID,
+				tagIDs.Tag3ID, tagIDs.Tag5ID, tagIDs.Tag6ID,
+			}},
+			{bkm3ID, storage.TaggingModeAll, []int{
+				tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID,
+			}},
+		}
+
+		for _, e := range expected {
+			if err := expectTaggings(tx, si, e.tgbID, e.tm, e.tagIDs); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testMoveTagDelNewLeaf(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := moveTag3UnderTag7(si, tagIDs, storage.TaggableLeafPolicyDel); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		// tag1 became a new leaf of bkm1 and bkm2, and should be deleted
+		expected := []struct {
+			tgbID  int
+			tm     storage.TaggingMode
+			tagIDs []int
+		}{
+			{bkm1ID, storage.TaggingModeLeafs, []int{tagIDs.Tag4ID}},
+			{bkm1ID, storage.TaggingModeAll, []int{
+				tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag3ID, tagIDs.Tag4ID,
+			}},
+			{bkm2ID, storage.TaggingModeLeafs, []int{tagIDs.Tag2ID, tagIDs.Tag6ID}},
+			{bkm2ID, storage.TaggingModeAll, []int{
+				tagIDs.RootTagID, tagIDs.Tag2ID, tagIDs.Tag7ID,
+				tagIDs.Tag3ID, tagIDs.Tag5ID, tagIDs.Tag6ID,
+			}},
+			{bkm3ID, storage.TaggingModeAll, []int{
+				tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID,
+			}},
+		}
+
+		for _, e := range expected {
+			if err := expectTaggings(tx, si, e.tgbID, e.tm, e.tagIDs); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+func testMoveTagUnderDescendant(t *testing.T, si storage.Storage) error {
+	tagIDs, _, _, _, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, newParentID := range []int{tagIDs.Tag1ID, tagIDs.Tag3ID, tagIDs.Tag6ID} {
+		err = si.Tx(func(tx *sql.Tx) error {
+			return si.UpdateTag(tx, &storage.TagData{
+				ID:          tagIDs.Tag1ID,
+				ParentTagID: cptr.Int(newParentID),
+			}, storage.TaggableLeafPolicyKeep)
+		})
+		if err == nil {
+			return errors.Errorf(
+				"should not be able to move tag %d under %d", tagIDs.Tag1ID, newParentID,
+			)
+		}
+	}
+
+	return nil
+}
+
+func testDeleteTagKeepNewLeaf(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		result, err := si.DeleteTag(tx, tagIDs.Tag5ID, storage.TaggableLeafPolicyKeep, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTagDeleteResult(result, []int{bkm2ID}, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// bkm2 was tagged with tag6, so now tag3 is its new leaf
+		if err := expectTaggings(tx, si, bkm2ID, storage.TaggingModeAll, []int{
+			tagIDs.RootTagID, tagIDs.Tag1ID, tagIDs.Tag2ID, tagIDs.Tag3ID,
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// bkm2 is still tagged with tag2, so after deleting tag1 it should stay
+		// tagged with tag2 only
+		result, err = si.DeleteTag(tx, tagIDs.Tag1ID, storage.TaggableLeafPolicyKeep, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTagDeleteResult(result, []int{bkm2ID}, []int{bkm1ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(tx, si, bkm2ID, storage.TaggingModeAll, []int{
+			tagIDs.RootTagID, tagIDs.Tag2ID,
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// bkm1 was tagged with tag4 only, so it is tagged with nothing but the
+		// root tag now, which means it should become untagged
+		if err := expectTaggings(tx, si, bkm1ID, storage.TaggingModeAll, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(tx, si, bkm3ID, storage.TaggingModeAll, []int{
+			tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID,
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// All the subtags should be deleted as well
+		for _, tagID := range []int{tagIDs.Tag1ID, tagIDs.Tag3ID, tagIDs.Tag4ID, tagIDs.Tag6ID} {
+			_, err := si.GetTag(tx, tagID, &storage.GetTagOpts{})
+			if errors.Cause(err) != storage.ErrTagDoesNotExist {
+				return errors.Errorf("tag %d should not exist, but got err: %v", tagID, err)
+			}
+		}
+
+		untagged, err := si.GetTaggedTaggableIDs(tx, nil, nil, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := checkTgb(untagged, []int{bkm1ID}); err != nil {
+			return errors.Annotatef(err, "untagged taggables")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The root tag can't be deleted
+	err = si.Tx(func(tx *sql.Tx) error {
+		_, err := si.DeleteTag(tx, tagIDs.RootTagID, storage.TaggableLeafPolicyKeep, false)
+		return err
+	})
+	if err == nil {
+		return errors.Errorf("should not be able to delete the root tag")
+	}
+
+	return nil
+}
+
+func testDeleteTagDelNewLeaf(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		// Dry run should only tell what would happen
+		result, err := si.DeleteTag(tx, tagIDs.Tag3ID, storage.TaggableLeafPolicyDel, true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTagDeleteResult(result, []int{bkm2ID}, []int{bkm1ID}); err != nil {
+			return errors.Annotatef(err, "dry run")
+		}
+
+		if _, err := si.GetTag(tx, tagIDs.Tag3ID, &storage.GetTagOpts{}); err != nil {
+			return errors.Annotatef(err, "dry run should not delete the tag")
+		}
+
+		if err := expectTaggings(tx, si, bkm1ID, storage.TaggingModeLeafs, []int{
+			tagIDs.Tag4ID,
+		}); err != nil {
+			return errors.Annotatef(err, "dry run should not change taggings")
+		}
+
+		result, err = si.DeleteTag(tx, tagIDs.Tag3ID, storage.TaggableLeafPolicyDel, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTagDeleteResult(result, []int{bkm2ID}, []int{bkm1ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		// tag1 became a new leaf of bkm1 and bkm2, and should be deleted; so bkm1
+		// becomes untagged, and bkm2 stays tagged with tag2 only
+		if err := expectTaggings(tx, si, bkm1ID, storage.TaggingModeAll, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(tx, si, bkm2ID, storage.TaggingModeAll, []int{
+			tagIDs.RootTagID, tagIDs.Tag2ID,
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(tx, si, bkm3ID, storage.TaggingModeAll, []int{
+			tagIDs.RootTagID, tagIDs.Tag7ID, tagIDs.Tag8ID,
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// The tag itself is still there, even though it's not used anymore
+		if _, err := si.GetTag(tx, tagIDs.Tag1ID, &storage.GetTagOpts{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	return errors.Trace(err)
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+func testTrash(t *testing.T, si storage.Storage) error {
+	tagIDs, bkm1ID, bkm2ID, bkm3ID, err := prepareMoveOrDeleteTest(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, _, err := testutils.CreateTestUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		rootTag, err := si.GetTag(tx, tagIDs.RootTagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u1ID := rootTag.OwnerID
+
+		note1ID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note1",
+			Format:  storage.NoteFormatPlain,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(tx, note1ID, []int{tagIDs.Tag4ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, id := range []int{bkm1ID, note1ID} {
+			if err := si.TrashTaggable(tx, id); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Trashed taggables are hidden
+		if err := expectTaggedBookmarks(tx, si, []int{tagIDs.Tag3ID}, u1ID, []int{bkm2ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectTaggedNotes(tx, si, []int{tagIDs.Tag3ID}, cptr.Int(u1ID), []int{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkms, err := si.GetBookmarksByURL(tx, "url1", u1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkms) != 0 {
+			return errors.Errorf("trashed bookmark should not be found by url, got %+v", bkms)
+		}
+
+		// ... but still can be fetched by id, and keep their taggings
+		bkm, err := si.GetBookmarkByID(tx, bkm1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if bkm.TrashedAt == 0 {
+			return errors.Errorf("trashed bookmark should have TrashedAt set")
+		}
+
+		if err := expectTaggings(tx, si, bkm1ID, storage.TaggingModeLeafs, []int{tagIDs.Tag4ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTrash(tx, si, u1ID, []int{bkm1ID, note1ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTrash(tx, si, u2ID, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// A trashed bookmark doesn't prevent creating another one with the same
+		// url, but then it can't be restored
+		bkm4ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url1",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.RestoreTaggable(tx, bkm1ID); err == nil {
+			return errors.Errorf("should not be able to restore a bookmark with a duplicate url")
+		}
+
+		if err := si.DeleteTaggable(tx, bkm4ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.RestoreTaggable(tx, bkm1ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = expectTaggedBookmarks(tx, si, []int{tagIDs.Tag3ID}, u1ID, []int{bkm1ID, bkm2ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Trashed taggables are retagged when tags change
+		if err := si.TrashTaggable(tx, bkm3ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.MergeTags(tx, tagIDs.Tag8ID, tagIDs.Tag2ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(tx, si, bkm3ID, storage.TaggingModeLeafs, []int{tagIDs.Tag2ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTrash(tx, si, u1ID, []int{bkm3ID, note1ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Purging
+		now := uint64(time.Now().Unix())
+
+		for _, tc := range []struct {
+			ownerID       *int
+			trashedBefore uint64
+			expected      []int
+		}{
+			{cptr.Int(u1ID), now - 3600, []int{}},
+			{cptr.Int(u2ID), now + 3600, []int{}},
+			{cptr.Int(u1ID), now + 3600, []int{bkm3ID, note1ID}},
+			{nil, now + 3600, []int{}},
+		} {
+			purgedIDs, err := si.PurgeTrash(tx, tc.ownerID, tc.trashedBefore)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if err := checkTgb(purgedIDs, tc.expected); err != nil {
+				return errors.Annotatef(err, "purging trash")
+			}
+		}
+
+		if err := expectTrash(tx, si, u1ID, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.GetNoteByID(tx, note1ID, nil)
+		if errors.Cause(err) != storage.ErrNoteDoesNotExist {
+			return errors.Errorf("expected ErrNoteDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// expectTaggedBookmarks checks that the bookmarks of the given owner tagged
+// with all of the given tags are the expected ones (the order doesn't matter).
+func expectTaggedBookmarks(
+	tx *sql.Tx, si storage.Storage, tagIDs []int, ownerID int, expected []int,
+) error {
+	page, err := si.GetTaggedBookmarks(tx, tagIDs, cptr.Int(ownerID), nil, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmIDs := []int{}
+	for _, bkm := range page.Bookmarks {
+		bkmIDs = append(bkmIDs, bkm.ID)
+	}
+
+	if err := checkTgb(bkmIDs, expected); err != nil {
+		return errors.Annotatef(err, "bookmarks tagged with %v", tagIDs)
+	}
+
+	return nil
+}
+
+// expectTrash checks that the trash of the given owner contains the expected
+// taggables (the order doesn't matter).
+func expectTrash(tx *sql.Tx, si storage.Storage, ownerID int, expected []int) error {
+	taggables, err := si.GetTrashedTaggables(tx, ownerID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ids := []int{}
+	for _, t := range taggables {
+		if t.OwnerID != ownerID || t.TrashedAt == 0 {
+			return errors.Errorf("wrong trashed taggable: %+v", t)
+		}
+		ids = append(ids, t.ID)
+	}
+
+	if err := checkTgb(ids, expected); err != nil {
+		return errors.Annotatef(err, "trash of user %d", ownerID)
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests integration_tests
+
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/testutils"
+
+	"github.com/juju/errors"
+)
+
+func testUsers(t *testing.T, si storage.Storage) error {
+	u1ID, _, err := testutils.CreateTestUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, _, err := testutils.CreateTestUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		for _, args := range []storage.GetUserArgs{
+			{ID: cptr.Int(u2ID)},
+			{Username: cptr.String("test2")},
+			{Email: cptr.String("2@1.1")},
+		} {
+			ud, err := si.GetUser(tx, &args)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if ud.ID != u2ID || ud.Username != "test2" || ud.Email != "2@1.1" {
+				return errors.Errorf("wrong user for %+v: %+v", args, ud)
+			}
+		}
+
+		_, err := si.GetUser(tx, &storage.GetUserArgs{Email: cptr.String("3@1.1")})
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("expected ErrUserDoesNotExist, got %v", err)
+		}
+
+		if err := si.SetUserPassword(tx, u1ID, "hash1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		ud, err := si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(u1ID)})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ud.Password != "hash1" {
+			return errors.Errorf("expected password hash %q, got %q", "hash1", ud.Password)
+		}
+
+		// Other users should be intact
+		ud, err = si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(u2ID)})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ud.Password != "" {
+			return errors.Errorf("expected empty password hash, got %q", ud.Password)
+		}
+
+		err = si.SetUserPassword(tx, u2ID+100, "hash2")
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("expected ErrUserDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func testExternalIdentities(t *testing.T, si storage.Storage) error {
+	userIDs, err := createTestUsers(si, 2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u1ID, u2ID := userIDs[0], userIDs[1]
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		// The same subject at different providers belongs to different users
+		for _, eid := range []storage.ExternalIdentityData{
+			{UserID: u1ID, Provider: "google", Subject: "sub1", Email: "1@1.1"},
+			{UserID: u1ID, Provider: "corp", Subject: "sub2", Email: "1@1.1"},
+			{UserID: u2ID, Provider: "corp", Subject: "sub1", Email: "2@2.2"},
+		} {
+			if _, err := si.CreateExternalIdentity(tx, &eid); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		for _, tc := range []struct {
+			provider, subject string
+			userID            int
+		}{
+			{"google", "sub1", u1ID},
+			{"corp", "sub2", u1ID},
+			{"corp", "sub1", u2ID},
+		} {
+			if err := expectExternalIdentityOwner(
+				tx, si, tc.provider, tc.subject, tc.userID,
+			); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		_, err := si.GetUserByExternalIdentity(tx, "google", "sub2")
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("expected ErrUserDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The identity can't belong to more than one user
+	err = si.Tx(func(tx *sql.Tx) error {
+		_, err := si.CreateExternalIdentity(tx, &storage.ExternalIdentityData{
+			UserID: u2ID, Provider: "google", Subject: "sub1", Email: "2@2.2",
+		})
+		return err
+	})
+	if err == nil {
+		return errors.Errorf("creating a duplicate identity should fail")
+	}
+
+	// Listing and deleting identities
+	err = si.Tx(func(tx *sql.Tx) error {
+		eids, err := si.GetExternalIdentities(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(eids) != 2 ||
+			eids[0].Provider != "google" || eids[0].Subject != "sub1" ||
+			eids[1].Provider != "corp" || eids[1].Subject != "sub2" ||
+			eids[0].UserID != u1ID || eids[0].Email != "1@1.1" || eids[0].CreatedAt == 0 {
+			return errors.Errorf("wrong identities of user %d: %+v", u1ID, eids)
+		}
+
+		if err := si.DeleteExternalIdentity(tx, eids[0].ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.DeleteExternalIdentity(tx, eids[0].ID)
+		if errors.Cause(err) != storage.ErrIdentityDoesNotExist {
+			return errors.Errorf("expected ErrIdentityDoesNotExist, got %v", err)
+		}
+
+		_, err = si.GetUserByExternalIdentity(tx, "google", "sub1")
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("expected ErrUserDoesNotExist, got %v", err)
+		}
+
+		eids, err = si.GetExternalIdentities(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(eids) != 1 || eids[0].Subject != "sub2" {
+			return errors.Errorf("wrong identities of user %d: %+v", u1ID, eids)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Identities are deleted together with the user
+	err = si.Tx(func(tx *sql.Tx) error {
+		if err := si.DeleteUser(tx, u2ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err := si.GetUserByExternalIdentity(tx, "corp", "sub1")
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("expected ErrUserDoesNotExist, got %v", err)
+		}
+
+		return expectExternalIdentityOwner(tx, si, "corp", "sub2", u1ID)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func expectExternalIdentityOwner(
+	tx *sql.Tx, si storage.Storage, provider, subject string, userID int,
+) error {
+	ud, err := si.GetUserByExternalIdentity(tx, provider, subject)
+	if err != nil {
+		return errors.Annotatef(err, "%s/%s", provider, subject)
+	}
+
+	if ud.ID != userID {
+		return errors.Errorf(
+			"%s/%s: expected user %d, got %d", provider, subject, userID, ud.ID,
+		)
+	}
+
+	return nil
+}
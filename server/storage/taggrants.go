@@ -0,0 +1,31 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storage
+
+import (
+	"github.com/juju/errors"
+)
+
+// TagGrantPermission tells what a grant allows the grantee to do with the
+// shared subtree.
+type TagGrantPermission string
+
+const (
+	TagGrantPermissionRead    TagGrantPermission = "read"
+	TagGrantPermissionDefault                    = TagGrantPermissionRead
+)
+
+// ValidateTagGrantPermission returns an error if the given permission is not
+// one of the known ones.
+func ValidateTagGrantPermission(perm TagGrantPermission) error {
+	switch perm {
+	case TagGrantPermissionRead:
+		return nil
+	}
+
+	return errors.Errorf(
+		"invalid grant permission %q, valid values are: %q",
+		perm, TagGrantPermissionRead,
+	)
+}
@@ -0,0 +1,363 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/juju/errors"
+)
+
+type TagQueryOp string
+
+const (
+	TagQueryOpTag TagQueryOp = "tag"
+	TagQueryOpAnd TagQueryOp = "and"
+	TagQueryOpOr  TagQueryOp = "or"
+	TagQueryOpNot TagQueryOp = "not"
+)
+
+const (
+	// Max nesting depth of parentheses and NOTs in a parsed query.
+	tagQueryMaxDepth = 32
+)
+
+// TagQuery is a boolean expression over tags. A taggable is tagged with a tag
+// if it's tagged with the tag itself or with any of its descendants.
+//
+// For TagQueryOpTag, TagID is the tag; for TagQueryOpAnd and TagQueryOpOr,
+// Operands contains two or more subexpressions; for TagQueryOpNot, Operands
+// contains exactly one.
+type TagQuery struct {
+	Op       TagQueryOp
+	TagID    int
+	Operands []TagQuery
+}
+
+func (q *TagQuery) Validate() error {
+	switch q.Op {
+	case TagQueryOpTag:
+		if len(q.Operands) != 0 {
+			return errors.Errorf("tag query %q should have no operands", q.Op)
+		}
+	case TagQueryOpAnd, TagQueryOpOr:
+		if len(q.Operands) < 2 {
+			return errors.Errorf("tag query %q should have at least 2 operands", q.Op)
+		}
+	case TagQueryOpNot:
+		if len(q.Operands) != 1 {
+			return errors.Errorf("tag query %q should have exactly 1 operand", q.Op)
+		}
+	default:
+		return errors.Errorf("invalid tag query op %q", q.Op)
+	}
+
+	for i := range q.Operands {
+		if err := q.Operands[i].Validate(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Eval returns whether the query matches a taggable; hasTag should return
+// whether the taggable is tagged with the given tag (or its descendants).
+// The query is assumed to be valid.
+func (q *TagQuery) Eval(hasTag func(tagID int) bool) bool {
+	switch q.Op {
+	case TagQueryOpTag:
+		return hasTag(q.TagID)
+	case TagQueryOpAnd:
+		for i := range q.Operands {
+			if !q.Operands[i].Eval(hasTag) {
+				return false
+			}
+		}
+		return true
+	case TagQueryOpOr:
+		for i := range q.Operands {
+			if q.Operands[i].Eval(hasTag) {
+				return true
+			}
+		}
+		return false
+	case TagQueryOpNot:
+		return !q.Operands[0].Eval(hasTag)
+	}
+
+	return false
+}
+
+func (q *TagQuery) String() string {
+	switch q.Op {
+	case TagQueryOpTag:
+		return strconv.Itoa(q.TagID)
+	case TagQueryOpAnd, TagQueryOpOr:
+		parts := []string{}
+		for i := range q.Operands {
+			parts = append(parts, q.Operands[i].String())
+		}
+		return "(" + strings.Join(parts, " "+strings.ToUpper(string(q.Op))+" ") + ")"
+	case TagQueryOpNot:
+		return "NOT " + q.Operands[0].String()
+	}
+
+	return fmt.Sprintf("<invalid op %q>", q.Op)
+}
+
+// ParseTagQuery parses a query like "go AND (http OR grpc) AND NOT
+// deprecated". Operators are case-insensitive, NOT binds tighter than AND,
+// which binds tighter than OR. Every tag reference is passed to resolveTag,
+// which should return the tag id; references are usually either ids or paths
+// (tag names can't look like numbers, so there's no ambiguity). References
+// which contain parens or look like operators should be quoted: "c++(old)";
+// a double quote inside a quoted reference is escaped with a backslash.
+func ParseTagQuery(
+	s string, resolveTag func(ref string) (tagID int, err error),
+) (*TagQuery, error) {
+	tokens, err := tokenizeTagQuery(s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p := &tagQueryParser{
+		tokens:     tokens,
+		resolveTag: resolveTag,
+	}
+
+	q, err := p.parseOr(0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if t := p.peek(); t.kind != tagQueryTokenEOF {
+		return nil, errors.Errorf(
+			"unexpected %s at position %d, expected AND, OR or end of query",
+			t.describe(), t.pos,
+		)
+	}
+
+	return q, nil
+}
+
+type tagQueryTokenKind int
+
+const (
+	tagQueryTokenEOF tagQueryTokenKind = iota
+	tagQueryTokenTag
+	tagQueryTokenAnd
+	tagQueryTokenOr
+	tagQueryTokenNot
+	tagQueryTokenLParen
+	tagQueryTokenRParen
+)
+
+type tagQueryToken struct {
+	kind tagQueryTokenKind
+	// Tag reference for tagQueryTokenTag
+	text string
+	// 1-based position of the token in the query, in runes
+	pos int
+}
+
+func (t *tagQueryToken) describe() string {
+	switch t.kind {
+	case tagQueryTokenEOF:
+		return "end of query"
+	case tagQueryTokenTag:
+		return fmt.Sprintf("tag %q", t.text)
+	case tagQueryTokenAnd:
+		return "AND"
+	case tagQueryTokenOr:
+		return "OR"
+	case tagQueryTokenNot:
+		return "NOT"
+	case tagQueryTokenLParen:
+		return `"("`
+	case tagQueryTokenRParen:
+		return `")"`
+	}
+
+	return "unknown token"
+}
+
+func tokenizeTagQuery(s string) ([]tagQueryToken, error) {
+	tokens := []tagQueryToken{}
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			tokens = append(tokens, tagQueryToken{kind: tagQueryTokenLParen, pos: pos})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, tagQueryToken{kind: tagQueryTokenRParen, pos: pos})
+			i++
+
+		case r == '"':
+			text := []rune{}
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, errors.Errorf("unterminated quote at position %d", pos)
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					text = append(text, runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					i++
+					break
+				}
+				text = append(text, runes[i])
+				i++
+			}
+
+			if len(text) == 0 {
+				return nil, errors.Errorf("empty tag at position %d", pos)
+			}
+
+			tokens = append(tokens, tagQueryToken{
+				kind: tagQueryTokenTag, text: string(text), pos: pos,
+			})
+
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) &&
+				runes[i] != '(' && runes[i] != ')' && runes[i] != '"' {
+				i++
+			}
+			text := string(runes[start:i])
+
+			kind := tagQueryTokenTag
+			switch strings.ToUpper(text) {
+			case "AND":
+				kind = tagQueryTokenAnd
+			case "OR":
+				kind = tagQueryTokenOr
+			case "NOT":
+				kind = tagQueryTokenNot
+			}
+
+			tokens = append(tokens, tagQueryToken{kind: kind, text: text, pos: pos})
+		}
+	}
+
+	tokens = append(tokens, tagQueryToken{kind: tagQueryTokenEOF, pos: len(runes) + 1})
+
+	return tokens, nil
+}
+
+type tagQueryParser struct {
+	tokens     []tagQueryToken
+	cur        int
+	resolveTag func(ref string) (int, error)
+}
+
+func (p *tagQueryParser) peek() *tagQueryToken {
+	return &p.tokens[p.cur]
+}
+
+func (p *tagQueryParser) next() *tagQueryToken {
+	t := &p.tokens[p.cur]
+	if t.kind != tagQueryTokenEOF {
+		p.cur++
+	}
+	return t
+}
+
+func (p *tagQueryParser) parseOr(depth int) (*TagQuery, error) {
+	return p.parseBinary(depth, TagQueryOpOr, tagQueryTokenOr, p.parseAnd)
+}
+
+func (p *tagQueryParser) parseAnd(depth int) (*TagQuery, error) {
+	return p.parseBinary(depth, TagQueryOpAnd, tagQueryTokenAnd, p.parseUnary)
+}
+
+// parseBinary parses one or more operands separated by the given operator
+// token.
+func (p *tagQueryParser) parseBinary(
+	depth int, op TagQueryOp, opToken tagQueryTokenKind,
+	parseOperand func(depth int) (*TagQuery, error),
+) (*TagQuery, error) {
+	operand, err := parseOperand(depth)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	operands := []TagQuery{*operand}
+	for p.peek().kind == opToken {
+		p.next()
+
+		operand, err := parseOperand(depth)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		operands = append(operands, *operand)
+	}
+
+	if len(operands) == 1 {
+		return &operands[0], nil
+	}
+
+	return &TagQuery{Op: op, Operands: operands}, nil
+}
+
+func (p *tagQueryParser) parseUnary(depth int) (*TagQuery, error) {
+	t := p.next()
+
+	isNested := t.kind == tagQueryTokenNot || t.kind == tagQueryTokenLParen
+	if isNested && depth >= tagQueryMaxDepth {
+		return nil, errors.Errorf(
+			"query is nested too deeply at position %d (max depth is %d)",
+			t.pos, tagQueryMaxDepth,
+		)
+	}
+
+	switch t.kind {
+	case tagQueryTokenNot:
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &TagQuery{Op: TagQueryOpNot, Operands: []TagQuery{*operand}}, nil
+
+	case tagQueryTokenLParen:
+		q, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if closing := p.next(); closing.kind != tagQueryTokenRParen {
+			return nil, errors.Errorf(
+				`unexpected %s at position %d, expected ")" to close "(" at position %d`,
+				closing.describe(), closing.pos, t.pos,
+			)
+		}
+		return q, nil
+
+	case tagQueryTokenTag:
+		tagID, err := p.resolveTag(t.text)
+		if err != nil {
+			return nil, errors.Annotatef(err, "tag %q at position %d", t.text, t.pos)
+		}
+		return &TagQuery{Op: TagQueryOpTag, TagID: tagID}, nil
+	}
+
+	return nil, errors.Errorf(
+		"unexpected %s at position %d, expected a tag, NOT or \"(\"", t.describe(), t.pos,
+	)
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package storage
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+var testTagIDs = map[string]int{
+	"go":         1,
+	"go/http":    2,
+	"grpc":       3,
+	"deprecated": 4,
+	"c++(old)":   5,
+	"and":        6,
+	`say"hi"`:    7,
+}
+
+func testResolveTag(ref string) (int, error) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return id, nil
+	}
+
+	if id, ok := testTagIDs[ref]; ok {
+		return id, nil
+	}
+
+	return 0, errors.Trace(ErrTagDoesNotExist)
+}
+
+func TestParseTagQuery(t *testing.T) {
+	for query, expected := range map[string]string{
+		"go": "1",
+		"10": "10",
+		"go AND (go/http OR grpc) AND NOT deprecated": "(1 AND (2 OR 3) AND NOT 4)",
+		"go and go/http or grpc":                      "((1 AND 2) OR 3)",
+		"go OR go/http AND grpc":                      "(1 OR (2 AND 3))",
+		"not not go":                                  "NOT NOT 1",
+		"NOT (go OR grpc)":                            "NOT (1 OR 3)",
+		"((go))":                                      "1",
+		`"c++(old)" AND "and" AND "say\"hi\""`:        "(5 AND 6 AND 7)",
+		"  go\tOR\n10  ":                              "(1 OR 10)",
+	} {
+		q, err := ParseTagQuery(query, testResolveTag)
+		if err != nil {
+			t.Errorf("query %q: unexpected error: %s", query, err)
+			continue
+		}
+
+		if err := q.Validate(); err != nil {
+			t.Errorf("query %q: invalid result: %s", query, err)
+		}
+
+		if q.String() != expected {
+			t.Errorf("query %q: expected %s, got %s", query, expected, q.String())
+		}
+	}
+}
+
+func TestParseTagQueryErrors(t *testing.T) {
+	for query, expected := range map[string]string{
+		"":                `unexpected end of query at position 1, expected a tag, NOT or "("`,
+		"go AND":          `unexpected end of query at position 7, expected a tag, NOT or "("`,
+		"go grpc":         `unexpected tag "grpc" at position 4, expected AND, OR or end of query`,
+		"(go OR grpc":     `unexpected end of query at position 12, expected ")" to close "(" at position 1`,
+		"go)":             `unexpected ")" at position 3, expected AND, OR or end of query`,
+		"go AND OR grpc":  `unexpected OR at position 8, expected a tag, NOT or "("`,
+		"go AND ()":       `unexpected ")" at position 9, expected a tag, NOT or "("`,
+		`go AND "grpc`:    `unterminated quote at position 8`,
+		`go AND ""`:       `empty tag at position 8`,
+		"go AND nonexist": `tag "nonexist" at position 8: tag does not exist`,
+	} {
+		_, err := ParseTagQuery(query, testResolveTag)
+		if err == nil {
+			t.Errorf("query %q: expected an error", query)
+			continue
+		}
+
+		if err.Error() != expected {
+			t.Errorf("query %q: expected error %q, got %q", query, expected, err.Error())
+		}
+	}
+
+	// Too deep nesting
+	query := "go"
+	for i := 0; i < tagQueryMaxDepth+1; i++ {
+		query = "(" + query + ")"
+	}
+	if _, err := ParseTagQuery(query, testResolveTag); err == nil {
+		t.Errorf("expected an error for a too deeply nested query")
+	}
+}
+
+func TestTagQueryEval(t *testing.T) {
+	q, err := ParseTagQuery("go AND (go/http OR grpc) AND NOT deprecated", testResolveTag)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for tagIDs, expected := range map[[4]bool]bool{
+		{true, true, false, false}:  true,
+		{true, false, true, false}:  true,
+		{true, true, true, false}:   true,
+		{true, true, false, true}:   false,
+		{false, true, true, false}:  false,
+		{true, false, false, false}: false,
+	} {
+		got := q.Eval(func(tagID int) bool {
+			return tagIDs[tagID-1]
+		})
+		if got != expected {
+			t.Errorf("tags %v: expected %v, got %v", tagIDs, expected, got)
+		}
+	}
+}
@@ -14,7 +14,22 @@ import (
 	"github.com/juju/errors"
 )
 
+// tablesDropper is implemented by storages which know how to wipe their
+// database by themselves; for other storages, Postgres is assumed.
+type tablesDropper interface {
+	DropAllTables() error
+}
+
 func PrepareTestDB(t *testing.T, si storage.Storage) error {
+	if td, ok := si.(tablesDropper); ok {
+		t.Logf("Dropping all tables")
+		if err := td.DropAllTables(); err != nil {
+			return errors.Annotatef(err, "dropping all tables")
+		}
+
+		return errors.Trace(applyMigrations(t, si))
+	}
+
 	// Drop all existing tables
 	tables, err := getAllTables(t, si)
 	if err != nil {
@@ -69,9 +84,13 @@ func PrepareTestDB(t *testing.T, si storage.Storage) error {
 		return nil
 	})
 
-	// Init schema (apply all migrations)
+	return errors.Trace(applyMigrations(t, si))
+}
+
+// applyMigrations inits schema (applies all migrations)
+func applyMigrations(t *testing.T, si storage.Storage) error {
 	t.Logf("Applying migrations...")
-	err = si.ApplyMigrations()
+	err := si.ApplyMigrations()
 	if err != nil {
 		return errors.Annotatef(err, "applying migrations")
 	}
@@ -162,7 +181,10 @@ func CreateTestUser(
 			)
 		}
 
-		token, err = si.GetAccessToken(tx, userID, "test token for a test user", true)
+		_, token, err = si.CreateAccessToken(tx, &storage.AccessTokenData{
+			UserID: userID,
+			Descr:  "test token for a test user",
+		})
 		if err != nil {
 			return errors.Annotatef(
 				err, "creating test access token for the user id %d", userID,
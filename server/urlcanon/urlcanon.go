@@ -0,0 +1,137 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package urlcanon converts URLs to a canonical form, so that different
+// spellings of the same URL (like "http://x.com/a" and "https://x.com/a/")
+// can be detected as duplicates.
+package urlcanon // import "dmitryfrank.com/geekmarks/server/urlcanon"
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Rules specifies which transformations are applied to URLs. The host is
+// always lowercased.
+type Rules struct {
+	// If true, "http" is treated as "https".
+	IgnoreScheme bool
+	// If true, trailing slashes of the path are removed.
+	TrimTrailingSlash bool
+	// If true, ports 80 for http and 443 for https are removed.
+	StripDefaultPort bool
+	// If true, internationalized domain names are converted to punycode.
+	PunycodeHost bool
+	// Names of the query parameters to remove; a name ending with "*" matches
+	// all parameters with the given prefix.
+	TrackingParams []string
+}
+
+// DefaultTrackingParams is a list of commonly used tracking query parameters.
+var DefaultTrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "yclid", "dclid", "msclkid", "mc_cid", "mc_eid",
+	"_ga", "_hsenc", "_hsmi", "ref_src",
+}
+
+// DefaultRules returns rules with all transformations enabled.
+func DefaultRules() *Rules {
+	return &Rules{
+		IgnoreScheme:      true,
+		TrimTrailingSlash: true,
+		StripDefaultPort:  true,
+		PunycodeHost:      true,
+		TrackingParams:    DefaultTrackingParams,
+	}
+}
+
+// Canonicalize returns the canonical form of the given URL. If the URL can't
+// be parsed or does not have a host, it's returned as is.
+func (r *Rules) Canonicalize(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || u.Opaque != "" {
+		return rawURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+
+	if r.PunycodeHost {
+		if asciiHost, err := idna.Lookup.ToASCII(host); err == nil {
+			host = asciiHost
+		}
+	}
+
+	if r.StripDefaultPort {
+		if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+			port = ""
+		}
+	}
+
+	if r.IgnoreScheme && u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+
+	// IPv6 addresses need to be bracketed
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if r.TrimTrailingSlash {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+	}
+
+	if len(r.TrackingParams) > 0 && u.RawQuery != "" {
+		u.RawQuery = r.stripTrackingParams(u.RawQuery)
+		u.ForceQuery = false
+	}
+
+	return u.String()
+}
+
+// stripTrackingParams removes tracking parameters from the raw query; the
+// order and the encoding of the remaining parameters are preserved.
+func (r *Rules) stripTrackingParams(rawQuery string) string {
+	params := []string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		name := param
+		if i := strings.Index(param, "="); i >= 0 {
+			name = param[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+
+		if !r.isTrackingParam(name) {
+			params = append(params, param)
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+func (r *Rules) isTrackingParam(name string) bool {
+	for _, p := range r.TrackingParams {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package urlcanon
+
+import (
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	rules := DefaultRules()
+
+	for _, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{"http://x.com/a", "https://x.com/a"},
+		{"https://x.com/a/", "https://x.com/a"},
+		{"https://x.com/a?utm_source=foo", "https://x.com/a"},
+		{"https://x.com/a?b=1&utm_medium=m&fbclid=2&c=3", "https://x.com/a?b=1&c=3"},
+		{"https://X.Com:443/", "https://x.com"},
+		{"http://x.com:80/a", "https://x.com/a"},
+		{"http://x.com:8080/a", "https://x.com:8080/a"},
+		{"https://x.com:80/a", "https://x.com:80/a"},
+		{"https://пример.рф/a", "https://xn--e1afmkfd.xn--p1ai/a"},
+		{"http://[::1]:80/a", "https://[::1]/a"},
+		{"https://x.com/a#frag", "https://x.com/a#frag"},
+		{"https://x.com/a%2Fb/", "https://x.com/a%2Fb"},
+		// Not URLs with a host: left as is
+		{"url_1", "url_1"},
+		{"mailto:a@x.com", "mailto:a@x.com"},
+		{"", ""},
+	} {
+		if got := rules.Canonicalize(tc.url); got != tc.expected {
+			t.Errorf("Canonicalize(%q): expected %q, got %q", tc.url, tc.expected, got)
+		}
+	}
+}
+
+func TestCanonicalizeNoRules(t *testing.T) {
+	rules := &Rules{}
+
+	for _, tc := range []struct {
+		url      string
+		expected string
+	}{
+		{"http://X.com/a/?utm_source=foo", "http://x.com/a/?utm_source=foo"},
+		{"https://x.com:443/", "https://x.com:443/"},
+	} {
+		if got := rules.Canonicalize(tc.url); got != tc.expected {
+			t.Errorf("Canonicalize(%q): expected %q, got %q", tc.url, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package userexport converts all data of a user to a self-contained
+// structure which doesn't depend on ids, and back, so that a user can be
+// moved to another database.
+//
+// Only the current state is exported: trashed taggables, revision history
+// and timestamps are not.
+package userexport // import "dmitryfrank.com/geekmarks/server/userexport"
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+// Version is the version of the export format.
+const Version = 1
+
+type UserData struct {
+	Version  int    `json:"version"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// Subtags of the root tag
+	Tags      []Tag      `json:"tags"`
+	Bookmarks []Bookmark `json:"bookmarks"`
+	Notes     []Note     `json:"notes"`
+}
+
+type Tag struct {
+	// The first name is the primary one
+	Names       []string `json:"names"`
+	Description string   `json:"description"`
+	Subtags     []Tag    `json:"subtags,omitempty"`
+}
+
+type Bookmark struct {
+	URL     string `json:"url"`
+	Title   string `json:"title"`
+	Comment string `json:"comment"`
+	// Paths of the leaf tags, made of primary names, like "/tag1/tag3"
+	Tags []string `json:"tags"`
+}
+
+type Note struct {
+	Title  string             `json:"title"`
+	Body   string             `json:"body"`
+	Format storage.NoteFormat `json:"format"`
+	// See Bookmark.Tags
+	Tags []string `json:"tags"`
+}
+
+// Export returns all data of the given user.
+func Export(tx *sql.Tx, si storage.Storage, userID int) (*UserData, error) {
+	ud, err := si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(userID)})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data := &UserData{
+		Version:   Version,
+		Username:  ud.Username,
+		Email:     ud.Email,
+		Tags:      []Tag{},
+		Bookmarks: []Bookmark{},
+		Notes:     []Note{},
+	}
+
+	rootTagID, err := si.GetRootTagID(tx, userID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsData, err := si.GetTags(tx, rootTagID, &storage.GetTagOpts{
+		GetNames:   true,
+		GetSubtags: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Map from tag id to its path
+	tagPaths := map[int]string{}
+	data.Tags = exportTags(tagsData, "", tagPaths)
+
+	// Every tagged taggable is tagged with the root tag, so all taggables are
+	// either tagged with it or untagged
+	taggableIDs := map[int]bool{}
+	for _, tagIDs := range [][]int{{rootTagID}, {}} {
+		ids, err := si.GetTaggedTaggableIDs(tx, tagIDs, cptr.Int(userID), nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, id := range ids {
+			taggableIDs[id] = true
+		}
+	}
+
+	ids := []int{}
+	for id := range taggableIDs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	noTagsOpts := &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	}
+
+	for _, id := range ids {
+		tags, err := getTagPaths(tx, si, id, tagPaths)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// Try a bookmark first, then a note
+		bkm, err := si.GetBookmarkByID(tx, id, noTagsOpts)
+		if err == nil {
+			if bkm.TrashedAt == 0 {
+				data.Bookmarks = append(data.Bookmarks, Bookmark{
+					URL:     bkm.URL,
+					Title:   bkm.Title,
+					Comment: bkm.Comment,
+					Tags:    tags,
+				})
+			}
+			continue
+		} else if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+			return nil, errors.Trace(err)
+		}
+
+		note, err := si.GetNoteByID(tx, id, noTagsOpts)
+		if err != nil {
+			return nil, errors.Annotatef(err, "taggable %d", id)
+		}
+		if note.TrashedAt == 0 {
+			data.Notes = append(data.Notes, Note{
+				Title:  note.Title,
+				Body:   note.Body,
+				Format: note.Format,
+				Tags:   tags,
+			})
+		}
+	}
+
+	return data, nil
+}
+
+func exportTags(tagsData []storage.TagData, parentPath string, tagPaths map[int]string) []Tag {
+	tags := []Tag{}
+	for _, td := range tagsData {
+		path := parentPath + "/" + td.Names[0]
+		tagPaths[td.ID] = path
+
+		tag := Tag{
+			Names: td.Names,
+		}
+		if td.Description != nil {
+			tag.Description = *td.Description
+		}
+		if len(td.Subtags) > 0 {
+			tag.Subtags = exportTags(td.Subtags, path, tagPaths)
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+func getTagPaths(
+	tx *sql.Tx, si storage.Storage, taggableID int, tagPaths map[int]string,
+) ([]string, error) {
+	tagIDs, err := si.GetTaggings(tx, taggableID, storage.TaggingModeLeafs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	paths := []string{}
+	for _, tagID := range tagIDs {
+		path, ok := tagPaths[tagID]
+		if !ok {
+			return nil, errors.Errorf(
+				"taggable %d is tagged with the tag %d of another user", taggableID, tagID,
+			)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// Import creates a new user with the given data, and returns its id.
+func Import(tx *sql.Tx, si storage.Storage, data *UserData) (userID int, err error) {
+	if err := checkVersion(data); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	userID, err = si.CreateUser(tx, &storage.UserData{
+		Username: data.Username,
+		Email:    data.Email,
+	})
+	if err != nil {
+		return 0, errors.Annotatef(err, "creating user %q", data.Username)
+	}
+
+	if err := ImportInto(tx, si, userID, data, nil); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return userID, nil
+}
+
+// ImportInto adds the given data to the existing user userID; the username
+// and email from the data are ignored.
+//
+// A tag which has the same name (any of them) as an existing tag under the
+// same parent is merged into it: the existing tag is kept as it is, and its
+// subtags are merged in the same way. A bookmark whose canonical URL is the
+// same as of an existing bookmark only adds its tags to the existing one.
+// Notes are always added.
+//
+// canonicalize is used to get canonical URLs of the bookmarks; if it's nil,
+// URLs are compared as they are, and canonical URLs are left empty.
+func ImportInto(
+	tx *sql.Tx, si storage.Storage, userID int, data *UserData,
+	canonicalize func(rawURL string) string,
+) error {
+	if err := checkVersion(data); err != nil {
+		return errors.Trace(err)
+	}
+
+	rootTagID, err := si.GetRootTagID(tx, userID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Map from tag path to its id
+	tagIDs := map[string]int{}
+	if err := importTags(tx, si, userID, rootTagID, "", data.Tags, tagIDs); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, bkm := range data.Bookmarks {
+		canonicalURL := ""
+		if canonicalize != nil {
+			canonicalURL = canonicalize(bkm.URL)
+		}
+
+		bkmID, err := getExistingBookmarkID(tx, si, userID, bkm.URL, canonicalURL)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if bkmID == 0 {
+			bkmID, err = si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID:      userID,
+				URL:          bkm.URL,
+				CanonicalURL: canonicalURL,
+				Title:        bkm.Title,
+				Comment:      bkm.Comment,
+			})
+			if err != nil {
+				return errors.Annotatef(err, "creating bookmark %q", bkm.URL)
+			}
+		}
+
+		if err := setTaggings(tx, si, bkmID, bkm.Tags, tagIDs); err != nil {
+			return errors.Annotatef(err, "bookmark %q", bkm.URL)
+		}
+	}
+
+	for _, note := range data.Notes {
+		noteID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: userID,
+			Title:   note.Title,
+			Body:    note.Body,
+			Format:  note.Format,
+		})
+		if err != nil {
+			return errors.Annotatef(err, "creating note %q", note.Title)
+		}
+
+		if err := setTaggings(tx, si, noteID, note.Tags, tagIDs); err != nil {
+			return errors.Annotatef(err, "note %q", note.Title)
+		}
+	}
+
+	return nil
+}
+
+func checkVersion(data *UserData) error {
+	if data.Version != Version {
+		return errors.Errorf(
+			"unsupported export version %d, expected %d", data.Version, Version,
+		)
+	}
+
+	return nil
+}
+
+// getExistingBookmarkID returns the id of the non-trashed bookmark of the user
+// with the given URL, or 0 if there is no such bookmark.
+func getExistingBookmarkID(
+	tx *sql.Tx, si storage.Storage, userID int, rawURL, canonicalURL string,
+) (int, error) {
+	if canonicalURL == "" {
+		canonicalURL = rawURL
+	}
+
+	bkms, err := si.GetBookmarksByURL(tx, canonicalURL, userID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if len(bkms) == 0 {
+		return 0, nil
+	}
+
+	return bkms[0].ID, nil
+}
+
+func importTags(
+	tx *sql.Tx, si storage.Storage, userID, parentTagID int, parentPath string,
+	tags []Tag, tagIDs map[string]int,
+) error {
+	for _, tag := range tags {
+		if len(tag.Names) == 0 {
+			return errors.Errorf("tag under %q has no names", parentPath+"/")
+		}
+
+		path := parentPath + "/" + tag.Names[0]
+
+		tagID, err := getExistingTagID(tx, si, parentTagID, tag.Names)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if tagID == 0 {
+			tagID, err = si.CreateTag(tx, &storage.TagData{
+				OwnerID:     userID,
+				ParentTagID: cptr.Int(parentTagID),
+				Description: cptr.String(tag.Description),
+				Names:       tag.Names,
+			})
+			if err != nil {
+				return errors.Annotatef(err, "creating tag %q", path)
+			}
+		}
+		tagIDs[path] = tagID
+
+		err = importTags(tx, si, userID, tagID, path, tag.Subtags, tagIDs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// getExistingTagID returns the id of the subtag of parentTagID which has any
+// of the given names, or 0 if there is no such subtag.
+func getExistingTagID(
+	tx *sql.Tx, si storage.Storage, parentTagID int, names []string,
+) (int, error) {
+	for _, name := range names {
+		tagID, err := si.GetTagIDByName(tx, parentTagID, name)
+		if err == nil {
+			return tagID, nil
+		}
+
+		if errors.Cause(err) != storage.ErrTagDoesNotExist {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return 0, nil
+}
+
+func setTaggings(
+	tx *sql.Tx, si storage.Storage, taggableID int, paths []string,
+	tagIDs map[string]int,
+) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	// Keep the existing taggings, if any, since the taggable might be merged
+	// with an existing one
+	ids, err := si.GetTaggings(tx, taggableID, storage.TaggingModeLeafs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, path := range paths {
+		// Be lenient about the trailing slash
+		tagID, ok := tagIDs["/"+strings.Trim(path, "/")]
+		if !ok {
+			return errors.Errorf("tag %q does not exist", path)
+		}
+		ids = append(ids, tagID)
+	}
+
+	err = si.SetTaggings(tx, taggableID, ids, storage.TaggingModeLeafs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,345 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package userexport
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/memory"
+	"dmitryfrank.com/geekmarks/server/storage/storagetest"
+	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+func TestExportImport(t *testing.T) {
+	if err := testExportImport(t); err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+	}
+}
+
+func testExportImport(t *testing.T) error {
+	si, err := memory.New()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := si.Connect(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := testutils.PrepareTestDB(t, si); err != nil {
+		return errors.Trace(err)
+	}
+
+	u1ID, _, err := testutils.CreateTestUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := storagetest.MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm1ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url_1",
+			Title:   "title_1",
+			Comment: "comment_1",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = si.SetTaggings(
+			tx, bkm1ID, []int{tagIDs.Tag4ID, tagIDs.Tag2ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Untagged bookmark
+		if _, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url_2",
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Trashed bookmark is not exported
+		bkm3ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url_3",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := si.TrashTaggable(tx, bkm3ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		noteID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note_title",
+			Body:    "note_body",
+			Format:  storage.NoteFormatMarkdown,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = si.SetTaggings(tx, noteID, []int{tagIDs.Tag6ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var exported *UserData
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		exported, err = Export(tx, si, u1ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expectedBookmarks := []Bookmark{
+		{
+			URL:     "url_1",
+			Title:   "title_1",
+			Comment: "comment_1",
+			Tags:    []string{"/tag1/tag3/tag4_alias", "/tag2"},
+		},
+		{
+			URL:  "url_2",
+			Tags: []string{},
+		},
+	}
+	if !reflect.DeepEqual(exported.Bookmarks, expectedBookmarks) {
+		return errors.Errorf(
+			"expected bookmarks %+v, got %+v", expectedBookmarks, exported.Bookmarks,
+		)
+	}
+
+	expectedNotes := []Note{
+		{
+			Title:  "note_title",
+			Body:   "note_body",
+			Format: storage.NoteFormatMarkdown,
+			Tags:   []string{"/tag1/tag3/tag5/tag6"},
+		},
+	}
+	if !reflect.DeepEqual(exported.Notes, expectedNotes) {
+		return errors.Errorf("expected notes %+v, got %+v", expectedNotes, exported.Notes)
+	}
+
+	// Import the data as another user, after passing it through JSON
+	jsonData, err := json.Marshal(exported)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var imported UserData
+	if err := json.Unmarshal(jsonData, &imported); err != nil {
+		return errors.Trace(err)
+	}
+	imported.Username = "test2"
+	imported.Email = "2@1.1"
+
+	var u2ID int
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		u2ID, err = Import(tx, si, &imported)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Export of the new user should be the same
+	var reexported *UserData
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		reexported, err = Export(tx, si, u2ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if !reflect.DeepEqual(reexported, &imported) {
+		return errors.Errorf("expected %+v, got %+v", imported, reexported)
+	}
+
+	// Importing the same user again fails, and nothing is left behind
+	err = si.Tx(func(tx *sql.Tx) error {
+		_, err := Import(tx, si, &imported)
+		return errors.Trace(err)
+	})
+	if err == nil {
+		return errors.Errorf("importing the same user twice should fail")
+	}
+
+	if err := storage.CheckIntegrity(si); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func TestImportInto(t *testing.T) {
+	if err := testImportInto(t); err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+	}
+}
+
+func testImportInto(t *testing.T) error {
+	si, err := memory.New()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := si.Connect(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := testutils.PrepareTestDB(t, si); err != nil {
+		return errors.Trace(err)
+	}
+
+	u1ID, _, err := testutils.CreateTestUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		tagIDs, err := storagetest.MakeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm1ID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:      u1ID,
+			URL:          "url_1",
+			CanonicalURL: "url_1",
+			Title:        "title_1",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = si.SetTaggings(tx, bkm1ID, []int{tagIDs.Tag2ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// "t1" is merged into "tag1" since it's also named "tag1_alias", and so is
+	// "tag3" under it; "URL_1" is the same as "url_1" after canonicalization.
+	data := &UserData{
+		Version: Version,
+		Tags: []Tag{
+			{
+				Names: []string{"t1", "tag1_alias"},
+				Subtags: []Tag{
+					{
+						Names:   []string{"tag3"},
+						Subtags: []Tag{{Names: []string{"new"}}},
+					},
+				},
+			},
+			{Names: []string{"other"}},
+		},
+		Bookmarks: []Bookmark{
+			{URL: "URL_1", Title: "title_1_2", Tags: []string{"/t1/tag3/new"}},
+			{URL: "url_2", Title: "title_2", Tags: []string{"/other"}},
+		},
+		Notes: []Note{
+			{Title: "note_title", Format: storage.NoteFormatMarkdown, Tags: []string{"/t1"}},
+		},
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		return errors.Trace(ImportInto(tx, si, u1ID, data, strings.ToLower))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var exported *UserData
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		exported, err = Export(tx, si, u1ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// 8 tags of the hierarchy, plus "new" and "other"
+	if cnt := countTags(exported.Tags); cnt != 10 {
+		return errors.Errorf("expected 10 tags, got %d: %+v", cnt, exported.Tags)
+	}
+
+	expectedBookmarks := []Bookmark{
+		{
+			URL:   "url_1",
+			Title: "title_1",
+			Tags:  []string{"/tag1/tag3/new", "/tag2"},
+		},
+		{
+			URL:   "url_2",
+			Title: "title_2",
+			Tags:  []string{"/other"},
+		},
+	}
+	if !reflect.DeepEqual(exported.Bookmarks, expectedBookmarks) {
+		return errors.Errorf(
+			"expected bookmarks %+v, got %+v", expectedBookmarks, exported.Bookmarks,
+		)
+	}
+
+	expectedNotes := []Note{
+		{
+			Title:  "note_title",
+			Format: storage.NoteFormatMarkdown,
+			Tags:   []string{"/tag1"},
+		},
+	}
+	if !reflect.DeepEqual(exported.Notes, expectedNotes) {
+		return errors.Errorf("expected notes %+v, got %+v", expectedNotes, exported.Notes)
+	}
+
+	if err := storage.CheckIntegrity(si); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func countTags(tags []Tag) int {
+	cnt := len(tags)
+	for _, tag := range tags {
+		cnt += countTags(tag.Subtags)
+	}
+	return cnt
+}